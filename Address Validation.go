@@ -0,0 +1,144 @@
+/*
+File Name:  Address Validation.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+The source address of an announcement could be spoofed. Adding the peer right away would direct responses and pings to the spoofed address, enabling reflection towards a victim.
+Similar to QUIC and DTLS address validation, the first announcement of an unknown peer is answered with a challenge containing a token. Only if the peer echoes the token from the same address, it is added to the peer list.
+
+The token is stateless: It is a MAC over the address and the public key of the peer, keyed with a random secret and bound to a time slot. It is valid for up to 2 time slots.
+The challenge is sent only via the receiving connection and only in reply to announcements that are at least as large, so it cannot be used for amplification.
+The echo contains the full announcement and is larger than the challenge. It is only sent if the challenge answers an announcement we sent to the address (a pending handshake) or a ping to a known peer, so a spoofed challenge cannot be used for amplification either.
+A ping from an unknown peer (which most likely forgot about us, for example after a restart) is answered with a single challenge via the receiving connection, which is about the size of the ping.
+Echoes are additionally limited per IP.
+Announcements received via IPv4 Broadcast or IPv6 Multicast are not challenged. Instead, our own announcement is sent to the sender, which then challenges us. This way the handshake is pending when its challenge arrives.
+Echoing a challenge counts as announcement sent by us, so the response of the peer that sent the challenge is accepted, see cmdResponse.
+
+Legacy peers (see Protocol Version.go) do not know CommandChallenge. Their first announcement is instead answered with an announcement without payload, which is not larger than theirs, and a pending handshake.
+They are only added when their response arrives from the same address, see cmdResponse. Responses to our own announcements never require a challenge.
+
+Payload of CommandChallenge:
+Offset  Size   Info
+0       16     Token
+
+Payload of CommandChallengeEcho:
+Offset  Size   Info
+0       16     Token
+16      ?      Payload of the announcement, see Endpoints.go
+*/
+
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// challengeTokenSize is the size of the token
+const challengeTokenSize = 16
+
+// challengeTimeSlot is the duration of a time slot the token is bound to
+const challengeTimeSlot = 30 * time.Second
+
+// challengeSecret is the key of the token MAC. It is created at startup.
+var challengeSecret = func() (secret []byte) {
+	secret = make([]byte, 32)
+	rand.Read(secret)
+	return secret
+}()
+
+// challengeEchoLimiter limits the echoes sent in reply to challenges: 1 per second per IP with a burst of 5.
+var challengeEchoLimiter = newIPRateLimiter(1, 5)
+
+// challengeToken returns the token for the address and public key in the given time slot
+func challengeToken(address *net.UDPAddr, publicKey *btcec.PublicKey, slot int64) []byte {
+	mac := hmac.New(sha256.New, challengeSecret)
+
+	var slotB [8]byte
+	binary.LittleEndian.PutUint64(slotB[:], uint64(slot))
+	var portB [2]byte
+	binary.LittleEndian.PutUint16(portB[:], uint16(address.Port))
+
+	mac.Write(slotB[:])
+	mac.Write(address.IP.To16())
+	mac.Write(portB[:])
+	mac.Write(publicKey.SerializeCompressed())
+
+	return mac.Sum(nil)[:challengeTokenSize]
+}
+
+// challengeSlot returns the current time slot
+func challengeSlot() int64 {
+	return time.Now().UnixNano() / int64(challengeTimeSlot)
+}
+
+// challengeVerify checks if the token is valid for the address and public key in the current or previous time slot
+func challengeVerify(token []byte, address *net.UDPAddr, publicKey *btcec.PublicKey) bool {
+	slot := challengeSlot()
+	return hmac.Equal(token, challengeToken(address, publicKey, slot)) || hmac.Equal(token, challengeToken(address, publicKey, slot-1))
+}
+
+// sendChallenge replies to the first announcement of an unknown peer with a challenge.
+// Announcements with a smaller payload than the challenge (including the maximum random garbage) are ignored, as the reply would be larger. Current peers always include the ephemeral key certificate.
+func sendChallenge(msg *packet2) {
+	if len(msg.Payload) < challengeTokenSize+maxRandomGarbage {
+		return
+	}
+
+	sendViaConnection(msg.SenderPublicKey, challengePacket(msg), msg.connection)
+}
+
+// challengePacket returns a new challenge for the sender of the message
+func challengePacket(msg *packet2) *PacketRaw {
+	return &PacketRaw{Command: CommandChallenge, Payload: challengeToken(msg.connection.Address, msg.SenderPublicKey, challengeSlot())}
+}
+
+// challengeSolicited checks if the challenge answers an announcement or a ping we sent to the address. Unsolicited challenges are not echoed, as the echo is larger than the challenge.
+func (peer *PeerInfo) challengeSolicited(msg *packet2) bool {
+	if handshakeIsPending(msg.connection.Address, msg.SenderPublicKey) {
+		return true
+	}
+
+	// A known peer that forgot about us answers our ping with a challenge, see cmdPing. The connection was only pinged if it existed before the challenge.
+	return peer != nil && time.Since(msg.connection.LastPingOut) < handshakeTimeout()
+}
+
+// cmdChallenge handles an incoming challenge by echoing the token together with the announcement.
+// Unsolicited challenges are ignored, as the echo is larger than the challenge.
+func (peer *PeerInfo) cmdChallenge(msg *packet2) {
+	if len(msg.Payload) != challengeTokenSize || !peer.challengeSolicited(msg) || !challengeEchoLimiter.allow(msg.connection.Address.IP) {
+		return
+	}
+
+	handshakeAdd(msg.connection.Address, msg.SenderPublicKey)
+
+	payload := append(append([]byte{}, msg.Payload...), announcementPacket().Payload...)
+	sendViaConnection(msg.SenderPublicKey, &PacketRaw{Command: CommandChallengeEcho, Payload: payload}, msg.connection)
+}
+
+// cmdChallengeEcho handles the echo of a challenge. If the token is valid, the sender owns the address and is handled like an announcement.
+func (peer *PeerInfo) cmdChallengeEcho(msg *packet2) {
+	if len(msg.Payload) < challengeTokenSize || !challengeVerify(msg.Payload[:challengeTokenSize], msg.connection.Address, msg.SenderPublicKey) {
+		return
+	}
+
+	// The echo counts as announcement towards the limit per IP. The token is valid for multiple echoes.
+	if !announcementAllowed(msg.connection.Address.IP) {
+		return
+	}
+
+	announcement := &packet2{SenderPublicKey: msg.SenderPublicKey, PacketRaw: PacketRaw{Protocol: msg.Protocol, Command: CommandAnnouncement, Payload: msg.Payload[challengeTokenSize:]}, connection: msg.connection}
+
+	if peer == nil {
+		peerAddAnnounced(announcement)
+		return
+	}
+
+	peer.cmdAnouncement(announcement)
+}
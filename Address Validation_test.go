@@ -0,0 +1,138 @@
+/*
+File Name:  Address Validation_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package core
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// testChallengeEcho returns the echo of the challenge token together with a new announcement of the remote node
+func testChallengeEcho(t *testing.T, remote *testRemote, token []byte) *PacketRaw {
+	payload := append(append([]byte{}, token...), remote.announcement(t, ProtocolVersion).Payload...)
+	return &PacketRaw{Command: CommandChallengeEcho, Payload: payload}
+}
+
+func TestChallengeValid(t *testing.T) {
+	testConfig(t)
+	testInitPeer(t)
+	network := testNetworkLoopback(t)
+
+	remote := testRemoteNew(t, network)
+	remote.send(t, remote.announcement(t, ProtocolVersion), remote.address())
+
+	challenge := remote.receive(t, time.Second)
+	if challenge == nil || challenge.Command != CommandChallenge || len(challenge.Payload) != challengeTokenSize {
+		t.Fatal("announcement not answered with a challenge")
+	}
+	if PeerlistLookup(remote.publicKey) != nil {
+		t.Fatal("peer added before the address was validated")
+	}
+
+	remote.send(t, testChallengeEcho(t, remote, challenge.Payload), remote.address())
+	if PeerlistLookup(remote.publicKey) == nil {
+		t.Fatal("peer not added after echoing the challenge")
+	}
+	if response := remote.receive(t, time.Second); response == nil || response.Command != CommandResponse {
+		t.Fatal("echo not answered with a response")
+	}
+}
+
+func TestChallengeSpoofed(t *testing.T) {
+	testConfig(t)
+	testInitPeer(t)
+	network := testNetworkLoopback(t)
+
+	attacker := testRemoteNew(t, network)
+	victim := testRemoteNew(t, network)
+	announcement := attacker.announcement(t, ProtocolVersion)
+
+	attacker.send(t, announcement, victim.address())
+	if PeerlistLookup(attacker.publicKey) != nil {
+		t.Fatal("peer added by a spoofed announcement")
+	}
+
+	// The challenge goes to the victim, which cannot decrypt it and never echoes it. It must not be larger than the announcement.
+	buffer := make([]byte, maxPacketSize)
+	victim.socket.SetReadDeadline(time.Now().Add(time.Second))
+	length, err := victim.socket.Read(buffer)
+	if err != nil {
+		t.Fatalf("no challenge sent to the source address: %v", err)
+	}
+	if length > packetLengthMin+len(announcement.Payload) {
+		t.Fatalf("challenge of %d bytes is larger than the announcement", length)
+	}
+	if packet := attacker.receive(t, 200*time.Millisecond); packet != nil {
+		t.Fatalf("attacker received command %d", packet.Command)
+	}
+
+	// Tokens are bound to the address. Neither a guessed token nor the victim's token echoed from the attacker's address is accepted.
+	attacker.send(t, testChallengeEcho(t, attacker, make([]byte, challengeTokenSize)), victim.address())
+	attacker.send(t, testChallengeEcho(t, attacker, challengeToken(victim.address(), attacker.publicKey, challengeSlot())), attacker.address())
+
+	if PeerlistLookup(attacker.publicKey) != nil {
+		t.Fatal("peer added without completing the validation")
+	}
+	if packet := attacker.receive(t, 200*time.Millisecond); packet != nil {
+		t.Fatalf("attacker received command %d", packet.Command)
+	}
+
+	// A spoofed challenge is not echoed, as the echo containing the announcement is larger than the challenge.
+	attacker.send(t, &PacketRaw{Command: CommandChallenge, Payload: make([]byte, challengeTokenSize)}, victim.address())
+	victim.socket.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if length, err := victim.socket.Read(buffer); err == nil {
+		t.Fatalf("spoofed challenge answered with %d bytes", length)
+	}
+}
+
+func TestChallengeEcho(t *testing.T) {
+	testConfig(t)
+	testInitPeer(t)
+	network := testNetworkLoopback(t)
+
+	// Only a challenge in reply to our announcement is echoed.
+	remote := testRemoteNew(t, network)
+	remote.send(t, &PacketRaw{Command: CommandChallenge, Payload: make([]byte, challengeTokenSize)}, remote.address())
+	if packet := remote.receive(t, 200*time.Millisecond); packet != nil {
+		t.Fatalf("unsolicited challenge answered with command %d", packet.Command)
+	}
+
+	handshakeAdd(remote.address(), remote.publicKey)
+	token := []byte("0123456789abcdef")
+	remote.send(t, &PacketRaw{Command: CommandChallenge, Payload: token}, remote.address())
+
+	echo := remote.receive(t, time.Second)
+	if echo == nil || echo.Command != CommandChallengeEcho {
+		t.Fatal("solicited challenge not echoed")
+	}
+	if !bytes.Equal(echo.Payload[:challengeTokenSize], token) || len(echo.Payload) <= challengeTokenSize {
+		t.Fatal("echo does not contain the token and the announcement")
+	}
+}
+
+func TestChallengeMulticast(t *testing.T) {
+	testConfig(t)
+	testInitPeer(t)
+	network := testNetworkLoopback(t)
+
+	// A peer discovered via Multicast is sent our announcement instead of a challenge, so that its challenge is echoed.
+	remote := testRemoteNew(t, network)
+	wire := testPacketWire(t, remote.privateKey, network, remote.address(), remote.announcement(t, ProtocolVersion))
+	wire.unicast = false
+	packetProcess(wire)
+
+	if packet := remote.receive(t, time.Second); packet == nil || packet.Command != CommandAnnouncement {
+		t.Fatal("Multicast announcement not answered with an announcement")
+	}
+	if !handshakeIsPending(remote.address(), remote.publicKey) {
+		t.Fatal("no handshake pending with the peer discovered via Multicast")
+	}
+	if PeerlistLookup(remote.publicKey) != nil {
+		t.Fatal("peer discovered via Multicast added before the address was validated")
+	}
+}
@@ -0,0 +1,171 @@
+/*
+File Name:  Announcement Replay.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+A captured announcement could be replayed to repeatedly trigger adding the peer and sending a response.
+Each packet carries a random nonce and is signed by the sender, so the encrypted signature is unique per packet and serves as per-handshake nonce that cannot be altered without invalidating the packet.
+Signatures of received announcements are remembered for announcementReplayWindow; an announcement with a known signature is a replay and is dropped.
+
+Since protocol version 1.1 announcements contain the time they were created, which is covered by the signature. Announcements older (or newer) than announcementTimeTolerance are dropped as stale.
+The tolerance is half the replay window, so any announcement that passes the time check is still remembered if it was received before. This tolerates clocks off by up to the tolerance.
+Announcements of older peers do not contain the time and are only checked against the remembered signatures.
+
+Announcements are checked against the per-IP limit before they are remembered, so a flood from a single IP cannot displace the signatures of other peers.
+
+Memory bound: At most announcementReplayLimit entries are kept (65 bytes signature and timestamp each, about 1.5 MB including map overhead). If the cache is full, the oldest entry is evicted.
+If entries are evicted before their window ended (more than announcementReplayLimit announcements within the window), replays of them are not detected. They are still subject to the time check and the announcement rate limit per IP.
+
+Payload following the protocol version block in the announcement:
+Offset  Size   Info
+0       8      Time the announcement was created, Unix time in seconds
+*/
+
+package core
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// announcementTimeTolerance is the maximum difference between the time an announcement was created and the local time
+const announcementTimeTolerance = 5 * time.Minute
+
+// announcementReplayWindow is the time a received announcement is remembered
+const announcementReplayWindow = 2 * announcementTimeTolerance
+
+// announcementReplayLimit is the maximum count of remembered announcements
+const announcementReplayLimit = 10000
+
+// announcementTimeSize is the size of the time in the announcement
+const announcementTimeSize = 8
+
+var announcementsSeen = newSignatureCache(announcementReplayLimit, announcementReplayWindow)
+
+// statsAnnouncementsReplayed is the count of incoming announcements dropped as replay
+var statsAnnouncementsReplayed uint64
+
+// StatsAnnouncementsReplayed returns the count of incoming announcements that were dropped because the identical packet was received before or because they are stale.
+func StatsAnnouncementsReplayed() uint64 {
+	return atomic.LoadUint64(&statsAnnouncementsReplayed)
+}
+
+// signatureCache remembers packet signatures for a limited time. If the cache is full, the oldest entry is evicted.
+type signatureCache struct {
+	window     time.Duration         // Time an entry is remembered
+	seen       map[string]time.Time  // Signature -> time added
+	order      []signatureCacheEntry // Ring buffer of the entries in the order they were added
+	next       int                   // Next slot in the ring buffer, which holds the oldest entry
+	sync.Mutex                       // Mutex for all fields above
+}
+
+type signatureCacheEntry struct {
+	key   string
+	added time.Time
+}
+
+func newSignatureCache(limit int, window time.Duration) *signatureCache {
+	return &signatureCache{window: window, seen: make(map[string]time.Time), order: make([]signatureCacheEntry, limit)}
+}
+
+// contains checks if the signature was added within the window
+func (cache *signatureCache) contains(signature []byte) bool {
+	cache.Lock()
+	defer cache.Unlock()
+
+	added, ok := cache.seen[string(signature)]
+	return ok && time.Since(added) < cache.window
+}
+
+// add adds the signature. If the cache is full, the oldest entry is evicted.
+func (cache *signatureCache) add(signature []byte) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	cache.addLocked(string(signature), time.Now())
+}
+
+// seenOrAdd checks if the signature was added within the window and adds it otherwise
+func (cache *signatureCache) seenOrAdd(signature []byte) bool {
+	key := string(signature)
+	now := time.Now()
+
+	cache.Lock()
+	defer cache.Unlock()
+
+	if added, ok := cache.seen[key]; ok && now.Sub(added) < cache.window {
+		return true
+	}
+
+	cache.addLocked(key, now)
+	return false
+}
+
+// addLocked adds the key to the cache. The caller must hold the mutex.
+func (cache *signatureCache) addLocked(key string, now time.Time) {
+	// The oldest entry is only removed from the map if it was not added again since.
+	oldest := cache.order[cache.next]
+	if added, ok := cache.seen[oldest.key]; ok && added.Equal(oldest.added) {
+		delete(cache.seen, oldest.key)
+	}
+
+	cache.order[cache.next] = signatureCacheEntry{key: key, added: now}
+	cache.next = (cache.next + 1) % len(cache.order)
+	cache.seen[key] = now
+}
+
+// encodeAnnouncementTime returns the current time for the announcement
+func encodeAnnouncementTime() (data []byte) {
+	data = make([]byte, announcementTimeSize)
+	binary.LittleEndian.PutUint64(data, uint64(time.Now().Unix()))
+	return data
+}
+
+// decodeAnnouncementTime returns the time the announcement was created. Returns false if the payload does not contain it.
+func decodeAnnouncementTime(payload []byte) (created time.Time, valid bool) {
+	certificate := payload[announcementEndpointsSize(payload):]
+	if len(certificate) < ephemeralCertificateSize {
+		return created, false
+	}
+
+	block := certificate[ephemeralCertificateSize:]
+	if _, _, valid = decodeProtocolVersion(block); !valid {
+		return created, false
+	}
+
+	offset := protocolVersionSizeMin + int(block[2])
+	if len(block) < offset+announcementTimeSize {
+		return created, false
+	}
+
+	return time.Unix(int64(binary.LittleEndian.Uint64(block[offset:offset+announcementTimeSize])), 0), true
+}
+
+// announcementStale checks if the announcement was created outside the time tolerance. Announcements without time are not stale.
+func announcementStale(payload []byte) bool {
+	created, valid := decodeAnnouncementTime(payload)
+	if !valid {
+		return false
+	}
+
+	age := time.Since(created)
+	return age > announcementTimeTolerance || age < -announcementTimeTolerance
+}
+
+// announcementAccept checks an incoming announcement against the rate limit per IP, the time tolerance and the remembered signatures.
+// Only announcements within the rate limit are remembered.
+func announcementAccept(sender *net.UDPAddr, raw []byte, payload []byte) bool {
+	if !announcementAllowed(sender.IP) {
+		return false
+	}
+
+	if announcementStale(payload) || announcementsSeen.seenOrAdd(raw[len(raw)-signatureSize:]) {
+		atomic.AddUint64(&statsAnnouncementsReplayed, 1)
+		return false
+	}
+
+	return true
+}
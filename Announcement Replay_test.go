@@ -0,0 +1,86 @@
+/*
+File Name:  Announcement Replay_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package core
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestAnnouncementReplay(t *testing.T) {
+	testConfig(t)
+	testInitPeer(t)
+	network := testNetworkLoopback(t)
+
+	remote := testRemoteNew(t, network)
+	wire := testPacketWire(t, remote.privateKey, network, remote.address(), remote.announcement(t, ProtocolVersion))
+	replayed := StatsAnnouncementsReplayed()
+
+	packetProcess(wire)
+	if packet := remote.receive(t, time.Second); packet == nil || packet.Command != CommandChallenge {
+		t.Fatal("first announcement not answered with a challenge")
+	}
+
+	// The captured packet is replayed, also from a different address.
+	packetProcess(wire)
+	wire.sender = testRemoteNew(t, network).address()
+	packetProcess(wire)
+
+	if packet := remote.receive(t, 200*time.Millisecond); packet != nil {
+		t.Fatalf("replayed announcement answered with command %d", packet.Command)
+	}
+	if StatsAnnouncementsReplayed() != replayed+2 {
+		t.Fatalf("%d replays counted instead of 2", StatsAnnouncementsReplayed()-replayed)
+	}
+
+	// A new announcement of the same peer is accepted.
+	remote.send(t, remote.announcement(t, ProtocolVersion), remote.address())
+	if packet := remote.receive(t, time.Second); packet == nil {
+		t.Fatal("new announcement not answered")
+	}
+}
+
+func TestAnnouncementStale(t *testing.T) {
+	testConfig(t)
+	testInitPeer(t)
+	network := testNetworkLoopback(t)
+
+	remote := testRemoteNew(t, network)
+	replayed := StatsAnnouncementsReplayed()
+
+	// The time is at the end of the payload.
+	packet := remote.announcement(t, ProtocolVersion)
+	created := packet.Payload[len(packet.Payload)-announcementTimeSize:]
+	binary.LittleEndian.PutUint64(created, uint64(time.Now().Add(-announcementTimeTolerance-time.Minute).Unix()))
+
+	remote.send(t, packet, remote.address())
+	if packet := remote.receive(t, 200*time.Millisecond); packet != nil {
+		t.Fatalf("stale announcement answered with command %d", packet.Command)
+	}
+	if StatsAnnouncementsReplayed() != replayed+1 {
+		t.Fatal("stale announcement not counted")
+	}
+}
+
+func TestSignatureCacheLimit(t *testing.T) {
+	cache := newSignatureCache(2, time.Minute)
+
+	for _, signature := range []string{"a", "b", "c"} {
+		if cache.seenOrAdd([]byte(signature)) {
+			t.Fatalf("signature %s seen before it was added", signature)
+		}
+	}
+
+	// The oldest one was evicted.
+	if cache.contains([]byte("a")) || !cache.contains([]byte("b")) || !cache.contains([]byte("c")) {
+		t.Fatal("oldest signature not evicted")
+	}
+	if len(cache.seen) != 2 {
+		t.Fatalf("cache holds %d entries", len(cache.seen))
+	}
+}
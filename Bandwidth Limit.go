@@ -0,0 +1,184 @@
+/*
+File Name:  Bandwidth Limit.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Global limit of outgoing bandwidth with fair sharing across peers.
+A global token bucket limits the total. Each peer has its own bucket whose rate is its weighted share of the global limit among the peers that recently sent data.
+The shares are rebalanced once per second, so a single busy peer may use the full bandwidth while it is the only one, but cannot starve others once they send too.
+
+Control traffic (announcements, responses, pings, pongs, disconnects, acknowledgements) is never delayed or dropped. It counts against the global limit.
+Other packets wait up to bandwidthWaitMax for tokens and are dropped afterwards.
+*/
+
+package core
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bandwidthWaitMax is the maximum time to wait for bandwidth before a packet is dropped
+const bandwidthWaitMax = 250 * time.Millisecond
+
+// bandwidthActive is the time after the last data packet during which a peer is considered active for fair sharing
+const bandwidthActive = 2 * time.Second
+
+// ErrBandwidthLimit is returned if a packet is dropped because the bandwidth limit is exceeded
+var ErrBandwidthLimit = errors.New("bandwidth limit exceeded")
+
+var (
+	bandwidthGlobal     *tokenBucket // Global limit. Nil if unlimited.
+	bandwidthSent       uint64       // Count of bytes sent to peers, for calculating the utilization
+	bandwidthDropped    uint64       // Count of packets dropped due to the limit
+	bandwidthUsed       float64      // Bytes per second sent to peers, measured over the last rebalance interval
+	bandwidthSentLast   uint64       // Value of bandwidthSent at the last rebalance
+	bandwidthRebalanced time.Time    // Time of the last rebalance
+	bandwidthMutex      sync.Mutex   // Mutex for bandwidthUsed, bandwidthSentLast and bandwidthRebalanced
+)
+
+// peerBandwidth is the bandwidth share of a single peer
+type peerBandwidth struct {
+	bucket     *tokenBucket // Fair share of the global limit. Nil until the first rebalance.
+	weight     float64      // Weight for the fair share. 0 = default of 1.
+	lastData   int64        // Last time a data packet was sent, Unix nanoseconds. Atomic access.
+	sync.Mutex              // Mutex for bucket and weight
+}
+
+// initBandwidthLimit creates or updates the global bandwidth limit based on the config
+func initBandwidthLimit() {
+	if config.GlobalBandwidthLimit <= 0 {
+		bandwidthGlobal = nil
+		return
+	}
+
+	rate := float64(config.GlobalBandwidthLimit)
+	if bandwidthGlobal != nil {
+		bandwidthGlobal.setRate(rate, rate)
+	} else {
+		bandwidthGlobal = newTokenBucket(rate, rate)
+	}
+}
+
+// isControlCommand checks if the command is control traffic that is prioritized over other traffic
+func isControlCommand(command uint8) bool {
+	switch command {
+	case CommandAnnouncement, CommandResponse, CommandPing, CommandPong, CommandDisconnect, CommandChatAck, CommandPeerRequest, CommandAck, CommandChallenge, CommandChallengeEcho, CommandRekey:
+		return true
+	}
+	return false
+}
+
+// bandwidthAllow checks if a packet to the peer may be sent under the bandwidth limit. Control traffic is always allowed.
+// Other packets wait up to bandwidthWaitMax for the peer's share and the global limit.
+func (peer *PeerInfo) bandwidthAllow(command uint8, size int) bool {
+	global := bandwidthGlobal
+	if global == nil {
+		return true
+	}
+
+	if isControlCommand(command) {
+		global.consume(float64(size))
+		atomic.AddUint64(&bandwidthSent, uint64(size))
+		return true
+	}
+
+	atomic.StoreInt64(&peer.bandwidth.lastData, time.Now().UnixNano())
+
+	peer.bandwidth.Lock()
+	bucket := peer.bandwidth.bucket
+	peer.bandwidth.Unlock()
+
+	for deadline := time.Now().Add(bandwidthWaitMax); ; time.Sleep(10 * time.Millisecond) {
+		if (bucket == nil || bucket.canTake(float64(size))) && global.canTake(float64(size)) {
+			if bucket != nil {
+				bucket.consume(float64(size))
+			}
+			global.consume(float64(size))
+			atomic.AddUint64(&bandwidthSent, uint64(size))
+			return true
+		}
+
+		if time.Now().After(deadline) {
+			atomic.AddUint64(&bandwidthDropped, 1)
+			return false
+		}
+	}
+}
+
+// bandwidthRebalance recalculates the fair share of each peer and the utilization. It is called once per second.
+// Active peers share the global limit by weight. Inactive peers get the share they would have if they became active.
+func bandwidthRebalance() {
+	global := bandwidthGlobal
+	if global == nil {
+		return
+	}
+
+	now := time.Now()
+	peers := PeerlistGet()
+	weights := make([]float64, len(peers))
+	active := make([]bool, len(peers))
+	var weightActive float64
+
+	for n, peer := range peers {
+		peer.bandwidth.Lock()
+		weights[n] = peer.bandwidth.weight
+		peer.bandwidth.Unlock()
+		if weights[n] <= 0 {
+			weights[n] = 1
+		}
+
+		if now.Sub(time.Unix(0, atomic.LoadInt64(&peer.bandwidth.lastData))) < bandwidthActive {
+			active[n] = true
+			weightActive += weights[n]
+		}
+	}
+
+	rate := float64(config.GlobalBandwidthLimit)
+
+	for n, peer := range peers {
+		share := rate * weights[n] / (weightActive + weights[n])
+		if active[n] {
+			share = rate * weights[n] / weightActive
+		}
+
+		peer.bandwidth.Lock()
+		if peer.bandwidth.bucket == nil {
+			peer.bandwidth.bucket = newTokenBucket(share, share)
+		} else {
+			peer.bandwidth.bucket.setRate(share, share)
+		}
+		peer.bandwidth.Unlock()
+	}
+
+	// utilization
+	sent := atomic.LoadUint64(&bandwidthSent)
+
+	bandwidthMutex.Lock()
+	if !bandwidthRebalanced.IsZero() {
+		if elapsed := now.Sub(bandwidthRebalanced).Seconds(); elapsed > 0 {
+			bandwidthUsed = float64(sent-bandwidthSentLast) / elapsed
+		}
+	}
+	bandwidthSentLast = sent
+	bandwidthRebalanced = now
+	bandwidthMutex.Unlock()
+}
+
+// SetBandwidthWeight sets the weight of the peer for the fair share of the global bandwidth limit. The default weight is 1. A peer with weight 2 gets twice the share of a peer with weight 1.
+func (peer *PeerInfo) SetBandwidthWeight(weight float64) {
+	peer.bandwidth.Lock()
+	peer.bandwidth.weight = weight
+	peer.bandwidth.Unlock()
+}
+
+// BandwidthUtilization returns the bytes per second recently sent to peers, the global limit in bytes per second (0 if unlimited), and the count of packets dropped due to the limit.
+func BandwidthUtilization() (used float64, limit int, dropped uint64) {
+	bandwidthMutex.Lock()
+	used = bandwidthUsed
+	bandwidthMutex.Unlock()
+
+	return used, config.GlobalBandwidthLimit, atomic.LoadUint64(&bandwidthDropped)
+}
@@ -0,0 +1,252 @@
+/*
+File Name:  Blockchain.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Request of blocks of a peer's blockchain via CommandGet. The blocks are provided by the application via a BlockStore.
+
+Get request payload:
+Offset  Size   Info
+0       4      Request ID, echoed in the response
+4       33     Public key (compressed) of the peer whose blockchain is requested
+37      8      Block height from (inclusive)
+45      8      Block height to (inclusive)
+
+Get response payload:
+Offset  Size   Info
+0       4      Request ID
+4       1      Status, see GetStatusX
+5       2      Count of blocks
+7       ?      Blocks, each prefixed with its 4-byte size
+
+The response is limited in size. If not all blocks fit, the response contains the first blocks only and the requester continues with the next height.
+*/
+
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// BlockStore provides blocks of blockchains to remote peers
+type BlockStore interface {
+	// GetBlocks returns the blocks of the peer's blockchain in the height range (inclusive), in order.
+	// It may return fewer blocks than requested, but only starting with the first height.
+	GetBlocks(publicKey *btcec.PublicKey, from, to uint64) (blocks [][]byte, err error)
+}
+
+// Status in the response to a get request
+const (
+	GetStatusOK           = 0 // Blocks are returned. The count may be smaller than requested.
+	GetStatusNotAvailable = 1 // The blocks are not available.
+	GetStatusBusy         = 2 // Too many simultaneous transfers, retry later.
+	GetStatusInvalid      = 3 // Invalid request.
+)
+
+// getRequestSize is the size of the get request payload
+const getRequestSize = 4 + btcec.PubKeyBytesLenCompressed + 8 + 8
+
+// getResponseMaxSize is the maximum size of the get response payload, to fit into a single UDP packet without fragmentation
+const getResponseMaxSize = 1200
+
+// getQueueTimeout is the maximum time an incoming get request waits for a free transfer slot
+const getQueueTimeout = 5 * time.Second
+
+var blockStore BlockStore
+var blockStoreMutex sync.RWMutex
+
+// SetBlockStore sets the store serving get requests from remote peers. If nil, all requests are answered as not available.
+func SetBlockStore(store BlockStore) {
+	blockStoreMutex.Lock()
+	blockStore = store
+	blockStoreMutex.Unlock()
+}
+
+// getRequest is a decoded get request
+type getRequest struct {
+	id        uint32
+	publicKey *btcec.PublicKey
+	from, to  uint64
+}
+
+// encodeGetRequest encodes the payload of a get request
+func encodeGetRequest(request getRequest) (payload []byte) {
+	payload = make([]byte, getRequestSize)
+	binary.LittleEndian.PutUint32(payload[0:4], request.id)
+	copy(payload[4:37], request.publicKey.SerializeCompressed())
+	binary.LittleEndian.PutUint64(payload[37:45], request.from)
+	binary.LittleEndian.PutUint64(payload[45:53], request.to)
+	return payload
+}
+
+// decodeGetRequest decodes the payload of a get request
+func decodeGetRequest(payload []byte) (request getRequest, err error) {
+	if len(payload) < getRequestSize {
+		return request, errors.New("get request: invalid size")
+	}
+
+	request.id = binary.LittleEndian.Uint32(payload[0:4])
+	if request.publicKey, err = btcec.ParsePubKey(payload[4:37], btcec.S256()); err != nil {
+		return request, err
+	}
+	request.from = binary.LittleEndian.Uint64(payload[37:45])
+	request.to = binary.LittleEndian.Uint64(payload[45:53])
+
+	if request.from > request.to {
+		return request, errors.New("get request: invalid height range")
+	}
+
+	return request, nil
+}
+
+// encodeGetResponse encodes the payload of a get response. Blocks that exceed the maximum size are not included.
+func encodeGetResponse(id uint32, status byte, blocks [][]byte) (payload []byte) {
+	payload = make([]byte, 7, getResponseMaxSize)
+	binary.LittleEndian.PutUint32(payload[0:4], id)
+	payload[4] = status
+
+	count := 0
+	for _, block := range blocks {
+		if len(payload)+4+len(block) > getResponseMaxSize || count == 0xFFFF {
+			break
+		}
+
+		var size [4]byte
+		binary.LittleEndian.PutUint32(size[:], uint32(len(block)))
+		payload = append(payload, size[:]...)
+		payload = append(payload, block...)
+		count++
+	}
+
+	binary.LittleEndian.PutUint16(payload[5:7], uint16(count))
+	return payload
+}
+
+// decodeGetResponse decodes the payload of a get response
+func decodeGetResponse(payload []byte) (id uint32, status byte, blocks [][]byte, err error) {
+	if len(payload) < 7 {
+		return 0, 0, nil, errors.New("get response: invalid size")
+	}
+
+	id = binary.LittleEndian.Uint32(payload[0:4])
+	status = payload[4]
+	count := int(binary.LittleEndian.Uint16(payload[5:7]))
+
+	data := payload[7:]
+	for n := 0; n < count; n++ {
+		if len(data) < 4 {
+			return id, status, nil, errors.New("get response: invalid block size")
+		}
+		size := binary.LittleEndian.Uint32(data[0:4])
+		if uint64(len(data)-4) < uint64(size) {
+			return id, status, nil, errors.New("get response: invalid block size")
+		}
+
+		blocks = append(blocks, data[4:4+size])
+		data = data[4+size:]
+	}
+
+	return id, status, blocks, nil
+}
+
+// cmdGet handles an incoming get request. The blocks are read from the block store in a separate routine to not block the packet worker.
+func (peer *PeerInfo) cmdGet(msg *packet2) {
+	if peer == nil {
+		return
+	}
+
+	request, err := decodeGetRequest(msg.Payload)
+	if err != nil {
+		if len(msg.Payload) >= 4 {
+			peer.send(&PacketRaw{Command: CommandGetResponse, Payload: encodeGetResponse(binary.LittleEndian.Uint32(msg.Payload[0:4]), GetStatusInvalid, nil)})
+		}
+		return
+	}
+
+	go peer.getServe(request)
+}
+
+// getServe reads the requested blocks from the block store and sends the response
+func (peer *PeerInfo) getServe(request getRequest) {
+	release, err := transfersInbound.acquire(getQueueTimeout)
+	if err != nil {
+		peer.send(&PacketRaw{Command: CommandGetResponse, Payload: encodeGetResponse(request.id, GetStatusBusy, nil)})
+		return
+	}
+	defer release()
+
+	blockStoreMutex.RLock()
+	store := blockStore
+	blockStoreMutex.RUnlock()
+
+	if store == nil {
+		peer.send(&PacketRaw{Command: CommandGetResponse, Payload: encodeGetResponse(request.id, GetStatusNotAvailable, nil)})
+		return
+	}
+
+	blocks, err := store.GetBlocks(request.publicKey, request.from, request.to)
+	if err != nil || len(blocks) == 0 {
+		peer.send(&PacketRaw{Command: CommandGetResponse, Payload: encodeGetResponse(request.id, GetStatusNotAvailable, nil)})
+		return
+	}
+
+	peer.send(&PacketRaw{Command: CommandGetResponse, Payload: encodeGetResponse(request.id, GetStatusOK, blocks)})
+}
+
+// cmdGetResponse handles the response to a get request
+func (peer *PeerInfo) cmdGetResponse(msg *packet2) {
+	if peer == nil || len(msg.Payload) < 4 {
+		return
+	}
+
+	requestResolve(peer, binary.LittleEndian.Uint32(msg.Payload[0:4]), msg)
+}
+
+// ErrBlocksNotAvailable is returned if the remote peer does not have the requested blocks
+var ErrBlocksNotAvailable = errors.New("blocks not available")
+
+// GetBlocks requests blocks of the blockchain of the public key from the peer, in the height range (inclusive).
+// The remote peer may return fewer blocks than requested; the caller continues with the next height.
+func GetBlocks(peer *PeerInfo, publicKey *btcec.PublicKey, from, to uint64, timeout time.Duration) (blocks [][]byte, err error) {
+	request := getRequest{id: rand.Uint32(), publicKey: publicKey, from: from, to: to}
+
+	release, err := transfersOutbound.acquire(timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	response := requestRegister(peer, CommandGetResponse, request.id)
+
+	if err = peer.send(&PacketRaw{Command: CommandGet, Payload: encodeGetRequest(request)}); err != nil {
+		requestRemove(peer, CommandGetResponse, request.id)
+		return nil, err
+	}
+
+	msg, err := requestWait(peer, CommandGetResponse, request.id, response, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	_, status, blocks, err := decodeGetResponse(msg.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	switch status {
+	case GetStatusOK:
+		return blocks, nil
+	case GetStatusBusy:
+		return nil, ErrTransfersBusy
+	case GetStatusInvalid:
+		return nil, errors.New("invalid get request")
+	default:
+		return nil, ErrBlocksNotAvailable
+	}
+}
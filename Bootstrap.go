@@ -13,9 +13,9 @@ Strategy for sending our IPv6 Multicast and IPv4 Broadcast messages:
 package core
 
 import (
+	"context"
 	"encoding/hex"
 	"errors"
-	"log"
 	"net"
 	"strconv"
 	"time"
@@ -43,12 +43,12 @@ loopSeedList:
 		// parse the Public Key
 		publicKeyB, err := hex.DecodeString(seed.PublicKey)
 		if err != nil {
-			log.Printf("initSeedList error public key '%s': %v", seed.PublicKey, err.Error())
+			logger.Errorf("initSeedList error public key '%s': %v", seed.PublicKey, err.Error())
 			continue
 		}
 
 		if peer.publicKey, err = btcec.ParsePubKey(publicKeyB, btcec.S256()); err != nil {
-			log.Printf("initSeedList error public key '%s': %v", seed.PublicKey, err.Error())
+			logger.Errorf("initSeedList error public key '%s': %v", seed.PublicKey, err.Error())
 			continue
 		}
 
@@ -56,7 +56,7 @@ loopSeedList:
 		for _, addressA := range seed.Address {
 			address, err := parseAddress(addressA)
 			if err != nil {
-				log.Printf("initSeedList error public key '%s' address '%s': %v", seed.PublicKey, addressA, err.Error())
+				logger.Errorf("initSeedList error public key '%s' address '%s': %v", seed.PublicKey, addressA, err.Error())
 				continue loopSeedList
 			}
 
@@ -92,14 +92,22 @@ func parseAddress(Address string) (remote *net.UDPAddr, err error) {
 // contact tries to contact the root peer on all networks
 func (peer *rootPeer) contact() {
 	for _, address := range peer.addresses {
-		sendAllNetworks(peer.publicKey, &PacketRaw{Command: 0}, address)
+		// IPv4 addresses are reached via NAT64 on IPv6-only networks.
+		address = nat64Address(address)
+
+		if endpointInBackoff(address) {
+			continue
+		}
+
+		handshakeAdd(address, peer.publicKey)
+		sendAllNetworks(peer.publicKey, announcementPacket(), address)
 	}
 }
 
 // bootstrap connects to the initial set of peers. It will also start the routine for ongoing sending of multicast/broadcast messages.
-func bootstrap() {
+func bootstrap(ctx context.Context) {
 	if len(rootPeers) == 0 {
-		log.Printf("bootstrap warning: Empty list of root peers. Connectivity relies on local peer discovery and incoming connections.\n")
+		logger.Warnf("bootstrap warning: Empty list of root peers. Connectivity relies on local peer discovery and incoming connections.\n")
 		return
 	}
 
@@ -127,7 +135,9 @@ func bootstrap() {
 
 	// Phase 1: First 10 minutes. Try every 7 seconds to connect to all root peers until at least 2 peers connected.
 	for n := 0; n < 10*60/7; n++ {
-		time.Sleep(time.Second * 7)
+		if !sleepContext(ctx, time.Second*7) {
+			return
+		}
 
 		if connected, total := countConnectedRootPeers(); connected == total || connected >= 2 {
 			return
@@ -138,7 +148,9 @@ func bootstrap() {
 
 	// Phase 2: After that (if not 2 peers), try every 5 minutes to connect to remaining root peers for a maximum of 1 hour.
 	for n := 0; n < 1*60/5; n++ {
-		time.Sleep(time.Minute * 5)
+		if !sleepContext(ctx, time.Minute*5) {
+			return
+		}
 
 		contactRootPeers()
 
@@ -147,23 +159,23 @@ func bootstrap() {
 		}
 	}
 
-	log.Printf("bootstrap unable to connect to at least 2 root peers, aborting\n")
+	logger.Warnf("bootstrap unable to connect to at least 2 root peers, aborting\n")
 }
 
-func autoMulticastBroadcast() {
+func autoMulticastBroadcast(ctx context.Context) {
 	sendMulticastBroadcast := func() {
 		networksMutex.RLock()
 		defer networksMutex.RUnlock()
 
 		for _, network := range networks6 {
 			if err := network.MulticastIPv6Send(); err != nil {
-				log.Printf("bootstrap error multicast from network address '%s': %v", network.address.IP.String(), err.Error())
+				logger.Errorf("bootstrap error multicast from network address '%s': %v", network.address.IP.String(), err.Error())
 			}
 		}
 
 		for _, network := range networks4 {
 			if err := network.BroadcastIPv4Send(); err != nil {
-				log.Printf("bootstrap error broadcast from network address '%s': %v", network.address.IP.String(), err.Error())
+				logger.Errorf("bootstrap error broadcast from network address '%s': %v", network.address.IP.String(), err.Error())
 			}
 		}
 	}
@@ -173,7 +185,9 @@ func autoMulticastBroadcast() {
 
 	// Phase 1: Resend every 10 seconds until at least 1 peer in the peer list
 	for {
-		time.Sleep(time.Second * 10)
+		if !sleepContext(ctx, time.Second*10) {
+			return
+		}
 
 		if PeerlistCount() >= 1 {
 			break
@@ -184,7 +198,9 @@ func autoMulticastBroadcast() {
 
 	// Phase 2: Every 10 minutes.
 	for {
-		time.Sleep(time.Minute * 10)
+		if !sleepContext(ctx, time.Minute*10) {
+			return
+		}
 		sendMulticastBroadcast()
 	}
 }
@@ -0,0 +1,169 @@
+/*
+File Name:  Captive Portal.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Detection of captive portals and hijacked networks (typically public Wi-Fi). After a network change, the root peers are contacted.
+* A valid response from any root peer means the network is online.
+* Packets that cannot be decrypted from a root peer address, or packets that look like HTTP, mean the traffic is intercepted: The network is captive.
+* No response at all means the network is offline (or all root peers are down).
+*/
+
+package core
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Network status as detected by the connectivity check
+const (
+	NetworkUnknown = 0 // No check was performed, there are no root peers to check against, or passive mode is enabled.
+	NetworkOnline  = 1 // Root peers are reachable.
+	NetworkCaptive = 2 // Responses are intercepted, for example by a captive portal. The user may need to log in.
+	NetworkOffline = 3 // No response from any root peer.
+)
+
+// captiveCheckDelay is the time to wait after a network change before checking, to allow the network to settle
+const captiveCheckDelay = 2 * time.Second
+
+// captiveCheckTimeout is the time to wait for responses from root peers
+const captiveCheckTimeout = 5 * time.Second
+
+var (
+	networkStatus         int                 // Result of the latest connectivity check
+	networkStatusCallback func(status int)    // Called when the status changes. May be nil.
+	captiveCheckRunning   int32               // 1 if a check is running. Atomic access.
+	captiveCheckSuspect   bool                // If intercepted packets were received during the current check
+	captiveCheckAddresses map[string]struct{} // Root peer addresses contacted during the current check. Nil if no check is running.
+	captiveCheckMutex     sync.Mutex          // Mutex for all variables above
+)
+
+// SetNetworkStatusCallback sets a function that is called when the network status changes, for example to prompt the user to log in to a captive portal. See the Network status constants.
+func SetNetworkStatusCallback(f func(status int)) {
+	captiveCheckMutex.Lock()
+	networkStatusCallback = f
+	captiveCheckMutex.Unlock()
+}
+
+// NetworkStatus returns the result of the latest connectivity check. See the Network status constants.
+func NetworkStatus() int {
+	captiveCheckMutex.Lock()
+	defer captiveCheckMutex.Unlock()
+
+	return networkStatus
+}
+
+// captiveCheckAfterChange runs the connectivity check after a network change. Concurrent network changes result in a single check.
+func captiveCheckAfterChange() {
+	if !atomic.CompareAndSwapInt32(&captiveCheckRunning, 0, 1) {
+		return
+	}
+
+	go func() {
+		time.Sleep(captiveCheckDelay)
+		checkNetworkConnectivity()
+		atomic.StoreInt32(&captiveCheckRunning, 0)
+	}()
+}
+
+// CheckNetworkConnectivity checks if root peers are reachable or responses are intercepted. It blocks until the check is complete. See the Network status constants.
+func CheckNetworkConnectivity() (status int) {
+	for !atomic.CompareAndSwapInt32(&captiveCheckRunning, 0, 1) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	defer atomic.StoreInt32(&captiveCheckRunning, 0)
+
+	return checkNetworkConnectivity()
+}
+
+// checkNetworkConnectivity performs the check. The caller must set captiveCheckRunning.
+func checkNetworkConnectivity() (status int) {
+	// In passive mode no announcements are sent proactively.
+	if len(rootPeers) == 0 || config.PassiveMode {
+		return NetworkUnknown
+	}
+
+	start := time.Now()
+
+	captiveCheckMutex.Lock()
+	captiveCheckSuspect = false
+	captiveCheckAddresses = make(map[string]struct{})
+	for _, peer := range rootPeers {
+		for _, address := range peer.addresses {
+			captiveCheckAddresses[nat64Address(address).String()] = struct{}{}
+		}
+	}
+	captiveCheckMutex.Unlock()
+
+	for _, peer := range rootPeers {
+		for _, address := range peer.addresses {
+			handshakeAdd(nat64Address(address), peer.publicKey)
+			sendAllNetworks(peer.publicKey, announcementPacket(), nat64Address(address))
+		}
+	}
+
+	status = NetworkOffline
+
+	for deadline := start.Add(captiveCheckTimeout); time.Now().Before(deadline); time.Sleep(250 * time.Millisecond) {
+		if captiveCheckRootPeerResponded(start) {
+			status = NetworkOnline
+			break
+		}
+	}
+
+	captiveCheckMutex.Lock()
+	if status != NetworkOnline && captiveCheckSuspect {
+		status = NetworkCaptive
+	}
+	captiveCheckAddresses = nil
+
+	changed := status != networkStatus
+	networkStatus = status
+	callback := networkStatusCallback
+	captiveCheckMutex.Unlock()
+
+	if changed && callback != nil {
+		callback(status)
+	}
+
+	return status
+}
+
+// captiveCheckRootPeerResponded checks if any root peer sent a valid packet since the start of the check
+func captiveCheckRootPeerResponded(start time.Time) bool {
+	for _, root := range rootPeers {
+		peer := PeerlistLookup(root.publicKey)
+		if peer == nil {
+			continue
+		}
+
+		for _, connection := range peer.GetConnections(true) {
+			if connection.LastPacketIn.After(start) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// captiveCheckInvalidPacket is called for incoming packets that cannot be decrypted. During a check, such packets from a root peer address or HTTP responses indicate interception.
+func captiveCheckInvalidPacket(packet *networkWire) {
+	if atomic.LoadInt32(&captiveCheckRunning) == 0 {
+		return
+	}
+
+	captiveCheckMutex.Lock()
+	defer captiveCheckMutex.Unlock()
+
+	if captiveCheckAddresses == nil {
+		return
+	}
+
+	if _, ok := captiveCheckAddresses[packet.sender.String()]; ok || bytes.HasPrefix(packet.raw, []byte("HTTP/")) {
+		captiveCheckSuspect = true
+	}
+}
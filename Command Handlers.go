@@ -0,0 +1,60 @@
+/*
+File Name:  Command Handlers.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Applications may handle their own commands via RegisterCommandHandler. Command numbers below CommandUserMin are reserved for the core library.
+*/
+
+package core
+
+import (
+	"errors"
+	"sync"
+)
+
+// CommandUserMin is the lowest command number available for custom commands. Lower ones are reserved for the core library.
+const CommandUserMin = 128
+
+// Message is an incoming message passed to custom command handlers
+type Message = packet2
+
+// ErrCommandReserved is returned when registering a handler for a command number reserved for the core library
+var ErrCommandReserved = errors.New("command number reserved for core commands")
+
+var commandHandlers [256]func(peer *PeerInfo, msg *Message)
+var commandHandlersMutex sync.RWMutex
+
+// RegisterCommandHandler registers the handler for a custom command. It replaces any previously registered handler for the command; nil removes it.
+// The handler is called from the packet workers. Peer is nil if the sender is not in the peer list. Use SendCommand to reply.
+func RegisterCommandHandler(command uint8, handler func(peer *PeerInfo, msg *Message)) error {
+	if command < CommandUserMin {
+		return ErrCommandReserved
+	}
+
+	commandHandlersMutex.Lock()
+	commandHandlers[command] = handler
+	commandHandlersMutex.Unlock()
+
+	return nil
+}
+
+// commandHandlerCall calls the registered handler for a custom command. Commands without handler are ignored.
+func commandHandlerCall(peer *PeerInfo, msg *Message) {
+	commandHandlersMutex.RLock()
+	handler := commandHandlers[msg.Command]
+	commandHandlersMutex.RUnlock()
+
+	if handler != nil {
+		handler(peer, msg)
+	}
+}
+
+// SendCommand sends a custom command to the peer
+func (peer *PeerInfo) SendCommand(command uint8, payload []byte) error {
+	if command < CommandUserMin {
+		return ErrCommandReserved
+	}
+
+	return peer.send(&PacketRaw{Command: command, Payload: payload})
+}
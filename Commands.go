@@ -7,7 +7,12 @@ Author:     Peter Kleissner
 package core
 
 import (
-	"fmt"
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/btcsuite/btcd/btcec"
@@ -16,18 +21,32 @@ import (
 // Commands between peers
 const (
 	// Peer List Management
-	CommandAnnouncement = 0 // Announcement
-	CommandResponse     = 1 // Response
-	CommandPing         = 2 // Keep-alive message (no payload).
-	CommandPong         = 3 // Response to ping (no payload).
+	CommandAnnouncement  = 0  // Announcement. Optional payload, see Endpoints.go.
+	CommandResponse      = 1  // Response
+	CommandPing          = 2  // Keep-alive message. Optional payload, see Ping Payload.go.
+	CommandPong          = 3  // Response to ping. Optional payload, see Ping Payload.go.
+	CommandDisconnect    = 5  // Notification that the sender removed the receiver from its peer list. Payload: 1 byte reason.
+	CommandPeerRequest   = 7  // Request for known peers. Payload see Peer Exchange.go.
+	CommandPeerResponse  = 8  // Response with known peers. Payload see Peer Exchange.go.
+	CommandChallenge     = 14 // Challenge to confirm the address of an unknown peer. Payload see Address Validation.go.
+	CommandChallengeEcho = 15 // Echo of the challenge. Payload see Address Validation.go.
+	CommandRekey         = 16 // New ephemeral key after a rotation. Payload see Ephemeral Key.go.
 
 	// Blockchain
-	CommandGet = 4 // Request blocks for specified peer.
+	CommandGet         = 4 // Request blocks for specified peer. Payload see Blockchain.go.
+	CommandGetResponse = 6 // Response to a get request. Payload see Blockchain.go.
+
+	// Transport
+	CommandFragment = 9  // Fragment of a packet with a payload larger than config.FragmentThreshold. Payload see Fragmentation.go.
+	CommandReliable = 12 // Packet that must be acknowledged. Payload see Reliable.go.
+	CommandAck      = 13 // Acknowledgement of a reliable packet. Payload see Reliable.go.
 
 	// File Discovery
 
 	// Debug
-	CommandChat = 10 // Chat message [debug]
+	CommandChat         = 10 // Chat message [debug]. Payload: The text.
+	CommandChatAck      = 11 // Acknowledgement of a reliable chat message [debug]. Payload: 4 bytes message ID of the chat message.
+	CommandChatReliable = 17 // Chat message that must be acknowledged [debug]. Payload: 4 bytes random message ID, then the text.
 )
 
 // packet2 is a high-level message between peers
@@ -35,79 +54,304 @@ type packet2 struct {
 	PacketRaw
 	SenderPublicKey *btcec.PublicKey // Sender Public Key, ECDSA (secp256k1) 257-bit
 	connection      *Connection      // Connection that received the packet
+	multicast       bool             // True if received via IPv4 Broadcast or IPv6 Multicast
+}
+
+// defaultAnnouncementLimit is the default count of announcements per second per source IP, see config.AnnouncementLimit
+const defaultAnnouncementLimit = 10
+
+// announcementLimitBurst is the count of seconds of announcements that may arrive at once from a single IP, for example when multiple nodes behind the same NAT join the network
+const announcementLimitBurst = 5
+
+// announcementLimiter limits incoming announcements per source IP. Nil if disabled.
+var announcementLimiter *ipRateLimiter
+
+// initAnnouncementLimit creates the announcement limiter based on the config
+func initAnnouncementLimit() {
+	if config.AnnouncementLimit < 0 {
+		announcementLimiter = nil
+		return
+	}
+	announcementLimiter = newIPRateLimiter(float64(config.AnnouncementLimit), float64(config.AnnouncementLimit*announcementLimitBurst))
+}
+
+// announcementAllowed checks if an incoming announcement from the IP is within the limit.
+// Spoofed source addresses or keys could otherwise flood the peer list and the log.
+func announcementAllowed(ip net.IP) bool {
+	if limiter := announcementLimiter; limiter != nil && !limiter.allow(ip) {
+		atomic.AddUint64(&statsAnnouncementsDropped, 1)
+		return false
+	}
+	return true
 }
 
-// cmdAnouncement handles an incoming announcement
+// cmdAnouncement handles an incoming announcement. The caller must check it via announcementAccept or announcementAllowed first.
 func (peer *PeerInfo) cmdAnouncement(msg *packet2) {
+	// Peers with an incompatible wire format are refused. If such a peer is known, it was most likely upgraded and is removed.
+	if !protocolCompatible(msg.Payload[announcementEndpointsSize(msg.Payload):], msg.connection.Address) {
+		if peer != nil {
+			PeerlistRemoveByKey(peer.PublicKey)
+		}
+		return
+	}
+
+	// The sender of the first announcement must prove that it owns the source address, see Address Validation.go.
+	// To a sender discovered via Broadcast or Multicast our own announcement is sent, so that its challenge is expected.
+	// Legacy peers do not know the challenge and are sent an announcement without payload instead; their response validates the address.
 	if peer == nil {
-		peer, added := PeerlistAdd(msg.SenderPublicKey, msg.connection)
-		fmt.Printf("Incoming initial announcement from %s\n", msg.connection.Address.String())
+		logger.Debugf("Incoming initial announcement from %s\n", msg.connection.Address.String())
 
-		// send the Response
-		if added {
-			peer.send(&PacketRaw{Command: CommandResponse})
+		switch {
+		case announcementLegacy(msg.Payload):
+			handshakeAdd(msg.connection.Address, msg.SenderPublicKey)
+			sendViaConnection(msg.SenderPublicKey, &PacketRaw{Command: CommandAnnouncement}, msg.connection)
+		case msg.multicast:
+			handshakeAdd(msg.connection.Address, msg.SenderPublicKey)
+			sendViaConnection(msg.SenderPublicKey, announcementPacket(), msg.connection)
+		default:
+			sendChallenge(msg)
 		}
-
 		return
 	}
-	fmt.Printf("Incoming secondary announcement from %s\n", msg.connection.Address.String())
+	logger.Debugf("Incoming secondary announcement from %s\n", msg.connection.Address.String())
+	peer.setEndpoints(decodeEndpoints(msg.Payload))
+	peer.setReachability(msg.Payload)
+	peer.setEphemeralKey(msg.Payload[announcementEndpointsSize(msg.Payload):])
+	peer.setProtocolVersion(msg.Payload[announcementEndpointsSize(msg.Payload):])
 
 	// Announcement from existing peer means the peer most likely restarted
-	peer.send(&PacketRaw{Command: CommandResponse})
+	peer.send(responsePacket(msg.connection.Address))
 }
 
-// cmdResponse handles the response to the announcement
+// peerAddAnnounced adds the sender of a validated initial announcement to the peer list and sends the response
+func peerAddAnnounced(msg *packet2) {
+	peer, added := PeerlistAdd(msg.SenderPublicKey, msg.connection)
+
+	if peer != nil {
+		peer.setEndpoints(decodeEndpoints(msg.Payload))
+		peer.setReachability(msg.Payload)
+		peer.setEphemeralKey(msg.Payload[announcementEndpointsSize(msg.Payload):])
+		peer.setProtocolVersion(msg.Payload[announcementEndpointsSize(msg.Payload):])
+	}
+
+	// send the Response
+	if added {
+		peer.send(responsePacket(msg.connection.Address))
+		peer.pexRequest()
+	}
+}
+
+// responsePacket returns a new response packet to the announcement received from the address
+func responsePacket(address *net.UDPAddr) *PacketRaw {
+	payload := encodeObservedAddress(address)
+	if certificate := encodeEphemeralCertificate(); len(certificate) > 0 {
+		payload = append(payload, certificate...)
+		payload = append(payload, encodeProtocolVersion()...)
+	}
+
+	return &PacketRaw{Command: CommandResponse, Payload: payload}
+}
+
+// cmdResponse handles the response to the announcement.
+// Responses from unknown peers are only accepted if we sent an announcement to the address and the sender has the expected public key. Otherwise the source address could be spoofed.
 func (peer *PeerInfo) cmdResponse(msg *packet2) {
+	pending := handshakeComplete(msg.connection.Address)
+	solicited := pending != nil && (pending.publicKey == nil || pending.publicKey.IsEqual(msg.SenderPublicKey))
+	if peer == nil && !solicited {
+		logger.Debugf("Dropping unsolicited response from %s\n", msg.connection.Address.String())
+		return
+	}
+
+	// Resolve after the peer is added, in case ConnectPeer waits for the response.
+	defer requestResolve(&PeerInfo{PublicKey: msg.SenderPublicKey}, connectRequestID, msg)
+
+	// The payload contains our address as observed by the remote peer. Older peers do not send it.
+	// It is only used if we started the handshake, so that unsolicited packets cannot influence the external address.
+	if observed := decodeObservedAddress(msg.Payload); observed != nil && solicited {
+		msg.connection.Network.recordObservedAddress(msg.connection.Address.IP, msg.SenderPublicKey, observed)
+	}
+
+	// Peers with an incompatible wire format are refused, as in cmdAnouncement. A known peer was most likely upgraded and is removed.
+	if len(msg.Payload) > observedAddressSize && !protocolCompatible(msg.Payload[observedAddressSize:], msg.connection.Address) {
+		if peer != nil {
+			PeerlistRemoveByKey(peer.PublicKey)
+		}
+		return
+	}
+
 	if peer == nil {
 		peer, _ = PeerlistAdd(msg.SenderPublicKey, msg.connection)
-		fmt.Printf("Incoming initial response from %s\n", msg.connection.Address.String())
+		logger.Debugf("Incoming initial response from %s\n", msg.connection.Address.String())
 
+		if peer != nil {
+			if len(msg.Payload) > observedAddressSize {
+				peer.setEphemeralKey(msg.Payload[observedAddressSize:])
+				peer.setProtocolVersion(msg.Payload[observedAddressSize:])
+			}
+			peer.pexRequest()
+		}
 		return
 	}
 
-	fmt.Printf("Incoming response from %s on %s\n", msg.connection.Address.String(), msg.connection.Address.String())
+	if len(msg.Payload) > observedAddressSize {
+		peer.setEphemeralKey(msg.Payload[observedAddressSize:])
+		peer.setProtocolVersion(msg.Payload[observedAddressSize:])
+	}
+
+	logger.Debugf("Incoming response from %s on %s\n", msg.connection.Address.String(), msg.connection.Address.String())
 }
 
+// pingUnknownLimiter limits the challenges sent in reply to pings from unknown peers: 1 per second per IP with a burst of 5.
+var pingUnknownLimiter = newIPRateLimiter(1, 5)
+
 // cmdPing handles an incoming ping message
 func (peer *PeerInfo) cmdPing(msg *packet2) {
 	if peer == nil {
-		// Unexpected incoming ping, reply with announce message
-		// TODO
+		// Unexpected incoming ping, reply with a challenge so the sender proves its address and the connection can be established, see Address Validation.go.
+		// The source IP could be spoofed to use this node as reflector, therefore only the small challenge is sent and the replies are limited per IP.
+		if !pingUnknownLimiter.allow(msg.connection.Address.IP) {
+			return
+		}
+
+		sendViaConnection(msg.SenderPublicKey, challengePacket(msg), msg.connection)
 		return
 	}
-	peer.send(&PacketRaw{Command: CommandPong})
+
+	echo := peer.handlePingFields(msg)
+
+	// The pong piggybacks the address of the pinging peer as observed by us. It is sent via the same connection so the observed address matches the network.
+	payload := encodePingFields(append([]pingField{{Type: pingFieldObservedAddress, Data: encodeObservedAddress(msg.connection.Address)}}, echo...)...)
+	peer.sendConnection(&PacketRaw{Command: CommandPong, Payload: payload}, msg.connection)
 	//fmt.Printf("Incoming ping from %s on %s\n", msg.connection.Address.String(), msg.connection.Address.String())
 }
 
 // cmdPong handles an incoming pong message
 func (peer *PeerInfo) cmdPong(msg *packet2) {
+	if peer == nil {
+		return
+	}
+
+	peer.handlePingFields(msg)
 	//fmt.Printf("Incoming pong from %s on %s\n", msg.connection.Address.String(), msg.connection.Address.String())
 }
 
+// Reasons for disconnect
+const (
+	DisconnectReasonUnspecified = 0 // No reason given
+	DisconnectReasonShutdown    = 1 // The peer is shutting down
+	DisconnectReasonRefused     = 2 // The peer does not want to communicate with the receiver
+)
+
+// cmdDisconnect handles an incoming disconnect notification. The peer is removed from the peer list.
+func (peer *PeerInfo) cmdDisconnect(msg *packet2) {
+	if peer == nil {
+		return
+	}
+
+	reason := byte(DisconnectReasonUnspecified)
+	if len(msg.Payload) >= 1 {
+		reason = msg.Payload[0]
+	}
+	logger.Infof("cmdDisconnect peer %x disconnected via %s, reason %d\n", peer.PublicKey.SerializeCompressed(), msg.connection.Address.String(), reason)
+
+	peer.RemoveAllConnections()
+	PeerlistRemove(peer)
+}
+
+// DisconnectPeer notifies the peer about the disconnect, removes all connections and removes the peer from the peer list. See the DisconnectReason constants.
+// Use PeerlistRemove to remove a peer locally without notifying it.
+func DisconnectPeer(peer *PeerInfo, reason byte) {
+	peer.send(&PacketRaw{Command: CommandDisconnect, Payload: []byte{reason}})
+
+	peer.RemoveAllConnections()
+	PeerlistRemove(peer)
+}
+
+// chatIDSize is the size of the message ID at the beginning of the payload of CommandChatReliable and CommandChatAck.
+// The ID is random and echoed in the acknowledgement, so that identical texts can be acknowledged separately.
+const chatIDSize = 4
+
+// chatReliablePacket returns a new reliable chat packet with a random message ID
+func chatReliablePacket(text string) (packet *PacketRaw, id uint32) {
+	id = rand.Uint32()
+
+	payload := make([]byte, chatIDSize+len(text))
+	binary.LittleEndian.PutUint32(payload[0:chatIDSize], id)
+	copy(payload[chatIDSize:], text)
+
+	return &PacketRaw{Command: CommandChatReliable, Payload: payload}, id
+}
+
 // cmdChat handles a chat message [debug]
 func (peer *PeerInfo) cmdChat(msg *packet2) {
-	fmt.Printf("Chat from '%s': %s\n", msg.connection.Address.String(), string(msg.PacketRaw.Payload))
+	logger.Infof("Chat from '%s': %s\n", msg.connection.Address.String(), string(msg.PacketRaw.Payload))
 }
 
-// pingTime is the time in seconds to send out ping messages
-const pingTime = 10
+// cmdChatReliable handles a chat message that must be acknowledged [debug]
+func (peer *PeerInfo) cmdChatReliable(msg *packet2) {
+	if len(msg.PacketRaw.Payload) < chatIDSize {
+		return
+	}
+
+	logger.Infof("Chat from '%s': %s\n", msg.connection.Address.String(), string(msg.PacketRaw.Payload[chatIDSize:]))
+
+	// acknowledge the message by echoing its ID
+	if peer != nil {
+		peer.send(&PacketRaw{Command: CommandChatAck, Payload: msg.PacketRaw.Payload[0:chatIDSize]})
+	}
+}
+
+// cmdChatAck handles the acknowledgement of a reliable chat message [debug]
+func (peer *PeerInfo) cmdChatAck(msg *packet2) {
+	if peer == nil || len(msg.PacketRaw.Payload) < chatIDSize {
+		return
+	}
+
+	requestResolve(peer, binary.LittleEndian.Uint32(msg.PacketRaw.Payload[0:chatIDSize]), msg)
+}
+
+// defaultPingTime is the default time in seconds to send out ping messages, see config.PingTime
+const defaultPingTime = 10
+
+// defaultConnectionInvalidate is the default threshold in seconds to invalidate formerly active connections that no longer receive incoming packets, see config.ConnectionInvalidate
+const defaultConnectionInvalidate = 22
 
-// connectionInvalidate is the threshold in seconds to invalidate formerly active connections that no longer receive incoming packets.
-const connectionInvalidate = 22
+// defaultConnectionRemove is the default threshold in seconds to remove inactive connections in case there is at least one active connection known, see config.ConnectionRemove
+const defaultConnectionRemove = 2 * 60
 
-// connectionRemove is the threshold in seconds to remove inactive connections in case there is at least one active connection known.
-const connectionRemove = 2 * 60
+// pingTime returns the interval to send out ping messages
+func pingTime() time.Duration {
+	return time.Duration(config.PingTime) * time.Second
+}
+
+// connectionInvalidate returns the threshold to invalidate formerly active connections that no longer receive incoming packets
+func connectionInvalidate() time.Duration {
+	return time.Duration(config.ConnectionInvalidate) * time.Second
+}
+
+// connectionRemove returns the threshold to remove inactive connections in case there is at least one active connection known
+func connectionRemove() time.Duration {
+	return time.Duration(config.ConnectionRemove) * time.Second
+}
 
 // autoPingAll sends out regular ping messages to all connections of all peers. This allows to detect invalid connections and eventually drop them.
-func autoPingAll() {
+// If config.DisableAutoPing is set, no pings are sent but connections are still invalidated and removed based on incoming packets.
+func autoPingAll(ctx context.Context) {
 	for {
-		time.Sleep(time.Second)
-		thresholdInvalidate1 := time.Now().Add(-connectionInvalidate * time.Second)
-		thresholdInvalidate2 := time.Now().Add(-connectionInvalidate * time.Second * 4)
-		thresholdPingOut1 := time.Now().Add(-pingTime * time.Second)
-		thresholdPingOut2 := time.Now().Add(-pingTime * time.Second * 4)
+		if !sleepContext(ctx, time.Second+pingJitter()) {
+			return
+		}
+		handshakeExpireAll()
+		bandwidthRebalance()
+
+		thresholdInvalidate1 := time.Now().Add(-connectionInvalidate())
+		thresholdInvalidate2 := time.Now().Add(-connectionInvalidate() * 4)
+		thresholdPingOut1 := time.Now().Add(-pingTime())
+		thresholdPingOut2 := time.Now().Add(-pingTime() * 4)
 
 		for _, peer := range PeerlistGet() {
+			peer.throughputSample()
+
 			// first handle active connections
 			for _, connection := range peer.GetConnections(true) {
 				thresholdPing := thresholdPingOut1
@@ -119,16 +363,18 @@ func autoPingAll() {
 				}
 
 				if connection.LastPacketIn.Before(thresholdInv) {
-					peer.invalidateActiveConnection(connection)
+					peer.invalidateActiveConnection(connection, "invalid: no packet in "+time.Since(connection.LastPacketIn).Round(time.Second).String())
 					continue
 				}
 
-				if connection.LastPacketIn.Before(thresholdPing) && connection.LastPingOut.Before(thresholdPing) {
+				if !config.DisableAutoPing && connection.LastPacketIn.Before(thresholdPing) && connection.LastPingOut.Before(thresholdPing.Add(-connection.pingJitter)) {
 					peer.sendPing(connection)
 					continue
 				}
 			}
 
+			peer.selectBestConnection()
+
 			// handle inactive connections
 			for _, connection := range peer.GetConnections(false) {
 				// If the inactive connection is expired, remove it; although only if there is at least one active connection, or two other inactive ones.
@@ -138,27 +384,76 @@ func autoPingAll() {
 				}
 
 				// if no ping was sent recently, send one now
-				if connection.LastPingOut.Before(thresholdPingOut1) {
+				if !config.DisableAutoPing && connection.LastPingOut.Before(thresholdPingOut1.Add(-connection.pingJitter)) {
 					peer.sendPing(connection)
 				}
 			}
+
+			// If all connections are lost, try the endpoints advertised by the peer.
+			if len(peer.GetConnections(true)) > 0 {
+				peer.reachabilityAttempt(true)
+			} else if !config.DisableAutoPing {
+				peer.tryEndpoints()
+			}
 		}
 	}
 }
 
+// pingJitter returns a random duration between -config.PingJitter and +config.PingJitter milliseconds.
+// It de-synchronizes pings across nodes and connections (for example of nodes started at the same time) without changing the average ping rate.
+func pingJitter() time.Duration {
+	if config.PingJitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Intn(2*config.PingJitter+1)-config.PingJitter) * time.Millisecond
+}
+
 // sendPing sends a ping to the target peer
 func (peer *PeerInfo) sendPing(connection *Connection) {
-	err := peer.sendConnection(&PacketRaw{Command: CommandPing}, connection)
+	err := peer.sendConnection(&PacketRaw{Command: CommandPing, Payload: encodePingFields(pingTimestamp())}, connection)
 	connection.LastPingOut = time.Now()
+	connection.pingJitter = pingJitter()
 
 	if (connection.Status == ConnectionActive || connection.Status == ConnectionRedundant) && IsNetworkErrorFatal(err) {
-		peer.invalidateActiveConnection(connection)
+		peer.invalidateActiveConnection(connection, "invalid: ping send error: "+err.Error())
 	}
 }
 
+// SendChatReliable sends a text message to the peer and waits until it is acknowledged. Returns ErrRequestTimeout if no acknowledgement is received in time.
+func SendChatReliable(peer *PeerInfo, text string, timeout time.Duration) (err error) {
+	packet, id := chatReliablePacket(text)
+	response := requestRegister(peer, CommandChatAck, id)
+
+	if err = peer.send(packet); err != nil {
+		requestRemove(peer, CommandChatAck, id)
+		return err
+	}
+
+	_, err = requestWait(peer, CommandChatAck, id, response, timeout)
+	return err
+}
+
 // SendChatAll sends a text message to all peers
 func SendChatAll(text string) {
 	for _, peer := range PeerlistGet() {
-		peer.send(&PacketRaw{Command: CommandChat, Payload: []byte(text)})
+		peer.SendChat(text)
 	}
 }
+
+// SendChat sends a text message to the peer
+func (peer *PeerInfo) SendChat(text string) {
+	peer.send(&PacketRaw{Command: CommandChat, Payload: []byte(text)})
+}
+
+// ErrPeerNotFound is returned if the peer is not in the peer list
+var ErrPeerNotFound = errors.New("peer not found")
+
+// SendChatTo sends a text message to the peer with the public key. The peer must be in the peer list.
+func SendChatTo(publicKey *btcec.PublicKey, text string) (err error) {
+	peer := PeerlistLookup(publicKey)
+	if peer == nil {
+		return ErrPeerNotFound
+	}
+
+	return peer.send(&PacketRaw{Command: CommandChat, Payload: []byte(text)})
+}
@@ -0,0 +1,136 @@
+/*
+File Name:  Commands_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestPingUnknownPeer(t *testing.T) {
+	testConfig(t)
+	testInitPeer(t)
+	network := testNetworkLoopback(t)
+	testNetworksRegister(t, network, testNetworkLoopback(t))
+
+	limiterOld := pingUnknownLimiter
+	pingUnknownLimiter = newIPRateLimiter(1, 2)
+	defer func() { pingUnknownLimiter = limiterOld }()
+
+	remote := testRemoteNew(t, network)
+
+	// A single challenge is sent via the receiving connection, regardless of the count of networks.
+	remote.send(t, &PacketRaw{Command: CommandPing, Payload: encodePingFields(pingTimestamp())}, remote.address())
+	challenge := remote.receive(t, time.Second)
+	if challenge == nil || challenge.Command != CommandChallenge {
+		t.Fatal("ping from unknown peer not answered with a challenge")
+	}
+	if packet := remote.receive(t, 200*time.Millisecond); packet != nil {
+		t.Fatalf("ping answered again with command %d", packet.Command)
+	}
+	if PeerlistLookup(remote.publicKey) != nil {
+		t.Fatal("unknown peer added to the peer list by a ping")
+	}
+
+	// Echoing the challenge establishes the connection.
+	echo := append(append([]byte{}, challenge.Payload...), remote.announcement(t, ProtocolVersion).Payload...)
+	remote.send(t, &PacketRaw{Command: CommandChallengeEcho, Payload: echo}, remote.address())
+	if PeerlistLookup(remote.publicKey) == nil {
+		t.Fatal("peer not added after echoing the challenge")
+	}
+
+	// The limit is per IP and the first ping used one of two. Above the limit the pings are ignored so the node cannot be used as reflector.
+	other := testRemoteNew(t, network)
+	other.send(t, &PacketRaw{Command: CommandPing}, other.address())
+	if packet := other.receive(t, time.Second); packet == nil {
+		t.Fatal("ping within the limit not answered")
+	}
+	other.send(t, &PacketRaw{Command: CommandPing}, other.address())
+	if packet := other.receive(t, 200*time.Millisecond); packet != nil {
+		t.Fatalf("ping above the limit replied with command %d", packet.Command)
+	}
+}
+
+func TestPingChallengeEcho(t *testing.T) {
+	testConfig(t)
+	testInitPeer(t)
+	network := testNetworkLoopback(t)
+
+	// The remote peer forgot about us and answers our ping with a challenge.
+	remote := testRemoteNew(t, network)
+	peer := remote.peerlistAdd(t)
+
+	challenge := &PacketRaw{Command: CommandChallenge, Payload: make([]byte, challengeTokenSize)}
+	remote.send(t, challenge, remote.address())
+	if packet := remote.receive(t, 200*time.Millisecond); packet != nil {
+		t.Fatalf("challenge without ping answered with command %d", packet.Command)
+	}
+
+	peer.sendPing(peer.GetConnections(true)[0])
+	if packet := remote.receive(t, time.Second); packet == nil || packet.Command != CommandPing {
+		t.Fatal("no ping sent")
+	}
+
+	remote.send(t, challenge, remote.address())
+	if packet := remote.receive(t, time.Second); packet == nil || packet.Command != CommandChallengeEcho {
+		t.Fatal("challenge answering our ping not echoed")
+	}
+}
+
+func TestChatReliable(t *testing.T) {
+	testConfig(t)
+	testInitPeer(t)
+	network := testNetworkLoopback(t)
+	testNetworksRegister(t, network)
+	remote := testRemoteNew(t, network)
+	peer := remote.peerlistAdd(t)
+	defer PeerlistRemove(peer)
+
+	// Plain chat messages carry only the text and are not acknowledged.
+	peer.SendChat("hello")
+	if chat := remote.receive(t, time.Second); chat == nil || chat.Command != CommandChat || !bytes.Equal(chat.Payload, []byte("hello")) {
+		t.Fatalf("plain chat message not received: %v", chat)
+	}
+	remote.send(t, &PacketRaw{Command: CommandChat, Payload: []byte("hi")}, remote.address())
+	if reply := remote.receive(t, 200*time.Millisecond); reply != nil {
+		t.Fatalf("plain chat message answered with command %d", reply.Command)
+	}
+
+	result := make(chan error, 1)
+	go func() { result <- SendChatReliable(peer, "hello", 5*time.Second) }()
+
+	chat := remote.receive(t, time.Second)
+	if chat == nil || chat.Command != CommandChatReliable || len(chat.Payload) != chatIDSize+5 {
+		t.Fatalf("reliable chat message not received: %v", chat)
+	}
+	id := chat.Payload[0:chatIDSize]
+
+	// A response of another request type with the same ID does not resolve the chat request.
+	getResponse := make([]byte, 4)
+	copy(getResponse, id)
+	remote.send(t, &PacketRaw{Command: CommandGetResponse, Payload: getResponse}, remote.address())
+	select {
+	case err := <-result:
+		t.Fatalf("chat resolved by a get response: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	remote.send(t, &PacketRaw{Command: CommandChatAck, Payload: id}, remote.address())
+	if err := <-result; err != nil {
+		t.Fatalf("reliable chat not acknowledged: %v", err)
+	}
+
+	// Incoming reliable chat messages are acknowledged with their ID.
+	payload := make([]byte, chatIDSize, chatIDSize+2)
+	binary.LittleEndian.PutUint32(payload, 1234)
+	remote.send(t, &PacketRaw{Command: CommandChatReliable, Payload: append(payload, "hi"...)}, remote.address())
+	if ack := remote.receive(t, time.Second); ack == nil || ack.Command != CommandChatAck || binary.LittleEndian.Uint32(ack.Payload) != 1234 {
+		t.Fatalf("reliable chat message not acknowledged: %v", ack)
+	}
+}
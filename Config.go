@@ -18,19 +18,101 @@ import (
 // Version is the current core library version
 const Version = "0.1"
 
-var config struct {
+// Config is the configuration of the core library. See Config Default.yaml for the defaults.
+type Config struct {
 	LogFile string `yaml:"LogFile"` // Log file
 
 	Listen        []string `yaml:"Listen"`        // IP:Port combinations
 	ListenWorkers int      `yaml:"ListenWorkers"` // Count of workers to process incoming raw packets. Default 2.
 
+	// Range of local ports to listen on if no port is specified. If PortRangeEnd is not set, only PortRangeStart is used. If not set, the default port 112 is tried and then a random one.
+	PortRangeStart int `yaml:"PortRangeStart"`
+	PortRangeEnd   int `yaml:"PortRangeEnd"`
+
+	DisableIPv4 bool `yaml:"DisableIPv4"` // If true, no IPv4 addresses are listened on, including IPv4 Broadcast.
+	DisableIPv6 bool `yaml:"DisableIPv6"` // If true, no IPv6 addresses are listened on, including IPv6 Multicast.
+
+	BindInterfaces []string `yaml:"BindInterfaces"` // Names of network adapters to listen on, for example "eth0". If empty, all adapters are used. Ignored if Listen is set.
+
+	ChangeMonitorFrequency int `yaml:"ChangeMonitorFrequency"` // Frequency in seconds to check for network changes. Default 10. On Linux the OS notifies about changes and polling is reduced to at most every 60 seconds.
+
+	// Policy if incoming packets arrive faster than the workers process them: "DropNewest" (default) or "BlockWithTimeout".
+	IncomingPolicy       string `yaml:"IncomingPolicy"`
+	IncomingBlockTimeout int    `yaml:"IncomingBlockTimeout"` // Maximum time in milliseconds to wait for "BlockWithTimeout". Default 100.
+
+	PacketChecksums   bool `yaml:"PacketChecksums"`   // If true, outgoing packets include a checksum to detect corruption. Incoming checksums are always verified.
+	PacketSequence    bool `yaml:"PacketSequence"`    // If true, outgoing packets to peers include a sequence number which allows the receiver to drop duplicates. Incoming sequence numbers are always processed.
+	PacketCompression bool `yaml:"PacketCompression"` // If true, outgoing payloads are compressed if it reduces their size. Incoming compressed payloads are always decompressed.
+
+	// End-to-end encryption of payloads to peers. Incoming encrypted payloads are always decrypted.
+	PayloadEncryption        bool  `yaml:"PayloadEncryption"`        // If true, outgoing payloads to peers are encrypted using a key derived via ECDH.
+	PayloadEncryptionExclude []int `yaml:"PayloadEncryptionExclude"` // Commands whose payloads are sent unencrypted, for example [2, 3] for ping and pong.
+
+	// Rotation of the ephemeral key from which the payload encryption keys are derived.
+	RekeyInterval int `yaml:"RekeyInterval"` // Interval in seconds. Default 3600, minimum 300.
+	RekeyBytes    int `yaml:"RekeyBytes"`    // Count of payload bytes encrypted with the current key after which it is rotated. Default 1 GiB, -1 = no limit.
+
+	FragmentThreshold int `yaml:"FragmentThreshold"` // Payload size in bytes above which packets to peers are split into fragments. Default 1200.
+
+	DisableBufferPool bool `yaml:"DisableBufferPool"` // If true, a new buffer is allocated for each incoming packet instead of reusing buffers from a pool.
+
+	GlobalBandwidthLimit int `yaml:"GlobalBandwidthLimit"` // Limit of outgoing traffic to all peers in bytes per second, fairly shared across peers. 0 = unlimited.
+
+	MaxConcurrentTransfers int `yaml:"MaxConcurrentTransfers"` // Maximum count of simultaneous inbound and (separately) outbound transfers. 0 = unlimited.
+
+	// Limits of incoming traffic per peer. 0 = unlimited.
+	PeerLimitPackets int `yaml:"PeerLimitPackets"` // Packets per second
+	PeerLimitBytes   int `yaml:"PeerLimitBytes"`   // Bytes per second
+
+	AnnouncementLimit int `yaml:"AnnouncementLimit"` // Incoming announcements per second per source IP. Bursts of 5 seconds are allowed. Default 10. Use -1 to disable.
+
+	PeerLimit int `yaml:"PeerLimit"` // Maximum count of peers in the peer list. 0 = unlimited.
+
+	// If true, no announcements are sent proactively (no bootstrap, Multicast or Broadcast). Incoming announcements and pings are still answered.
+	PassiveMode bool `yaml:"PassiveMode"`
+
+	// If true, no pings are sent. Connections are kept alive only by incoming packets including pings from the remote peer.
+	DisableAutoPing bool `yaml:"DisableAutoPing"`
+
+	// Keep-alive timing in seconds. Connections are pinged if no packet was received within PingTime (default 10), invalidated after ConnectionInvalidate (default 22) and removed after being inactive for ConnectionRemove (default 120).
+	// ConnectionInvalidate must be greater than PingTime, and ConnectionRemove greater than ConnectionInvalidate.
+	PingTime             int `yaml:"PingTime"`
+	ConnectionInvalidate int `yaml:"ConnectionInvalidate"`
+	ConnectionRemove     int `yaml:"ConnectionRemove"`
+
+	PingJitter int `yaml:"PingJitter"` // Maximum random jitter in milliseconds added to the ping timing to avoid synchronized pings. Default 500. Use -1 to disable.
+
+	HandshakeTimeout int `yaml:"HandshakeTimeout"` // Time in seconds to wait for the response to an announcement before the endpoint is considered failed. Default 20.
+
+	MulticastJoinRetries int `yaml:"MulticastJoinRetries"` // Count of retries with exponential backoff to join the IPv6 Multicast group. Default 5. Use -1 for none.
+
+	LogListenSummary bool `yaml:"LogListenSummary"` // If true, a single summary line is logged at startup. The lines per listening address are logged at debug level instead of info.
+
+	// External address detection
+	ObservedAddrSamples int `yaml:"ObservedAddrSamples"` // Count of distinct source networks (/24 for IPv4, /48 for IPv6) whose observed address is kept. Default 8.
+	ObservedAddrQuorum  int `yaml:"ObservedAddrQuorum"`  // Count of source networks that must agree on the external address. Default 3.
+
+	EnableUPnP bool `yaml:"EnableUPnP"` // If true, a UDP port mapping is requested via UPnP for IPv4 networks listening on a private IP.
+
+	NAT64Prefix string `yaml:"NAT64Prefix"` // NAT64 prefix to reach IPv4 addresses on IPv6-only networks, for example "64:ff9b::/96". If empty, it is detected automatically.
+
+	// Peers only reachable via link-local addresses are confined to the local network segment.
+	DisableLinkLocalPeers bool `yaml:"DisableLinkLocalPeers"` // If true, peers that are only reachable via link-local addresses are not added to the peer list.
+
+	UserAgent string `yaml:"UserAgent"` // Name and version of the software sent to peers in the announcement. Default "Peernet Core/" and the library version.
+
 	// User specific settings
-	PrivateKey string `yaml:"PrivateKey"` // The Private Key, hex encoded so it can be copied manually
+	PrivateKey     string `yaml:"PrivateKey"`     // The Private Key, hex encoded so it can be copied manually
+	PrivateKeyFile string `yaml:"PrivateKeyFile"` // File containing the Private Key, hex encoded or PEM. Takes precedence over PrivateKey. Created if it does not exist.
+
+	PrivateKeyMnemonic string `yaml:"PrivateKeyMnemonic"` // Mnemonic (BIP39) to derive the Private Key deterministically. Takes precedence over PrivateKey and PrivateKeyFile.
 
 	// Initial peer seed list
 	SeedList []peerSeed `yaml:"SeedList"`
 }
 
+var config Config
+
 // peerSeed is a singl peer entry from the config's seed list
 type peerSeed struct {
 	PublicKey string   `yaml:"PublicKey"` // Public key = peer ID. Hex encoded.
@@ -68,20 +150,34 @@ func LoadConfig(filename string) (status int, err error) {
 	return 3, nil
 }
 
+// saveConfig writes the config to the file it was loaded from. If the config was not loaded via LoadConfig (for example when using Start), there is no file and nothing is written.
 func saveConfig() {
+	if configFile == "" {
+		return
+	}
+
 	data, err := yaml.Marshal(config)
 	if err != nil {
-		log.Printf("saveConfig Error marshalling config: %v\n", err.Error())
+		logger.Errorf("saveConfig Error marshalling config: %v\n", err.Error())
 		return
 	}
 
 	err = ioutil.WriteFile(configFile, data, 0644)
 	if err != nil {
-		log.Printf("saveConfig Error writing config '%s': %v\n", configFile, err.Error())
+		logger.Errorf("saveConfig Error writing config '%s': %v\n", configFile, err.Error())
 		return
 	}
 }
 
+// GetConfigRedacted returns the current config YAML encoded. The private key and the mnemonic are removed.
+func GetConfigRedacted() (data []byte, err error) {
+	redacted := config
+	redacted.PrivateKey = ""
+	redacted.PrivateKeyMnemonic = ""
+
+	return yaml.Marshal(redacted)
+}
+
 // InitLog redirects subsequent log messages into the default log file specified in the configuration
 func InitLog() (err error) {
 	logFile, err := os.OpenFile(config.LogFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
@@ -91,7 +187,7 @@ func InitLog() (err error) {
 	//defer logFile.Close()	// has to remain open until program closes
 
 	log.SetOutput(logFile)
-	log.Printf("---- Peernet Command-Line Client " + Version + " ----\n")
+	logger.Infof("---- Peernet Command-Line Client " + Version + " ----\n")
 
 	return nil
 }
@@ -16,25 +16,63 @@ import (
 )
 
 // Connection is an established connection between a remote IP address and a local network adapter.
-// New connections may only be created in case of successful INCOMING packets.
+// New active connections may only be created in case of successful INCOMING packets. Endpoints advertised by the peer are added as inactive candidates, see addCandidateConnection.
 type Connection struct {
-	Network       *Network     // network which received the packet
-	Address       *net.UDPAddr // address of the sender or receiver
-	LastPacketIn  time.Time    // Last time an incoming packet was received.
-	LastPacketOut time.Time    // Last time an outgoing packet was attempted to send.
-	LastPingOut   time.Time    // Last ping out.
-	Expires       time.Time    // Inactive connections only: Expiry date. If it does not become active by that date, it will be considered expired and removed.
-	Status        int          // 0 = Active established connection, 1 = Inactive, 2 = Removed, 3 = Redundant
+	Network       *Network         // network which received the packet
+	Address       *net.UDPAddr     // address of the sender or receiver. For link-local IPv6 the zone is the adapter of the network.
+	LastPacketIn  time.Time        // Last time an incoming packet was received.
+	LastPacketOut time.Time        // Last time an outgoing packet was attempted to send.
+	LastPingOut   time.Time        // Last ping out.
+	Expires       time.Time        // Inactive connections only: Expiry date. If it does not become active by that date, it will be considered expired and removed.
+	Status        ConnectionStatus // 0 = Active established connection, 1 = Inactive, 2 = Removed, 3 = Redundant
+	statusReason  atomic.Value     // Explanation of the current status (string), atomic access. See StatusReason.
+	pingJitter    time.Duration    // Random offset to the ping interval. Renewed after each ping.
+	RTT           time.Duration    // Round-trip time measured via ping and pong, as moving average. 0 if not measured yet. Protected by the peer mutex, see GetRTT.
 }
 
+// ConnectionStatus is the status of a connection
+type ConnectionStatus int
+
 // Connection status
 const (
-	ConnectionActive = iota
-	ConnectionInactive
-	ConnectionRemoved
-	ConnectionRedundant // Same as active. Incoming packets are accepted. Outgoing use only for redundancy. Reduces ping overhead.
+	ConnectionActive    ConnectionStatus = iota // Active established connection
+	ConnectionInactive                          // No longer valid. It is removed if it does not become valid again before it expires.
+	ConnectionRemoved                           // Removed from the peer
+	ConnectionRedundant                         // Same as active. Incoming packets are accepted. Outgoing use only for redundancy. Reduces ping overhead.
 )
 
+// String returns the name of the status
+func (status ConnectionStatus) String() string {
+	switch status {
+	case ConnectionActive:
+		return "active"
+	case ConnectionInactive:
+		return "inactive"
+	case ConnectionRemoved:
+		return "removed"
+	case ConnectionRedundant:
+		return "redundant"
+	default:
+		return "unknown"
+	}
+}
+
+// setStatus changes the status of the connection and records the reason. Changes are logged at debug level to diagnose churning connections.
+func (c *Connection) setStatus(status ConnectionStatus, reason string) {
+	if c.Status != status {
+		logger.Debugf("Connection to %s changed status from %s to %s: %s\n", c.Address.String(), c.Status, status, reason)
+	}
+
+	c.Status = status
+	c.statusReason.Store(reason)
+}
+
+// StatusReason returns an explanation of the current status of the connection
+func (c *Connection) StatusReason() string {
+	reason, _ := c.statusReason.Load().(string)
+	return reason
+}
+
 // Equal checks if the connection was established other the same network adapter using the same IP address. Port is intentionally not checked.
 func (c *Connection) Equal(other *Connection) bool {
 	return c.Address.IP.Equal(other.Address.IP) && c.Network.address.IP.Equal(other.Network.address.IP)
@@ -51,8 +89,52 @@ func (peer *PeerInfo) GetConnections(active bool) (connections []*Connection) {
 	return peer.connectionInactive
 }
 
+// ConnectionInfo is a copy of the details of a connection at a point in time
+type ConnectionInfo struct {
+	Local         *net.UDPAddr     // Local address of the network. Nil if the network is unknown.
+	Address       *net.UDPAddr     // Remote address
+	Status        ConnectionStatus // See ConnectionActive and others
+	StatusReason  string           // Explanation of the status
+	LastPacketIn  time.Time        // Last time an incoming packet was received
+	LastPacketOut time.Time        // Last time an outgoing packet was attempted to send
+	LastPingOut   time.Time        // Last ping out
+	Expires       time.Time        // Inactive connections only: Expiry date
+	RTT           time.Duration    // Round-trip time, 0 if not measured yet
+	Latest        bool             // If true, the connection is the one used for sending
+}
+
+// ConnectionsSnapshot returns copies of the details of all active and inactive connections. Active connections are listed first.
+func (peer *PeerInfo) ConnectionsSnapshot() (connections []ConnectionInfo) {
+	peer.RLock()
+	defer peer.RUnlock()
+
+	for _, list := range [][]*Connection{peer.connectionActive, peer.connectionInactive} {
+		for _, connection := range list {
+			info := ConnectionInfo{
+				Address:       &net.UDPAddr{IP: connection.Address.IP, Port: connection.Address.Port, Zone: connection.Address.Zone},
+				Status:        connection.Status,
+				StatusReason:  connection.StatusReason(),
+				LastPacketIn:  connection.LastPacketIn,
+				LastPacketOut: connection.LastPacketOut,
+				LastPingOut:   connection.LastPingOut,
+				Expires:       connection.Expires,
+				RTT:           connection.RTT,
+				Latest:        connection == peer.connectionLatest,
+			}
+			if connection.Network != nil {
+				info.Local = connection.Network.address
+			}
+
+			connections = append(connections, info)
+		}
+	}
+
+	return connections
+}
+
 // registerConnection registers an incoming connection for an existing peer. If new, it will add to the list. If previously inactive, it will elevate.
 func (peer *PeerInfo) registerConnection(incoming *Connection) (result *Connection) {
+	defer peer.eventUpdate() // after unlocking
 	peer.Lock()
 	defer peer.Unlock()
 
@@ -60,12 +142,19 @@ func (peer *PeerInfo) registerConnection(incoming *Connection) (result *Connecti
 	for _, connection := range peer.connectionActive {
 		if connection.Equal(incoming) {
 			// Connection already established. Verify port and update if necessary.
-			// Some NATs may rotate ports. Some mobile phone providers even rotate IPs which is not detected here.
+			// Some NATs may rotate ports (rebinding). Changed IPs are handled below as new connection.
 			if connection.Address.Port != incoming.Address.Port {
 				connection.Address.Port = incoming.Address.Port
 			}
 
-			connection.Status = ConnectionActive
+			// A faster latest connection that is still alive is kept, see selectBestConnection.
+			if latest := peer.connectionLatest; latest != nil && latest != connection && latest.isFasterAlive(connection) {
+				return connection
+			}
+
+			if connection.Status != ConnectionActive || peer.connectionLatest != connection {
+				connection.setStatus(ConnectionActive, "active: primary, latest incoming packet")
+			}
 			peer.setConnectionLatest(connection)
 			return connection
 		}
@@ -79,7 +168,7 @@ func (peer *PeerInfo) registerConnection(incoming *Connection) (result *Connecti
 			}
 
 			// elevate by adding to active and mark as latest active
-			connection.Status = ConnectionActive
+			connection.setStatus(ConnectionActive, "active: primary, revived by incoming packet")
 			peer.connectionActive = append(peer.connectionActive, connection)
 			peer.setConnectionLatest(connection)
 
@@ -95,12 +184,65 @@ func (peer *PeerInfo) registerConnection(incoming *Connection) (result *Connecti
 	}
 
 	// otherwise it is a new connection!
+	// If an active connection via the same network went silent, the peer most likely changed its IP (NAT rebinding, mobile phone providers rotating IPs).
+	// The incoming packet confirms that the new address works, therefore the silent one is retired immediately instead of waiting for the invalidation threshold.
+	thresholdSilent := time.Now().Add(-pingTime())
+	var retire []*Connection
+	for _, connection := range peer.connectionActive {
+		if connection.Network == incoming.Network && connection.LastPacketIn.Before(thresholdSilent) {
+			retire = append(retire, connection)
+		}
+	}
+	for _, connection := range retire {
+		peer.invalidateActiveConnectionLocked(connection, "invalid: silent, peer changed address to "+incoming.Address.String())
+	}
+
 	peer.connectionActive = append(peer.connectionActive, incoming)
 	peer.setConnectionLatest(incoming)
 
 	return incoming
 }
 
+// rttSwitchPercent is the round-trip time in percent of the latest connection that another connection must undercut to replace it. This prevents flapping between similar paths.
+const rttSwitchPercent = 80
+
+// isFasterAlive checks if the connection received a packet within the ping interval and has a measured round-trip time lower than the other connection. The caller must hold the peer lock.
+func (c *Connection) isFasterAlive(other *Connection) bool {
+	return c.RTT > 0 && (other.RTT == 0 || c.RTT < other.RTT) && time.Since(c.LastPacketIn) < pingTime()
+}
+
+// selectBestConnection promotes the active connection with the lowest round-trip time to the latest connection, which is used for sending.
+// If the latest connection was invalidated, the best remaining one is used, or any active one if no round-trip time is measured yet.
+func (peer *PeerInfo) selectBestConnection() {
+	peer.Lock()
+	defer peer.Unlock()
+
+	var best *Connection
+	for _, connection := range peer.connectionActive {
+		if connection.RTT > 0 && (best == nil || connection.RTT < best.RTT) {
+			best = connection
+		}
+	}
+
+	latest := peer.connectionLatest
+
+	switch {
+	case latest == nil && best == nil:
+		if len(peer.connectionActive) == 0 {
+			return
+		}
+		best = peer.connectionActive[0]
+	case latest == nil:
+	case best == nil || best == latest:
+		return
+	case latest.RTT > 0 && best.RTT*100 >= latest.RTT*rttSwitchPercent:
+		return
+	}
+
+	best.setStatus(ConnectionActive, "active: primary, lowest round-trip time")
+	peer.setConnectionLatest(best)
+}
+
 // setConnectionLatest updates the latest valid connection to use for sending. All other connections will be changed to redundant, which reduces ping overhead.
 func (peer *PeerInfo) setConnectionLatest(latest *Connection) {
 	if peer.connectionLatest == latest {
@@ -113,18 +255,25 @@ func (peer *PeerInfo) setConnectionLatest(latest *Connection) {
 		if connection == latest {
 			continue
 		}
-		connection.Status = ConnectionRedundant
+		connection.setStatus(ConnectionRedundant, "redundant: duplicate of latest connection "+latest.Address.String())
 	}
 }
 
-// invalidateActiveConnection invalidates an active connection
-func (peer *PeerInfo) invalidateActiveConnection(input *Connection) {
+// invalidateActiveConnection invalidates an active connection. The reason is recorded for the status.
+func (peer *PeerInfo) invalidateActiveConnection(input *Connection, reason string) {
+	defer peer.eventUpdate() // after unlocking
 	peer.Lock()
 	defer peer.Unlock()
 
+	peer.invalidateActiveConnectionLocked(input, reason)
+}
+
+// invalidateActiveConnectionLocked invalidates an active connection. The caller must hold the peer lock.
+func (peer *PeerInfo) invalidateActiveConnectionLocked(input *Connection, reason string) {
 	// Change the status to inactive and start the expiration. If the connection does not become valid by that date, it will be removed.
-	input.Status = ConnectionInactive
-	input.Expires = time.Now().Add(connectionRemove * time.Second)
+	input.setStatus(ConnectionInactive, reason)
+	input.Expires = time.Now().Add(connectionRemove())
+	peer.statsConnectionInvalidated()
 
 	// remove from connectionLatest if selected so it won't be used by standard send function
 	if peer.connectionLatest == input {
@@ -153,7 +302,8 @@ func (peer *PeerInfo) removeInactiveConnection(input *Connection) {
 	peer.Lock()
 	defer peer.Unlock()
 
-	input.Status = ConnectionRemoved
+	input.setStatus(ConnectionRemoved, "removed: inactive connection expired")
+	peer.statsConnectionsRemoved(1)
 
 	for n, connection := range peer.connectionInactive {
 		if connection == input {
@@ -170,9 +320,105 @@ func (peer *PeerInfo) removeInactiveConnection(input *Connection) {
 	}
 }
 
+// RemoveAllConnections removes all active and inactive connections of the peer
+func (peer *PeerInfo) RemoveAllConnections() {
+	peer.removeAllConnections()
+	peer.eventUpdate()
+}
+
+// removeAllConnections removes all connections without invoking the peer callbacks, so it may be called while holding the peer list mutex
+func (peer *PeerInfo) removeAllConnections() {
+	peer.Lock()
+	defer peer.Unlock()
+
+	for _, connections := range [][]*Connection{peer.connectionActive, peer.connectionInactive} {
+		for _, connection := range connections {
+			connection.setStatus(ConnectionRemoved, "removed: peer disconnected")
+		}
+	}
+	peer.statsConnectionsRemoved(len(peer.connectionActive) + len(peer.connectionInactive))
+
+	peer.connectionActive = nil
+	peer.connectionInactive = nil
+	peer.connectionLatest = nil
+}
+
+// ConnectionsByAddress returns all active and inactive connections of all peers to the remote IP
+func ConnectionsByAddress(ip net.IP) (connections []*Connection) {
+	for _, peer := range PeerlistGet() {
+		peer.RLock()
+		for _, list := range [][]*Connection{peer.connectionActive, peer.connectionInactive} {
+			for _, connection := range list {
+				if connection.Address.IP.Equal(ip) {
+					connections = append(connections, connection)
+				}
+			}
+		}
+		peer.RUnlock()
+	}
+
+	return connections
+}
+
+// Connections returns all active and inactive connections of all peers that use the network. If the network is terminated, these connections are rerouted via another network if possible.
+func (network *Network) Connections() (connections []*Connection) {
+	for _, peer := range PeerlistGet() {
+		peer.RLock()
+		for _, list := range [][]*Connection{peer.connectionActive, peer.connectionInactive} {
+			for _, connection := range list {
+				if connection.Network == network {
+					connections = append(connections, connection)
+				}
+			}
+		}
+		peer.RUnlock()
+	}
+
+	return connections
+}
+
+// DropConnectionsByAddress removes all connections of all peers to the remote IP. It returns the count of dropped connections.
+// Peers are kept in the peer list even if they have no connections left.
+func DropConnectionsByAddress(ip net.IP) (count int) {
+	for _, peer := range PeerlistGet() {
+		count += peer.removeConnectionsByIP(ip)
+	}
+
+	return count
+}
+
+// removeConnectionsByIP removes all connections of the peer to the remote IP
+func (peer *PeerInfo) removeConnectionsByIP(ip net.IP) (count int) {
+	defer peer.eventUpdate() // after unlocking
+	peer.Lock()
+	defer peer.Unlock()
+
+	filter := func(connections []*Connection) (remaining []*Connection) {
+		for _, connection := range connections {
+			if !connection.Address.IP.Equal(ip) {
+				remaining = append(remaining, connection)
+				continue
+			}
+
+			connection.setStatus(ConnectionRemoved, "removed: dropped by address")
+			if peer.connectionLatest == connection {
+				peer.connectionLatest = nil
+			}
+			count++
+		}
+		return remaining
+	}
+
+	peer.connectionActive = filter(peer.connectionActive)
+	peer.connectionInactive = filter(peer.connectionInactive)
+	peer.statsConnectionsRemoved(count)
+
+	return count
+}
+
 // ---- sending code ----
 
-// send sends a raw packet to the peer. Only uses active connections.
+// send sends a raw packet to the peer. Only uses active connections. Payloads larger than config.FragmentThreshold are sent in fragments.
 func (peer *PeerInfo) send(packet *PacketRaw) (err error) {
 	if len(peer.connectionActive) == 0 {
 		return errors.New("no valid connection to peer")
@@ -180,28 +426,41 @@ func (peer *PeerInfo) send(packet *PacketRaw) (err error) {
 
 	packet.Protocol = 0
 
+	if len(packet.Payload) > config.FragmentThreshold && packet.Command != CommandFragment {
+		return peer.sendFragments(packet)
+	}
+
+	packet.Sequence = peer.sequenceNext()
+	packet.Encrypted = payloadEncryptCommand(packet.Command) && !peer.isLegacy()
+
 	raw, err := PacketEncrypt(peerPrivateKey, peer.PublicKey, packet)
 	if err != nil {
 		return err
 	}
 
+	if !peer.bandwidthAllow(packet.Command, len(raw)) {
+		return ErrBandwidthLimit
+	}
+
 	atomic.AddUint64(&peer.StatsPacketSent, 1)
+	atomic.AddUint64(&peer.StatsBytesSent, uint64(len(raw)))
 
 	// Send out the wire. Use connectionLatest if available.
 	// Failover: If sending fails and there are other connections available, try those. Automatically update connectionLatest if one is successful.
 	// Windows: This works great in case the adapter gets disabled, however, does not detect if the network cable is unplugged.
+	peer.RLock()
 	c := peer.connectionLatest
-	if c != nil {
-		c.LastPacketOut = time.Now()
+	peer.RUnlock()
 
-		if err = c.Network.send(c.Address.IP, c.Address.Port, raw); err == nil {
+	if c != nil {
+		if err = peer.sendVia(c, raw); err == nil {
 			return nil
 		}
 
 		// Invalid connection, immediately invalidate. Fallback to broadcast to all other active ones.
 		// Windows: A common error when the network adapter is disabled is "wsasendto: The requested address is not valid in its context".
 		if IsNetworkErrorFatal(err) {
-			peer.invalidateActiveConnection(c)
+			peer.invalidateActiveConnection(c, "invalid: send error: "+err.Error())
 		}
 	}
 
@@ -210,8 +469,7 @@ func (peer *PeerInfo) send(packet *PacketRaw) (err error) {
 	// The receiver is responsible for incoming deduplication of packets.
 	activeConnections := peer.GetConnections(true)
 	for _, c := range activeConnections {
-		c.LastPacketOut = time.Now()
-		c.Network.send(c.Address.IP, c.Address.Port, raw)
+		peer.sendVia(c, raw)
 	}
 
 	return nil // on broadcast no error is known and returned
@@ -220,15 +478,106 @@ func (peer *PeerInfo) send(packet *PacketRaw) (err error) {
 // sendConnection sends a packet to the peer using the specific connection
 func (peer *PeerInfo) sendConnection(packet *PacketRaw, connection *Connection) (err error) {
 	packet.Protocol = 0
+	packet.Sequence = peer.sequenceNext()
+	packet.Encrypted = payloadEncryptCommand(packet.Command) && !peer.isLegacy()
 	raw, err := PacketEncrypt(peerPrivateKey, peer.PublicKey, packet)
 	if err != nil {
 		return err
 	}
 
+	if !peer.bandwidthAllow(packet.Command, len(raw)) {
+		return ErrBandwidthLimit
+	}
+
 	atomic.AddUint64(&peer.StatsPacketSent, 1)
-	connection.LastPacketOut = time.Now()
+	atomic.AddUint64(&peer.StatsBytesSent, uint64(len(raw)))
+
+	return peer.sendVia(connection, raw)
+}
+
+// sendVia sends the raw packet via the connection. If the network of the connection was terminated (for example the IP was removed), it is rerouted via another network that can reach the remote address.
+func (peer *PeerInfo) sendVia(c *Connection, raw []byte) (err error) {
+	if err = c.send(raw); err != ErrNetworkTerminated {
+		return err
+	}
+
+	if c = peer.rerouteConnection(c); c == nil {
+		return ErrNetworkTerminated
+	}
+
+	return c.send(raw)
+}
+
+// rerouteConnection invalidates the connection via a terminated network and returns a connection to the same remote address via another network. Returns nil if no network is available.
+// The new connection is registered via registerConnection, so that an existing connection via that network is used instead of creating a duplicate.
+func (peer *PeerInfo) rerouteConnection(c *Connection) (rerouted *Connection) {
+	network := findNetworkForRemoteZone(c.Address.IP, c.Address.Zone)
+	if network == nil {
+		return nil
+	}
+
+	peer.Lock()
+	if c.Status == ConnectionActive || c.Status == ConnectionRedundant {
+		peer.invalidateActiveConnectionLocked(c, "invalid: network terminated")
+	}
+	peer.Unlock()
+
+	// The time of the last incoming packet is kept, so that the new connection is invalidated as usual if the peer is no longer reachable.
+	rerouted = &Connection{Network: network, Address: &net.UDPAddr{IP: c.Address.IP, Port: c.Address.Port, Zone: network.linkLocalZone(c.Address.IP)}, Status: ConnectionActive, LastPacketIn: c.LastPacketIn}
+	rerouted.statusReason.Store("active: rerouted from terminated network")
+
+	return peer.registerConnection(rerouted)
+}
+
+// send sends the raw packet via the connection. Returns ErrNetworkTerminated if the network of the connection was terminated, see PeerInfo.sendVia.
+func (c *Connection) send(raw []byte) (err error) {
+	c.LastPacketOut = time.Now()
+
+	return c.Network.send(c.Address.IP, c.Address.Port, raw)
+}
+
+// findNetworkForRemote returns a network that is not terminated and can reach the remote IP. Returns nil if none is available.
+func findNetworkForRemote(remote net.IP) (result *Network) {
+	return findNetworkForRemoteZone(remote, "")
+}
+
+// findNetworkForRemoteZone is like findNetworkForRemote, but for link-local remote IPs with a zone only networks on the adapter of the zone are used. Link-local addresses are not reachable via other adapters.
+func findNetworkForRemoteZone(remote net.IP, zone string) (result *Network) {
+	networksMutex.RLock()
+	defer networksMutex.RUnlock()
+
+	networks := networks4
+	if IsIPv6(remote.To16()) {
+		networks = networks6
+	}
+
+	for _, network := range networks {
+		// Do not mix link-local unicast targets with non link-local networks (only when iface is known, i.e. not catch all local)
+		if network.iface != nil && remote.IsLinkLocalUnicast() != network.address.IP.IsLinkLocalUnicast() {
+			continue
+		}
+
+		if zone != "" && network.iface != nil && remote.IsLinkLocalUnicast() && network.iface.Name != zone {
+			continue
+		}
+
+		if !network.IsTerminated() {
+			return network
+		}
+	}
+
+	return nil
+}
+
+// sendViaConnection sends a packet via the connection. Unlike sendConnection the receiver does not need to be in the peer list. The connection is not rerouted if its network was terminated.
+func sendViaConnection(receiverPublicKey *btcec.PublicKey, packet *PacketRaw, connection *Connection) (err error) {
+	packet.Protocol = 0
+	raw, err := PacketEncrypt(peerPrivateKey, receiverPublicKey, packet)
+	if err != nil {
+		return err
+	}
 
-	return connection.Network.send(connection.Address.IP, connection.Address.Port, raw)
+	return connection.send(raw)
 }
 
 // sendAllNetworks sends a raw packet via all networks
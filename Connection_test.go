@@ -0,0 +1,102 @@
+/*
+File Name:  Connection_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package core
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// testConfig resets the config to the defaults for the duration of the test
+func testConfig(t *testing.T) {
+	previous := config
+	t.Cleanup(func() { config = previous })
+
+	config = Config{}
+	configDefaults()
+}
+
+// testConnection returns a new active connection to the address via the network
+func testConnection(network *Network, address string, lastPacketIn time.Time) *Connection {
+	udpAddr, _ := net.ResolveUDPAddr("udp", address)
+	return &Connection{Network: network, Address: udpAddr, LastPacketIn: lastPacketIn, Status: ConnectionActive}
+}
+
+func TestRegisterConnectionPortChange(t *testing.T) {
+	testConfig(t)
+	network := &Network{address: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 112}}
+
+	existing := testConnection(network, "192.0.2.1:1000", time.Now())
+	peer := &PeerInfo{connectionActive: []*Connection{existing}, connectionLatest: existing}
+
+	result := peer.registerConnection(testConnection(network, "192.0.2.1:2000", time.Now()))
+	if result != existing {
+		t.Fatal("source port change created a new connection")
+	}
+	if existing.Address.Port != 2000 {
+		t.Fatalf("port not updated, is %d", existing.Address.Port)
+	}
+	if len(peer.connectionActive) != 1 || len(peer.connectionInactive) != 0 {
+		t.Fatalf("connections: %d active, %d inactive", len(peer.connectionActive), len(peer.connectionInactive))
+	}
+}
+
+func TestRegisterConnectionRetiresSilent(t *testing.T) {
+	testConfig(t)
+	network := &Network{address: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 112}}
+	otherNetwork := &Network{address: &net.UDPAddr{IP: net.IPv4(10, 0, 1, 1), Port: 112}}
+
+	silent := testConnection(network, "192.0.2.1:1000", time.Now().Add(-2*pingTime()))
+	alive := testConnection(otherNetwork, "192.0.2.1:1000", time.Now().Add(-2*pingTime()))
+	peer := &PeerInfo{connectionActive: []*Connection{silent, alive}, connectionLatest: silent}
+
+	// The peer changed its IP. The silent connection via the same network is retired, the one via another network is kept.
+	incoming := testConnection(network, "198.51.100.1:3000", time.Now())
+	if result := peer.registerConnection(incoming); result != incoming {
+		t.Fatal("new address not registered as new connection")
+	}
+
+	if peer.connectionLatest != incoming {
+		t.Fatal("new connection not used as latest")
+	}
+	if len(peer.connectionInactive) != 1 || peer.connectionInactive[0] != silent || silent.Status != ConnectionInactive {
+		t.Fatal("silent connection not retired")
+	}
+	if len(peer.connectionActive) != 2 || alive.Status == ConnectionInactive {
+		t.Fatal("connection via another network retired")
+	}
+}
+
+func TestRegisterConnectionKeepsAlive(t *testing.T) {
+	testConfig(t)
+	network := &Network{address: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 112}}
+
+	recent := testConnection(network, "192.0.2.1:1000", time.Now())
+	peer := &PeerInfo{connectionActive: []*Connection{recent}, connectionLatest: recent}
+
+	peer.registerConnection(testConnection(network, "198.51.100.1:3000", time.Now()))
+
+	if len(peer.connectionActive) != 2 || len(peer.connectionInactive) != 0 || recent.Status == ConnectionInactive {
+		t.Fatal("connection that is still alive retired")
+	}
+}
+
+func TestConnectionStatusString(t *testing.T) {
+	for status, name := range map[ConnectionStatus]string{
+		ConnectionActive:        "active",
+		ConnectionRedundant:     "redundant",
+		ConnectionInactive:      "inactive",
+		ConnectionRemoved:       "removed",
+		ConnectionStatus(-1):    "unknown",
+		ConnectionRedundant + 1: "unknown",
+	} {
+		if status.String() != name {
+			t.Fatalf("status %d is '%s' instead of '%s'", int(status), status.String(), name)
+		}
+	}
+}
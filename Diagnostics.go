@@ -0,0 +1,102 @@
+/*
+File Name:  Diagnostics.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Diagnostics provide a snapshot of the current state (networks, peers and their connections) for debugging purposes.
+*/
+
+package core
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+// DiagnosticsNetwork is a single listening network in the diagnostics snapshot
+type DiagnosticsNetwork struct {
+	Adapter       string   `json:"adapter"`             // Adapter name
+	Address       string   `json:"address"`             // IP:Port where the network listens
+	MulticastIPv6 string   `json:"multicast,omitempty"` // Multicast IP, IPv6 only
+	BroadcastIPv4 []string `json:"broadcast,omitempty"` // Broadcast IPs, IPv4 only
+}
+
+// DiagnosticsConnection is a single connection to a peer in the diagnostics snapshot
+type DiagnosticsConnection struct {
+	Local         string           `json:"local"`      // Local IP:Port
+	Remote        string           `json:"remote"`     // Remote IP:Port
+	Status        ConnectionStatus `json:"status"`     // See ConnectionActive and others
+	StatusText    string           `json:"statustext"` // Name of the status, see ConnectionStatus.String
+	StatusReason  string           `json:"reason"`     // Explanation of the status
+	LastPacketIn  time.Time        `json:"lastpacketin"`
+	LastPacketOut time.Time        `json:"lastpacketout"`
+	RTT           int64            `json:"rtt"` // Round-trip time in milliseconds, 0 if not measured
+}
+
+// DiagnosticsPeer is a single peer in the diagnostics snapshot
+type DiagnosticsPeer struct {
+	PublicKey       string                  `json:"publickey"` // Compressed public key, hex encoded
+	PacketsSent     uint64                  `json:"packetssent"`
+	PacketsReceived uint64                  `json:"packetsreceived"`
+	LastSeen        time.Time               `json:"lastseen"`            // Last time a packet was received from the peer
+	ProtocolVersion uint16                  `json:"protocolversion"`     // Protocol version as reported by the peer, 0 if unknown
+	UserAgent       string                  `json:"useragent,omitempty"` // Software of the peer as reported by the peer
+	Connections     []DiagnosticsConnection `json:"connections"`
+}
+
+// Diagnostics is a snapshot of the current state
+type Diagnostics struct {
+	Version   string               `json:"version"`   // Core library version
+	PublicKey string               `json:"publickey"` // Own public key, hex encoded
+	Networks  []DiagnosticsNetwork `json:"networks"`  // All listening networks
+	Peers     []DiagnosticsPeer    `json:"peers"`     // All peers in the peer list
+}
+
+// GetDiagnostics returns a snapshot of the current networks and peers
+func GetDiagnostics() (diagnostics *Diagnostics) {
+	diagnostics = &Diagnostics{Version: Version}
+	if peerPublicKey != nil {
+		diagnostics.PublicKey = hex.EncodeToString(peerPublicKey.SerializeCompressed())
+	}
+
+	networksMutex.RLock()
+	for _, networks := range [][]*Network{networks6, networks4} {
+		for _, network := range networks {
+			listen, multicastIPv6, broadcastIPv4 := network.GetListen()
+			networkD := DiagnosticsNetwork{Adapter: network.GetAdapterName(), Address: listen.String()}
+			if multicastIPv6 != nil {
+				networkD.MulticastIPv6 = multicastIPv6.String()
+			}
+			for _, ip := range broadcastIPv4 {
+				networkD.BroadcastIPv4 = append(networkD.BroadcastIPv4, ip.String())
+			}
+			diagnostics.Networks = append(diagnostics.Networks, networkD)
+		}
+	}
+	networksMutex.RUnlock()
+
+	for _, peer := range PeerlistGet() {
+		peerD := DiagnosticsPeer{PublicKey: hex.EncodeToString(peer.PublicKey.SerializeCompressed()), PacketsSent: atomic.LoadUint64(&peer.StatsPacketSent), PacketsReceived: atomic.LoadUint64(&peer.StatsPacketReceived)}
+
+		peer.RLock()
+		peerD.LastSeen = peer.LastSeen
+		peerD.ProtocolVersion, peerD.UserAgent = peer.ProtocolVersion, peer.UserAgent
+		for _, connections := range [][]*Connection{peer.connectionActive, peer.connectionInactive} {
+			for _, connection := range connections {
+				peerD.Connections = append(peerD.Connections, DiagnosticsConnection{Local: connection.Network.address.String(), Remote: connection.Address.String(), Status: connection.Status, StatusText: connection.Status.String(), StatusReason: connection.StatusReason(), LastPacketIn: connection.LastPacketIn, LastPacketOut: connection.LastPacketOut, RTT: connection.RTT.Milliseconds()})
+			}
+		}
+		peer.RUnlock()
+
+		diagnostics.Peers = append(diagnostics.Peers, peerD)
+	}
+
+	return diagnostics
+}
+
+// DiagnosticsJSON returns the diagnostics snapshot JSON encoded
+func DiagnosticsJSON() (data []byte, err error) {
+	return json.MarshalIndent(GetDiagnostics(), "", "  ")
+}
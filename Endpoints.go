@@ -0,0 +1,234 @@
+/*
+File Name:  Endpoints.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Nodes advertise the endpoints (IP:Port) they are reachable on in the announcement. This includes all listening addresses and the external addresses detected behind NAT.
+Multi-homed and port-forwarded nodes are reachable via endpoints that the remote peer would not learn otherwise.
+The external addresses come first, since only announcementEndpointsMax endpoints are advertised and nodes with many listening IPs would otherwise crowd them out.
+
+The endpoints received from a peer are added as inactive candidate connections, which are pinged like any other inactive connection. A reply via an endpoint activates the candidate.
+Candidates that never reply expire like other inactive connections. If all connections to a peer are lost, its endpoints are tried again.
+
+Payload of CommandAnnouncement (optional, older peers send none):
+Offset  Size   Info
+0       1      Reachability of the sender, see Reachability.go
+1       1      Count of endpoints
+2       18*n   Endpoints in preference order, see encodeObservedAddress
+?       106    Optional: Certificate of the ephemeral key, see Ephemeral Key.go
+?       ?      Optional: Protocol version and user agent, see Protocol Version.go
+?       8      Optional: Time the announcement was created, see Announcement Replay.go
+*/
+
+package core
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// announcementEndpointsMax is the maximum count of endpoints in an announcement
+const announcementEndpointsMax = 8
+
+// isRoutableIP checks if the IP is suitable for advertising to other peers. Loopback, link-local, multicast and unspecified IPs are not.
+// Private IPs are routable in the local network and therefore included.
+func isRoutableIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+// localEndpoints returns the routable endpoints of this node in preference order: External addresses detected behind NAT, then listening addresses (IPv6 first).
+func localEndpoints() (endpoints []*net.UDPAddr) {
+	var listen []*net.UDPAddr
+
+	ipsListenMutex.RLock()
+	for listenA := range ipsListen {
+		host, portA, err := net.SplitHostPort(listenA)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(host)
+		port, _ := strconv.Atoi(portA)
+		if ip != nil && port > 0 && isRoutableIP(ip) {
+			listen = append(listen, &net.UDPAddr{IP: ip, Port: port})
+		}
+	}
+	ipsListenMutex.RUnlock()
+
+	sort.Slice(listen, func(i, j int) bool {
+		if IsIPv4(listen[i].IP) != IsIPv4(listen[j].IP) {
+			return !IsIPv4(listen[i].IP)
+		}
+		return listen[i].String() < listen[j].String()
+	})
+
+	for _, network := range networksSnapshot() {
+		if _, external := network.ObservedAddresses(); external != nil && isRoutableIP(external.IP) {
+			endpoints = append(endpoints, external)
+		}
+		if external, _ := network.STUNAddress(); external != nil && isRoutableIP(external.IP) {
+			endpoints = append(endpoints, external)
+		}
+		if external := network.UPnPAddress(); external != nil && external.IP != nil && isRoutableIP(external.IP) {
+			endpoints = append(endpoints, external)
+		}
+	}
+
+	endpoints = append(endpoints, listen...)
+
+	return endpointsFilter(endpoints)
+}
+
+// endpointsFilter removes duplicate and non-routable endpoints and limits the count
+func endpointsFilter(endpoints []*net.UDPAddr) (filtered []*net.UDPAddr) {
+	seen := make(map[string]struct{})
+
+	for _, endpoint := range endpoints {
+		if len(filtered) >= announcementEndpointsMax {
+			break
+		}
+		if !isRoutableIP(endpoint.IP) {
+			continue
+		}
+		key := net.JoinHostPort(endpoint.IP.String(), strconv.Itoa(endpoint.Port))
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+
+		filtered = append(filtered, endpoint)
+	}
+
+	return filtered
+}
+
+// announcementPacket returns a new announcement packet including the local endpoints
+func announcementPacket() *PacketRaw {
+	endpoints := localEndpoints()
+
+	payload := []byte{localReachability(), byte(len(endpoints))}
+	for _, endpoint := range endpoints {
+		payload = append(payload, encodeObservedAddress(endpoint)...)
+	}
+
+	if certificate := encodeEphemeralCertificate(); len(certificate) > 0 {
+		payload = append(payload, certificate...)
+		payload = append(payload, encodeProtocolVersion()...)
+		payload = append(payload, encodeAnnouncementTime()...)
+	}
+
+	return &PacketRaw{Protocol: 0, Command: CommandAnnouncement, Payload: payload}
+}
+
+// announcementEndpointsSize returns the size of the endpoints in the announcement payload
+func announcementEndpointsSize(payload []byte) (size int) {
+	if len(payload) < 2 {
+		return len(payload)
+	}
+
+	size = 2 + int(payload[1])*observedAddressSize
+	if size > len(payload) {
+		return len(payload)
+	}
+	return size
+}
+
+// decodeEndpoints decodes the endpoints from an announcement payload. Invalid, duplicate and non-routable endpoints are ignored.
+func decodeEndpoints(payload []byte) (endpoints []*net.UDPAddr) {
+	if len(payload) < 2 {
+		return nil
+	}
+
+	count := int(payload[1])
+	payload = payload[2:]
+
+	for n := 0; n < count && len(payload) >= observedAddressSize; n++ {
+		if endpoint := decodeObservedAddress(payload[:observedAddressSize]); endpoint != nil {
+			endpoints = append(endpoints, endpoint)
+		}
+		payload = payload[observedAddressSize:]
+	}
+
+	return endpointsFilter(endpoints)
+}
+
+// setEndpoints sets the endpoints advertised by the peer and adds them as candidate connections
+func (peer *PeerInfo) setEndpoints(endpoints []*net.UDPAddr) {
+	peer.Lock()
+	peer.Endpoints = endpoints
+	peer.Unlock()
+
+	for _, endpoint := range endpoints {
+		peer.addCandidateConnection(endpoint)
+	}
+}
+
+// addCandidateConnection adds an inactive connection to the endpoint, unless the peer already has a connection to it. It becomes active when a packet is received via it, see registerConnection.
+func (peer *PeerInfo) addCandidateConnection(endpoint *net.UDPAddr) {
+	if IsAddressSelf(endpoint) {
+		return
+	}
+
+	endpoint = nat64Address(endpoint)
+	network := findNetworkForRemote(endpoint.IP)
+	if network == nil {
+		return
+	}
+
+	candidate := &Connection{Network: network, Address: &net.UDPAddr{IP: endpoint.IP, Port: endpoint.Port}, Status: ConnectionInactive, Expires: time.Now().Add(connectionRemove())}
+	candidate.statusReason.Store("inactive: candidate, endpoint advertised by peer")
+
+	peer.Lock()
+	defer peer.Unlock()
+
+	for _, connections := range [][]*Connection{peer.connectionActive, peer.connectionInactive} {
+		for _, connection := range connections {
+			if connection.Equal(candidate) {
+				return
+			}
+		}
+	}
+
+	peer.connectionInactive = append(peer.connectionInactive, candidate)
+}
+
+// tryEndpoints sends a ping to each advertised endpoint of the peer that is not already used by a connection. It is called if the peer has no active connection.
+// A reply from the peer via an endpoint establishes a new connection. At most one attempt is made per ping interval.
+func (peer *PeerInfo) tryEndpoints() {
+	peer.Lock()
+	if time.Since(peer.endpointsLastTry) < pingTime() || len(peer.Endpoints) == 0 {
+		peer.Unlock()
+		return
+	}
+	peer.endpointsLastTry = time.Now()
+	endpoints := peer.Endpoints
+	peer.Unlock()
+
+	// If this attempt succeeds, the peer has active connections again before the next one and reachabilityAttempt is reset.
+	peer.reachabilityAttempt(false)
+
+	raw, err := PacketEncrypt(peerPrivateKey, peer.PublicKey, &PacketRaw{Protocol: 0, Command: CommandPing})
+	if err != nil {
+		return
+	}
+
+loopEndpoints:
+	for _, endpoint := range endpoints {
+		if IsAddressSelf(endpoint) {
+			continue
+		}
+		for _, connections := range [][]*Connection{peer.GetConnections(true), peer.GetConnections(false)} {
+			for _, connection := range connections {
+				if connection.Address.IP.Equal(endpoint.IP) && connection.Address.Port == endpoint.Port {
+					continue loopEndpoints
+				}
+			}
+		}
+
+		endpoint = nat64Address(endpoint)
+		if network := findNetworkForRemote(endpoint.IP); network != nil {
+			network.send(endpoint.IP, endpoint.Port, raw)
+		}
+	}
+}
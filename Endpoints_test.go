@@ -0,0 +1,81 @@
+/*
+File Name:  Endpoints_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package core
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLocalEndpointsExternalFirst(t *testing.T) {
+	ipsListenMutex.Lock()
+	ipsListenOld := ipsListen
+	ipsListen = make(map[string]struct{})
+	for n := 1; n <= announcementEndpointsMax+1; n++ {
+		ipsListen[net.JoinHostPort("192.0.2."+strconv.Itoa(n), "112")] = struct{}{}
+	}
+	ipsListenMutex.Unlock()
+	defer func() {
+		ipsListenMutex.Lock()
+		ipsListen = ipsListenOld
+		ipsListenMutex.Unlock()
+	}()
+
+	external := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 5000}
+	network := &Network{address: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 112}}
+	network.upnp.external = external
+	testNetworksRegister(t, network)
+
+	endpoints := localEndpoints()
+	if len(endpoints) != announcementEndpointsMax {
+		t.Fatalf("%d endpoints, expected %d", len(endpoints), announcementEndpointsMax)
+	} else if endpoints[0].String() != external.String() {
+		t.Fatalf("external address not first: %v", endpoints)
+	}
+}
+
+func TestEndpointsCandidate(t *testing.T) {
+	testConfig(t)
+	testInitPeer(t)
+	config.DisableAutoPing = true
+
+	network := testNetworkLoopback(t)
+	testNetworksRegister(t, network)
+	remote := testRemoteNew(t, network)
+	peer := remote.peerlistAdd(t)
+	defer PeerlistRemove(peer)
+
+	endpoint := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 5000}
+	announcement := remote.announcement(t, ProtocolVersion)
+	announcement.Payload = append(append([]byte{announcement.Payload[0], 1}, encodeObservedAddress(endpoint)...), announcement.Payload[2:]...)
+	remote.send(t, announcement, remote.address())
+
+	var candidate *Connection
+	for _, connection := range peer.GetConnections(false) {
+		if connection.Address.String() == endpoint.String() {
+			candidate = connection
+		}
+	}
+	if candidate == nil {
+		t.Fatal("advertised endpoint not added as inactive connection")
+	} else if candidate.Status != ConnectionInactive || candidate.Network != network {
+		t.Fatalf("candidate connection status %s network %v", candidate.Status, candidate.Network)
+	}
+
+	// A second announcement does not duplicate the candidate.
+	peer.setEndpoints([]*net.UDPAddr{endpoint, remote.address()})
+	if count := len(peer.GetConnections(false)); count != 1 {
+		t.Fatalf("%d inactive connections after repeated endpoints, expected 1", count)
+	}
+
+	// An incoming packet via the endpoint activates the candidate.
+	if result := peer.registerConnection(testConnection(network, endpoint.String(), time.Now())); result != candidate || candidate.Status != ConnectionActive {
+		t.Fatalf("candidate not activated, status %s", candidate.Status)
+	}
+}
@@ -0,0 +1,307 @@
+/*
+File Name:  Ephemeral Key.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Two-tier keys: The long-term identity key (peer ID) signs a short-lived ephemeral key, which is rotated regularly.
+The ephemeral public key and the signature (certificate) are exchanged in the announcement and the response. Peers verify the signature against the identity key of the sender.
+The key is rotated after config.RekeyInterval or once config.RekeyBytes were encrypted with it, and the new certificate is sent to all peers via CommandRekey (payload: certificate).
+A peer whose stored key changed answers with its own certificate, which confirms the receipt. Unconfirmed peers receive the certificate again until the grace period ends.
+The certificate contains an expiry. Expired certificates are refused and the ephemeral key of a peer is no longer used once its certificate expired.
+This file only handles the exchange of the ephemeral keys. They are used for key agreement by the payload encryption, see Payload Encryption.go.
+After a rotation the previous key remains valid for ephemeralKeyGrace for packets in flight and is then discarded, together with all keys derived from it.
+
+Certificate (since protocol version 2.0, older versions did not contain the expiry):
+Offset  Size   Info
+0       33     Ephemeral public key, compressed
+33      8      Expiry, Unix time in seconds
+41      65     Signature of the identity key over the hash of the ephemeral public key and the expiry
+*/
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// ephemeralCertificateSize is the size of the certificate of the ephemeral key
+const ephemeralCertificateSize = btcec.PubKeyBytesLenCompressed + 8 + signatureSize
+
+// ephemeralCertificateSizeV1 is the size of the certificate before protocol version 2.0, which did not contain the expiry
+const ephemeralCertificateSizeV1 = btcec.PubKeyBytesLenCompressed + signatureSize
+
+// defaultRekeyInterval is the default interval in seconds to rotate the ephemeral key, see config.RekeyInterval
+const defaultRekeyInterval = 3600
+
+// rekeyIntervalMin is the minimum interval in seconds to rotate the ephemeral key. It exceeds the grace period, so that only one previous key is kept.
+const rekeyIntervalMin = 300
+
+// defaultRekeyBytes is the default count of bytes encrypted with an ephemeral key after which it is rotated, see config.RekeyBytes
+const defaultRekeyBytes = 1 << 30
+
+// ephemeralKeyGrace is the time the previous ephemeral key remains valid after a rotation
+const ephemeralKeyGrace = 2 * time.Minute
+
+// ephemeralRekeyCheck is the interval to check if the ephemeral key must be rotated
+const ephemeralRekeyCheck = 10 * time.Second
+
+// ephemeralKeyValidity returns the time the certificate of an ephemeral key is valid. It exceeds the rotation interval, so that peers can use the key until they receive the next one.
+func ephemeralKeyValidity() time.Duration {
+	return 2 * time.Duration(config.RekeyInterval) * time.Second
+}
+
+var (
+	ephemeralPrivateKey  *btcec.PrivateKey
+	ephemeralPublicKey   *btcec.PublicKey
+	ephemeralCertificate []byte            // Certificate of the current ephemeral key, signed by the identity key
+	ephemeralPrevious    *btcec.PrivateKey // Previous ephemeral key, valid during the grace period. Nil once discarded.
+	ephemeralRotated     time.Time         // Time of the last rotation
+	ephemeralMutex       sync.RWMutex      // Mutex for the ephemeral keys
+)
+
+// ephemeralBytesEncrypted is the count of payload bytes encrypted with the current ephemeral key, atomic access
+var ephemeralBytesEncrypted uint64
+
+// initEphemeralKey creates the first ephemeral key. The identity key must be loaded first.
+func initEphemeralKey() {
+	if err := ephemeralKeyRotate(); err != nil {
+		logger.Errorf("initEphemeralKey Error creating ephemeral key: %s\n", err.Error())
+	}
+}
+
+// ephemeralKeyRotate creates a new ephemeral key and signs it with the identity key
+func ephemeralKeyRotate() (err error) {
+	privateKey, publicKey, err := Secp256k1NewPrivateKey()
+	if err != nil {
+		return err
+	}
+
+	signed := make([]byte, btcec.PubKeyBytesLenCompressed+8)
+	copy(signed, publicKey.SerializeCompressed())
+	binary.LittleEndian.PutUint64(signed[btcec.PubKeyBytesLenCompressed:], uint64(time.Now().Add(ephemeralKeyValidity()).Unix()))
+
+	signature, err := btcec.SignCompact(btcec.S256(), peerPrivateKey, hashData(signed), true)
+	if err != nil {
+		return err
+	}
+
+	ephemeralMutex.Lock()
+	ephemeralPrevious = ephemeralPrivateKey
+	ephemeralPrivateKey, ephemeralPublicKey = privateKey, publicKey
+	ephemeralCertificate = append(signed, signature...)
+	ephemeralRotated = time.Now()
+	atomic.StoreUint64(&ephemeralBytesEncrypted, 0)
+	ephemeralMutex.Unlock()
+
+	return nil
+}
+
+// ephemeralKeyRotateDue checks if the current ephemeral key must be rotated, either by time or by the count of bytes encrypted with it
+func ephemeralKeyRotateDue() bool {
+	ephemeralMutex.RLock()
+	rotated := ephemeralRotated
+	ephemeralMutex.RUnlock()
+
+	if time.Since(rotated) >= time.Duration(config.RekeyInterval)*time.Second {
+		return true
+	}
+	return config.RekeyBytes > 0 && atomic.LoadUint64(&ephemeralBytesEncrypted) >= uint64(config.RekeyBytes)
+}
+
+// ephemeralKeyDiscardPrevious discards the previous ephemeral key and all payload ciphers derived from it
+func ephemeralKeyDiscardPrevious() {
+	ephemeralMutex.Lock()
+	ephemeralPrevious = nil
+	ephemeralMutex.Unlock()
+
+	payloadCiphersReset()
+}
+
+// autoEphemeralKeyRotate rotates the ephemeral key when due and sends the new one to all peers. The previous key is discarded after the grace period.
+func autoEphemeralKeyRotate(ctx context.Context) {
+	for {
+		if !sleepContext(ctx, ephemeralRekeyCheck) {
+			return
+		}
+
+		ephemeralMutex.RLock()
+		rotated, previous := ephemeralRotated, ephemeralPrevious != nil
+		ephemeralMutex.RUnlock()
+
+		// The key is not rotated again before the previous one is discarded.
+		if previous {
+			if time.Since(rotated) >= ephemeralKeyGrace {
+				ephemeralKeyDiscardPrevious()
+			} else {
+				rekeySendUnconfirmed()
+			}
+			continue
+		}
+
+		if !ephemeralKeyRotateDue() {
+			continue
+		}
+
+		if err := ephemeralKeyRotate(); err != nil {
+			logger.Errorf("autoEphemeralKeyRotate Error creating ephemeral key: %s\n", err.Error())
+			continue
+		}
+
+		rekeySendUnconfirmed()
+	}
+}
+
+// rekeyPacket returns a new rekey packet with the certificate of the current ephemeral key
+func rekeyPacket() *PacketRaw {
+	return &PacketRaw{Command: CommandRekey, Payload: encodeEphemeralCertificate()}
+}
+
+// rekeySendUnconfirmed sends the current ephemeral key to all peers that did not confirm it since the last rotation. Legacy peers do not know the rekey message and are skipped.
+func rekeySendUnconfirmed() {
+	ephemeralMutex.RLock()
+	rotated := ephemeralRotated
+	ephemeralMutex.RUnlock()
+
+	for _, peer := range PeerlistGet() {
+		if peer.isLegacy() {
+			continue
+		}
+
+		peer.RLock()
+		confirmed := peer.rekeyReceived.After(rotated)
+		peer.RUnlock()
+
+		if !confirmed {
+			peer.send(rekeyPacket())
+		}
+	}
+}
+
+// cmdRekey handles an incoming rekey message with a new ephemeral key of the peer. A changed key is answered with the own certificate, which confirms the receipt.
+func (peer *PeerInfo) cmdRekey(msg *packet2) {
+	if peer == nil {
+		return
+	}
+
+	valid, changed := peer.setEphemeralKey(msg.Payload)
+	if !valid {
+		return
+	}
+
+	peer.Lock()
+	peer.rekeyReceived = time.Now()
+	peer.Unlock()
+
+	if changed {
+		peer.send(rekeyPacket())
+	}
+}
+
+// ephemeralPrivateKeyByID returns the local ephemeral key with the key ID. The previous key is only returned during the grace period.
+func ephemeralPrivateKeyByID(id []byte) *btcec.PrivateKey {
+	ephemeralMutex.RLock()
+	defer ephemeralMutex.RUnlock()
+
+	if ephemeralPrivateKey != nil && bytes.Equal(ephemeralKeyID(ephemeralPrivateKey.PubKey()), id) {
+		return ephemeralPrivateKey
+	}
+	if ephemeralPrevious != nil && time.Since(ephemeralRotated) < ephemeralKeyGrace && bytes.Equal(ephemeralKeyID(ephemeralPrevious.PubKey()), id) {
+		return ephemeralPrevious
+	}
+	return nil
+}
+
+// ExportEphemeralKey returns the current ephemeral key pair
+func ExportEphemeralKey() (privateKey *btcec.PrivateKey, publicKey *btcec.PublicKey) {
+	ephemeralMutex.RLock()
+	defer ephemeralMutex.RUnlock()
+
+	return ephemeralPrivateKey, ephemeralPublicKey
+}
+
+// encodeEphemeralCertificate returns the certificate of the current ephemeral key. Empty if there is none.
+func encodeEphemeralCertificate() (certificate []byte) {
+	ephemeralMutex.RLock()
+	defer ephemeralMutex.RUnlock()
+
+	return append(certificate, ephemeralCertificate...)
+}
+
+// decodeEphemeralCertificate decodes the certificate and verifies that it is signed by the identity key. Returns nil if invalid or expired.
+func decodeEphemeralCertificate(identity *btcec.PublicKey, data []byte) (ephemeral *btcec.PublicKey, expires time.Time) {
+	if len(data) < ephemeralCertificateSize {
+		return nil, expires
+	}
+
+	signed := data[:btcec.PubKeyBytesLenCompressed+8]
+	signer, _, err := btcec.RecoverCompact(btcec.S256(), data[len(signed):ephemeralCertificateSize], hashData(signed))
+	if err != nil || !signer.IsEqual(identity) {
+		return nil, expires
+	}
+
+	expires = time.Unix(int64(binary.LittleEndian.Uint64(signed[btcec.PubKeyBytesLenCompressed:])), 0)
+	if time.Now().After(expires) {
+		return nil, expires
+	}
+
+	ephemeral, err = btcec.ParsePubKey(signed[:btcec.PubKeyBytesLenCompressed], btcec.S256())
+	if err != nil {
+		return nil, expires
+	}
+
+	return ephemeral, expires
+}
+
+// setEphemeralKey verifies the certificate and stores the ephemeral key of the peer. Invalid and expired certificates are ignored.
+// Changed indicates whether the key differs from the one stored before.
+func (peer *PeerInfo) setEphemeralKey(certificate []byte) (valid, changed bool) {
+	ephemeral, expires := decodeEphemeralCertificate(peer.PublicKey, certificate)
+	if ephemeral == nil {
+		return false, false
+	}
+
+	peer.Lock()
+	defer peer.Unlock()
+
+	changed = peer.EphemeralPublicKey == nil || !peer.EphemeralPublicKey.IsEqual(ephemeral)
+	if changed && peer.EphemeralPublicKey != nil {
+		peer.ephemeralPrevious = peer.EphemeralPublicKey
+		peer.ephemeralChanged = time.Now()
+	}
+	peer.EphemeralPublicKey = ephemeral
+	peer.ephemeralExpires = expires
+
+	return true, changed
+}
+
+// GetEphemeralKey returns the current verified ephemeral key of the peer. Nil if unknown or if its certificate expired.
+func (peer *PeerInfo) GetEphemeralKey() *btcec.PublicKey {
+	peer.RLock()
+	defer peer.RUnlock()
+
+	if time.Now().After(peer.ephemeralExpires) {
+		return nil
+	}
+	return peer.EphemeralPublicKey
+}
+
+// ephemeralKeyByID returns the ephemeral key of the peer with the key ID. The previous key is only returned during the grace period.
+func (peer *PeerInfo) ephemeralKeyByID(id []byte) *btcec.PublicKey {
+	peer.RLock()
+	defer peer.RUnlock()
+
+	if peer.EphemeralPublicKey != nil && time.Now().Before(peer.ephemeralExpires) && bytes.Equal(ephemeralKeyID(peer.EphemeralPublicKey), id) {
+		return peer.EphemeralPublicKey
+	}
+	if peer.ephemeralPrevious != nil && time.Since(peer.ephemeralChanged) < ephemeralKeyGrace && bytes.Equal(ephemeralKeyID(peer.ephemeralPrevious), id) {
+		return peer.ephemeralPrevious
+	}
+	return nil
+}
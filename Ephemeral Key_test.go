@@ -0,0 +1,82 @@
+/*
+File Name:  Ephemeral Key_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package core
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEphemeralKeyRotateDue(t *testing.T) {
+	testInitPeer(t)
+	previous := config
+	defer func() { config = previous }()
+
+	config.RekeyBytes = 1000
+	if ephemeralKeyRotateDue() {
+		t.Fatal("rotation due right after rotating")
+	}
+
+	atomic.AddUint64(&ephemeralBytesEncrypted, 1000)
+	if !ephemeralKeyRotateDue() {
+		t.Fatal("rotation not due after the byte limit")
+	}
+
+	config.RekeyBytes = -1
+	if ephemeralKeyRotateDue() {
+		t.Fatal("rotation due with the byte limit disabled")
+	}
+
+	ephemeralMutex.Lock()
+	ephemeralRotated = time.Now().Add(-time.Duration(config.RekeyInterval) * time.Second)
+	ephemeralMutex.Unlock()
+	if !ephemeralKeyRotateDue() {
+		t.Fatal("rotation not due after the interval")
+	}
+}
+
+func TestEphemeralKeyChange(t *testing.T) {
+	testInitPeer(t)
+	peer := &PeerInfo{PublicKey: peerPublicKey}
+
+	first, _ := ExportEphemeralKey()
+	if valid, changed := peer.setEphemeralKey(encodeEphemeralCertificate()); !valid || !changed {
+		t.Fatalf("first key: valid %t, changed %t", valid, changed)
+	}
+	if valid, changed := peer.setEphemeralKey(encodeEphemeralCertificate()); !valid || changed {
+		t.Fatalf("same key: valid %t, changed %t", valid, changed)
+	}
+
+	if err := ephemeralKeyRotate(); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := ExportEphemeralKey()
+	if valid, changed := peer.setEphemeralKey(encodeEphemeralCertificate()); !valid || !changed {
+		t.Fatalf("new key: valid %t, changed %t", valid, changed)
+	}
+
+	if key := peer.ephemeralKeyByID(ephemeralKeyID(second.PubKey())); key == nil || !key.IsEqual(second.PubKey()) {
+		t.Fatal("current key not found")
+	}
+	if key := peer.ephemeralKeyByID(ephemeralKeyID(first.PubKey())); key == nil || !key.IsEqual(first.PubKey()) {
+		t.Fatal("previous key not accepted during the grace period")
+	}
+
+	peer.Lock()
+	peer.ephemeralChanged = time.Now().Add(-ephemeralKeyGrace)
+	peer.Unlock()
+	if peer.ephemeralKeyByID(ephemeralKeyID(first.PubKey())) != nil {
+		t.Fatal("previous key accepted after the grace period")
+	}
+
+	// A certificate signed by another identity is refused.
+	other := &PeerInfo{PublicKey: first.PubKey()}
+	if valid, _ := other.setEphemeralKey(encodeEphemeralCertificate()); valid {
+		t.Fatal("certificate of another identity accepted")
+	}
+}
@@ -0,0 +1,208 @@
+/*
+File Name:  Fragmentation.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Payloads larger than config.FragmentThreshold are split into fragments, each sent as a separate CommandFragment packet.
+The receiver collects the fragments of a message (in any order) and dispatches the reassembled packet as if it was received in one piece.
+Incomplete messages are discarded after fragmentTimeout. Lost fragments are not retransmitted.
+Only fragments from peers in the peer list are accepted. Incomplete messages are limited per sender (fragmentSetsPerSender) and in total (fragmentSetsMax), and the data of all incomplete messages is limited to fragmentBytesMax.
+
+Payload of CommandFragment:
+Offset  Size   Info
+0       4      Message ID, unique per sender
+4       2      Index of the fragment, starting at 0
+6       2      Count of fragments
+8       1      Command of the original packet
+9       ?      Data
+*/
+
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// fragmentHeaderSize is the size of the header of each fragment
+const fragmentHeaderSize = 9
+
+// defaultFragmentThreshold is the default payload size above which packets are fragmented, see config.FragmentThreshold.
+// It keeps packets including the header and signature below the typical MTU of 1500 bytes.
+const defaultFragmentThreshold = 1200
+
+// fragmentThresholdMin is the minimum allowed fragment threshold
+const fragmentThresholdMin = 256
+
+// fragmentThresholdMax is the maximum allowed fragment threshold, so that packets fit into the receive buffer
+const fragmentThresholdMax = maxPacketSize - packetLengthMin - sequenceSize - checksumSize - payloadEncryptionOverhead - maxRandomGarbage
+
+// fragmentCountMax is the maximum count of fragments of a single message
+const fragmentCountMax = 256
+
+// fragmentTimeout is the time after which an incomplete message is discarded
+const fragmentTimeout = 10 * time.Second
+
+// fragmentSetsMax is the maximum count of incomplete messages from all senders
+const fragmentSetsMax = 128
+
+// fragmentSetsPerSender is the maximum count of incomplete messages from a single sender
+const fragmentSetsPerSender = 8
+
+// fragmentBytesMax is the maximum size of the data of all incomplete messages
+const fragmentBytesMax = 8 * 1024 * 1024
+
+// ErrPayloadTooLarge is returned if a payload exceeds the maximum count of fragments
+var ErrPayloadTooLarge = errors.New("payload too large")
+
+// fragmentKey identifies a message
+type fragmentKey struct {
+	sender [btcec.PubKeyBytesLenCompressed]byte
+	id     uint32
+}
+
+// fragmentSet contains the received fragments of a message
+type fragmentSet struct {
+	command   uint8
+	fragments [][]byte
+	received  int
+	size      int
+	created   time.Time
+}
+
+var (
+	fragmentSets      = make(map[fragmentKey]*fragmentSet)
+	fragmentBytes     int // Size of the data of all incomplete messages
+	fragmentMutex     sync.Mutex
+	fragmentMessageID uint32 // Last used message ID, atomic access
+)
+
+// statsFragmentsExpired is the count of incomplete messages discarded after the timeout
+var statsFragmentsExpired uint64
+
+// StatsFragmentsExpired returns the count of fragmented messages that were discarded because not all fragments arrived in time.
+func StatsFragmentsExpired() uint64 {
+	return atomic.LoadUint64(&statsFragmentsExpired)
+}
+
+// sendFragments splits the packet into fragments and sends them to the peer
+func (peer *PeerInfo) sendFragments(packet *PacketRaw) (err error) {
+	dataSize := config.FragmentThreshold - fragmentHeaderSize
+	count := (len(packet.Payload) + dataSize - 1) / dataSize
+	if count > fragmentCountMax {
+		return ErrPayloadTooLarge
+	}
+
+	id := atomic.AddUint32(&fragmentMessageID, 1)
+
+	for n := 0; n < count; n++ {
+		data := packet.Payload[n*dataSize:]
+		if len(data) > dataSize {
+			data = data[:dataSize]
+		}
+
+		payload := make([]byte, fragmentHeaderSize+len(data))
+		binary.LittleEndian.PutUint32(payload[0:4], id)
+		binary.LittleEndian.PutUint16(payload[4:6], uint16(n))
+		binary.LittleEndian.PutUint16(payload[6:8], uint16(count))
+		payload[8] = packet.Command
+		copy(payload[fragmentHeaderSize:], data)
+
+		if err = peer.send(&PacketRaw{Command: CommandFragment, Payload: payload}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// cmdFragment handles an incoming fragment. Once all fragments of the message are received, the reassembled packet is dispatched.
+func (peer *PeerInfo) cmdFragment(msg *packet2) {
+	// Fragments from unknown peers are dropped, otherwise anyone could fill the buffers.
+	if peer == nil || len(msg.Payload) < fragmentHeaderSize {
+		return
+	}
+
+	key := fragmentKey{sender: publicKey2Compressed(msg.SenderPublicKey), id: binary.LittleEndian.Uint32(msg.Payload[0:4])}
+	index := int(binary.LittleEndian.Uint16(msg.Payload[4:6]))
+	count := int(binary.LittleEndian.Uint16(msg.Payload[6:8]))
+	command := msg.Payload[8]
+
+	// Nested fragments are not allowed.
+	if count == 0 || count > fragmentCountMax || index >= count || command == CommandFragment {
+		return
+	}
+
+	fragmentMutex.Lock()
+
+	fragmentExpire()
+
+	data := msg.Payload[fragmentHeaderSize:]
+	if fragmentBytes+len(data) > fragmentBytesMax {
+		fragmentMutex.Unlock()
+		return
+	}
+
+	set, ok := fragmentSets[key]
+	if !ok {
+		if len(fragmentSets) >= fragmentSetsMax || fragmentSetsOf(key.sender) >= fragmentSetsPerSender {
+			fragmentMutex.Unlock()
+			return
+		}
+		set = &fragmentSet{command: command, fragments: make([][]byte, count), created: time.Now()}
+		fragmentSets[key] = set
+	}
+
+	// Fragments that do not match the message or are received twice are ignored.
+	if len(set.fragments) != count || set.command != command || set.fragments[index] != nil {
+		fragmentMutex.Unlock()
+		return
+	}
+
+	set.fragments[index] = data
+	set.received++
+	set.size += len(data)
+	fragmentBytes += len(data)
+
+	if set.received < count {
+		fragmentMutex.Unlock()
+		return
+	}
+
+	delete(fragmentSets, key)
+	fragmentBytes -= set.size
+	fragmentMutex.Unlock()
+
+	payload := make([]byte, 0, set.size)
+	for _, data := range set.fragments {
+		payload = append(payload, data...)
+	}
+
+	packetDispatch(peer, &packet2{SenderPublicKey: msg.SenderPublicKey, PacketRaw: PacketRaw{Protocol: msg.Protocol, Command: command, Payload: payload}, connection: msg.connection})
+}
+
+// fragmentExpire discards incomplete messages that timed out. The caller must hold fragmentMutex.
+func fragmentExpire() {
+	for key, set := range fragmentSets {
+		if time.Since(set.created) > fragmentTimeout {
+			delete(fragmentSets, key)
+			fragmentBytes -= set.size
+			atomic.AddUint64(&statsFragmentsExpired, 1)
+		}
+	}
+}
+
+// fragmentSetsOf returns the count of incomplete messages from the sender. The caller must hold fragmentMutex.
+func fragmentSetsOf(sender [btcec.PubKeyBytesLenCompressed]byte) (count int) {
+	for key := range fragmentSets {
+		if key.sender == sender {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,133 @@
+/*
+File Name:  Fragmentation_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// testFragments splits the payload into fragments of the given data size, in the format of CommandFragment
+func testFragments(id uint32, command uint8, payload []byte, dataSize int) (fragments [][]byte) {
+	count := (len(payload) + dataSize - 1) / dataSize
+
+	for n := 0; n < count; n++ {
+		data := payload[n*dataSize:]
+		if len(data) > dataSize {
+			data = data[:dataSize]
+		}
+
+		fragment := make([]byte, fragmentHeaderSize+len(data))
+		binary.LittleEndian.PutUint32(fragment[0:4], id)
+		binary.LittleEndian.PutUint16(fragment[4:6], uint16(n))
+		binary.LittleEndian.PutUint16(fragment[6:8], uint16(count))
+		fragment[8] = command
+		copy(fragment[fragmentHeaderSize:], data)
+
+		fragments = append(fragments, fragment)
+	}
+
+	return fragments
+}
+
+// testFragmentReceiver registers a handler for the custom command that records the reassembled payloads
+func testFragmentReceiver(t *testing.T, command uint8) (received func() [][]byte) {
+	var payloads [][]byte
+	var mutex sync.Mutex
+
+	RegisterCommandHandler(command, func(peer *PeerInfo, msg *Message) {
+		mutex.Lock()
+		payloads = append(payloads, msg.Payload)
+		mutex.Unlock()
+	})
+	t.Cleanup(func() { RegisterCommandHandler(command, nil) })
+
+	return func() [][]byte {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return payloads
+	}
+}
+
+// testFragmentSend delivers the fragment from the sender. Peer is nil if the sender is not in the peer list.
+func testFragmentSend(peer *PeerInfo, sender *btcec.PublicKey, fragment []byte) {
+	connection := testConnection(testNetwork, "192.0.2.1:112", time.Now())
+	peer.cmdFragment(&packet2{SenderPublicKey: sender, PacketRaw: PacketRaw{Command: CommandFragment, Payload: fragment}, connection: connection})
+}
+
+func TestFragmentOutOfOrder(t *testing.T) {
+	testConfig(t)
+	received := testFragmentReceiver(t, CommandUserMin)
+	_, publicKey, _ := Secp256k1NewPrivateKey()
+	peer := &PeerInfo{PublicKey: publicKey}
+
+	payload := bytes.Repeat([]byte("0123456789"), 100)
+	fragments := testFragments(1, CommandUserMin, payload, 300)
+	if len(fragments) != 4 {
+		t.Fatalf("%d fragments", len(fragments))
+	}
+
+	for _, index := range []int{3, 1, 1, 0} {
+		testFragmentSend(peer, publicKey, fragments[index])
+	}
+	if len(received()) != 0 {
+		t.Fatal("incomplete message dispatched")
+	}
+
+	testFragmentSend(peer, publicKey, fragments[2])
+	if payloads := received(); len(payloads) != 1 || !bytes.Equal(payloads[0], payload) {
+		t.Fatalf("reassembled %d messages", len(payloads))
+	}
+
+	// Fragments from unknown peers are dropped.
+	for _, fragment := range testFragments(2, CommandUserMin, payload, 300) {
+		testFragmentSend(nil, publicKey, fragment)
+	}
+	if len(received()) != 1 {
+		t.Fatal("message from unknown peer dispatched")
+	}
+}
+
+func TestFragmentTimeout(t *testing.T) {
+	testConfig(t)
+	received := testFragmentReceiver(t, CommandUserMin)
+	_, publicKey, _ := Secp256k1NewPrivateKey()
+	peer := &PeerInfo{PublicKey: publicKey}
+
+	fragments := testFragments(3, CommandUserMin, bytes.Repeat([]byte{1}, 900), 300)
+	testFragmentSend(peer, publicKey, fragments[0])
+	testFragmentSend(peer, publicKey, fragments[1])
+
+	// The last fragment is dropped and arrives only after the timeout.
+	fragmentMutex.Lock()
+	for _, set := range fragmentSets {
+		set.created = set.created.Add(-fragmentTimeout - time.Second)
+	}
+	fragmentMutex.Unlock()
+
+	expired := StatsFragmentsExpired()
+	testFragmentSend(peer, publicKey, fragments[2])
+
+	if len(received()) != 0 {
+		t.Fatal("message dispatched after the timeout")
+	}
+	if StatsFragmentsExpired() != expired+1 {
+		t.Fatal("incomplete message not expired")
+	}
+
+	fragmentMutex.Lock()
+	bytesPending := fragmentBytes
+	fragmentMutex.Unlock()
+	if bytesPending != len(fragments[2])-fragmentHeaderSize {
+		t.Fatalf("%d bytes pending after expiry", bytesPending)
+	}
+}
@@ -0,0 +1,191 @@
+/*
+File Name:  Handshake.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Table of pending handshakes: Addresses that were sent an announcement (or are in the process of validation) but did not complete the handshake yet.
+The table is bounded in size and entries expire, so that spraying spoofed source addresses cannot exhaust memory with half-open handshakes.
+If the table is full, expired entries are removed first and then the oldest entry is evicted.
+
+If no response is received within the handshake timeout (config.HandshakeTimeout), the handshake failed and the endpoint is marked as failed.
+Failed endpoints are not contacted again until their backoff elapsed, which doubles with each consecutive failure.
+*/
+
+package core
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// pendingHandshake is a single handshake that was not yet completed
+type pendingHandshake struct {
+	address   *net.UDPAddr     // Remote address
+	publicKey *btcec.PublicKey // Expected public key of the remote peer. Nil if unknown.
+	created   time.Time        // When the handshake was started
+}
+
+// failedEndpoint is an endpoint that did not complete the handshake
+type failedEndpoint struct {
+	failures int       // Count of consecutive failures
+	last     time.Time // Time of the last failure
+}
+
+// handshakePendingLimit is the maximum count of pending handshakes and failed endpoints
+const handshakePendingLimit = 1000
+
+// defaultHandshakeTimeout is the default time in seconds after which a pending handshake fails
+const defaultHandshakeTimeout = 20
+
+// handshakeBackoffMax is the maximum backoff in seconds for failed endpoints
+const handshakeBackoffMax = 10 * 60
+
+var handshakesPending = make(map[string]*pendingHandshake)
+var endpointsFailed = make(map[string]*failedEndpoint)
+var handshakesMutex sync.Mutex
+
+func handshakeKey(address *net.UDPAddr) string {
+	return net.JoinHostPort(address.IP.String(), strconv.Itoa(address.Port))
+}
+
+// handshakeTimeout returns the time after which a pending handshake fails
+func handshakeTimeout() time.Duration {
+	return time.Duration(config.HandshakeTimeout) * time.Second
+}
+
+// handshakeAdd adds a pending handshake. An existing entry for the same address is replaced.
+func handshakeAdd(address *net.UDPAddr, publicKey *btcec.PublicKey) {
+	handshakesMutex.Lock()
+	defer handshakesMutex.Unlock()
+
+	key := handshakeKey(address)
+
+	if _, ok := handshakesPending[key]; !ok && len(handshakesPending) >= handshakePendingLimit {
+		handshakeExpire()
+
+		if len(handshakesPending) >= handshakePendingLimit {
+			handshakeEvictOldest()
+		}
+	}
+
+	handshakesPending[key] = &pendingHandshake{address: address, publicKey: publicKey, created: time.Now()}
+}
+
+// handshakeComplete removes the pending handshake for the address and returns it. Returns nil if none is pending or it expired.
+// Any failure of the endpoint is reset.
+func handshakeComplete(address *net.UDPAddr) (pending *pendingHandshake) {
+	handshakesMutex.Lock()
+	defer handshakesMutex.Unlock()
+
+	key := handshakeKey(address)
+	delete(endpointsFailed, key)
+
+	pending, ok := handshakesPending[key]
+	if !ok {
+		return nil
+	}
+	delete(handshakesPending, key)
+
+	if time.Since(pending.created) >= handshakeTimeout() {
+		return nil
+	}
+
+	return pending
+}
+
+// handshakeIsPending checks if a handshake with the address is pending and not expired. If the public key of the remote peer is known, it must match.
+func handshakeIsPending(address *net.UDPAddr, publicKey *btcec.PublicKey) bool {
+	handshakesMutex.Lock()
+	defer handshakesMutex.Unlock()
+
+	pending, ok := handshakesPending[handshakeKey(address)]
+	return ok && time.Since(pending.created) < handshakeTimeout() && (pending.publicKey == nil || pending.publicKey.IsEqual(publicKey))
+}
+
+// handshakeExpire removes all expired pending handshakes and marks their endpoints as failed. The caller must hold the mutex.
+func handshakeExpire() {
+	threshold := time.Now().Add(-handshakeTimeout())
+
+	for key, pending := range handshakesPending {
+		if pending.created.Before(threshold) {
+			delete(handshakesPending, key)
+			endpointFailed(key)
+		}
+	}
+}
+
+// endpointFailed records a failed handshake for the endpoint. The caller must hold the mutex.
+func endpointFailed(key string) {
+	failed, ok := endpointsFailed[key]
+	if !ok {
+		// Flood: forget all failures rather than grow unbounded.
+		if len(endpointsFailed) >= handshakePendingLimit {
+			endpointsFailed = make(map[string]*failedEndpoint)
+		}
+
+		failed = &failedEndpoint{}
+		endpointsFailed[key] = failed
+	}
+
+	failed.failures++
+	failed.last = time.Now()
+}
+
+// handshakeEvictOldest removes the oldest pending handshake. The caller must hold the mutex.
+func handshakeEvictOldest() {
+	var oldestKey string
+	var oldest *pendingHandshake
+
+	for key, pending := range handshakesPending {
+		if oldest == nil || pending.created.Before(oldest.created) {
+			oldestKey, oldest = key, pending
+		}
+	}
+
+	if oldest != nil {
+		delete(handshakesPending, oldestKey)
+	}
+}
+
+// handshakeExpireAll removes expired pending handshakes. It is called regularly to detect failed handshakes in time.
+func handshakeExpireAll() {
+	handshakesMutex.Lock()
+	defer handshakesMutex.Unlock()
+
+	handshakeExpire()
+}
+
+// endpointInBackoff checks if the endpoint failed recently and shall not be contacted yet
+func endpointInBackoff(address *net.UDPAddr) bool {
+	handshakesMutex.Lock()
+	defer handshakesMutex.Unlock()
+
+	failed, ok := endpointsFailed[handshakeKey(address)]
+	if !ok {
+		return false
+	}
+
+	backoff := handshakeTimeout()
+	for n := 1; n < failed.failures && backoff < handshakeBackoffMax*time.Second; n++ {
+		backoff *= 2
+	}
+	if backoff > handshakeBackoffMax*time.Second {
+		backoff = handshakeBackoffMax * time.Second
+	}
+
+	return time.Since(failed.last) < backoff
+}
+
+// PendingHandshakeCount returns the current count of pending handshakes
+func PendingHandshakeCount() (count int) {
+	handshakesMutex.Lock()
+	defer handshakesMutex.Unlock()
+
+	handshakeExpire()
+
+	return len(handshakesPending)
+}
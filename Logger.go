@@ -0,0 +1,46 @@
+/*
+File Name:  Logger.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package core
+
+import "log"
+
+// Logger is the interface for all log output of the core library. Use SetLogger to route it to a custom logger.
+type Logger interface {
+	Debugf(format string, v ...interface{}) // Verbose output for debugging, for example each incoming announcement
+	Infof(format string, v ...interface{})  // Regular events, for example listening on a new address
+	Warnf(format string, v ...interface{})  // Unexpected conditions that are handled, for example an invalid config value replaced by the default
+	Errorf(format string, v ...interface{}) // Errors, for example failing to listen on an address
+}
+
+// logger is the current logger
+var logger Logger = logStd{}
+
+// SetLogger sets the logger for all log output of the core library. It must be called before Init. Nil restores the default logger.
+// The default logger writes to the standard log package (which is redirected to config.LogFile) and discards debug messages.
+func SetLogger(custom Logger) {
+	if custom == nil {
+		custom = logStd{}
+	}
+	logger = custom
+}
+
+// logStd is the default logger based on the standard log package
+type logStd struct{}
+
+func (logStd) Debugf(format string, v ...interface{}) {}
+
+func (logStd) Infof(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+func (logStd) Warnf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+func (logStd) Errorf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
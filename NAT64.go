@@ -0,0 +1,96 @@
+/*
+File Name:  NAT64.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+On IPv6-only networks with NAT64, IPv4 addresses are reachable via IPv6 addresses synthesized from the NAT64 prefix.
+The prefix is detected by resolving the well-known name "ipv4only.arpa" (RFC 7050), or set in the config. Only /96 prefixes are supported, which are the most common (including the well-known prefix 64:ff9b::/96).
+Detection only runs if there is no IPv4 network at startup.
+*/
+
+package core
+
+import (
+	"net"
+	"sync"
+)
+
+// nat64WellKnownIPs are the IPv4 addresses of ipv4only.arpa (RFC 7050)
+var nat64WellKnownIPs = []net.IP{net.IPv4(192, 0, 0, 170), net.IPv4(192, 0, 0, 171)}
+
+var nat64Prefix *net.IPNet
+var nat64Mutex sync.RWMutex
+
+// initNAT64 sets the NAT64 prefix from the config, or starts the detection if there is no IPv4 network.
+func initNAT64() {
+	if config.NAT64Prefix != "" {
+		_, prefix, err := net.ParseCIDR(config.NAT64Prefix)
+		if err != nil || IsIPv4(prefix.IP) {
+			logger.Errorf("initNAT64 Error invalid NAT64 prefix '%s'\n", config.NAT64Prefix)
+			return
+		} else if ones, _ := prefix.Mask.Size(); ones != 96 {
+			logger.Errorf("initNAT64 Error unsupported NAT64 prefix '%s', only /96 is supported\n", config.NAT64Prefix)
+			return
+		}
+
+		nat64Mutex.Lock()
+		nat64Prefix = prefix
+		nat64Mutex.Unlock()
+		return
+	}
+
+	if len(GetNetworks(4)) == 0 && len(GetNetworks(6)) > 0 {
+		go nat64Detect()
+	}
+}
+
+// nat64Detect detects the NAT64 prefix by resolving ipv4only.arpa. On IPv6-only networks with DNS64 it resolves to IPv6 addresses containing the well-known IPv4 addresses.
+func nat64Detect() {
+	IPs, err := net.LookupIP("ipv4only.arpa")
+	if err != nil {
+		return
+	}
+
+	for _, ip := range IPs {
+		if IsIPv4(ip) {
+			continue
+		}
+
+		for _, wellKnown := range nat64WellKnownIPs {
+			if ip.To16()[12:16].Equal(wellKnown.To4()) {
+				prefix := &net.IPNet{IP: make(net.IP, 16), Mask: net.CIDRMask(96, 128)}
+				copy(prefix.IP, ip.To16()[0:12])
+
+				nat64Mutex.Lock()
+				nat64Prefix = prefix
+				nat64Mutex.Unlock()
+
+				logger.Infof("nat64Detect detected NAT64 prefix %s\n", prefix.String())
+				return
+			}
+		}
+	}
+}
+
+// NAT64Prefix returns the NAT64 prefix, either detected or from the config. Nil if none.
+func NAT64Prefix() *net.IPNet {
+	nat64Mutex.RLock()
+	defer nat64Mutex.RUnlock()
+
+	return nat64Prefix
+}
+
+// nat64Address returns the address to use for reaching the remote address. If the remote address is IPv4, there is no IPv4 network, and a NAT64 prefix is known, the synthesized IPv6 address is returned.
+// Otherwise the remote address is returned unchanged.
+func nat64Address(remote *net.UDPAddr) *net.UDPAddr {
+	prefix := NAT64Prefix()
+	if prefix == nil || !IsIPv4(remote.IP) || len(GetNetworks(4)) > 0 {
+		return remote
+	}
+
+	ip := make(net.IP, 16)
+	copy(ip[0:12], prefix.IP.To16()[0:12])
+	copy(ip[12:16], remote.IP.To4())
+
+	return &net.UDPAddr{IP: ip, Port: remote.Port}
+}
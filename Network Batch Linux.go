@@ -0,0 +1,87 @@
+//go:build linux
+// +build linux
+
+/*
+File Name:  Network Batch Linux.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Batch receiving on Linux: Multiple incoming packets are read with a single system call (recvmmsg), which reduces the overhead per packet on busy nodes.
+Each packet is read into its own buffer from the pool, which is passed to the workers as with single reads. Datagrams larger than the buffer are truncated by the kernel and dropped.
+*/
+
+package core
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// listenBatchSize is the maximum count of packets read per system call
+const listenBatchSize = 32
+
+// listenBatch reads incoming packets in batches until the network is terminated. It returns false if batch reading is not available.
+func (network *Network) listenBatch() (supported bool) {
+	// ipv4.Message and ipv6.Message are the same type.
+	var readBatch func(messages []ipv4.Message, flags int) (int, error)
+	if IsIPv4(network.address.IP) {
+		readBatch = ipv4.NewPacketConn(network.socket).ReadBatch
+	} else {
+		readBatch = ipv6.NewPacketConn(network.socket).ReadBatch
+	}
+
+	messages := make([]ipv4.Message, listenBatchSize)
+	for n := range messages {
+		messages[n].Buffers = [][]byte{packetBufferGet()}
+	}
+
+	// Unused buffers are returned to the pool when the network is terminated.
+	defer func() {
+		for n := range messages {
+			packetBufferPut(messages[n].Buffers[0])
+		}
+	}()
+
+	for !network.IsTerminated() {
+		count, err := readBatch(messages, 0)
+
+		if err != nil {
+			// Exit on closed socket. Error will be "use of closed network connection".
+			if network.IsTerminated() {
+				return true
+			}
+
+			logger.Debugf("listenBatch Error receiving UDP messages: %v\n", err) // Only log for debug purposes.
+			time.Sleep(time.Millisecond * 50)                                    // In case of endless errors, prevent ddos of CPU.
+			continue
+		}
+
+		for n := 0; n < count; n++ {
+			// A truncated datagram cannot be a valid packet. The buffer is reused for the next read.
+			if messages[n].Flags&syscall.MSG_TRUNC != 0 {
+				network.statsIn(messages[n].N)
+				network.statsDropped()
+				continue
+			}
+
+			buffer := messages[n].Buffers[0]
+			sender, ok := messages[n].Addr.(*net.UDPAddr)
+
+			// The buffer is passed on, therefore a new one is needed for the next read.
+			messages[n].Buffers[0] = packetBufferGet()
+
+			if !ok {
+				packetBufferPut(buffer)
+				continue
+			}
+
+			network.receive(buffer, messages[n].N, sender)
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,100 @@
+//go:build linux
+// +build linux
+
+/*
+File Name:  Network Batch Linux_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package core
+
+import (
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// benchmarkListenWindow is the maximum count of packets in flight, so that the socket receive buffer does not overflow
+const benchmarkListenWindow = 64
+
+// benchmarkListen measures the packets per second received over loopback by the read loop
+func benchmarkListen(b *testing.B, listen func(network *Network)) {
+	socket, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Skipf("loopback not available: %v", err)
+	}
+	network := &Network{socket: socket, address: socket.LocalAddr().(*net.UDPAddr), terminateSignal: make(chan interface{})}
+
+	client, err := net.DialUDP("udp4", nil, network.address)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+
+	previous := rawPacketsIncoming
+	rawPacketsIncoming = make(chan networkWire, 1000)
+	defer func() { rawPacketsIncoming = previous }()
+
+	var received uint64
+	drained := make(chan struct{})
+	go func(incoming chan networkWire) {
+		for packet := range incoming {
+			packetBufferPut(packet.raw)
+			atomic.AddUint64(&received, 1)
+		}
+		close(drained)
+	}(rawPacketsIncoming)
+
+	stopped := make(chan struct{})
+	go func() {
+		listen(network)
+		close(stopped)
+	}()
+
+	packet := make([]byte, 512)
+	for n := range packet {
+		packet[n] = 0x01
+	}
+
+	b.SetBytes(int64(len(packet)))
+	b.ResetTimer()
+	start := time.Now()
+
+	for sent := 0; sent < b.N; {
+		if uint64(sent)-atomic.LoadUint64(&received) >= benchmarkListenWindow {
+			runtime.Gosched()
+			continue
+		}
+		if _, err := client.Write(packet); err != nil {
+			b.Fatal(err)
+		}
+		sent++
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadUint64(&received) < uint64(b.N) {
+		if time.Now().After(deadline) {
+			b.Fatalf("received %d of %d packets", atomic.LoadUint64(&received), b.N)
+		}
+		runtime.Gosched()
+	}
+
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "packets/s")
+
+	network.Terminate()
+	<-stopped
+	close(rawPacketsIncoming)
+	<-drained
+}
+
+func BenchmarkListenSingle(b *testing.B) {
+	benchmarkListen(b, func(network *Network) { network.listenSingle() })
+}
+
+func BenchmarkListenBatch(b *testing.B) {
+	benchmarkListen(b, func(network *Network) { network.listenBatch() })
+}
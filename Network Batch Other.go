@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+/*
+File Name:  Network Batch Other.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package core
+
+// listenBatch is not available on this OS. Packets are read one by one.
+func (network *Network) listenBatch() (supported bool) {
+	return false
+}
@@ -0,0 +1,101 @@
+//go:build linux
+// +build linux
+
+/*
+File Name:  Network Change Linux.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Notifications about network changes on Linux via netlink. They allow to react on changed links and IP addresses immediately instead of waiting for the next poll.
+*/
+
+package core
+
+import (
+	"syscall"
+)
+
+// Netlink multicast groups, see rtnetlink.h. They are not defined in the syscall package.
+const (
+	netlinkGroupLink     = 0x1   // RTMGRP_LINK
+	netlinkGroupIPv4Addr = 0x10  // RTMGRP_IPV4_IFADDR
+	netlinkGroupIPv6Addr = 0x100 // RTMGRP_IPV6_IFADDR
+)
+
+// networkChangeNotifications subscribes to netlink notifications about changed links and IP addresses. The returned channel receives a signal on any change and is closed if the subscription fails later.
+// Returns nil if the subscription is not available; the network change monitor then only polls. The subscription ends when the stop channel is closed.
+func networkChangeNotifications(stop <-chan struct{}) (notify <-chan struct{}) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		logger.Warnf("networkChangeNotifications error opening netlink socket: %s\n", err.Error())
+		return nil
+	}
+
+	address := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: netlinkGroupLink | netlinkGroupIPv4Addr | netlinkGroupIPv6Addr}
+	if err := syscall.Bind(fd, address); err != nil {
+		logger.Warnf("networkChangeNotifications error subscribing to netlink notifications: %s\n", err.Error())
+		syscall.Close(fd)
+		return nil
+	}
+
+	// The receive timeout allows to check the stop channel regularly.
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &syscall.Timeval{Sec: 1}); err != nil {
+		logger.Warnf("networkChangeNotifications error setting netlink receive timeout: %s\n", err.Error())
+		syscall.Close(fd)
+		return nil
+	}
+
+	signal := make(chan struct{}, 1)
+
+	go func() {
+		defer syscall.Close(fd)
+		defer close(signal)
+
+		buffer := make([]byte, 16*1024)
+
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			length, _, err := syscall.Recvfrom(fd, buffer, 0)
+			if err == syscall.EINTR || err == syscall.EAGAIN {
+				continue
+			} else if err != nil && err != syscall.ENOBUFS { // ENOBUFS = notifications were lost, which is still a change
+				logger.Warnf("networkChangeNotifications error receiving netlink notification: %s\n", err.Error())
+				return
+			}
+
+			if err == nil && !netlinkIsAddressOrLinkChange(buffer[:length]) {
+				continue
+			}
+
+			// Multiple notifications are coalesced into a single signal.
+			select {
+			case signal <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return signal
+}
+
+// netlinkIsAddressOrLinkChange checks if the netlink messages contain a change of a link or IP address
+func netlinkIsAddressOrLinkChange(data []byte) bool {
+	messages, err := syscall.ParseNetlinkMessage(data)
+	if err != nil {
+		return true // unknown, check anyway
+	}
+
+	for _, message := range messages {
+		switch message.Header.Type {
+		case syscall.RTM_NEWLINK, syscall.RTM_DELLINK, syscall.RTM_NEWADDR, syscall.RTM_DELADDR:
+			return true
+		}
+	}
+
+	return false
+}
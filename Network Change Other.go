@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+/*
+File Name:  Network Change Other.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package core
+
+// networkChangeNotifications is not available on this OS. The network change monitor only polls.
+func networkChangeNotifications(stop <-chan struct{}) (notify <-chan struct{}) {
+	return nil
+}
@@ -0,0 +1,54 @@
+/*
+File Name:  Network Dedup.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+IPv6 Multicast and IPv4 Broadcast packets may be received multiple times: When listening on multiple IPs of the same adapter, or when listening on a wildcard address and an explicit IP at the same time.
+Each sent packet is unique (random nonce and signature), so the identical raw packet received again within a short time window is a duplicate and is dropped.
+*/
+
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// packetSeenTTL is the time in seconds a received packet is remembered
+const packetSeenTTL = 3
+
+// packetSeenLimit is the maximum count of remembered packets
+const packetSeenLimit = 1000
+
+var packetsSeen = make(map[string]time.Time)
+var packetsSeenMutex sync.Mutex
+
+// packetSeenBefore checks if the raw packet was received before and remembers it otherwise.
+func packetSeenBefore(raw []byte) bool {
+	// The encrypted signature is unique per packet and serves as key.
+	key := string(raw[len(raw)-signatureSize:])
+	now := time.Now()
+
+	packetsSeenMutex.Lock()
+	defer packetsSeenMutex.Unlock()
+
+	if seen, ok := packetsSeen[key]; ok && now.Sub(seen) < packetSeenTTL*time.Second {
+		return true
+	}
+
+	if len(packetsSeen) >= packetSeenLimit {
+		for keyR, seen := range packetsSeen {
+			if now.Sub(seen) >= packetSeenTTL*time.Second {
+				delete(packetsSeen, keyR)
+			}
+		}
+
+		// Flood: forget everything rather than grow unbounded.
+		if len(packetsSeen) >= packetSeenLimit {
+			packetsSeen = make(map[string]time.Time)
+		}
+	}
+
+	packetsSeen[key] = now
+	return false
+}
@@ -7,9 +7,12 @@ Author:     Peter Kleissner
 package core
 
 import (
-	"log"
+	"context"
+	"errors"
 	"net"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -29,10 +32,8 @@ func FindInterfaceByIP(ip net.IP) (iface *net.Interface, ipnet *net.IPNet) {
 
 		// iterate through all IPs of the interfaces
 		for _, address := range addresses {
-			addressIP := address.(*net.IPNet).IP
-
-			if addressIP.Equal(ip) {
-				return &ifaceSingle, address.(*net.IPNet)
+			if ipnet := addressToIPNet(address); ipnet != nil && ipnet.IP.Equal(ip) {
+				return &ifaceSingle, ipnet
 			}
 		}
 	}
@@ -40,6 +41,61 @@ func FindInterfaceByIP(ip net.IP) (iface *net.Interface, ipnet *net.IPNet) {
 	return nil, nil
 }
 
+// findInterfaceByZone finds the interface specified by the IPv6 zone, which is either the interface name or its index. The IP must be available at the interface.
+func findInterfaceByZone(zone string, ip net.IP) (iface *net.Interface, ipnet *net.IPNet) {
+	iface, err := net.InterfaceByName(zone)
+	if err != nil {
+		index, err := strconv.Atoi(zone)
+		if err != nil {
+			return nil, nil
+		}
+		if iface, err = net.InterfaceByIndex(index); err != nil {
+			return nil, nil
+		}
+	}
+
+	addresses, err := iface.Addrs()
+	if err != nil {
+		return nil, nil
+	}
+
+	for _, address := range addresses {
+		if ipnet := addressToIPNet(address); ipnet != nil && ipnet.IP.Equal(ip) {
+			return iface, ipnet
+		}
+	}
+
+	return nil, nil
+}
+
+// FindInterfaceByName finds an interface by its name (for example "eth0") and returns its addresses.
+func FindInterfaceByName(name string) (iface *net.Interface, addresses []net.Addr, err error) {
+	if iface, err = net.InterfaceByName(name); err != nil {
+		return nil, nil, err
+	}
+
+	if addresses, err = iface.Addrs(); err != nil {
+		return nil, nil, err
+	}
+
+	return iface, addresses, nil
+}
+
+// isInterfaceBound checks if the interface may be used for listening according to config.BindInterfaces. If the list is empty, all interfaces are used.
+func isInterfaceBound(name string) bool {
+	if len(config.BindInterfaces) == 0 {
+		return true
+	}
+
+	for _, bind := range config.BindInterfaces {
+		if bind == name {
+			return true
+		}
+	}
+
+	return false
+}
+
 // NetworkListIPs returns a list of all IPs
 func NetworkListIPs() (IPs []net.IP, err error) {
 
@@ -57,14 +113,31 @@ func NetworkListIPs() (IPs []net.IP, err error) {
 
 		// iterate through all IPs of the interfaces
 		for _, address := range addresses {
-			addressIP := address.(*net.IPNet).IP
-			IPs = append(IPs, addressIP)
+			if ipnet := addressToIPNet(address); ipnet != nil {
+				IPs = append(IPs, ipnet.IP)
+			}
 		}
 	}
 
 	return IPs, nil
 }
 
+// addressToIPNet returns the IP network of an interface address. Some platforms return *net.IPAddr instead of *net.IPNet; the mask is then the full length of the IP.
+// Returns nil for other address types.
+func addressToIPNet(address net.Addr) *net.IPNet {
+	switch v := address.(type) {
+	case *net.IPNet:
+		return v
+	case *net.IPAddr:
+		if ip4 := v.IP.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(8*net.IPv4len, 8*net.IPv4len)}
+		}
+		return &net.IPNet{IP: v.IP, Mask: net.CIDRMask(8*net.IPv6len, 8*net.IPv6len)}
+	}
+
+	return nil
+}
+
 // IsIPv4 checks if an IP address is IPv4
 func IsIPv4(IP net.IP) bool {
 	return IP.To4() != nil
@@ -82,6 +155,11 @@ func IsNetworkErrorFatal(err error) bool {
 		return false
 	}
 
+	// The remote network or host is unreachable, or the local IP was removed (for example the adapter was disabled).
+	if errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.EADDRNOTAVAIL) {
+		return true
+	}
+
 	// Windows: A common error when the network adapter is disabled is "wsasendto: The requested address is not valid in its context".
 	if strings.Contains(err.Error(), "requested address is not valid in its context") {
 		return true
@@ -90,161 +168,187 @@ func IsNetworkErrorFatal(err error) bool {
 	return false
 }
 
-// changeMonitorFrequency is the frequency in seconds to check for a network change
-const changeMonitorFrequency = 10
+// defaultChangeMonitorFrequency is the default frequency in seconds to check for a network change, see config.ChangeMonitorFrequency
+const defaultChangeMonitorFrequency = 10
+
+// changeMonitorFrequencyNotify is the minimum frequency in seconds to check for a network change if the OS notifies about changes. Polling is kept in case a notification is missed.
+const changeMonitorFrequencyNotify = 60
+
+// changeMonitorSettle is the time to wait after a change notification before checking, as a single change typically causes multiple notifications
+const changeMonitorSettle = 250 * time.Millisecond
+
+// changeMonitorBackoffMax is the maximum delay in seconds between checks if enumerating the network adapters fails repeatedly (for example during OS suspend).
+const changeMonitorBackoffMax = 5 * 60
 
 // networkChangeMonitor() monitors for network changes to act accordingly
-func networkChangeMonitor() {
-	// If manual IPs are entered, no need for monitoring for any network changes.
-	if len(config.Listen) > 0 {
-		return
+func networkChangeMonitor(ctx context.Context) {
+	// If the OS notifies about changes, polling is only a fallback.
+	notify := networkChangeNotifications(ctx.Done())
+
+	// The frequency is read on every check, as it may change via Reconfigure.
+	frequency := func() time.Duration {
+		if notify != nil && config.ChangeMonitorFrequency < changeMonitorFrequencyNotify {
+			return time.Second * changeMonitorFrequencyNotify
+		}
+		return time.Second * time.Duration(config.ChangeMonitorFrequency)
 	}
 
+	delay := frequency()
+	failures := 0
+
 	for {
-		time.Sleep(time.Second * changeMonitorFrequency)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		case _, ok := <-notify:
+			if !ok {
+				// Notifications are no longer available.
+				notify = nil
+				delay = frequency()
+				continue
+			}
 
+			time.Sleep(changeMonitorSettle)
+			select {
+			case <-notify:
+			default:
+			}
+		}
+
+		// If manual IPs are entered, no need for monitoring for any network changes. The list may change at runtime via Reconfigure.
+		if len(config.Listen) > 0 {
+			delay = frequency()
+			continue
+		}
+
+		// On consecutive failures the delay is doubled up to the maximum. Only the first failure and the recovery are logged.
 		interfaceList, err := net.Interfaces()
 		if err != nil {
-			log.Printf("networkChangeMonitor enumerating network adapters failed: %s\n", err.Error())
+			if failures == 0 {
+				logger.Errorf("networkChangeMonitor enumerating network adapters failed: %s\n", err.Error())
+			}
+			failures++
+
+			if delay *= 2; delay > time.Second*changeMonitorBackoffMax {
+				delay = time.Second * changeMonitorBackoffMax
+			}
 			continue
+		} else if failures > 0 {
+			logger.Infof("networkChangeMonitor enumerating network adapters recovered after %d failures\n", failures)
+			failures = 0
 		}
+		delay = frequency()
 
-		ifacesNew := make(map[string][]net.Addr)
+		networkChangeMutex.Lock()
+		if networksShutdown {
+			networkChangeMutex.Unlock()
+			return
+		}
+		networkChangeDetect(interfaceList)
+		networkChangeMutex.Unlock()
+	}
+}
 
-		for _, iface := range interfaceList {
-			addressesNew, err := iface.Addrs()
-			if err != nil {
-				log.Printf("initNetwork error enumerating IPs for network adapter '%s': %s\n", iface.Name, err.Error())
-				continue
-			}
-			ifacesNew[iface.Name] = addressesNew
+// networkChangeDetect compares the network adapters with the known ones and starts or terminates networks for added or removed interfaces and IPs.
+// The caller must hold networkChangeMutex.
+func networkChangeDetect(interfaceList []net.Interface) {
+	localIPsRefresh(interfaceList)
 
-			// was the interface added?
-			addressesExist, ok := ifacesExist[iface.Name]
-			if !ok {
-				networkChangeInterfaceNew(iface, addressesNew)
-			} else {
-				// new IPs added for this interface?
-				for _, addr := range addressesNew {
-					exists := false
-					for _, exist := range addressesExist {
-						if exist.String() == addr.String() {
-							exists = true
-							break
-						}
-					}
+	ifacesNew := make(map[string][]net.Addr)
 
-					if !exists {
-						networkChangeIPNew(iface, addr)
+	for _, iface := range interfaceList {
+		addressesNew, err := iface.Addrs()
+		if err != nil {
+			logger.Errorf("initNetwork error enumerating IPs for network adapter '%s': %s\n", iface.Name, err.Error())
+			continue
+		}
+		ifacesNew[iface.Name] = addressesNew
+
+		// was the interface added?
+		addressesExist, ok := ifacesExist[iface.Name]
+		if !ok {
+			networkChangeInterfaceNew(iface, addressesNew)
+		} else {
+			// new IPs added for this interface?
+			for _, addr := range addressesNew {
+				exists := false
+				for _, exist := range addressesExist {
+					if exist.String() == addr.String() {
+						exists = true
+						break
 					}
 				}
 
-				// were IPs removed from this interface
-				for _, exist := range addressesExist {
-					removed := true
-					for _, addr := range addressesNew {
-						if exist.String() == addr.String() {
-							removed = false
-							break
-						}
-					}
+				if !exists {
+					networkChangeIPNew(iface, addr)
+				}
+			}
 
-					if removed {
-						networkChangeIPRemove(iface, exist)
+			// were IPs removed from this interface
+			for _, exist := range addressesExist {
+				removed := true
+				for _, addr := range addressesNew {
+					if exist.String() == addr.String() {
+						removed = false
+						break
 					}
 				}
-			}
-		}
 
-		// was an existing interface removed?
-		for ifaceExist, addressesExist := range ifacesExist {
-			if _, ok := ifacesNew[ifaceExist]; !ok {
-				networkChangeInterfaceRemove(ifaceExist, addressesExist)
+				if removed {
+					networkChangeIPRemove(iface, exist)
+				}
 			}
 		}
+	}
 
-		ifacesExist = ifacesNew
+	// was an existing interface removed?
+	for ifaceExist, addressesExist := range ifacesExist {
+		if _, ok := ifacesNew[ifaceExist]; !ok {
+			networkChangeInterfaceRemove(ifaceExist, addressesExist)
+		}
 	}
+
+	ifacesExist = ifacesNew
 }
 
 // networkChangeInterfaceNew is called when a new interface is detected
 func networkChangeInterfaceNew(iface net.Interface, addresses []net.Addr) {
-	log.Printf("networkChangeInterfaceNew new interface '%s' (%d IPs)\n", iface.Name, len(addresses))
+	logger.Infof("networkChangeInterfaceNew new interface '%s' (%d IPs)\n", iface.Name, len(addresses))
 
 	networkStart(iface, addresses)
+	captiveCheckAfterChange()
+	go stunRefresh()
 }
 
 // networkChangeInterfaceRemove is called when an existing interface is removed
 func networkChangeInterfaceRemove(iface string, addresses []net.Addr) {
-	networksMutex.RLock()
-	defer networksMutex.RUnlock()
-
-	log.Printf("networkChangeInterfaceRemove removing interface '%s' (%d IPs)\n", iface, len(addresses))
-
-	for n, network := range networks6 {
-		if network.iface != nil && network.iface.Name == iface {
-			network.Terminate()
-
-			// remove from list
-			networksNew := networks6[:n]
-			if n < len(networks6)-1 {
-				networksNew = append(networksNew, networks6[n+1:]...)
-			}
-			networks6 = networksNew
-		}
-	}
+	logger.Infof("networkChangeInterfaceRemove removing interface '%s' (%d IPs)\n", iface, len(addresses))
 
-	for n, network := range networks4 {
+	// Terminate outside of networksMutex, as it waits for the listen routines to exit.
+	for _, network := range networksSnapshot() {
 		if network.iface != nil && network.iface.Name == iface {
-			network.Terminate()
-
-			// remove from list
-			networksNew := networks4[:n]
-			if n < len(networks4)-1 {
-				networksNew = append(networksNew, networks4[n+1:]...)
-			}
-			networks4 = networksNew
+			networksRemove(network)
 		}
 	}
 }
 
 // networkChangeIPNew is called when an existing interface lists a new IP
 func networkChangeIPNew(iface net.Interface, address net.Addr) {
-	log.Printf("networkChangeIPNew new interface '%s' IP %s\n", iface.Name, address.String())
+	logger.Infof("networkChangeIPNew new interface '%s' IP %s\n", iface.Name, address.String())
 
 	networkStart(iface, []net.Addr{address})
+	captiveCheckAfterChange()
+	go stunRefresh()
 }
 
 // networkChangeIPRemove is called when an existing interface removes an IP
 func networkChangeIPRemove(iface net.Interface, address net.Addr) {
-	networksMutex.RLock()
-	defer networksMutex.RUnlock()
-
-	log.Printf("networkChangeIPRemove remove interface '%s' IP %s\n", iface.Name, address.String())
-
-	for n, network := range networks6 {
-		if network.address.IP.Equal(address.(*net.IPNet).IP) {
-			network.Terminate()
+	logger.Infof("networkChangeIPRemove remove interface '%s' IP %s\n", iface.Name, address.String())
 
-			// remove from list
-			networksNew := networks6[:n]
-			if n < len(networks6)-1 {
-				networksNew = append(networksNew, networks6[n+1:]...)
-			}
-			networks6 = networksNew
-		}
-	}
-
-	for n, network := range networks4 {
-		if network.address.IP.Equal(address.(*net.IPNet).IP) {
-			network.Terminate()
-
-			// remove from list
-			networksNew := networks4[:n]
-			if n < len(networks4)-1 {
-				networksNew = append(networksNew, networks4[n+1:]...)
-			}
-			networks4 = networksNew
+	for _, network := range networksSnapshot() {
+		if ipnet := addressToIPNet(address); ipnet != nil && network.address.IP.Equal(ipnet.IP) {
+			networksRemove(network)
 		}
 	}
 }
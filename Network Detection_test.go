@@ -0,0 +1,87 @@
+/*
+File Name:  Network Detection_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestAddressToIPNet(t *testing.T) {
+	_, ipnet, _ := net.ParseCIDR("192.168.1.0/24")
+	ipnet.IP = net.ParseIP("192.168.1.10")
+
+	tests := []struct {
+		address net.Addr
+		ip      net.IP
+		ones    int
+	}{
+		{ipnet, net.ParseIP("192.168.1.10"), 24},
+		{&net.IPAddr{IP: net.ParseIP("10.0.0.1")}, net.ParseIP("10.0.0.1"), 32},
+		{&net.IPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0"}, net.ParseIP("fe80::1"), 128},
+	}
+
+	for _, test := range tests {
+		result := addressToIPNet(test.address)
+		if result == nil {
+			t.Fatalf("%s: no IP extracted", test.address.String())
+		}
+		if ones, _ := result.Mask.Size(); !result.IP.Equal(test.ip) || ones != test.ones {
+			t.Errorf("%s: extracted %s", test.address.String(), result.String())
+		}
+	}
+
+	// Other address types are skipped.
+	for _, address := range []net.Addr{&net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 112}, &net.UnixAddr{Name: "/tmp/socket", Net: "unix"}, nil} {
+		if result := addressToIPNet(address); result != nil {
+			t.Errorf("%v: unexpected IP %s", address, result.String())
+		}
+	}
+}
+
+func TestNetworkListIPs(t *testing.T) {
+	IPs, err := NetworkListIPs()
+	if err != nil {
+		t.Skipf("network adapters not available: %v", err)
+	}
+
+	for _, ip := range IPs {
+		if iface, ipnet := FindInterfaceByIP(ip); iface == nil || !ipnet.IP.Equal(ip) {
+			t.Errorf("adapter of IP %s not found", ip.String())
+		}
+	}
+}
+
+func TestIsNetworkErrorFatal(t *testing.T) {
+	// wrap returns the errno as returned by UDPConn.WriteTo
+	wrap := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("sendto", errno)}
+	}
+
+	for _, errno := range []syscall.Errno{syscall.ENETUNREACH, syscall.EHOSTUNREACH, syscall.EADDRNOTAVAIL} {
+		if !IsNetworkErrorFatal(wrap(errno)) {
+			t.Fatalf("error '%v' not fatal", wrap(errno))
+		}
+		if err := fmt.Errorf("send: %w", wrap(errno)); !IsNetworkErrorFatal(err) {
+			t.Fatalf("wrapped error '%v' not fatal", err)
+		}
+	}
+
+	if !IsNetworkErrorFatal(errors.New("wsasendto: The requested address is not valid in its context.")) {
+		t.Fatal("Windows error for a disabled adapter not fatal")
+	}
+
+	for _, err := range []error{nil, wrap(syscall.ECONNREFUSED), wrap(syscall.EAGAIN), wrap(syscall.ENOBUFS)} {
+		if IsNetworkErrorFatal(err) {
+			t.Fatalf("error '%v' is fatal", err)
+		}
+	}
+}
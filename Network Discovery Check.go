@@ -0,0 +1,165 @@
+/*
+File Name:  Network Discovery Check.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Self-test of local peer discovery. A discovery packet is sent via IPv6 Multicast and IPv4 Broadcast on each network.
+Since loopback is enabled, the packet is expected to be received back by our own Multicast/Broadcast listeners, where it is detected as self-packet.
+If it is not received back, local discovery most likely does not work on this host.
+*/
+
+package core
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Status of local discovery on a network
+const (
+	DiscoveryWorking     = 0 // The discovery packet was received back.
+	DiscoveryNotJoined   = 1 // IPv6: The Multicast group is not joined. IPv4: The Broadcast socket is not open.
+	DiscoverySendFailed  = 2 // Sending the discovery packet failed. Multicast/Broadcast is blocked by the OS or not supported by the interface.
+	DiscoveryNotReceived = 3 // The discovery packet was sent but not received back. A firewall is suspected.
+)
+
+// discoveryCheckWait is the time to wait for the discovery packets to be received back
+const discoveryCheckWait = time.Second
+
+// DiscoveryNetworkStatus is the result of the local discovery self-test for a single network
+type DiscoveryNetworkStatus struct {
+	Adapter string // Network adapter name
+	Address string // Listening address
+	IPv6    bool   // True for IPv6 Multicast, false for IPv4 Broadcast
+	Status  int    // See Discovery constants
+	Message string // Human readable explanation of the status
+}
+
+// DiscoveryStatus is the result of the local discovery self-test
+type DiscoveryStatus struct {
+	Networks         []DiscoveryNetworkStatus // Status per network
+	MulticastWorking bool                     // If IPv6 Multicast works on at least one network
+	BroadcastWorking bool                     // If IPv4 Broadcast works on at least one network
+}
+
+var (
+	discoveryCheckRun     sync.Mutex     // Only one self-test at a time
+	discoveryCheckSenders []*net.UDPAddr // Senders of self-packets received during the self-test. Nil if no self-test is active.
+	discoveryCheckMutex   sync.Mutex     // Mutex for discoveryCheckSenders
+)
+
+// discoveryCheckReceived is called by the Multicast and Broadcast listeners when a self-packet is received
+func discoveryCheckReceived(sender *net.UDPAddr) {
+	discoveryCheckMutex.Lock()
+	defer discoveryCheckMutex.Unlock()
+
+	if discoveryCheckSenders != nil {
+		discoveryCheckSenders = append(discoveryCheckSenders, sender)
+	}
+}
+
+// CheckLocalDiscovery tests if IPv6 Multicast and IPv4 Broadcast work on this host. It sends a discovery packet on each network and reports whether it was received back.
+// It blocks for about one second. Note that the discovery packets are regular announcements and are also received by other peers in the local network.
+func CheckLocalDiscovery() (status DiscoveryStatus) {
+	discoveryCheckRun.Lock()
+	defer discoveryCheckRun.Unlock()
+
+	discoveryCheckMutex.Lock()
+	discoveryCheckSenders = []*net.UDPAddr{}
+	discoveryCheckMutex.Unlock()
+
+	networks := networksSnapshot()
+	sendErrors := make([]error, len(networks))
+
+	for n, network := range networks {
+		sendErrors[n] = network.discoveryCheckSend()
+	}
+
+	time.Sleep(discoveryCheckWait)
+
+	discoveryCheckMutex.Lock()
+	senders := discoveryCheckSenders
+	discoveryCheckSenders = nil
+	discoveryCheckMutex.Unlock()
+
+	for n, network := range networks {
+		networkS := DiscoveryNetworkStatus{Adapter: network.GetAdapterName(), Address: network.address.String(), IPv6: !IsIPv4(network.address.IP)}
+
+		switch {
+		case sendErrors[n] == errDiscoveryNotJoined && networkS.IPv6:
+			networkS.Status = DiscoveryNotJoined
+			networkS.Message = "IPv6 Multicast group not joined. Multicast is blocked or not supported on this interface."
+
+		case sendErrors[n] == errDiscoveryNotJoined:
+			networkS.Status = DiscoveryNotJoined
+			networkS.Message = "IPv4 Broadcast socket not open. Broadcast is not available on this interface."
+
+		case sendErrors[n] != nil:
+			networkS.Status = DiscoverySendFailed
+			networkS.Message = "Sending failed: " + sendErrors[n].Error() + ". Multicast/Broadcast is blocked by the OS or not supported on this interface."
+
+		case !network.discoveryCheckMatch(senders):
+			networkS.Status = DiscoveryNotReceived
+			networkS.Message = "Discovery packet was sent but not received back. A firewall is suspected to block incoming Multicast/Broadcast packets."
+
+		default:
+			networkS.Status = DiscoveryWorking
+			networkS.Message = "Working"
+			if networkS.IPv6 {
+				status.MulticastWorking = true
+			} else {
+				status.BroadcastWorking = true
+			}
+		}
+
+		status.Networks = append(status.Networks, networkS)
+	}
+
+	return status
+}
+
+// errDiscoveryNotJoined is returned if the network cannot send Multicast/Broadcast packets
+var errDiscoveryNotJoined = errors.New("multicast group not joined or broadcast socket not open")
+
+// discoveryCheckSend sends a discovery packet via IPv6 Multicast or IPv4 Broadcast
+func (network *Network) discoveryCheckSend() (err error) {
+	if IsIPv4(network.address.IP) {
+		// The broadcast IPs are only set once the broadcast socket is open.
+		_, _, broadcastIPv4 := network.GetListen()
+		if len(broadcastIPv4) == 0 {
+			return errDiscoveryNotJoined
+		}
+
+		raw, err := PacketEncrypt(peerPrivateKey, ipv4BroadcastPublicKey, announcementPacket())
+		if err != nil {
+			return err
+		}
+
+		for _, ip := range broadcastIPv4 {
+			if err = network.send(ip, ipv4BroadcastPort, raw); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if !network.IsMulticastActive() {
+		return errDiscoveryNotJoined
+	}
+
+	return network.MulticastIPv6Send()
+}
+
+// discoveryCheckMatch checks if any of the senders is the network's listening address
+func (network *Network) discoveryCheckMatch(senders []*net.UDPAddr) bool {
+	for _, sender := range senders {
+		if sender.Port == network.address.Port && (network.address.IP.IsUnspecified() || sender.IP.Equal(network.address.IP)) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -10,7 +10,6 @@ package core
 
 import (
 	"encoding/hex"
-	"log"
 	"net"
 	"strconv"
 	"time"
@@ -40,14 +39,26 @@ func (network *Network) BroadcastIPv4() (err error) {
 	}
 
 	// listen on a special socket
-	network.broadcastSocket, err = reuseport.ListenPacket("udp4", net.JoinHostPort(network.address.IP.String(), strconv.Itoa(ipv4BroadcastPort)))
+	socket, err := reuseport.ListenPacket("udp4", net.JoinHostPort(network.address.IP.String(), strconv.Itoa(ipv4BroadcastPort)))
 	if err != nil {
 		return err
 	}
 
+	// The network may be terminated concurrently, which closes the socket under the lock.
+	network.Lock()
+	if network.isTerminated {
+		network.Unlock()
+		socket.Close()
+		return ErrNetworkTerminated
+	}
+	network.broadcastSocket = socket
 	network.broadcastIPv4 = networkToIPv4BroadcastIPs(network.ipnet)
+	network.Unlock()
 
-	go network.BroadcastIPv4Listen()
+	if !network.startWorker(network.BroadcastIPv4Listen) {
+		network.broadcastSocket.Close()
+		return ErrNetworkTerminated
+	}
 
 	return nil
 }
@@ -56,50 +67,65 @@ func (network *Network) BroadcastIPv4() (err error) {
 // Fork from network.Listen! Keep any changes synced.
 func (network *Network) BroadcastIPv4Listen() {
 	for {
-		// Buffer: Must be created for each packet as it is passed as pointer.
+		// Buffer: Each packet needs its own buffer as it is passed to the workers. It is taken from the pool and returned by the worker after processing.
 		// If the buffer is too small, ReadFromUDP only reads until its length and returns this error: "wsarecvfrom: A message sent on a datagram socket was larger than the internal message buffer or some other network limit, or the buffer used to receive a datagram into was smaller than the datagram itself."
-		buffer := make([]byte, maxPacketSize)
+		buffer := packetBufferGet()
 		length, sender, err := network.broadcastSocket.ReadFrom(buffer)
 
 		if err != nil {
-			log.Printf("Listen Error receiving UDP message: %v\n", err) // Only log for debug purposes.
-			time.Sleep(time.Millisecond * 50)                           // In case of endless errors, prevent ddos of CPU.
+			// Exit on closed socket when the network is terminated.
+			if network.IsTerminated() {
+				packetBufferPut(buffer)
+				return
+			}
+
+			logger.Debugf("Listen Error receiving UDP message: %v\n", err) // Only log for debug purposes.
+			time.Sleep(time.Millisecond * 50)                              // In case of endless errors, prevent ddos of CPU.
+			packetBufferPut(buffer)
 			continue
 		}
 
 		if IsAddressSelf(sender.(*net.UDPAddr)) {
+			discoveryCheckReceived(sender.(*net.UDPAddr))
+			packetBufferPut(buffer)
 			continue
 		}
 
 		// For good network practice (and reducing amount of parallel connections), do not allow link-local to talk to non-link-local addresses.
 		if sender.(*net.UDPAddr).IP.IsLinkLocalUnicast() != network.address.IP.IsLinkLocalUnicast() {
+			packetBufferPut(buffer)
 			continue
 		}
 
 		//fmt.Printf("BroadcastIPv4Listen from %s at network %s\n", sender.String(), network.address.String())
 
+		network.statsIn(length)
+
 		if length < packetLengthMin {
 			// Discard packets that do not meet the minimum length.
+			network.statsDropped()
+			packetBufferPut(buffer)
 			continue
 		}
 
 		// send the packet to a channel which is processed by multiple workers.
-		rawPacketsIncoming <- networkWire{network: network, sender: sender.(*net.UDPAddr), raw: buffer[:length], receiverPublicKey: ipv4BroadcastPublicKey, unicast: false}
+		packetEnqueue(networkWire{network: network, sender: sender.(*net.UDPAddr), raw: buffer[:length], receiverPublicKey: ipv4BroadcastPublicKey, unicast: false})
 	}
 }
 
 // BroadcastIPv4Send sends out a single broadcast messages to discover peers
 func (network *Network) BroadcastIPv4Send() (err error) {
-	raw, err := PacketEncrypt(peerPrivateKey, ipv4BroadcastPublicKey, &PacketRaw{Protocol: 0, Command: 0})
+	raw, err := PacketEncrypt(peerPrivateKey, ipv4BroadcastPublicKey, announcementPacket())
 	if err != nil {
 		return err
 	}
 
 	// send out the wire
-	for _, ip := range network.broadcastIPv4 {
+	_, _, broadcastIPv4 := network.GetListen()
+	for _, ip := range broadcastIPv4 {
 		err = network.send(ip, ipv4BroadcastPort, raw)
 		if err != nil {
-			log.Printf("Error sending UDP packet: %v\n", err)
+			logger.Errorf("Error sending UDP packet: %v\n", err)
 		}
 	}
 
@@ -127,10 +153,15 @@ func networkToIPv4BroadcastIPs(ipnet *net.IPNet) (broadcastIPs []net.IP) {
 			}
 
 			for _, address := range addresses {
-				net1 := address.(*net.IPNet)
+				net1 := addressToIPNet(address)
 
 				// TODO: Does the rfc3927Net make sense?
-				if !IsIPv4(net1.IP) || rfc3927Net.Contains(net1.IP) {
+				if net1 == nil || !IsIPv4(net1.IP) || rfc3927Net.Contains(net1.IP) {
+					continue
+				}
+
+				// Without a known subnet there is no directed broadcast address.
+				if ones, bits := net1.Mask.Size(); ones == bits {
 					continue
 				}
 
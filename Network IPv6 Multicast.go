@@ -18,9 +18,8 @@ package core
 
 import (
 	"encoding/hex"
-	"log"
+	"errors"
 	"net"
-	"strconv"
 	"time"
 
 	"github.com/btcsuite/btcd/btcec"
@@ -50,17 +49,24 @@ func (network *Network) MulticastIPv6Join() (err error) {
 		return
 	}
 
-	network.multicastIP = net.ParseIP(ipv6MulticastGroup)
+	multicastIP := net.ParseIP(ipv6MulticastGroup)
 
 	// listen on a special socket
-	network.multicastSocket, err = reuseport.ListenPacket("udp6", net.JoinHostPort(network.address.IP.String(), strconv.Itoa(ipv6MulticastPort)))
+	socket, err := reuseport.ListenPacket("udp6", (&net.UDPAddr{IP: network.address.IP, Port: ipv6MulticastPort, Zone: network.address.Zone}).String())
 	if err != nil {
 		return err
 	}
 
+	// close the socket if joining fails, so a retry can start fresh
+	defer func() {
+		if err != nil {
+			socket.Close()
+		}
+	}()
+
 	joinMulticastGroup := func(iface *net.Interface) (err error) {
-		pc := ipv6.NewPacketConn(network.multicastSocket)
-		if err := pc.JoinGroup(iface, &net.UDPAddr{IP: network.multicastIP}); err != nil {
+		pc := ipv6.NewPacketConn(socket)
+		if err := pc.JoinGroup(iface, &net.UDPAddr{IP: multicastIP}); err != nil {
 			return err
 		}
 
@@ -68,7 +74,7 @@ func (network *Network) MulticastIPv6Join() (err error) {
 		if loop, err := pc.MulticastLoopback(); err == nil {
 			if !loop {
 				if err := pc.SetMulticastLoopback(true); err != nil {
-					log.Printf("MulticastJoin Error setting multicast loopback status: %v\n", err)
+					logger.Errorf("MulticastJoin Error setting multicast loopback status: %v\n", err)
 				}
 			}
 		}
@@ -82,65 +88,141 @@ func (network *Network) MulticastIPv6Join() (err error) {
 			return err
 		}
 	} else {
-		interfaceList, err := net.Interfaces()
-		if err != nil {
+		var interfaceList []net.Interface
+		if interfaceList, err = net.Interfaces(); err != nil {
 			return err
 		}
 
+		// Interfaces that do not support Multicast fail. It is only an error if no interface could join.
+		joined := 0
 		for _, ifaceSingle := range interfaceList {
-			joinMulticastGroup(&ifaceSingle)
+			if errJoin := joinMulticastGroup(&ifaceSingle); errJoin != nil {
+				logger.Debugf("MulticastJoin Error joining group on interface '%s': %v\n", ifaceSingle.Name, errJoin)
+				err = errJoin
+				continue
+			}
+			joined++
 		}
+
+		if joined == 0 {
+			if err == nil {
+				err = errors.New("no network interface")
+			}
+			return err
+		}
+		err = nil
+	}
+
+	// The socket is only set under the lock, since Terminate closes it concurrently.
+	network.Lock()
+	if network.isTerminated {
+		network.Unlock()
+		err = ErrNetworkTerminated
+		return err
 	}
+	network.multicastIP = multicastIP
+	network.multicastSocket = socket
+	network.Unlock()
 
-	go network.MulticastIPv6Listen()
+	if !network.startWorker(network.MulticastIPv6Listen) {
+		return ErrNetworkTerminated
+	}
+
+	network.Lock()
+	network.multicastActive = true
+	network.Unlock()
 
 	return nil
 }
 
+// multicastIPv6JoinRetry joins the Multicast group. Joining may fail transiently if the interface is not fully ready, for example right after a network change.
+// It retries with exponential backoff. If it ultimately fails, only a warning is logged; the unicast listener remains active.
+func (network *Network) multicastIPv6JoinRetry() {
+	backoff := time.Second
+
+	for attempt := 0; ; attempt++ {
+		err := network.MulticastIPv6Join()
+		if err == nil {
+			return
+		} else if network.IsTerminated() {
+			return
+		} else if attempt >= config.MulticastJoinRetries {
+			logger.Warnf("multicastIPv6JoinRetry warning: Multicast disabled for network '%s' after %d attempts: %v\n", network.address.IP.String(), attempt+1, err)
+			return
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// IsMulticastActive checks if the network successfully joined the IPv6 Multicast group
+func (network *Network) IsMulticastActive() bool {
+	network.RLock()
+	defer network.RUnlock()
+
+	return network.multicastActive
+}
+
 // MulticastIPv6Listen listens for incoming multicast packets
 // Fork from network.Listen! Keep any changes synced.
 func (network *Network) MulticastIPv6Listen() {
 	for {
-		// Buffer: Must be created for each packet as it is passed as pointer.
+		// Buffer: Each packet needs its own buffer as it is passed to the workers. It is taken from the pool and returned by the worker after processing.
 		// If the buffer is too small, ReadFromUDP only reads until its length and returns this error: "wsarecvfrom: A message sent on a datagram socket was larger than the internal message buffer or some other network limit, or the buffer used to receive a datagram into was smaller than the datagram itself."
-		buffer := make([]byte, maxPacketSize)
+		buffer := packetBufferGet()
 		length, sender, err := network.multicastSocket.ReadFrom(buffer)
 
 		if err != nil {
-			log.Printf("Listen Error receiving UDP message: %v\n", err) // Only log for debug purposes.
-			time.Sleep(time.Millisecond * 50)                           // In case of endless errors, prevent ddos of CPU.
+			// Exit on closed socket when the network is terminated.
+			if network.IsTerminated() {
+				packetBufferPut(buffer)
+				return
+			}
+
+			logger.Debugf("Listen Error receiving UDP message: %v\n", err) // Only log for debug purposes.
+			time.Sleep(time.Millisecond * 50)                              // In case of endless errors, prevent ddos of CPU.
+			packetBufferPut(buffer)
 			continue
 		}
 
 		// skip incoming packets that were looped back
 		if IsAddressSelf(sender.(*net.UDPAddr)) {
+			discoveryCheckReceived(sender.(*net.UDPAddr))
+			packetBufferPut(buffer)
 			continue
 		}
 
 		// For good network practice (and reducing amount of parallel connections), do not allow link-local to talk to non-link-local addresses.
 		if sender.(*net.UDPAddr).IP.IsLinkLocalUnicast() != network.address.IP.IsLinkLocalUnicast() {
+			packetBufferPut(buffer)
 			continue
 		}
 
 		//fmt.Printf("MulticastIPv6Listen from %s at network %s\n", sender.String(), network.address.String())
 
+		network.statsIn(length)
+
 		if length < packetLengthMin {
 			// Discard packets that do not meet the minimum length.
+			network.statsDropped()
+			packetBufferPut(buffer)
 			continue
 		}
 
 		// send the packet to a channel which is processed by multiple workers.
-		rawPacketsIncoming <- networkWire{network: network, sender: sender.(*net.UDPAddr), raw: buffer[:length], receiverPublicKey: ipv6MulticastPublicKey, unicast: false}
+		packetEnqueue(networkWire{network: network, sender: sender.(*net.UDPAddr), raw: buffer[:length], receiverPublicKey: ipv6MulticastPublicKey, unicast: false})
 	}
 }
 
 // MulticastIPv6Send sends out a single multicast messages to discover peers at the same site
 func (network *Network) MulticastIPv6Send() (err error) {
-	raw, err := PacketEncrypt(peerPrivateKey, ipv6MulticastPublicKey, &PacketRaw{Protocol: 0, Command: 0})
+	raw, err := PacketEncrypt(peerPrivateKey, ipv6MulticastPublicKey, announcementPacket())
 	if err != nil {
 		return err
 	}
 
 	// send out the wire
-	return network.send(network.multicastIP, ipv6MulticastPort, raw)
+	_, multicastIP, _ := network.GetListen()
+	return network.send(multicastIP, ipv6MulticastPort, raw)
 }
@@ -10,8 +10,8 @@ IPv6 is always preferred.
 package core
 
 import (
+	"context"
 	"errors"
-	"log"
 	"math/rand"
 	"net"
 	"strconv"
@@ -32,49 +32,223 @@ type networkWire struct {
 }
 
 var (
-	rawPacketsIncoming chan networkWire      // channel for processing incoming decoded packets by workers
-	ipsListen          map[string]struct{}   // list of IPs currently listening on
-	ipsListenMutex     sync.RWMutex          // Mutext for ipsListen
-	ifacesExist        map[string][]net.Addr // list of currently known interfaces with list of IP addresses
+	rawPacketsIncoming  chan networkWire      // channel for processing incoming decoded packets by workers
+	ipsListen           map[string]struct{}   // list of IPs currently listening on
+	listenPorts         map[int]int           // count of entries in ipsListen per port
+	ipsListenMutex      sync.RWMutex          // Mutext for ipsListen and listenPorts
+	localIPs            map[string]struct{}   // all IPs of all network adapters, key is the 16-byte IP
+	localIPsMutex       sync.RWMutex          // Mutex for localIPs
+	ifacesExist         map[string][]net.Addr // list of currently known interfaces with list of IP addresses
+	networksConfigured  map[string]*Network   // list of networks started from config.Listen, key is the entry in config.Listen
+	networkChangeMutex  sync.Mutex            // Mutex for changing the set of networks via the network change monitor or Reconfigure
+	networksShutdown    bool                  // If true, Shutdown was called. Protected by networkChangeMutex.
+	packetWorkers       sync.WaitGroup        // running packet workers
+	packetWorkersCancel context.CancelFunc    // cancels the context of the packet workers on Shutdown
 )
 
+// defaultListenWorkers is the default count of packet workers. More workers help busy nodes such as relays; constrained devices may use 1.
+const defaultListenWorkers = 2
+
 // initNetwork sets up the network configuration and starts listening.
 func initNetwork() {
 	rawPacketsIncoming = make(chan networkWire, 1000) // buffer up to 1000 UDP packets before they get buffered by the OS network stack and eventually dropped
 	ipsListen = make(map[string]struct{})
+	listenPorts = make(map[int]int)
+	localIPsRefresh(nil)
 	ifacesExist = make(map[string][]net.Addr)
+	networksConfigured = make(map[string]*Network)
+	var packetWorkersContext context.Context
+	packetWorkersContext, packetWorkersCancel = context.WithCancel(context.Background())
+	networksShutdown = false
 	rand.Seed(time.Now().UnixNano()) // we are not using "crypto/rand" for speed tradeoff
 
-	if config.ListenWorkers == 0 {
-		config.ListenWorkers = 2
-	}
+	configDefaults()
+	initBandwidthLimit()
+	initTransferLimits()
+	initAnnouncementLimit()
+	initReliable()
+
+	logger.Infof("initNetwork starting %d packet workers\n", config.ListenWorkers)
+
 	for n := 0; n < config.ListenWorkers; n++ {
-		go packetWorker(rawPacketsIncoming)
+		packetWorkers.Add(1)
+		go packetWorker(packetWorkersContext, rawPacketsIncoming)
 	}
 
 	// check if user specified where to listen
+	// Wildcard addresses (0.0.0.0 and ::) and explicit IPs may be combined, for example to listen on a specific IP with a forwarded port.
+	// Broadcast and Multicast packets received on both are deduplicated in the packet worker.
 	if len(config.Listen) > 0 {
-		for _, listenA := range config.Listen {
-			host, portA, err := net.SplitHostPort(listenA)
-			if err != nil && strings.Contains(err.Error(), "missing port in address") { // port is optional
-				host = listenA
-				portA = "0"
-			} else if err != nil {
-				log.Printf("initNetwork Error invalid input listen address '%s': %s\n", listenA, err.Error())
-				continue
-			}
+		networksStartConfigured()
+		return
+	}
 
-			portI, _ := strconv.Atoi(portA)
+	networkStartAll()
+}
 
-			if _, err := networkPrepareListen(host, portI); err != nil {
-				log.Printf("initNetwork Error listen on '%s': %s\n", listenA, err.Error())
-				continue
-			}
-		}
+// networkShutdown terminates all networks and stops the packet workers. It blocks until all listen routines and packet workers exited.
+// Packets remaining in the incoming channel are not processed.
+func networkShutdown() {
+	networkChangeMutex.Lock()
+	defer networkChangeMutex.Unlock()
 
+	if networksShutdown {
 		return
 	}
+	networksShutdown = true
+
+	for _, network := range networksSnapshot() {
+		networksRemove(network)
+	}
+
+	networksConfigured = make(map[string]*Network)
+	ifacesExist = make(map[string][]net.Addr)
+
+	packetWorkersCancel()
+	packetWorkers.Wait()
+}
+
+// configDefaults sets the defaults for config values that are not set
+func configDefaults() {
+	// Without workers all incoming packets would be silently dropped.
+	if config.ListenWorkers < 0 {
+		logger.Warnf("initNetwork invalid ListenWorkers %d, using default %d\n", config.ListenWorkers, defaultListenWorkers)
+	}
+	if config.ListenWorkers <= 0 {
+		config.ListenWorkers = defaultListenWorkers
+	}
+	if config.ChangeMonitorFrequency < 0 {
+		logger.Warnf("initNetwork invalid ChangeMonitorFrequency %d, using default %d\n", config.ChangeMonitorFrequency, defaultChangeMonitorFrequency)
+	}
+	if config.ChangeMonitorFrequency <= 0 {
+		config.ChangeMonitorFrequency = defaultChangeMonitorFrequency
+	}
+	if config.HandshakeTimeout == 0 {
+		config.HandshakeTimeout = defaultHandshakeTimeout
+	}
+	if config.FragmentThreshold != 0 && (config.FragmentThreshold < fragmentThresholdMin || config.FragmentThreshold > fragmentThresholdMax) {
+		logger.Warnf("initNetwork invalid FragmentThreshold %d, using default %d\n", config.FragmentThreshold, defaultFragmentThreshold)
+		config.FragmentThreshold = 0
+	}
+	if config.FragmentThreshold == 0 {
+		config.FragmentThreshold = defaultFragmentThreshold
+	}
+	if config.PortRangeStart > 0 && config.PortRangeEnd == 0 {
+		config.PortRangeEnd = config.PortRangeStart
+	}
+	if config.PortRangeStart < 0 || config.PortRangeStart > 65535 || config.PortRangeEnd > 65535 || config.PortRangeEnd < config.PortRangeStart {
+		logger.Warnf("initNetwork invalid port range %d-%d, using automatic port selection\n", config.PortRangeStart, config.PortRangeEnd)
+		config.PortRangeStart, config.PortRangeEnd = 0, 0
+	}
+	switch config.IncomingPolicy {
+	case IncomingDropNewest, IncomingBlockWithTimeout:
+	case "":
+		config.IncomingPolicy = IncomingDropNewest
+	default:
+		logger.Warnf("initNetwork invalid IncomingPolicy '%s', using default %s\n", config.IncomingPolicy, IncomingDropNewest)
+		config.IncomingPolicy = IncomingDropNewest
+	}
+	if config.IncomingBlockTimeout <= 0 {
+		config.IncomingBlockTimeout = 100
+	}
+	if config.AnnouncementLimit == 0 {
+		config.AnnouncementLimit = defaultAnnouncementLimit
+	}
+	if config.PingTime < 0 || config.ConnectionInvalidate < 0 || config.ConnectionRemove < 0 {
+		logger.Warnf("initNetwork invalid negative PingTime, ConnectionInvalidate or ConnectionRemove, using defaults\n")
+		config.PingTime, config.ConnectionInvalidate, config.ConnectionRemove = 0, 0, 0
+	}
+	if config.PingTime == 0 {
+		config.PingTime = defaultPingTime
+	}
+	if config.ConnectionInvalidate == 0 {
+		config.ConnectionInvalidate = defaultConnectionInvalidate
+	}
+	if config.ConnectionRemove == 0 {
+		config.ConnectionRemove = defaultConnectionRemove
+	}
+	if config.ConnectionInvalidate <= config.PingTime || config.ConnectionRemove <= config.ConnectionInvalidate {
+		logger.Warnf("initNetwork invalid keep-alive timing PingTime %d, ConnectionInvalidate %d, ConnectionRemove %d: ConnectionInvalidate must be greater than PingTime and ConnectionRemove greater than ConnectionInvalidate. Using defaults %d, %d, %d\n", config.PingTime, config.ConnectionInvalidate, config.ConnectionRemove, defaultPingTime, defaultConnectionInvalidate, defaultConnectionRemove)
+		config.PingTime, config.ConnectionInvalidate, config.ConnectionRemove = defaultPingTime, defaultConnectionInvalidate, defaultConnectionRemove
+	}
+	if config.PingJitter == 0 {
+		config.PingJitter = 500
+	}
+	if config.MulticastJoinRetries == 0 {
+		config.MulticastJoinRetries = 5
+	}
+	if config.ObservedAddrSamples == 0 {
+		config.ObservedAddrSamples = defaultObservedAddrSamples
+	}
+	if config.ObservedAddrQuorum == 0 {
+		config.ObservedAddrQuorum = defaultObservedAddrQuorum
+	}
+	if config.RekeyInterval != 0 && config.RekeyInterval < rekeyIntervalMin {
+		logger.Warnf("initNetwork invalid RekeyInterval %d, using default %d\n", config.RekeyInterval, defaultRekeyInterval)
+		config.RekeyInterval = 0
+	}
+	if config.RekeyInterval == 0 {
+		config.RekeyInterval = defaultRekeyInterval
+	}
+	if config.RekeyBytes == 0 {
+		config.RekeyBytes = defaultRekeyBytes
+	}
+}
+
+// networksStartConfigured starts listening on all entries from config.Listen that are not listening yet
+func networksStartConfigured() {
+	for _, listenA := range config.Listen {
+		if _, ok := networksConfigured[listenA]; ok {
+			continue
+		}
+
+		if netw := networkStartConfigured(listenA); netw != nil {
+			networksConfigured[listenA] = netw
+		}
+	}
+}
+
+// networkStartConfigured starts listening on an entry from config.Listen. The port is optional. Returns nil on error.
+func networkStartConfigured(listenA string) (netw *Network) {
+	host, portA, err := net.SplitHostPort(listenA)
+	if err != nil && (strings.Contains(err.Error(), "missing port in address") || isIPWithZone(listenA)) { // port is optional
+		host = listenA
+		portA = "0"
+	} else if err != nil {
+		logger.Errorf("initNetwork Error invalid input listen address '%s': %s\n", listenA, err.Error())
+		return nil
+	}
+
+	portI, _ := strconv.Atoi(portA)
+
+	netw, err = networkPrepareListen(host, portI)
+	if err != nil {
+		logger.Errorf("initNetwork Error listen on '%s': %s\n", listenA, err.Error())
+		return nil
+	}
+
+	if netw.address.IP.IsUnspecified() {
+		addListenAddressWildcard(netw.address)
+	} else {
+		addListenAddress(netw.address)
+	}
+
+	logListen("Listen on UDP %s\n", netw.address.String())
+
+	return netw
+}
+
+// logListen logs a new listening address. If config.LogListenSummary is set, it is logged at debug level, since the summary replaces it at info level.
+func logListen(format string, v ...interface{}) {
+	if config.LogListenSummary {
+		logger.Debugf(format, v...)
+	} else {
+		logger.Infof(format, v...)
+	}
+}
 
+// networkStartAll starts listening on all IPs of all network adapters
+func networkStartAll() {
 	// Listen on all IPv4 and IPv6 addresses
 	//if _, err := networkPrepareListen("0.0.0.0", 0); err != nil {
 	//	log.Printf("initNetwork Error listen on all IPv4 addresses (0.0.0.0): %s\n", err.Error())
@@ -89,30 +263,46 @@ func initNetwork() {
 	// * Network adapters and IPs might change. Simplest case is if someone changes Wifi network.
 	interfaceList, err := net.Interfaces()
 	if err != nil {
-		log.Printf("initNetwork enumerating network adapters failed: %s\n", err.Error())
+		logger.Errorf("initNetwork enumerating network adapters failed: %s\n", err.Error())
 		return
 	}
 
+	countListen, countIfaces := 0, 0
+
 	for _, iface := range interfaceList {
 		addresses, err := iface.Addrs()
 		if err != nil {
-			log.Printf("initNetwork error enumerating IPs for network adapter '%s': %s\n", iface.Name, err.Error())
+			logger.Errorf("initNetwork error enumerating IPs for network adapter '%s': %s\n", iface.Name, err.Error())
 			continue
 		}
 
 		ifacesExist[iface.Name] = addresses
 
-		networkStart(iface, addresses)
+		if count := networkStart(iface, addresses); count > 0 {
+			countListen += count
+			countIfaces++
+		}
+	}
+
+	if config.LogListenSummary {
+		logger.Infof("Listening on %d addresses across %d interfaces\n", countListen, countIfaces)
 	}
 }
 
-// networkStart will start the listeners on all the IP addresses for the network
-func networkStart(iface net.Interface, addresses []net.Addr) {
+// networkStart will start the listeners on all the IP addresses for the network. It returns the count of started listeners.
+func networkStart(iface net.Interface, addresses []net.Addr) (count int) {
+	if !isInterfaceBound(iface.Name) {
+		return 0
+	}
+
 	for _, address := range addresses {
-		net1 := address.(*net.IPNet)
+		net1 := addressToIPNet(address)
+		if net1 == nil {
+			continue
+		}
 
 		// Do not listen on lookpback IPs. They are not even needed for discovery of machine-local peers (they will be discovered via regular multicast/broadcast).
-		if net1.IP.IsLoopback() {
+		if net1.IP.IsLoopback() || isIPFamilyDisabled(net1.IP) {
 			continue
 		}
 
@@ -126,28 +316,54 @@ func networkStart(iface net.Interface, addresses []net.Addr) {
 				continue
 			}
 
-			log.Printf("initNetwork error listening on network adapter '%s' IPv4 '%s': %s\n", iface.Name, net1.IP.String(), err.Error())
+			logger.Errorf("initNetwork error listening on network adapter '%s' IPv4 '%s': %s\n", iface.Name, net1.IP.String(), err.Error())
 			continue
 		}
 
 		addListenAddress(netw.address)
+		count++
+
+		logListen("Listen on network '%s' UDP %s\n", iface.Name, netw.address.String())
+	}
+
+	return count
+}
 
-		log.Printf("Listen on network '%s' UDP %s\n", iface.Name, netw.address.String())
+// ErrIPFamilyDisabled is returned when listening on an IP of a family disabled via config.DisableIPv4 or config.DisableIPv6
+var ErrIPFamilyDisabled = errors.New("IP family disabled")
+
+// isIPFamilyDisabled checks if the IP belongs to a family disabled in the config
+func isIPFamilyDisabled(ip net.IP) bool {
+	if IsIPv4(ip) {
+		return config.DisableIPv4
 	}
+	return config.DisableIPv6
 }
 
 // networkPrepareListen prepares to listen on the given IP address. If port is 0, one is chosen automatically.
+// IPv6 addresses may contain a zone (for example "fe80::1%eth0"), which selects the network interface.
 func networkPrepareListen(ipA string, port int) (network *Network, err error) {
+	ipA, zone := splitIPZone(ipA)
+
 	ip := net.ParseIP(ipA)
 	if ip == nil {
 		return nil, errors.New("Invalid input IP")
 	}
 
+	if isIPFamilyDisabled(ip) {
+		return nil, ErrIPFamilyDisabled
+	}
+
 	network = new(Network)
 	network.terminateSignal = make(chan interface{})
 
 	// get the network interface that belongs to the IP
-	if ipA != "0.0.0.0" && ipA != "::" {
+	if zone != "" {
+		network.iface, network.ipnet = findInterfaceByZone(zone, ip)
+		if network.iface == nil {
+			return nil, errors.New("Error finding the IP on the network interface specified by the zone")
+		}
+	} else if !ip.IsUnspecified() {
 		network.iface, network.ipnet = FindInterfaceByIP(ip)
 		if network.iface == nil {
 			return nil, errors.New("Error finding the network interface belonging to IP")
@@ -169,30 +385,77 @@ func networkPrepareListen(ipA string, port int) (network *Network, err error) {
 	} else {
 		networks6 = append(networks6, network)
 		networksMutex.Unlock()
-		network.MulticastIPv6Join()
+		go network.multicastIPv6JoinRetry()
 	}
 
-	go network.Listen()
+	network.startWorker(network.Listen)
+
+	// Request a port mapping from the router. Only IPv4 networks on a private IP are behind NAT.
+	if config.EnableUPnP && IsIPv4(ip) && isPrivateIP(ip) {
+		network.startWorker(network.upnpMapper)
+	}
 
 	return network, nil
 }
 
+// splitIPZone splits an IP address into the IP and the IPv6 zone, if any. Example: "fe80::1%eth0" returns "fe80::1" and "eth0".
+func splitIPZone(ipA string) (ip, zone string) {
+	if i := strings.LastIndex(ipA, "%"); i >= 0 {
+		return ipA[:i], ipA[i+1:]
+	}
+	return ipA, ""
+}
+
+// isIPWithZone checks if the input is an IP address without port, with an optional zone
+func isIPWithZone(ipA string) bool {
+	ip, _ := splitIPZone(ipA)
+	return net.ParseIP(ip) != nil
+}
+
 // addListenAddress adds a listening IP:Port to the list.
 func addListenAddress(addr *net.UDPAddr) {
+	key := net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port))
+
 	ipsListenMutex.Lock()
-	ipsListen[net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port))] = struct{}{}
+	if _, ok := ipsListen[key]; !ok {
+		ipsListen[key] = struct{}{}
+		listenPorts[addr.Port]++
+	}
 	ipsListenMutex.Unlock()
 }
 
+// addListenAddressWildcard adds all local IPs of the same IP family with the port of the wildcard listening address to the list.
+// IPs added later are detected by IsAddressSelf via the listening port and the list of local IPs.
+func addListenAddressWildcard(addr *net.UDPAddr) {
+	IPs, err := NetworkListIPs()
+	if err != nil {
+		return
+	}
+
+	for _, ip := range IPs {
+		if IsIPv4(ip) == IsIPv4(addr.IP) {
+			addListenAddress(&net.UDPAddr{IP: ip, Port: addr.Port})
+		}
+	}
+}
+
 // removeListenAddress removes a listening address from the list
 func removeListenAddress(addr *net.UDPAddr) {
+	key := net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port))
+
 	ipsListenMutex.Lock()
-	delete(ipsListen, net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port)))
+	if _, ok := ipsListen[key]; ok {
+		delete(ipsListen, key)
+		if listenPorts[addr.Port]--; listenPorts[addr.Port] <= 0 {
+			delete(listenPorts, addr.Port)
+		}
+	}
 	ipsListenMutex.Unlock()
 }
 
 // IsAddressSelf checks if the senders address is actually listening address. This prevents loopback packets from being considered.
-// Note: This does not work when listening on 0.0.0.0 or ::1 and binding the sending socket to that.
+// Packets sent from a local IP that is not listened on explicitly (for example a temporary IPv6 address chosen by the OS for a wildcard socket) are detected if the port is one of the listening ports.
+// Other nodes on the same machine use different ports and are not considered self.
 func IsAddressSelf(addr *net.UDPAddr) bool {
 	if addr == nil {
 		return false
@@ -201,6 +464,48 @@ func IsAddressSelf(addr *net.UDPAddr) bool {
 	// do not use addr.String() since it addds the Zone for IPv6 which may be ambiguous (can be adapter name or address literal).
 	ipsListenMutex.RLock()
 	_, ok := ipsListen[net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port))]
+	portListen := listenPorts[addr.Port] > 0
 	ipsListenMutex.RUnlock()
+
+	return ok || (portListen && IsLocalIP(addr.IP))
+}
+
+// IsLocalIP checks if the IP belongs to any network adapter of this machine, regardless of whether it is listened on. The zone of IPv6 addresses is ignored.
+func IsLocalIP(ip net.IP) bool {
+	key := string(ip.To16())
+
+	localIPsMutex.RLock()
+	_, ok := localIPs[key]
+	localIPsMutex.RUnlock()
+
 	return ok
 }
+
+// localIPsRefresh updates the list of local IPs from the list of network adapters. If nil, the network adapters are enumerated.
+func localIPsRefresh(interfaceList []net.Interface) {
+	if interfaceList == nil {
+		var err error
+		if interfaceList, err = net.Interfaces(); err != nil {
+			return
+		}
+	}
+
+	ips := make(map[string]struct{})
+
+	for _, iface := range interfaceList {
+		addresses, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, address := range addresses {
+			if ipnet := addressToIPNet(address); ipnet != nil {
+				ips[string(ipnet.IP.To16())] = struct{}{}
+			}
+		}
+	}
+
+	localIPsMutex.Lock()
+	localIPs = ips
+	localIPsMutex.Unlock()
+}
@@ -0,0 +1,267 @@
+/*
+File Name:  Network Init_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package core
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testLoopbackIPv4 returns the loopback adapter and its IPv4 address. The test is skipped if there is none.
+func testLoopbackIPv4(t *testing.T) (iface *net.Interface, address net.Addr) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		t.Skipf("network adapters not available: %v", err)
+	}
+
+	for n := range interfaces {
+		if interfaces[n].Flags&net.FlagLoopback == 0 {
+			continue
+		}
+		addresses, _ := interfaces[n].Addrs()
+		for _, address := range addresses {
+			if ipnet := addressToIPNet(address); ipnet != nil && IsIPv4(ipnet.IP) {
+				return &interfaces[n], address
+			}
+		}
+	}
+
+	t.Skip("no loopback adapter with an IPv4 address")
+	return nil, nil
+}
+
+// testLinkLocalIPv6 returns an adapter with a link-local IPv6 address. The test is skipped if there is none.
+func testLinkLocalIPv6(t *testing.T) (iface *net.Interface, ip net.IP) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		t.Skipf("network adapters not available: %v", err)
+	}
+
+	for n := range interfaces {
+		if interfaces[n].Flags&net.FlagUp == 0 {
+			continue
+		}
+		addresses, _ := interfaces[n].Addrs()
+		for _, address := range addresses {
+			if ipnet := addressToIPNet(address); ipnet != nil && IsIPv6(ipnet.IP) && ipnet.IP.IsLinkLocalUnicast() {
+				return &interfaces[n], ipnet.IP
+			}
+		}
+	}
+
+	t.Skip("no adapter with a link-local IPv6 address")
+	return nil, nil
+}
+
+// testNetworksRemoveAll terminates and removes all networks
+func testNetworksRemoveAll() {
+	for _, network := range networksSnapshot() {
+		networksRemove(network)
+	}
+}
+
+// TestNetworksConcurrentRemove starts listeners while the IP is removed concurrently. Run with -race.
+func TestNetworksConcurrentRemove(t *testing.T) {
+	testConfig(t)
+	iface, address := testLoopbackIPv4(t)
+	ip := addressToIPNet(address).IP.String()
+	defer testNetworksRemoveAll()
+
+	const count = 20
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+
+		for n := 0; n < count; n++ {
+			if _, err := networkPrepareListen(ip, 0); err != nil {
+				t.Errorf("listen on %s: %v", ip, err)
+				return
+			}
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			networkChangeIPRemove(*iface, address)
+			for _, network := range networksSnapshot() {
+				network.GetListen()
+			}
+		}
+	}()
+
+	wg.Wait()
+
+	// A final removal event removes all remaining networks on the IP.
+	networkChangeIPRemove(*iface, address)
+	for _, network := range networksSnapshot() {
+		if network.address.IP.String() == ip {
+			t.Fatalf("network %s not removed", network.address.String())
+		}
+	}
+}
+
+func TestSplitIPZone(t *testing.T) {
+	tests := []struct {
+		input, ip, zone string
+	}{
+		{"fe80::1%eth0", "fe80::1", "eth0"},
+		{"fe80::1%12", "fe80::1", "12"},
+		{"fe80::1", "fe80::1", ""},
+		{"192.168.1.1", "192.168.1.1", ""},
+	}
+
+	for _, test := range tests {
+		if ip, zone := splitIPZone(test.input); ip != test.ip || zone != test.zone {
+			t.Errorf("splitIPZone(%q) = %q, %q", test.input, ip, zone)
+		}
+		if !isIPWithZone(test.input) {
+			t.Errorf("isIPWithZone(%q) = false", test.input)
+		}
+	}
+
+	if isIPWithZone("[fe80::1%eth0]:112") {
+		t.Error("address with port detected as IP")
+	}
+
+	// The zone is kept by net.SplitHostPort for addresses with port.
+	if host, _, err := net.SplitHostPort("[fe80::1%eth0]:112"); err != nil || host != "fe80::1%eth0" {
+		t.Errorf("SplitHostPort returned %q, %v", host, err)
+	}
+}
+
+func TestNetworkPrepareListenZone(t *testing.T) {
+	testConfig(t)
+	iface, ip := testLinkLocalIPv6(t)
+
+	// The zone can be the adapter name or its index.
+	for _, zone := range []string{iface.Name, strconv.Itoa(iface.Index)} {
+		network, err := networkPrepareListen(ip.String()+"%"+zone, 0)
+		if err != nil {
+			t.Fatalf("listen on %s%%%s: %v", ip.String(), zone, err)
+		}
+
+		if network.iface == nil || network.iface.Index != iface.Index {
+			t.Errorf("zone %q: wrong adapter", zone)
+		}
+		if !network.address.IP.Equal(ip) || network.address.Zone != iface.Name {
+			t.Errorf("zone %q: listening on %s", zone, network.address.String())
+		}
+
+		networksRemove(network)
+	}
+
+	if _, err := networkPrepareListen(ip.String()+"%peernet-invalid", 0); err == nil {
+		t.Error("listen with an unknown zone succeeded")
+	}
+}
+
+func TestDisableIPFamily(t *testing.T) {
+	testConfig(t)
+	config.DisableIPv6 = true
+	defer testNetworksRemoveAll()
+
+	ipsListenMutex.Lock()
+	ipsListen, listenPorts = make(map[string]struct{}), make(map[int]int)
+	ipsListenMutex.Unlock()
+
+	if _, err := networkPrepareListen("::1", 0); err != ErrIPFamilyDisabled {
+		t.Fatalf("listen on disabled IPv6: %v", err)
+	}
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		t.Skipf("network adapters not available: %v", err)
+	}
+	for _, iface := range interfaces {
+		if addresses, err := iface.Addrs(); err == nil {
+			networkStart(iface, addresses)
+		}
+	}
+
+	networksMutex.RLock()
+	count6 := len(networks6)
+	networksMutex.RUnlock()
+	if count6 != 0 {
+		t.Fatalf("%d IPv6 networks started while disabled", count6)
+	}
+
+	config.DisableIPv4, config.DisableIPv6 = true, false
+	if _, err := networkPrepareListen("127.0.0.1", 0); err != ErrIPFamilyDisabled {
+		t.Fatalf("listen on disabled IPv4: %v", err)
+	}
+}
+
+// testLogger records the log output per level
+type testLogger struct {
+	sync.Mutex
+	debug, info []string
+}
+
+func (l *testLogger) Debugf(format string, v ...interface{}) {
+	l.Lock()
+	l.debug = append(l.debug, fmt.Sprintf(format, v...))
+	l.Unlock()
+}
+
+func (l *testLogger) Infof(format string, v ...interface{}) {
+	l.Lock()
+	l.info = append(l.info, fmt.Sprintf(format, v...))
+	l.Unlock()
+}
+
+func (l *testLogger) Warnf(format string, v ...interface{})  {}
+func (l *testLogger) Errorf(format string, v ...interface{}) {}
+
+func TestLogListenSummary(t *testing.T) {
+	defer SetLogger(nil)
+
+	ipsListenMutex.Lock()
+	ipsListen, listenPorts = make(map[string]struct{}), make(map[int]int)
+	ipsListenMutex.Unlock()
+
+	for _, summary := range []bool{false, true} {
+		testConfig(t)
+		config.LogListenSummary = summary
+		recorder := &testLogger{}
+		SetLogger(recorder)
+
+		if netw := networkStartConfigured("127.0.0.1:0"); netw == nil {
+			t.Fatal("listen on 127.0.0.1 failed")
+		}
+		testNetworksRemoveAll()
+
+		lines, other := recorder.info, recorder.debug
+		if summary {
+			lines, other = recorder.debug, recorder.info
+		}
+		if len(lines) != 1 || !strings.HasPrefix(lines[0], "Listen on UDP 127.0.0.1:") {
+			t.Fatalf("summary %t: listen line not logged at the expected level: %q", summary, lines)
+		}
+		for _, line := range other {
+			if strings.HasPrefix(line, "Listen on") {
+				t.Fatalf("summary %t: listen line logged at both levels", summary)
+			}
+		}
+	}
+}
@@ -0,0 +1,190 @@
+/*
+File Name:  Network Reconfigure.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Reconfigure applies a new config at runtime without a restart. The identity and the peer list are kept, which avoids a discovery cold-start.
+Only listeners that changed are closed or opened. Known peers are announced via new listeners so they learn about the new connections.
+*/
+
+package core
+
+import (
+	"errors"
+	"net"
+)
+
+// Reconfigure applies the new config. The private key in the new config is ignored and the current one is kept, as well as the peer list.
+// Listeners are only closed and opened for entries in Listen that changed. Changing BindInterfaces, DisableIPv4 or DisableIPv6 restarts all listeners. Changing ListenWorkers requires a restart. Per-peer limits apply to new peers.
+// The new config is not saved to the config file.
+func Reconfigure(newConfig Config) (err error) {
+	networkChangeMutex.Lock()
+	defer networkChangeMutex.Unlock()
+
+	if networksShutdown {
+		return errors.New("network is shut down")
+	}
+
+	networksBefore := networksSnapshot()
+	listenBefore := config.Listen
+	bindBefore := config.BindInterfaces
+	disableIPv4Before, disableIPv6Before := config.DisableIPv4, config.DisableIPv6
+
+	newConfig.PrivateKey = config.PrivateKey
+	newConfig.ListenWorkers = config.ListenWorkers
+	config = newConfig
+	configDefaults()
+	initBandwidthLimit()
+	initTransferLimits()
+	initAnnouncementLimit()
+
+	switch {
+	case len(listenBefore) == 0 && len(config.Listen) == 0:
+		// Listening on all network adapters remains. Changes of the network adapters are handled by the network change monitor.
+		// If the bound network adapters or the IP families changed, all listeners are restarted.
+		if !stringsEqual(bindBefore, config.BindInterfaces) || disableIPv4Before != config.DisableIPv4 || disableIPv6Before != config.DisableIPv6 {
+			for _, network := range networksBefore {
+				networksRemove(network)
+			}
+			ifacesExist = make(map[string][]net.Addr)
+
+			networkStartAll()
+		}
+
+	case len(listenBefore) == 0:
+		// Switch from all network adapters to the configured list.
+		for _, network := range networksBefore {
+			networksRemove(network)
+		}
+		ifacesExist = make(map[string][]net.Addr)
+
+		networksStartConfigured()
+
+	case len(config.Listen) == 0:
+		// Switch from the configured list to all network adapters.
+		for _, network := range networksConfigured {
+			networksRemove(network)
+		}
+		networksConfigured = make(map[string]*Network)
+
+		networkStartAll()
+
+	default:
+		// Only close the listeners for removed entries and open new ones.
+		listenNew := make(map[string]struct{})
+		for _, listenA := range config.Listen {
+			listenNew[listenA] = struct{}{}
+		}
+
+		for listenA, network := range networksConfigured {
+			if _, ok := listenNew[listenA]; !ok {
+				networksRemove(network)
+				delete(networksConfigured, listenA)
+			}
+		}
+
+		networksStartConfigured()
+	}
+
+	// Announce to all peers via the new listeners.
+	for _, network := range networksSnapshot() {
+		if !networkInList(network, networksBefore) {
+			network.announcePeers()
+		}
+	}
+
+	if len(config.Listen) > 0 && len(networksConfigured) == 0 {
+		return errors.New("no listen address could be started")
+	}
+
+	return nil
+}
+
+// stringsEqual checks if both lists contain the same strings in the same order
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for n := range a {
+		if a[n] != b[n] {
+			return false
+		}
+	}
+	return true
+}
+
+// networksSnapshot returns a copy of the list of all IPv6 and IPv4 networks
+func networksSnapshot() (networks []*Network) {
+	networksMutex.RLock()
+	defer networksMutex.RUnlock()
+
+	networks = append(networks, networks6...)
+	networks = append(networks, networks4...)
+
+	return networks
+}
+
+// networkInList checks if the network is in the list
+func networkInList(network *Network, list []*Network) bool {
+	for _, network2 := range list {
+		if network2 == network {
+			return true
+		}
+	}
+
+	return false
+}
+
+// networksRemove terminates the network and removes it from the list of networks
+func networksRemove(network *Network) {
+	network.Terminate()
+
+	networksMutex.Lock()
+	defer networksMutex.Unlock()
+
+	filter := func(networks []*Network) (networksNew []*Network) {
+		for _, network2 := range networks {
+			if network2 != network {
+				networksNew = append(networksNew, network2)
+			}
+		}
+		return networksNew
+	}
+
+	networks6 = filter(networks6)
+	networks4 = filter(networks4)
+}
+
+// announcePeers sends an announcement to the addresses of all known peers that are reachable via the network
+func (network *Network) announcePeers() {
+	packet := announcementPacket()
+
+	for _, peer := range PeerlistGet() {
+		raw, err := PacketEncrypt(peerPrivateKey, peer.PublicKey, packet)
+		if err != nil {
+			continue
+		}
+
+		sent := make(map[string]struct{})
+
+		for _, connections := range [][]*Connection{peer.GetConnections(true), peer.GetConnections(false)} {
+			for _, connection := range connections {
+				remote := connection.Address
+
+				if IsIPv6(remote.IP.To16()) != IsIPv6(network.address.IP.To16()) {
+					continue
+				}
+				// Do not mix link-local unicast targets with non link-local networks (only when iface is known, i.e. not catch all local)
+				if network.iface != nil && remote.IP.IsLinkLocalUnicast() != network.address.IP.IsLinkLocalUnicast() {
+					continue
+				}
+				if _, ok := sent[remote.String()]; ok {
+					continue
+				}
+				sent[remote.String()] = struct{}{}
+
+				network.send(remote.IP, remote.Port, raw)
+			}
+		}
+	}
+}
@@ -0,0 +1,203 @@
+/*
+File Name:  Network Statistics.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package core
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// networkStats contains the statistics of a single network. All counters include the Multicast and Broadcast sockets.
+type networkStats struct {
+	packetsIn      uint64 // Packets received
+	bytesIn        uint64 // Bytes received
+	packetsOut     uint64 // Packets sent
+	bytesOut       uint64 // Bytes sent
+	packetsDropped uint64 // Received packets that were dropped (invalid size)
+}
+
+// statsTotal contains the statistics of all networks since the start of the process, including networks that were closed. Unlike a sum over the current networks, the counters never decrease.
+var statsTotal networkStats
+
+// statsHandlerPanics is the count of panics in command handlers, see packetDispatch
+var statsHandlerPanics uint64
+
+// StatsHandlerPanics returns the count of panics in command handlers. Each panic dropped the packet that caused it.
+func StatsHandlerPanics() uint64 {
+	return atomic.LoadUint64(&statsHandlerPanics)
+}
+
+// statsChecksumMismatch is the count of incoming packets dropped due to a checksum mismatch
+var statsChecksumMismatch uint64
+
+// StatsChecksumMismatch returns the count of incoming packets that were dropped because their checksum did not match. This indicates corruption on the network path.
+func StatsChecksumMismatch() uint64 {
+	return atomic.LoadUint64(&statsChecksumMismatch)
+}
+
+// statsSignatureInvalid is the count of incoming packets dropped due to an invalid signature
+var statsSignatureInvalid uint64
+
+// StatsSignatureInvalid returns the count of incoming packets that were dropped because no sender public key could be recovered from the signature.
+func StatsSignatureInvalid() uint64 {
+	return atomic.LoadUint64(&statsSignatureInvalid)
+}
+
+// statsPacketsDuplicate is the count of incoming packets dropped as duplicates based on their sequence number
+var statsPacketsDuplicate uint64
+
+// StatsPacketsDuplicate returns the count of incoming packets from peers that were dropped because their sequence number was received before.
+func StatsPacketsDuplicate() uint64 {
+	return atomic.LoadUint64(&statsPacketsDuplicate)
+}
+
+// statsAnnouncementsDropped is the count of incoming announcements dropped due to config.AnnouncementLimit
+var statsAnnouncementsDropped uint64
+
+// StatsAnnouncementsDropped returns the count of incoming announcements that were dropped because the source IP exceeded config.AnnouncementLimit.
+func StatsAnnouncementsDropped() uint64 {
+	return atomic.LoadUint64(&statsAnnouncementsDropped)
+}
+
+// statsConnectionsInvalidated is the count of active connections of all peers that were invalidated
+var statsConnectionsInvalidated uint64
+
+// statsConnectionsRemoved is the count of connections of all peers that were removed
+var statsConnectionsRemoved uint64
+
+// StatsConnectionsInvalidated returns the count of active connections of all peers that were invalidated, for example because no packet was received in time.
+// A high rate indicates a flaky network where connections are constantly dropped and rebuilt. See PeerInfo.StatsConnectionsInvalidated for the count per peer.
+func StatsConnectionsInvalidated() uint64 {
+	return atomic.LoadUint64(&statsConnectionsInvalidated)
+}
+
+// StatsConnectionsRemoved returns the count of connections of all peers that were removed, either because they expired as inactive or because the peer was removed.
+func StatsConnectionsRemoved() uint64 {
+	return atomic.LoadUint64(&statsConnectionsRemoved)
+}
+
+// statsConnectionInvalidated counts an invalidated connection of the peer
+func (peer *PeerInfo) statsConnectionInvalidated() {
+	atomic.AddUint64(&peer.StatsConnectionsInvalidated, 1)
+	atomic.AddUint64(&statsConnectionsInvalidated, 1)
+}
+
+// statsConnectionsRemoved counts removed connections of the peer
+func (peer *PeerInfo) statsConnectionsRemoved(count int) {
+	if count <= 0 {
+		return
+	}
+	atomic.AddUint64(&peer.StatsConnectionsRemoved, uint64(count))
+	atomic.AddUint64(&statsConnectionsRemoved, uint64(count))
+}
+
+// statsIn counts an incoming packet
+func (network *Network) statsIn(length int) {
+	atomic.AddUint64(&network.stats.packetsIn, 1)
+	atomic.AddUint64(&network.stats.bytesIn, uint64(length))
+	atomic.AddUint64(&statsTotal.packetsIn, 1)
+	atomic.AddUint64(&statsTotal.bytesIn, uint64(length))
+}
+
+// statsOut counts an outgoing packet
+func (network *Network) statsOut(length int) {
+	atomic.AddUint64(&network.stats.packetsOut, 1)
+	atomic.AddUint64(&network.stats.bytesOut, uint64(length))
+	atomic.AddUint64(&statsTotal.packetsOut, 1)
+	atomic.AddUint64(&statsTotal.bytesOut, uint64(length))
+}
+
+// statsDropped counts a received packet that was dropped
+func (network *Network) statsDropped() {
+	atomic.AddUint64(&network.stats.packetsDropped, 1)
+	atomic.AddUint64(&statsTotal.packetsDropped, 1)
+}
+
+// ListenerStats contains the statistics of a single network (listening IP:Port)
+type ListenerStats struct {
+	Address           *net.UDPAddr // IP:Port where the network listens
+	Adapter           string       // Adapter name
+	PacketsIn         uint64       // Packets received
+	BytesIn           uint64       // Bytes received
+	PacketsOut        uint64       // Packets sent
+	BytesOut          uint64       // Bytes sent
+	PacketsDropped    uint64       // Received packets that were dropped
+	ConnectionsActive int          // Count of active (including redundant) connections using the network
+}
+
+// NetworkStatsPerListener returns the statistics for each network
+func NetworkStatsPerListener() (stats []ListenerStats) {
+	// count active connections per network
+	connections := make(map[*Network]int)
+	for _, peer := range PeerlistGet() {
+		for _, connection := range peer.GetConnections(true) {
+			connections[connection.Network]++
+		}
+	}
+
+	networksMutex.RLock()
+	defer networksMutex.RUnlock()
+
+	for _, networks := range [][]*Network{networks6, networks4} {
+		for _, network := range networks {
+			stats = append(stats, ListenerStats{
+				Address:           network.address,
+				Adapter:           network.GetAdapterName(),
+				PacketsIn:         atomic.LoadUint64(&network.stats.packetsIn),
+				BytesIn:           atomic.LoadUint64(&network.stats.bytesIn),
+				PacketsOut:        atomic.LoadUint64(&network.stats.packetsOut),
+				BytesOut:          atomic.LoadUint64(&network.stats.bytesOut),
+				PacketsDropped:    atomic.LoadUint64(&network.stats.packetsDropped),
+				ConnectionsActive: connections[network],
+			})
+		}
+	}
+
+	return stats
+}
+
+// TotalStats contains the aggregate statistics of all networks and peers
+type TotalStats struct {
+	PacketsIn           uint64 // Packets received on all networks, including closed ones
+	BytesIn             uint64 // Bytes received on all networks, including closed ones
+	PacketsOut          uint64 // Packets sent on all networks, including closed ones
+	BytesOut            uint64 // Bytes sent on all networks, including closed ones
+	PacketsDropped      uint64 // Received packets that were dropped due to invalid size or a full incoming channel, including closed networks
+	Peers               int    // Count of peers in the peer list
+	ConnectionsActive   int    // Count of active (including redundant) connections across all peers
+	ConnectionsInactive int    // Count of inactive connections across all peers
+
+	ConnectionsInvalidated uint64 // Count of active connections that were invalidated, see StatsConnectionsInvalidated
+	ConnectionsRemoved     uint64 // Count of connections that were removed, see StatsConnectionsRemoved
+}
+
+// NetworkStats returns the aggregate statistics. The traffic counters are cumulative since the start of the process and do not decrease when a network is closed.
+// See NetworkStatsPerListener for the counters of the current networks.
+func NetworkStats() (stats TotalStats) {
+	for _, listener := range NetworkStatsPerListener() {
+		stats.ConnectionsActive += listener.ConnectionsActive
+	}
+
+	stats.PacketsIn = atomic.LoadUint64(&statsTotal.packetsIn)
+	stats.BytesIn = atomic.LoadUint64(&statsTotal.bytesIn)
+	stats.PacketsOut = atomic.LoadUint64(&statsTotal.packetsOut)
+	stats.BytesOut = atomic.LoadUint64(&statsTotal.bytesOut)
+	stats.PacketsDropped = atomic.LoadUint64(&statsTotal.packetsDropped)
+
+	for _, peer := range PeerlistGet() {
+		stats.Peers++
+
+		peer.RLock()
+		stats.ConnectionsInactive += len(peer.connectionInactive)
+		peer.RUnlock()
+	}
+
+	stats.ConnectionsInvalidated = StatsConnectionsInvalidated()
+	stats.ConnectionsRemoved = StatsConnectionsRemoved()
+
+	return stats
+}
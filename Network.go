@@ -7,9 +7,10 @@ Author:     Peter Kleissner
 package core
 
 import (
+	"context"
 	"errors"
-	"log"
 	"net"
+	"runtime/debug"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -24,11 +25,17 @@ type Network struct {
 	socket          *net.UDPConn     // active socket for send/receive
 	multicastIP     net.IP           // Multicast IP, IPv6 only.
 	multicastSocket net.PacketConn   // Multicast socket, IPv6 only.
+	multicastActive bool             // If the Multicast group was joined successfully, IPv6 only.
 	broadcastSocket net.PacketConn   // Broadcast socket, IPv4 only.
 	broadcastIPv4   []net.IP         // Broadcast IPs, IPv4 only.
 	isTerminated    bool             // If true, the network was signaled for termination
 	terminateSignal chan interface{} // gets closed on termination signal, can be used in select via "case _ = <- network.terminateSignal:"
 	sync.RWMutex                     // for sychronized closing
+	workers         sync.WaitGroup   // Listen routines of the network, see startWorker
+	observed        networkObserved  // Samples of the external address as observed by peers
+	stun            networkSTUN      // External address detected via STUN
+	upnp            networkUPnP      // Port mapping via UPnP
+	stats           networkStats     // Statistics
 }
 
 // networks is a list of all connected networks
@@ -50,8 +57,14 @@ func (network *Network) AutoAssignPort(ip net.IP, port int) (err error) {
 	// A common error return is "bind: The requested address is not valid in its context.".
 	// This error was observed when the network interface might not be ready after boot but also when listening on a link-local IPv4 (169.254.) for an inactive adapter.
 	// Previously the algorithm retried up to n times, but this would unnecessarily delay startup in case the IP is actual unlistenable.
+	// Link-local IPv6 addresses require the zone to listen on.
+	zone := ""
+	if network.iface != nil && IsIPv6(ip) && ip.IsLinkLocalUnicast() {
+		zone = network.iface.Name
+	}
+
 	connectPortTry := func(port int) (address *net.UDPAddr, socket *net.UDPConn, err error) {
-		address = &net.UDPAddr{IP: ip, Port: port}
+		address = &net.UDPAddr{IP: ip, Port: port, Zone: zone}
 		if socket, err = net.ListenUDP(networkA, address); err != nil {
 			return nil, nil, err
 		}
@@ -72,6 +85,17 @@ func (network *Network) AutoAssignPort(ip net.IP, port int) (err error) {
 		return err
 	}
 
+	// If a port range is configured, only ports within it are used.
+	if config.PortRangeStart > 0 {
+		for port = config.PortRangeStart; port <= config.PortRangeEnd; port++ {
+			if network.address, network.socket, err = connectPortTry(port); err == nil {
+				return nil
+			}
+		}
+
+		return ErrPortRangeExhausted
+	}
+
 	// try default main port, then random
 	if network.address, network.socket, err = connectPortTry(defaultPort); err == nil {
 		return nil
@@ -84,113 +108,370 @@ func (network *Network) AutoAssignPort(ip net.IP, port int) (err error) {
 	return err
 }
 
+// linkLocalZone returns the zone (adapter name) to use for the IP via this network. Link-local IPv6 addresses are only unique per adapter and require the zone. Empty for other IPs or if the adapter is not known.
+func (network *Network) linkLocalZone(ip net.IP) string {
+	if network.iface == nil || !IsIPv6(ip) || !ip.IsLinkLocalUnicast() {
+		return ""
+	}
+	return network.iface.Name
+}
+
+// ErrPortRangeExhausted is returned if no port in the range config.PortRangeStart to config.PortRangeEnd could be listened on
+var ErrPortRangeExhausted = errors.New("no free port in the configured port range")
+
+// ErrNetworkTerminated is returned when sending via a network that was terminated
+var ErrNetworkTerminated = errors.New("network terminated")
+
 // send sends a message
 func (network *Network) send(IP net.IP, port int, raw []byte) (err error) {
-	_, err = network.socket.WriteTo(raw, &net.UDPAddr{IP: IP, Port: port})
+	if network.IsTerminated() {
+		return ErrNetworkTerminated
+	}
+
+	_, err = network.socket.WriteTo(raw, &net.UDPAddr{IP: IP, Port: port, Zone: network.linkLocalZone(IP)})
+	if err == nil {
+		network.statsOut(len(raw))
+	}
 	return err
 }
 
+// IsTerminated checks if the network was terminated
+func (network *Network) IsTerminated() bool {
+	network.RLock()
+	defer network.RUnlock()
+
+	return network.isTerminated
+}
+
 // Currently packets are maxed at 4 KB. This is going to be refined.
 const maxPacketSize = 4096
 
-// Listen starts listening for incoming packets on the given UDP connection
+// packetBufferPool reuses the buffers for incoming packets to reduce allocations. Buffers are returned by the packet worker after processing.
+var packetBufferPool = sync.Pool{New: func() interface{} { return make([]byte, maxPacketSize) }}
+
+// packetBufferGet returns a buffer for an incoming packet. If config.DisableBufferPool is set, a new buffer is allocated.
+func packetBufferGet() []byte {
+	if config.DisableBufferPool {
+		return make([]byte, maxPacketSize)
+	}
+	return packetBufferPool.Get().([]byte)
+}
+
+// packetBufferPut returns a buffer to the pool. The buffer must not be used afterwards.
+func packetBufferPut(buffer []byte) {
+	if config.DisableBufferPool || cap(buffer) != maxPacketSize {
+		return
+	}
+	packetBufferPool.Put(buffer[:maxPacketSize])
+}
+
+// Listen starts listening for incoming packets on the given UDP connection. On Linux multiple packets are read per system call, see Network Batch Linux.go.
 func (network *Network) Listen() {
-	for !network.isTerminated {
-		// Buffer: Must be created for each packet as it is passed as pointer.
+	if network.listenBatch() {
+		return
+	}
+
+	network.listenSingle()
+}
+
+// listenSingle reads incoming packets one by one until the network is terminated. It is the portable fallback if batch reading is not available.
+func (network *Network) listenSingle() {
+	for !network.IsTerminated() {
+		// Buffer: Each packet needs its own buffer as it is passed to the workers. It is taken from the pool and returned by the worker after processing.
 		// If the buffer is too small, ReadFromUDP only reads until its length and returns this error: "wsarecvfrom: A message sent on a datagram socket was larger than the internal message buffer or some other network limit, or the buffer used to receive a datagram into was smaller than the datagram itself."
-		buffer := make([]byte, maxPacketSize)
+		buffer := packetBufferGet()
 		length, sender, err := network.socket.ReadFromUDP(buffer)
 
 		if err != nil {
 			// Exit on closed socket. Error will be "use of closed network connection".
-			if network.isTerminated {
+			if network.IsTerminated() {
+				packetBufferPut(buffer)
 				return
 			}
 
-			log.Printf("Listen Error receiving UDP message: %v\n", err) // Only log for debug purposes.
-			time.Sleep(time.Millisecond * 50)                           // In case of endless errors, prevent ddos of CPU.
+			logger.Debugf("Listen Error receiving UDP message: %v\n", err) // Only log for debug purposes.
+			time.Sleep(time.Millisecond * 50)                              // In case of endless errors, prevent ddos of CPU.
+			packetBufferPut(buffer)
 			continue
 		}
 
-		if length < packetLengthMin {
-			// Discard packets that do not meet the minimum length.
-			continue
-		}
+		network.receive(buffer, length, sender)
+	}
+}
+
+// receive handles a packet received on the listening socket. The buffer is passed to the workers or returned to the pool.
+func (network *Network) receive(buffer []byte, length int, sender *net.UDPAddr) {
+	network.statsIn(length)
+
+	// Responses to STUN requests are sent to the listening socket.
+	if stunResponse(buffer[:length]) {
+		packetBufferPut(buffer)
+		return
+	}
 
-		// send the packet to a channel which is processed by multiple workers.
-		rawPacketsIncoming <- networkWire{network: network, sender: sender, raw: buffer[:length], receiverPublicKey: peerPublicKey, unicast: true}
+	if length < packetLengthMin {
+		// Discard packets that do not meet the minimum length.
+		network.statsDropped()
+		packetBufferPut(buffer)
+		return
 	}
+
+	// send the packet to a channel which is processed by multiple workers.
+	packetEnqueue(networkWire{network: network, sender: sender, raw: buffer[:length], receiverPublicKey: peerPublicKey, unicast: true})
 }
 
-// packetWorker handles incoming packets.
-func packetWorker(packets <-chan networkWire) {
-	for packet := range packets {
-		decoded, senderPublicKey, err := PacketDecrypt(packet.raw, packet.receiverPublicKey)
-		if err != nil {
-			//log.Printf("packetWorker Error decrypting packet from '%s': %s\n", packet.sender.String(), err.Error())
-			continue
-		}
+// Policies if the channel for incoming packets is full
+const (
+	IncomingDropNewest       = "DropNewest"       // Drop the incoming packet immediately. Best for latency.
+	IncomingBlockWithTimeout = "BlockWithTimeout" // Wait up to config.IncomingBlockTimeout for a free slot, then drop. Applies backpressure to the read loop, best for lossless small bursts.
+)
 
-		// immediately discard message if sender = self
-		if senderPublicKey.IsEqual(peerPublicKey) {
-			continue
+// statsIncomingDropped is the count of incoming packets dropped because the channel was full
+var statsIncomingDropped uint64
+
+// incomingDroppedLogged is the time (Unix nanoseconds) of the last warning about dropped packets, and the count of dropped packets at that time
+var incomingDroppedLogged, incomingDroppedLoggedCount uint64
+
+// incomingDroppedLogInterval is the minimum time between warnings about dropped packets
+const incomingDroppedLogInterval = time.Minute
+
+// packetEnqueue passes the incoming packet to the workers. If the channel is full, the packet is handled according to config.IncomingPolicy.
+func packetEnqueue(packet networkWire) {
+	select {
+	case rawPacketsIncoming <- packet:
+		return
+	default:
+	}
+
+	if config.IncomingPolicy == IncomingBlockWithTimeout {
+		timer := time.NewTimer(time.Duration(config.IncomingBlockTimeout) * time.Millisecond)
+		defer timer.Stop()
+
+		select {
+		case rawPacketsIncoming <- packet:
+			return
+		case <-timer.C:
 		}
+	}
 
-		// supported protocol version
-		if decoded.Protocol != 0 {
-			continue
+	dropped := atomic.AddUint64(&statsIncomingDropped, 1)
+	packet.network.statsDropped()
+	packetBufferPut(packet.raw)
+
+	// The warning is throttled, since drops typically come in bursts.
+	now := uint64(time.Now().UnixNano())
+	last := atomic.LoadUint64(&incomingDroppedLogged)
+	if now-last >= uint64(incomingDroppedLogInterval) && atomic.CompareAndSwapUint64(&incomingDroppedLogged, last, now) {
+		since := atomic.SwapUint64(&incomingDroppedLoggedCount, dropped)
+		logger.Warnf("packetEnqueue incoming packet channel full, dropped %d packets (%d total). Consider increasing ListenWorkers.\n", dropped-since, dropped)
+	}
+}
+
+// StatsPacketsDropped returns the count of incoming packets dropped by the application because the packet workers could not keep up.
+// Packets dropped by the OS before they are read from the socket are not included.
+func StatsPacketsDropped() uint64 {
+	return atomic.LoadUint64(&statsIncomingDropped)
+}
+
+// IncomingPolicy returns the policy if the channel for incoming packets is full, and the count of packets dropped because of it
+func IncomingPolicy() (policy string, dropped uint64) {
+	return config.IncomingPolicy, atomic.LoadUint64(&statsIncomingDropped)
+}
+
+// packetWorker handles incoming packets until the stop channel is closed.
+func packetWorker(ctx context.Context, packets <-chan networkWire) {
+	defer packetWorkers.Done()
+
+	for {
+		select {
+		case packet := <-packets:
+			packetProcess(packet)
+
+			// The buffer is no longer used after processing. Decoded data such as the payload is copied.
+			packetBufferPut(packet.raw)
+
+		case <-ctx.Done():
+			return
 		}
+	}
+}
 
-		connection := &Connection{Network: packet.network, Address: packet.sender, Status: ConnectionActive}
+// packetProcess decrypts an incoming packet and calls the handler.
+func packetProcess(packet networkWire) {
+	// Broadcast and Multicast packets may be received on multiple sockets.
+	if !packet.unicast && packetSeenBefore(packet.raw) {
+		return
+	}
 
-		peer := PeerlistLookup(senderPublicKey)
-		if peer != nil {
-			// Existing peers: Update statistics and network address if new
-			atomic.AddUint64(&peer.StatsPacketReceived, 1)
-			connection = peer.registerConnection(connection)
+	decoded, senderPublicKey, err := PacketDecrypt(packet.raw, packet.receiverPublicKey)
+	if err == ErrChecksumMismatch {
+		atomic.AddUint64(&statsChecksumMismatch, 1)
+		return
+	} else if err == ErrSignatureInvalid {
+		atomic.AddUint64(&statsSignatureInvalid, 1)
+		captiveCheckInvalidPacket(&packet)
+		return
+	} else if err != nil {
+		//log.Printf("packetWorker Error decrypting packet from '%s': %s\n", packet.sender.String(), err.Error())
+		captiveCheckInvalidPacket(&packet)
+		return
+	}
+
+	// immediately discard message if sender = self
+	if senderPublicKey.IsEqual(peerPublicKey) {
+		// An announcement from a foreign address indicates another node using the same private key.
+		if decoded.Command == CommandAnnouncement {
+			duplicateIdentityCheck(packet.sender, packet.raw, decoded.Payload)
 		}
+		return
+	}
 
-		connection.LastPacketIn = time.Now()
+	// supported protocol version
+	if decoded.Protocol != 0 {
+		return
+	}
 
-		// process the packet
-		message := &packet2{SenderPublicKey: senderPublicKey, PacketRaw: *decoded, connection: connection}
+	// Banned peers are ignored entirely. No response is sent.
+	if IsPeerBanned(senderPublicKey) {
+		return
+	}
 
-		switch decoded.Command {
-		case CommandAnnouncement: // Announce
-			peer.cmdAnouncement(message)
+	// Announcements above the limit and replayed ones are dropped. Broadcast and Multicast duplicates were already filtered above.
+	if decoded.Command == CommandAnnouncement && !announcementAccept(packet.sender, packet.raw, decoded.Payload) {
+		return
+	}
+
+	// The zone of link-local senders identifies the adapter, in case the OS did not report it.
+	if packet.sender.Zone == "" {
+		packet.sender.Zone = packet.network.linkLocalZone(packet.sender.IP)
+	}
+
+	connection := &Connection{Network: packet.network, Address: packet.sender, Status: ConnectionActive}
+	connection.statusReason.Store("active: new connection")
+
+	peer := PeerlistLookup(senderPublicKey)
+
+	// Drop packets from peers exceeding their rate limit.
+	if peer != nil && !peer.rateLimitAllow(len(packet.raw)) {
+		return
+	}
 
-		case CommandResponse: // Response
-			peer.cmdResponse(message)
+	// Drop duplicates of packets with a sequence number.
+	if peer != nil && decoded.Sequence != 0 && peer.sequenceIn.isDuplicate(decoded.Sequence) {
+		atomic.AddUint64(&statsPacketsDuplicate, 1)
+		return
+	}
+
+	if peer != nil {
+		// Existing peers: Update statistics and network address if new
+		atomic.AddUint64(&peer.StatsPacketReceived, 1)
+		atomic.AddUint64(&peer.StatsBytesReceived, uint64(len(packet.raw)))
+		connection = peer.registerConnection(connection)
+	}
 
-		case CommandPing: // Ping
-			peer.cmdPing(message)
+	connection.LastPacketIn = time.Now()
 
-		case CommandPong: // Ping
-			peer.cmdPong(message)
+	if peer != nil {
+		peer.Lock()
+		peer.LastSeen = connection.LastPacketIn
+		peer.Unlock()
+	}
 
-		case CommandChat: // Chat [debug]
-			peer.cmdChat(message)
+	// process the packet
+	message := &packet2{SenderPublicKey: senderPublicKey, PacketRaw: *decoded, connection: connection, multicast: !packet.unicast}
 
-		default: // Unknown command
+	packetDispatch(peer, message)
+}
 
+// packetDispatch calls the handler for the command. Peer is nil if the sender is not in the peer list.
+// A panic in a handler (for example caused by a malformed packet) is logged and counted, and does not stop the packet worker.
+func packetDispatch(peer *PeerInfo, message *packet2) {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddUint64(&statsHandlerPanics, 1)
+			logger.Errorf("packetDispatch panic in handler for command %d from '%s': %v\n%s\n", message.Command, message.connection.Address.String(), r, debug.Stack())
 		}
+	}()
+
+	switch message.Command {
+	case CommandAnnouncement: // Announce
+		peer.cmdAnouncement(message)
+
+	case CommandResponse: // Response
+		peer.cmdResponse(message)
 
+	case CommandPing: // Ping
+		peer.cmdPing(message)
+
+	case CommandPong: // Ping
+		peer.cmdPong(message)
+
+	case CommandDisconnect: // Disconnect
+		peer.cmdDisconnect(message)
+
+	case CommandGet: // Get blocks
+		peer.cmdGet(message)
+
+	case CommandGetResponse: // Response to get blocks
+		peer.cmdGetResponse(message)
+
+	case CommandChallenge: // Challenge to confirm our address
+		peer.cmdChallenge(message)
+
+	case CommandChallengeEcho: // Echo of our challenge
+		peer.cmdChallengeEcho(message)
+
+	case CommandRekey: // New ephemeral key
+		peer.cmdRekey(message)
+
+	case CommandPeerRequest: // Request for known peers
+		peer.cmdPeerRequest(message)
+
+	case CommandPeerResponse: // Known peers
+		peer.cmdPeerResponse(message)
+
+	case CommandFragment: // Fragment of a larger packet
+		peer.cmdFragment(message)
+
+	case CommandReliable: // Packet to acknowledge
+		peer.cmdReliable(message)
+
+	case CommandAck: // Acknowledgement of a reliable packet
+		peer.cmdAck(message)
+
+	case CommandChat: // Chat [debug]
+		peer.cmdChat(message)
+
+	case CommandChatReliable: // Chat to acknowledge [debug]
+		peer.cmdChatReliable(message)
+
+	case CommandChatAck: // Chat acknowledgement [debug]
+		peer.cmdChatAck(message)
+
+	default: // Custom command registered by the application, otherwise unknown
+		commandHandlerCall(peer, message)
 	}
 }
 
-// GetNetworks returns the list of connected networks
+// GetNetworks returns a copy of the list of connected networks
 func GetNetworks(networkType int) (networks []*Network) {
+	networksMutex.RLock()
+	defer networksMutex.RUnlock()
+
 	switch networkType {
 	case 4:
-		return networks4
+		return append(networks, networks4...)
 	case 6:
-		return networks6
+		return append(networks, networks6...)
 	}
 	return nil
 }
 
 // GetListen returns connectivity information
 func (network *Network) GetListen() (listen *net.UDPAddr, multicastIPv6 net.IP, broadcastIPv4 []net.IP) {
+	network.RLock()
+	defer network.RUnlock()
+
 	return network.address, network.multicastIP, network.broadcastIPv4
 }
 
@@ -202,12 +483,13 @@ func (network *Network) GetAdapterName() string {
 	return "[unknown adapter]"
 }
 
-// Terminate sends the termination signal to all workers. It is safe to call Terminate multiple times.
+// Terminate sends the termination signal to all workers and waits until all listen routines of the network exited. It is safe to call Terminate multiple times.
 func (network *Network) Terminate() {
 	network.Lock()
-	defer network.Unlock()
 
 	if network.isTerminated {
+		network.Unlock()
+		network.workers.Wait()
 		return
 	}
 
@@ -216,5 +498,34 @@ func (network *Network) Terminate() {
 	close(network.terminateSignal) // safety guaranteed via lock
 	network.socket.Close()         // Will stop the listener from blocking on network.socket.ReadFromUDP
 
+	// The Multicast and Broadcast listeners stop the same way.
+	if network.multicastSocket != nil {
+		network.multicastSocket.Close()
+	}
+	if network.broadcastSocket != nil {
+		network.broadcastSocket.Close()
+	}
+
 	removeListenAddress(network.address)
+	network.Unlock()
+
+	network.workers.Wait()
+}
+
+// startWorker starts a listen routine of the network, unless the network is terminated. Terminate waits for all started routines to exit.
+func (network *Network) startWorker(worker func()) bool {
+	network.Lock()
+	defer network.Unlock()
+
+	if network.isTerminated {
+		return false
+	}
+
+	network.workers.Add(1)
+	go func() {
+		defer network.workers.Done()
+		worker()
+	}()
+
+	return true
 }
@@ -0,0 +1,277 @@
+/*
+File Name:  Network_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package core
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// testPacketWire encrypts the packet from the sender to this node and returns it as received via the network
+func testPacketWire(t *testing.T, sender *btcec.PrivateKey, network *Network, address *net.UDPAddr, packet *PacketRaw) networkWire {
+	raw, err := PacketEncrypt(sender, peerPublicKey, packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return networkWire{network: network, sender: address, raw: raw, receiverPublicKey: peerPublicKey, unicast: true}
+}
+
+// testCommandHandler registers a handler for the custom command that counts the incoming messages. It is removed when the test ends.
+func testCommandHandler(t *testing.T, command uint8) (count *uint64) {
+	count = new(uint64)
+	RegisterCommandHandler(command, func(peer *PeerInfo, msg *Message) {
+		atomic.AddUint64(count, 1)
+	})
+	t.Cleanup(func() { RegisterCommandHandler(command, nil) })
+
+	return count
+}
+
+// testNetworkLoopback returns a new network listening on the IPv4 loopback address. It is terminated when the test ends.
+func testNetworkLoopback(t *testing.T) (network *Network) {
+	socket, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("loopback not available: %v", err)
+	}
+
+	network = &Network{socket: socket, address: socket.LocalAddr().(*net.UDPAddr), terminateSignal: make(chan interface{})}
+	t.Cleanup(network.Terminate)
+
+	return network
+}
+
+// testNetworksRegister replaces the list of networks, as used for sending to addresses without a connection. The previous list is restored when the test ends.
+func testNetworksRegister(t *testing.T, networks ...*Network) {
+	networksMutex.Lock()
+	networks4Old, networks6Old := networks4, networks6
+	networks4, networks6 = nil, nil
+	for _, network := range networks {
+		if IsIPv4(network.address.IP) {
+			networks4 = append(networks4, network)
+		} else {
+			networks6 = append(networks6, network)
+		}
+	}
+	networksMutex.Unlock()
+
+	t.Cleanup(func() {
+		networksMutex.Lock()
+		networks4, networks6 = networks4Old, networks6Old
+		networksMutex.Unlock()
+	})
+}
+
+// testRemote is a simulated remote node. Its packets are processed as if received via the network, replies are read from its socket.
+type testRemote struct {
+	privateKey *btcec.PrivateKey
+	publicKey  *btcec.PublicKey
+	socket     *net.UDPConn
+	network    *Network // Network of this node that receives the packets
+}
+
+// testRemoteNew creates a new remote node with its own identity and socket
+func testRemoteNew(t *testing.T, network *Network) (remote *testRemote) {
+	remote = &testRemote{network: network}
+
+	var err error
+	if remote.privateKey, remote.publicKey, err = Secp256k1NewPrivateKey(); err != nil {
+		t.Fatal(err)
+	}
+	if remote.socket, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+		t.Skipf("loopback not available: %v", err)
+	}
+	t.Cleanup(func() { remote.socket.Close() })
+
+	return remote
+}
+
+// address returns the address of the remote node
+func (remote *testRemote) address() *net.UDPAddr {
+	address := *remote.socket.LocalAddr().(*net.UDPAddr)
+	return &address
+}
+
+// send processes the packet from the remote node. The source address may be spoofed.
+func (remote *testRemote) send(t *testing.T, packet *PacketRaw, source *net.UDPAddr) {
+	packetProcess(testPacketWire(t, remote.privateKey, remote.network, source, packet))
+}
+
+// receive returns the next packet sent to the remote node, or nil if none arrives within the timeout
+func (remote *testRemote) receive(t *testing.T, timeout time.Duration) (packet *PacketRaw) {
+	buffer := make([]byte, maxPacketSize)
+	remote.socket.SetReadDeadline(time.Now().Add(timeout))
+
+	for {
+		length, err := remote.socket.Read(buffer)
+		if err != nil {
+			return nil
+		}
+		if length < packetLengthMin {
+			continue
+		}
+
+		packet, sender, err := PacketDecrypt(buffer[:length], remote.publicKey)
+		if err != nil || !sender.IsEqual(peerPublicKey) {
+			t.Fatalf("invalid packet received: %v", err)
+		}
+		return packet
+	}
+}
+
+// peerlistAdd adds the remote node to the peer list with an active connection via the network
+func (remote *testRemote) peerlistAdd(t *testing.T) (peer *PeerInfo) {
+	peer, _ = PeerlistAdd(remote.publicKey, &Connection{Network: remote.network, Address: remote.address(), Status: ConnectionActive, LastPacketIn: time.Now()})
+	if peer == nil {
+		t.Fatal("remote node not added to the peer list")
+	}
+	return peer
+}
+
+// announcement returns a new announcement of the remote node with the given protocol version
+func (remote *testRemote) announcement(t *testing.T, protocolVersion uint16) *PacketRaw {
+	_, ephemeral, err := Secp256k1NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate := make([]byte, btcec.PubKeyBytesLenCompressed+8)
+	copy(certificate, ephemeral.SerializeCompressed())
+	binary.LittleEndian.PutUint64(certificate[btcec.PubKeyBytesLenCompressed:], uint64(time.Now().Add(time.Hour).Unix()))
+	signature, err := btcec.SignCompact(btcec.S256(), remote.privateKey, hashData(certificate), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version := make([]byte, protocolVersionSizeMin)
+	binary.LittleEndian.PutUint16(version[0:2], protocolVersion)
+
+	payload := []byte{0, 0} // reachability, no endpoints
+	payload = append(payload, certificate...)
+	payload = append(payload, signature...)
+	payload = append(payload, version...)
+	payload = append(payload, encodeAnnouncementTime()...)
+
+	return &PacketRaw{Command: CommandAnnouncement, Payload: payload}
+}
+
+func TestListenWorkers(t *testing.T) {
+	for _, workers := range []int{-1, 0, 1, 4} {
+		testConfig(t)
+		config.ListenWorkers = workers
+		configDefaults()
+		testInitPeer(t)
+
+		expected := workers
+		if workers <= 0 {
+			expected = defaultListenWorkers
+		}
+		if config.ListenWorkers != expected {
+			t.Fatalf("ListenWorkers %d: effective %d, expected %d", workers, config.ListenWorkers, expected)
+		}
+
+		count := testCommandHandler(t, CommandUserMin)
+		sender, _, _ := Secp256k1NewPrivateKey()
+		network := &Network{address: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 112}}
+
+		const packets = 50
+		incoming := make(chan networkWire, packets)
+		for n := 0; n < packets; n++ {
+			address := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000 + n}
+			incoming <- testPacketWire(t, sender, network, address, &PacketRaw{Command: CommandUserMin})
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		for n := 0; n < config.ListenWorkers; n++ {
+			packetWorkers.Add(1)
+			go packetWorker(ctx, incoming)
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+		for atomic.LoadUint64(count) < packets && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+		packetWorkers.Wait()
+
+		if processed := atomic.LoadUint64(count); processed != packets {
+			t.Fatalf("ListenWorkers %d: %d of %d packets processed", workers, processed, packets)
+		}
+	}
+}
+
+func TestLinkLocalZone(t *testing.T) {
+	testConfig(t)
+	testInitPeer(t)
+	testCommandHandler(t, CommandUserMin)
+
+	eth7 := &Network{iface: &net.Interface{Index: 7, Name: "eth7"}, address: &net.UDPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth7"}}
+	eth8 := &Network{iface: &net.Interface{Index: 8, Name: "eth8"}, address: &net.UDPAddr{IP: net.ParseIP("fe80::2"), Zone: "eth8"}}
+	testNetworksRegister(t, eth7, eth8)
+
+	if zone := eth8.linkLocalZone(net.ParseIP("2001:db8::1")); zone != "" {
+		t.Fatalf("zone %s for a global IPv6 address", zone)
+	}
+	if zone := eth8.linkLocalZone(net.ParseIP("169.254.1.1")); zone != "" {
+		t.Fatalf("zone %s for a link-local IPv4 address", zone)
+	}
+
+	// The peer is discovered via the second adapter. The OS did not report the zone.
+	privateKey, publicKey, err := Secp256k1NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, _ := PeerlistAdd(publicKey, testConnection(testNetwork, "192.0.2.1:112", time.Now()))
+
+	remoteIP := net.ParseIP("fe80::99")
+	packetProcess(testPacketWire(t, privateKey, eth8, &net.UDPAddr{IP: remoteIP, Port: 112}, &PacketRaw{Command: CommandUserMin}))
+
+	var connection *Connection
+	for _, c := range peer.GetConnections(true) {
+		if c.Address.IP.Equal(remoteIP) {
+			connection = c
+		}
+	}
+	if connection == nil {
+		t.Fatal("link-local connection not registered")
+	} else if connection.Address.Zone != "eth8" || connection.Network != eth8 {
+		t.Fatalf("link-local connection with zone '%s' via network '%s'", connection.Address.Zone, connection.Network.address.Zone)
+	}
+
+	// Link-local addresses are only reachable via the adapter of their zone.
+	if network := findNetworkForRemoteZone(remoteIP, connection.Address.Zone); network != eth8 {
+		t.Fatal("link-local connection not routed via the adapter of its zone")
+	}
+	if network := findNetworkForRemoteZone(remoteIP, "eth7"); network != eth7 {
+		t.Fatal("link-local address with zone eth7 not routed via eth7")
+	}
+}
+
+func TestNetworkStatsCumulative(t *testing.T) {
+	network := testNetworkLoopback(t)
+	before := NetworkStats()
+
+	testNetworksRegister(t, network)
+	if err := network.send(network.address.IP, network.address.Port, make([]byte, 10)); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	network.statsDropped()
+
+	// The counters of a closed network are kept in the totals.
+	testNetworksRegister(t)
+	network.Terminate()
+
+	after := NetworkStats()
+	if after.PacketsOut < before.PacketsOut+1 || after.BytesOut < before.BytesOut+10 || after.PacketsDropped < before.PacketsDropped+1 {
+		t.Fatalf("totals decreased after the network was closed: before %+v, after %+v", before, after)
+	}
+}
@@ -0,0 +1,125 @@
+/*
+File Name:  Observed Address.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Peers report the address they see us from in the response to an announcement. This allows to detect the external address (IP:Port) behind NAT.
+Only responses to handshakes started by us are used. Observed addresses in pongs are ignored, as they are sent by any connected peer at any time.
+
+A single party cannot move the believed external address: Only one sample per source network (/24 for IPv4, /48 for IPv6) is kept, and an address must be reported by a quorum of distinct source networks.
+Counting public keys instead would allow a single host to create any count of keys.
+
+Payload of CommandResponse:
+Offset  Size   Info
+0       16     Observed IP of the receiver (IPv4 in IPv6 format)
+16      2      Observed port of the receiver
+18      106    Optional: Certificate of the ephemeral key, see Ephemeral Key.go
+124     ?      Optional: Protocol version and user agent, see Protocol Version.go
+*/
+
+package core
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// ObservedAddress is an external address of a network as reported by a single peer
+type ObservedAddress struct {
+	Address   *net.UDPAddr     // Observed IP:Port
+	PublicKey *btcec.PublicKey // Peer who reported it
+	Source    net.IP           // IP of the peer who reported it
+	Time      time.Time        // When it was reported
+}
+
+// networkObserved contains the observed address samples for a network
+type networkObserved struct {
+	samples []ObservedAddress
+	sync.Mutex
+}
+
+// Default count of distinct source networks consulted and count of agreeing ones required.
+const defaultObservedAddrSamples = 8
+const defaultObservedAddrQuorum = 3
+
+const observedAddressSize = 18
+
+// encodeObservedAddress encodes the address as seen by us, to be sent to the remote peer
+func encodeObservedAddress(address *net.UDPAddr) (payload []byte) {
+	payload = make([]byte, observedAddressSize)
+	copy(payload[0:16], address.IP.To16())
+	binary.LittleEndian.PutUint16(payload[16:18], uint16(address.Port))
+	return payload
+}
+
+// decodeObservedAddress decodes an observed address. Returns nil if invalid.
+func decodeObservedAddress(payload []byte) (address *net.UDPAddr) {
+	if len(payload) < observedAddressSize {
+		return nil
+	}
+
+	ip := make(net.IP, 16)
+	copy(ip, payload[0:16])
+	port := int(binary.LittleEndian.Uint16(payload[16:18]))
+	if port == 0 || ip.IsUnspecified() {
+		return nil
+	}
+
+	return &net.UDPAddr{IP: ip, Port: port}
+}
+
+// observedSourceNetwork returns the network of the IP that counts as a single source: /24 for IPv4 and /48 for IPv6
+func observedSourceNetwork(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// recordObservedAddress records the observed address reported by a peer at the source IP. Only the latest sample per source network is kept.
+func (network *Network) recordObservedAddress(source net.IP, publicKey *btcec.PublicKey, address *net.UDPAddr) {
+	network.observed.Lock()
+	defer network.observed.Unlock()
+
+	sourceNetwork := observedSourceNetwork(source)
+
+	samples := network.observed.samples[:0]
+	for _, sample := range network.observed.samples {
+		if observedSourceNetwork(sample.Source) != sourceNetwork {
+			samples = append(samples, sample)
+		}
+	}
+	samples = append(samples, ObservedAddress{Address: address, PublicKey: publicKey, Source: source, Time: time.Now()})
+
+	// drop the oldest samples
+	if len(samples) > config.ObservedAddrSamples {
+		samples = samples[len(samples)-config.ObservedAddrSamples:]
+	}
+
+	network.observed.samples = samples
+}
+
+// ObservedAddresses returns the current samples of the observed external address, and the address agreed on by a quorum of source networks (nil if none).
+func (network *Network) ObservedAddresses() (samples []ObservedAddress, external *net.UDPAddr) {
+	network.observed.Lock()
+	defer network.observed.Unlock()
+
+	samples = make([]ObservedAddress, len(network.observed.samples))
+	copy(samples, network.observed.samples)
+
+	votes := make(map[string]int)
+	for _, sample := range samples {
+		key := sample.Address.String()
+		votes[key]++
+
+		if votes[key] >= config.ObservedAddrQuorum && (external == nil || votes[key] > votes[external.String()]) {
+			external = sample.Address
+		}
+	}
+
+	return samples, external
+}
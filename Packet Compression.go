@@ -0,0 +1,71 @@
+/*
+File Name:  Packet Compression.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+If config.PacketCompression is set, payloads above compressionThreshold are compressed using DEFLATE (RFC 1951) and flagged in the size field, see Packet Encoding.go.
+The compressed payload is only used if it is smaller. Incoming compressed payloads are always decompressed, so peers with compression disabled still read packets from peers with compression enabled.
+*/
+
+package core
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// compressionThreshold is the payload size in bytes above which payloads are compressed. Smaller payloads rarely benefit.
+const compressionThreshold = 128
+
+// compressionSizeMax is the maximum size of a decompressed payload. It protects against decompression bombs.
+const compressionSizeMax = 64 * 1024
+
+// ErrDecompression is returned if a compressed payload is invalid or exceeds compressionSizeMax
+var ErrDecompression = errors.New("invalid compressed payload")
+
+// compressionWriters reuses the compressors, as each one allocates several hundred KB
+var compressionWriters = sync.Pool{New: func() interface{} {
+	writer, _ := flate.NewWriter(nil, flate.DefaultCompression)
+	return writer
+}}
+
+// compressPayload compresses the payload. Returns nil if compression is disabled or does not reduce the size.
+func compressPayload(payload []byte) (compressed []byte) {
+	if !config.PacketCompression || len(payload) <= compressionThreshold {
+		return nil
+	}
+
+	var buffer bytes.Buffer
+	writer := compressionWriters.Get().(*flate.Writer)
+	defer compressionWriters.Put(writer)
+
+	writer.Reset(&buffer)
+	if _, err := writer.Write(payload); err != nil {
+		return nil
+	}
+	if err := writer.Close(); err != nil {
+		return nil
+	}
+
+	if buffer.Len() >= len(payload) {
+		return nil
+	}
+
+	return buffer.Bytes()
+}
+
+// decompressPayload decompresses the payload
+func decompressPayload(compressed []byte) (payload []byte, err error) {
+	reader := flate.NewReader(bytes.NewReader(compressed))
+	defer reader.Close()
+
+	if payload, err = ioutil.ReadAll(io.LimitReader(reader, compressionSizeMax+1)); err != nil || len(payload) > compressionSizeMax {
+		return nil, ErrDecompression
+	}
+
+	return payload, nil
+}
@@ -8,14 +8,21 @@ Offset  Size   Info
 0       4      Nonce
 4       1      Protocol version = 0
 5       1      Command
-6       2      Size of payload data
+6       2      Size of payload data. The highest bit indicates that a checksum follows the payload, the second highest bit that a sequence number follows, the third highest bit that the payload is compressed, the fourth highest bit that the payload is encrypted end-to-end.
 8       ?      Payload
+        4      Optional: Sequence number
+        4      Optional: CRC32 (IEEE) of the plaintext header, payload and sequence number
         ?      Randomized garbage
 ?		65     Signature, ECDSA secp256k1 512-bit + 1 header byte
 
 The peer ID of the sender, which is a ECDSA (secp256k1) 257-bit public key, can be extracted from the ECDSA signature.
 The signature is applied on the entire packet, which guarantees that the signature becomes invalid should someone try to forge the receiver (i.e. forward the packet).
 Because the signature could be a possible fingerpint, it is encrypted itself.
+
+The checksum is optional (see config.PacketChecksums). It detects corruption, for example due to faulty UDP checksum offloading, and distinguishes it from malformed or malicious packets.
+The sequence number is optional (see config.PacketSequence and Packet Sequence.go). It allows the receiver to drop duplicates.
+The payload may be compressed (see config.PacketCompression and Packet Compression.go). The size field and checksum refer to the compressed payload.
+The payload may be encrypted end-to-end after compression (see config.PayloadEncryption and Payload Encryption.go). The size field and checksum refer to the encrypted payload.
 */
 
 package core
@@ -23,6 +30,7 @@ package core
 import (
 	"encoding/binary"
 	"errors"
+	"hash/crc32"
 	"math/rand"
 
 	"github.com/btcsuite/btcd/btcec"
@@ -32,9 +40,11 @@ import (
 
 // PacketRaw is a decrypted P2P message
 type PacketRaw struct {
-	Protocol uint8  // Protocol version = 0
-	Command  uint8  // 0 = Announcement
-	Payload  []byte // Payload
+	Protocol  uint8  // Protocol version = 0
+	Command   uint8  // 0 = Announcement
+	Payload   []byte // Payload
+	Sequence  uint32 // Sequence number, 0 = none
+	Encrypted bool   // If the payload is encrypted end-to-end, see Payload Encryption.go
 }
 
 // The minimum packet size is 8 bytes (minimum header size) + 65 bytes (signature)
@@ -42,6 +52,27 @@ const packetLengthMin = 8 + signatureSize
 const signatureSize = 65
 const maxRandomGarbage = 20
 
+// sizeFlagChecksum is the flag in the size field indicating that a checksum follows the payload
+const sizeFlagChecksum = 0x8000
+
+// checksumSize is the size of the optional checksum
+const checksumSize = 4
+
+// sizeFlagSequence is the flag in the size field indicating that a sequence number follows the payload
+const sizeFlagSequence = 0x4000
+
+// sequenceSize is the size of the optional sequence number
+const sequenceSize = 4
+
+// sizeFlagCompressed is the flag in the size field indicating that the payload is compressed
+const sizeFlagCompressed = 0x2000
+
+// ErrChecksumMismatch is returned if the packet checksum does not match, which indicates corruption
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ErrSignatureInvalid is returned if no public key can be recovered from the packet signature
+var ErrSignatureInvalid = errors.New("invalid signature")
+
 // PacketDecrypt decrypts the packet, verifies its signature and returns a high-level version of the packet.
 func PacketDecrypt(raw []byte, receiverPublicKey *btcec.PublicKey) (packet *PacketRaw, senderPublicKey *btcec.PublicKey, err error) {
 	// Packet is assumed to be already checked for minimum length.
@@ -51,32 +82,80 @@ func PacketDecrypt(raw []byte, receiverPublicKey *btcec.PublicKey) (packet *Pack
 	nonce := make([]byte, 8)
 	copy(nonce[0:4], raw[0:4])
 	copy(nonce[4:8], raw[0:4])
+	keySalsa := publicKeyToSalsa20Key(receiverPublicKey)
+
+	// Decrypt the packet using Salsa20. It is decrypted before verifying the signature, so that the checksum can detect corruption first.
+	bufferDecrypted := make([]byte, len(raw)-signatureSize-4) // full length -signature -nonce
+	salsa20.XORKeyStream(bufferDecrypted[:], raw[4:len(raw)-signatureSize], nonce, keySalsa)
+
+	sizeField := binary.LittleEndian.Uint16(bufferDecrypted[2:4])
+	sizePayload := sizeField &^ (sizeFlagChecksum | sizeFlagSequence | sizeFlagCompressed | sizeFlagEncrypted)
+	hasChecksum := sizeField&sizeFlagChecksum != 0
+	hasSequence := sizeField&sizeFlagSequence != 0
+	isCompressed := sizeField&sizeFlagCompressed != 0
+	isEncrypted := sizeField&sizeFlagEncrypted != 0
+
+	sizeMax := len(bufferDecrypted) - 4
+	if hasChecksum {
+		sizeMax -= checksumSize
+	}
+	if hasSequence {
+		sizeMax -= sequenceSize
+	}
+	if int(sizePayload) > sizeMax { // invalid length?
+		return nil, nil, errors.New("invalid length field")
+	}
+
+	// Size of the header, payload and sequence number
+	sizeData := 4 + int(sizePayload)
+	if hasSequence {
+		sizeData += sequenceSize
+	}
+
+	if hasChecksum {
+		checksum := crc32.NewIEEE()
+		checksum.Write(raw[0:4])
+		checksum.Write(bufferDecrypted[0:sizeData])
+		if checksum.Sum32() != binary.LittleEndian.Uint32(bufferDecrypted[sizeData:sizeData+checksumSize]) {
+			return nil, nil, ErrChecksumMismatch
+		}
+	}
 
 	// Verify the signature and extract the public key from it.
 	var signature [signatureSize]byte
 	copy(signature[:], raw[len(raw)-signatureSize:])
-	keySalsa := publicKeyToSalsa20Key(receiverPublicKey)
 	salsa20.XORKeyStream(signature[:], signature[:], nonce, keySalsa)
 
+	// A modified packet either fails recovery or recovers a different public key, which cannot impersonate the original sender.
 	senderPublicKey, _, err = btcec.RecoverCompact(btcec.S256(), signature[:], hashData(raw[:len(raw)-signatureSize]))
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, ErrSignatureInvalid
 	}
 
-	// Decrypt the packet using Salsa20.
-	bufferDecrypted := make([]byte, len(raw)-signatureSize-4) // full length -signature -nonce
-	salsa20.XORKeyStream(bufferDecrypted[:], raw[4:len(raw)-signatureSize], nonce, keySalsa)
-
 	// copy all fields
-	packet = &PacketRaw{Protocol: bufferDecrypted[0], Command: bufferDecrypted[1]}
+	packet = &PacketRaw{Protocol: bufferDecrypted[0], Command: bufferDecrypted[1], Encrypted: isEncrypted}
+	payload := bufferDecrypted[4 : 4+int(sizePayload)]
 
-	sizePayload := binary.LittleEndian.Uint16(bufferDecrypted[2:4])
-	if int(sizePayload) > len(bufferDecrypted)-4 { // invalid length?
-		return nil, nil, errors.New("invalid length field")
+	// Decrypted and decompressed only after the signature was verified. The decrypted payload is a new buffer.
+	if isEncrypted {
+		if payload, err = decryptPayload(receiverPublicKey, senderPublicKey, packet.Command, payload); err != nil {
+			return nil, nil, err
+		}
 	}
-	if sizePayload > 0 {
+
+	if isCompressed {
+		if packet.Payload, err = decompressPayload(payload); err != nil {
+			return nil, nil, err
+		}
+	} else if isEncrypted {
+		packet.Payload = payload
+	} else if sizePayload > 0 {
 		packet.Payload = make([]byte, int(sizePayload))
-		copy(packet.Payload, bufferDecrypted[4:4+int(sizePayload)])
+		copy(packet.Payload, payload)
+	}
+
+	if hasSequence {
+		packet.Sequence = binary.LittleEndian.Uint32(bufferDecrypted[4+int(sizePayload) : 4+int(sizePayload)+sequenceSize])
 	}
 
 	return packet, senderPublicKey, nil
@@ -84,8 +163,32 @@ func PacketDecrypt(raw []byte, receiverPublicKey *btcec.PublicKey) (packet *Pack
 
 // PacketEncrypt encrypts a packet using the provided senders private key and receivers compressed public key.
 func PacketEncrypt(senderPrivateKey *btcec.PrivateKey, receiverPublicKey *btcec.PublicKey, packet *PacketRaw) (raw []byte, err error) {
-	garbage := packetGarbage(packetLengthMin + len(packet.Payload))
-	raw = make([]byte, packetLengthMin+len(packet.Payload)+len(garbage))
+	payload := packet.Payload
+	compressed := compressPayload(payload)
+	if compressed != nil {
+		payload = compressed
+	}
+
+	// Empty payloads are not encrypted, there is nothing to protect.
+	encrypted := packet.Encrypted && len(payload) > 0
+	if encrypted {
+		if payload, err = encryptPayload(receiverPublicKey, packet.Command, payload); err != nil {
+			return nil, err
+		}
+	}
+
+	// The checksum is optional and part of the encrypted data following the payload.
+	sizeChecksum := 0
+	if config.PacketChecksums {
+		sizeChecksum = checksumSize
+	}
+	sizeSequence := 0
+	if packet.Sequence != 0 {
+		sizeSequence = sequenceSize
+	}
+
+	garbage := packetGarbage(packetLengthMin + len(payload) + sizeSequence + sizeChecksum)
+	raw = make([]byte, packetLengthMin+len(payload)+sizeSequence+sizeChecksum+len(garbage))
 
 	nonceC := rand.Uint32()
 	nonce := make([]byte, 8)
@@ -96,13 +199,37 @@ func PacketEncrypt(senderPrivateKey *btcec.PrivateKey, receiverPublicKey *btcec.
 	raw[4] = packet.Protocol
 	raw[5] = packet.Command
 
-	binary.LittleEndian.PutUint16(raw[6:8], uint16(len(packet.Payload)))
-	copy(raw[8:], packet.Payload)
-	copy(raw[8+len(packet.Payload):8+len(packet.Payload)+len(garbage)], garbage)
+	sizeField := uint16(len(payload))
+	if sizeChecksum > 0 {
+		sizeField |= sizeFlagChecksum
+	}
+	if sizeSequence > 0 {
+		sizeField |= sizeFlagSequence
+	}
+	if compressed != nil {
+		sizeField |= sizeFlagCompressed
+	}
+	if encrypted {
+		sizeField |= sizeFlagEncrypted
+	}
+	binary.LittleEndian.PutUint16(raw[6:8], sizeField)
+	copy(raw[8:], payload)
+
+	if sizeSequence > 0 {
+		binary.LittleEndian.PutUint32(raw[8+len(payload):8+len(payload)+sequenceSize], packet.Sequence)
+	}
+
+	if sizeChecksum > 0 {
+		offset := 8 + len(payload) + sizeSequence
+		binary.LittleEndian.PutUint32(raw[offset:offset+checksumSize], crc32.ChecksumIEEE(raw[0:offset]))
+	}
+
+	sizeData := 8 + len(payload) + sizeSequence + sizeChecksum
+	copy(raw[sizeData:sizeData+len(garbage)], garbage)
 
 	// encrypt it using Salsa20
 	keySalsa := publicKeyToSalsa20Key(receiverPublicKey)
-	salsa20.XORKeyStream(raw[4:8+len(packet.Payload)+len(garbage)], raw[4:8+len(packet.Payload)+len(garbage)], nonce, keySalsa)
+	salsa20.XORKeyStream(raw[4:sizeData+len(garbage)], raw[4:sizeData+len(garbage)], nonce, keySalsa)
 
 	// add signature
 	signature, err := btcec.SignCompact(btcec.S256(), senderPrivateKey, hashData(raw[:len(raw)-signatureSize]), true)
@@ -113,6 +240,11 @@ func PacketEncrypt(senderPrivateKey *btcec.PrivateKey, receiverPublicKey *btcec.
 	salsa20.XORKeyStream(signature[:], signature[:], nonce, keySalsa)
 	copy(raw[len(raw)-signatureSize:], signature)
 
+	// Our own announcements are remembered to detect replays of them, see duplicateIdentityCheck.
+	if packet.Command == CommandAnnouncement && senderPrivateKey == peerPrivateKey {
+		announcementsSent.add(raw[len(raw)-signatureSize:])
+	}
+
 	return raw, nil
 }
 
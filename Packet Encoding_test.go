@@ -0,0 +1,88 @@
+/*
+File Name:  Packet Encoding_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package core
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPacketSignatureValid(t *testing.T) {
+	testConfig(t)
+	sender, senderPublicKey, _ := Secp256k1NewPrivateKey()
+	_, receiverPublicKey, _ := Secp256k1NewPrivateKey()
+	payload := []byte("signed payload")
+
+	raw, err := PacketEncrypt(sender, receiverPublicKey, &PacketRaw{Command: CommandChat, Payload: payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet, recovered, err := PacketDecrypt(raw, receiverPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !recovered.IsEqual(senderPublicKey) {
+		t.Fatal("recovered sender does not match")
+	}
+	if packet.Command != CommandChat || !bytes.Equal(packet.Payload, payload) {
+		t.Fatalf("packet mismatch: command %d, payload %q", packet.Command, packet.Payload)
+	}
+}
+
+func TestPacketSignatureTampered(t *testing.T) {
+	testConfig(t)
+	sender, senderPublicKey, _ := Secp256k1NewPrivateKey()
+	_, receiverPublicKey, _ := Secp256k1NewPrivateKey()
+
+	raw, err := PacketEncrypt(sender, receiverPublicKey, &PacketRaw{Command: CommandChat, Payload: []byte("signed payload")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Any modified byte either fails or recovers a different public key, which cannot impersonate the sender.
+	for n := range raw {
+		tampered := append([]byte{}, raw...)
+		tampered[n] ^= 0x01
+
+		if _, recovered, err := PacketDecrypt(tampered, receiverPublicKey); err == nil && recovered.IsEqual(senderPublicKey) {
+			t.Fatalf("packet modified at offset %d accepted as from the sender", n)
+		}
+	}
+
+	// With a checksum the corruption is detected before the signature is verified.
+	config.PacketChecksums = true
+	if raw, err = PacketEncrypt(sender, receiverPublicKey, &PacketRaw{Command: CommandChat, Payload: []byte("signed payload")}); err != nil {
+		t.Fatal(err)
+	}
+	raw[10] ^= 0x01
+	if _, _, err := PacketDecrypt(raw, receiverPublicKey); err != ErrChecksumMismatch {
+		t.Fatalf("corrupted packet with checksum: %v", err)
+	}
+}
+
+func TestPacketSignatureMismatchedKey(t *testing.T) {
+	testConfig(t)
+	sender, senderPublicKey, _ := Secp256k1NewPrivateKey()
+	_, receiverPublicKey, _ := Secp256k1NewPrivateKey()
+	_, otherPublicKey, _ := Secp256k1NewPrivateKey()
+
+	raw, err := PacketEncrypt(sender, receiverPublicKey, &PacketRaw{Command: CommandChat, Payload: []byte("signed payload")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A packet forwarded to another receiver cannot be attributed to the sender.
+	if _, recovered, err := PacketDecrypt(raw, otherPublicKey); err == nil && recovered.IsEqual(senderPublicKey) {
+		t.Fatal("packet for another receiver accepted as from the sender")
+	}
+
+	// The signature of one key is never attributed to another key.
+	if _, recovered, err := PacketDecrypt(raw, receiverPublicKey); err != nil || recovered.IsEqual(otherPublicKey) {
+		t.Fatalf("signature attributed to the wrong key: %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+/*
+File Name:  Packet Sequence.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Packets to a peer may be received multiple times, for example if they are sent via all active connections because no latest connection is known.
+If config.PacketSequence is set, packets sent to peers carry a sequence number that is incremented per receiving peer. The receiver drops packets whose sequence number it has seen before.
+
+Each peer keeps a sliding window of the last sequenceWindowSize sequence numbers below the highest one received. The memory is fixed at 16 bytes per peer regardless of traffic.
+Packets older than the window are accepted, as they cannot be told apart from packets after a restart of the sender.
+The first sequence number per peer is random, so that sequence numbers after a restart of the sender are unlikely to fall into the receivers window.
+*/
+
+package core
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// sequenceWindowSize is the count of sequence numbers (including the highest one) that are remembered per peer
+const sequenceWindowSize = 64
+
+// sequenceWindow remembers recently received sequence numbers
+type sequenceWindow struct {
+	sync.Mutex
+	highest uint32 // Highest sequence number received
+	seen    uint64 // Bit n is set if the sequence number highest-n was received. Zero if no sequence number was received yet.
+}
+
+// isDuplicate checks if the sequence number was received before and remembers it otherwise
+func (window *sequenceWindow) isDuplicate(sequence uint32) bool {
+	window.Lock()
+	defer window.Unlock()
+
+	if window.seen == 0 {
+		window.highest = sequence
+		window.seen = 1
+		return false
+	}
+
+	// Newer sequence number: Move the window. The difference is interpreted signed to handle wraparound.
+	if ahead := int32(sequence - window.highest); ahead > 0 {
+		if ahead >= sequenceWindowSize {
+			window.seen = 1
+		} else {
+			window.seen = window.seen<<uint(ahead) | 1
+		}
+		window.highest = sequence
+		return false
+	}
+
+	behind := window.highest - sequence
+	if behind >= sequenceWindowSize {
+		return false
+	}
+
+	bit := uint64(1) << behind
+	if window.seen&bit != 0 {
+		return true
+	}
+	window.seen |= bit
+
+	return false
+}
+
+// sequenceNext returns the sequence number for the next packet to the peer. It is 0 (none) if config.PacketSequence is not set.
+func (peer *PeerInfo) sequenceNext() uint32 {
+	if !config.PacketSequence {
+		return 0
+	}
+
+	// 0 indicates no sequence number and is skipped on wraparound.
+	for {
+		if sequence := atomic.AddUint32(&peer.sequenceOut, 1); sequence != 0 {
+			return sequence
+		}
+	}
+}
@@ -0,0 +1,82 @@
+/*
+File Name:  Packet Sequence_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package core
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestSequenceWindow(t *testing.T) {
+	var window sequenceWindow
+
+	steps := []struct {
+		sequence  uint32
+		duplicate bool
+	}{
+		{100, false},
+		{100, true},
+		{102, false},
+		{101, false}, // out of order
+		{101, true},
+		{102, true},
+		{102 + sequenceWindowSize, false}, // moves the window
+		{102, false},                      // older than the window, accepted
+		{103, false},                      // the oldest one still in the window, not received yet
+		{103, true},
+		{0xFFFFFFFF, false},                   // far ahead, interpreted as older than the window
+		{102 + sequenceWindowSize + 1, false}, // next one
+		{102 + sequenceWindowSize + 1, true},  // duplicate
+		{102 + sequenceWindowSize + 1 + 63, false}, // moves the window by 63
+		{102 + sequenceWindowSize + 1, true},       // still in the window
+	}
+
+	for n, step := range steps {
+		if duplicate := window.isDuplicate(step.sequence); duplicate != step.duplicate {
+			t.Fatalf("step %d: sequence %d duplicate %t, expected %t", n, step.sequence, duplicate, step.duplicate)
+		}
+	}
+
+	// Wraparound
+	var wrap sequenceWindow
+	wrap.isDuplicate(0xFFFFFFFE)
+	if wrap.isDuplicate(1) || !wrap.isDuplicate(0xFFFFFFFE) || !wrap.isDuplicate(1) {
+		t.Fatal("wraparound not handled")
+	}
+}
+
+func TestSequenceDuplicatePacket(t *testing.T) {
+	testConfig(t)
+	testInitPeer(t)
+	network := testNetworkLoopback(t)
+	count := testCommandHandler(t, CommandUserMin)
+
+	remote := testRemoteNew(t, network)
+	remote.peerlistAdd(t)
+
+	wire := testPacketWire(t, remote.privateKey, network, remote.address(), &PacketRaw{Command: CommandUserMin, Sequence: 1000})
+	duplicates := StatsPacketsDuplicate()
+
+	packetProcess(wire)
+	packetProcess(wire)
+
+	if processed := atomic.LoadUint64(count); processed != 1 {
+		t.Fatalf("packet processed %d times", processed)
+	}
+	if StatsPacketsDuplicate() != duplicates+1 {
+		t.Fatal("duplicate not counted")
+	}
+
+	// Without sequence number, duplicates cannot be detected.
+	wire = testPacketWire(t, remote.privateKey, network, remote.address(), &PacketRaw{Command: CommandUserMin})
+	packetProcess(wire)
+	packetProcess(wire)
+
+	if processed := atomic.LoadUint64(count); processed != 3 {
+		t.Fatalf("packets without sequence number processed %d times", processed-1)
+	}
+}
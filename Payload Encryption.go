@@ -0,0 +1,211 @@
+/*
+File Name:  Payload Encryption.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+The packet encryption (Salsa20) uses the public key of the receiver and therefore only obfuscates the packet. Payloads of packets to peers can additionally be encrypted end-to-end.
+The key is derived via ECDH from the ephemeral keys of both peers (see Ephemeral Key.go), which results in the same shared secret on both sides. The payload is encrypted and authenticated using AES-256-GCM.
+Since the ephemeral keys are rotated and old ones are discarded, a compromised identity key or a later compromised ephemeral key does not expose past payloads (forward secrecy).
+After a rotation the previous keys remain valid for ephemeralKeyGrace, so that packets in flight can still be decrypted.
+
+Encryption is optional (see config.PayloadEncryption) and indicated by a flag in the size field. Incoming encrypted payloads are always decrypted. Payloads are compressed before encryption.
+Announcements, responses and rekey messages are never encrypted, as they carry the ephemeral keys. Payloads can only be encrypted to peers whose ephemeral key is known.
+
+Encrypted payload:
+Offset  Size   Info
+0       4      Key ID of the ephemeral key of the sender
+4       4      Key ID of the ephemeral key of the receiver
+8       12     Nonce, random
+20      ?      Encrypted payload
+?       16     Authentication tag
+
+The key ID is the beginning of the hash of the compressed ephemeral public key. The key IDs and the command are authenticated together with the payload.
+*/
+
+package core
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// sizeFlagEncrypted is the flag in the size field indicating that the payload is encrypted end-to-end
+const sizeFlagEncrypted = 0x1000
+
+// ephemeralKeyIDSize is the size of a key ID
+const ephemeralKeyIDSize = 4
+
+// payloadHeaderSize is the size of the key IDs at the beginning of an encrypted payload
+const payloadHeaderSize = 2 * ephemeralKeyIDSize
+
+// payloadNonceSize is the size of the nonce of an encrypted payload
+const payloadNonceSize = 12
+
+// payloadEncryptionOverhead is the count of bytes an encrypted payload is larger than the plaintext (key IDs, nonce and authentication tag)
+const payloadEncryptionOverhead = payloadHeaderSize + payloadNonceSize + 16
+
+// payloadCiphersMax is the maximum count of cached ciphers, one per pair of ephemeral keys
+const payloadCiphersMax = 4096
+
+// payloadKeyContext is hashed together with the shared secret to derive the key, so that the key is not used for anything else
+const payloadKeyContext = "Peernet payload encryption"
+
+// payloadCiphers caches the ciphers per pair of ephemeral keys. It is cleared when a previous ephemeral key is discarded, so that no derived key outlives it.
+var payloadCiphers = make(map[string]cipher.AEAD)
+var payloadCiphersMutex sync.Mutex
+
+// ErrPayloadDecryption is returned if an encrypted payload cannot be decrypted or fails authentication
+var ErrPayloadDecryption = errors.New("payload decryption failed")
+
+// ErrNoEphemeralKey is returned if a payload cannot be encrypted because the ephemeral key of the receiver is not known
+var ErrNoEphemeralKey = errors.New("ephemeral key of the receiver unknown")
+
+// payloadEncryptCommand checks if the payload of an outgoing packet to a peer shall be encrypted
+func payloadEncryptCommand(command uint8) bool {
+	if !config.PayloadEncryption {
+		return false
+	}
+
+	// The receiver needs the ephemeral keys in these packets to decrypt anything.
+	switch command {
+	case CommandAnnouncement, CommandResponse, CommandRekey:
+		return false
+	}
+
+	for _, exclude := range config.PayloadEncryptionExclude {
+		if exclude == int(command) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ephemeralKeyID returns the key ID of the ephemeral public key
+func ephemeralKeyID(publicKey *btcec.PublicKey) []byte {
+	return hashData(publicKey.SerializeCompressed())[:ephemeralKeyIDSize]
+}
+
+// payloadCipher returns the cipher for the local and the remote ephemeral key. It is cached, since the ECDH calculation is expensive.
+func payloadCipher(local *btcec.PrivateKey, remote *btcec.PublicKey) (aead cipher.AEAD, err error) {
+	cacheKey := string(local.PubKey().SerializeCompressed()) + string(remote.SerializeCompressed())
+
+	payloadCiphersMutex.Lock()
+	aead, ok := payloadCiphers[cacheKey]
+	payloadCiphersMutex.Unlock()
+	if ok {
+		return aead, nil
+	}
+
+	secret := btcec.GenerateSharedSecret(local, remote)
+	block, err := aes.NewCipher(hashData(append(secret, payloadKeyContext...)))
+	if err != nil {
+		return nil, err
+	}
+	if aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+
+	payloadCiphersMutex.Lock()
+	// Flood: forget all ciphers rather than grow unbounded. They are recreated on demand.
+	if len(payloadCiphers) >= payloadCiphersMax {
+		payloadCiphers = make(map[string]cipher.AEAD)
+	}
+	payloadCiphers[cacheKey] = aead
+	payloadCiphersMutex.Unlock()
+
+	return aead, nil
+}
+
+// payloadCiphersReset removes all cached ciphers
+func payloadCiphersReset() {
+	payloadCiphersMutex.Lock()
+	payloadCiphers = make(map[string]cipher.AEAD)
+	payloadCiphersMutex.Unlock()
+}
+
+// sealPayload encrypts the payload with the key agreed between the local and the remote ephemeral key
+func sealPayload(local *btcec.PrivateKey, remote *btcec.PublicKey, command uint8, payload []byte) (encrypted []byte, err error) {
+	aead, err := payloadCipher(local, remote)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted = make([]byte, payloadHeaderSize+payloadNonceSize, payloadHeaderSize+payloadNonceSize+len(payload)+aead.Overhead())
+	copy(encrypted[0:ephemeralKeyIDSize], ephemeralKeyID(local.PubKey()))
+	copy(encrypted[ephemeralKeyIDSize:payloadHeaderSize], ephemeralKeyID(remote))
+	if _, err = rand.Read(encrypted[payloadHeaderSize:]); err != nil {
+		return nil, err
+	}
+
+	additional := append([]byte{command}, encrypted[:payloadHeaderSize]...)
+	return aead.Seal(encrypted, encrypted[payloadHeaderSize:payloadHeaderSize+payloadNonceSize], payload, additional), nil
+}
+
+// openPayload decrypts the payload with the key agreed between the local and the remote ephemeral key
+func openPayload(local *btcec.PrivateKey, remote *btcec.PublicKey, command uint8, encrypted []byte) (payload []byte, err error) {
+	if len(encrypted) < payloadEncryptionOverhead || !bytes.Equal(encrypted[0:ephemeralKeyIDSize], ephemeralKeyID(remote)) || !bytes.Equal(encrypted[ephemeralKeyIDSize:payloadHeaderSize], ephemeralKeyID(local.PubKey())) {
+		return nil, ErrPayloadDecryption
+	}
+
+	aead, err := payloadCipher(local, remote)
+	if err != nil {
+		return nil, ErrPayloadDecryption
+	}
+
+	additional := append([]byte{command}, encrypted[:payloadHeaderSize]...)
+	if payload, err = aead.Open(nil, encrypted[payloadHeaderSize:payloadHeaderSize+payloadNonceSize], encrypted[payloadHeaderSize+payloadNonceSize:], additional); err != nil {
+		return nil, ErrPayloadDecryption
+	}
+
+	return payload, nil
+}
+
+// encryptPayload encrypts the payload for the receiver, which must be in the peer list and have a known ephemeral key. The current local ephemeral key is used.
+func encryptPayload(receiverPublicKey *btcec.PublicKey, command uint8, payload []byte) (encrypted []byte, err error) {
+	peer := PeerlistLookup(receiverPublicKey)
+	if peer == nil {
+		return nil, ErrNoEphemeralKey
+	}
+
+	local, _ := ExportEphemeralKey()
+	remote := peer.GetEphemeralKey()
+	if local == nil || remote == nil {
+		return nil, ErrNoEphemeralKey
+	}
+
+	if encrypted, err = sealPayload(local, remote, command, payload); err != nil {
+		return nil, err
+	}
+
+	atomic.AddUint64(&ephemeralBytesEncrypted, uint64(len(payload)))
+	return encrypted, nil
+}
+
+// decryptPayload decrypts a payload from the sender. Only payloads sent to this node by peers in the peer list can be decrypted.
+// The key IDs select the ephemeral keys; previous keys are accepted during the grace period after a rotation.
+func decryptPayload(receiverPublicKey, senderPublicKey *btcec.PublicKey, command uint8, encrypted []byte) (payload []byte, err error) {
+	if len(encrypted) < payloadEncryptionOverhead || peerPublicKey == nil || !receiverPublicKey.IsEqual(peerPublicKey) {
+		return nil, ErrPayloadDecryption
+	}
+
+	peer := PeerlistLookup(senderPublicKey)
+	if peer == nil {
+		return nil, ErrPayloadDecryption
+	}
+
+	remote := peer.ephemeralKeyByID(encrypted[0:ephemeralKeyIDSize])
+	local := ephemeralPrivateKeyByID(encrypted[ephemeralKeyIDSize:payloadHeaderSize])
+	if remote == nil || local == nil {
+		return nil, ErrPayloadDecryption
+	}
+
+	return openPayload(local, remote, command, encrypted)
+}
@@ -0,0 +1,192 @@
+/*
+File Name:  Payload Encryption_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package core
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// testInitPeer initializes the identity and the ephemeral key of this node and an empty peer list
+func testInitPeer(t *testing.T) {
+	config.RekeyInterval = defaultRekeyInterval
+
+	var err error
+	if peerPrivateKey, peerPublicKey, err = Secp256k1NewPrivateKey(); err != nil {
+		t.Fatal(err)
+	}
+	peerList = make(map[[btcec.PubKeyBytesLenCompressed]byte]*PeerInfo)
+
+	ephemeralMutex.Lock()
+	ephemeralPrivateKey, ephemeralPrevious = nil, nil
+	ephemeralMutex.Unlock()
+	if err = ephemeralKeyRotate(); err != nil {
+		t.Fatal(err)
+	}
+	payloadCiphersReset()
+}
+
+// testAddPeer adds a peer with a new identity and ephemeral key to the peer list
+func testAddPeer(t *testing.T) (peer *PeerInfo, ephemeral *btcec.PrivateKey) {
+	_, identity, err := Secp256k1NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ephemeral, _, err = Secp256k1NewPrivateKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	peer = &PeerInfo{PublicKey: identity, EphemeralPublicKey: ephemeral.PubKey(), ephemeralExpires: time.Now().Add(ephemeralKeyValidity())}
+	peerlistMutex.Lock()
+	peerList[publicKey2Compressed(identity)] = peer
+	peerlistMutex.Unlock()
+
+	return peer, ephemeral
+}
+
+func TestPayloadEncryptDecrypt(t *testing.T) {
+	local, _, _ := Secp256k1NewPrivateKey()
+	remote, _, _ := Secp256k1NewPrivateKey()
+	payload := []byte("end-to-end encrypted payload")
+
+	encrypted, err := sealPayload(local, remote.PubKey(), CommandGet, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(encrypted) != len(payload)+payloadEncryptionOverhead {
+		t.Fatalf("encrypted size %d, expected %d", len(encrypted), len(payload)+payloadEncryptionOverhead)
+	}
+
+	decrypted, err := openPayload(remote, local.PubKey(), CommandGet, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, payload) {
+		t.Fatalf("decrypted payload mismatch: %q", decrypted)
+	}
+}
+
+func TestPayloadDecryptWrongKey(t *testing.T) {
+	local, _, _ := Secp256k1NewPrivateKey()
+	remote, _, _ := Secp256k1NewPrivateKey()
+	other, _, _ := Secp256k1NewPrivateKey()
+
+	encrypted, err := sealPayload(local, remote.PubKey(), CommandGet, []byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := openPayload(other, local.PubKey(), CommandGet, encrypted); err != ErrPayloadDecryption {
+		t.Fatalf("decryption with the wrong key: %v", err)
+	}
+
+	// Same key IDs, but a key agreed with a different sender.
+	payloadCiphersReset()
+	if _, err := openPayload(remote, other.PubKey(), CommandGet, encrypted); err != ErrPayloadDecryption {
+		t.Fatalf("decryption with the wrong sender key: %v", err)
+	}
+}
+
+func TestPayloadDecryptTampered(t *testing.T) {
+	local, _, _ := Secp256k1NewPrivateKey()
+	remote, _, _ := Secp256k1NewPrivateKey()
+
+	encrypted, err := sealPayload(local, remote.PubKey(), CommandGet, []byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := append([]byte{}, encrypted...)
+	tampered[len(tampered)-1] ^= 0x01
+	if _, err := openPayload(remote, local.PubKey(), CommandGet, tampered); err != ErrPayloadDecryption {
+		t.Fatalf("tampered tag accepted: %v", err)
+	}
+
+	tampered = append([]byte{}, encrypted...)
+	tampered[payloadHeaderSize+payloadNonceSize] ^= 0x01
+	if _, err := openPayload(remote, local.PubKey(), CommandGet, tampered); err != ErrPayloadDecryption {
+		t.Fatalf("tampered ciphertext accepted: %v", err)
+	}
+
+	// The command is authenticated.
+	if _, err := openPayload(remote, local.PubKey(), CommandGetResponse, encrypted); err != ErrPayloadDecryption {
+		t.Fatalf("different command accepted: %v", err)
+	}
+
+	if _, err := openPayload(remote, local.PubKey(), CommandGet, encrypted[:payloadEncryptionOverhead-1]); err != ErrPayloadDecryption {
+		t.Fatalf("truncated payload accepted: %v", err)
+	}
+}
+
+func TestPayloadEncryptCommand(t *testing.T) {
+	previous := config
+	defer func() { config = previous }()
+
+	config.PayloadEncryption = false
+	if payloadEncryptCommand(CommandGet) {
+		t.Fatal("payload encrypted while disabled")
+	}
+
+	config.PayloadEncryption = true
+	config.PayloadEncryptionExclude = []int{CommandPing}
+	if !payloadEncryptCommand(CommandGet) {
+		t.Fatal("payload not encrypted while enabled")
+	}
+	if payloadEncryptCommand(CommandPing) {
+		t.Fatal("excluded command encrypted")
+	}
+	if payloadEncryptCommand(CommandAnnouncement) || payloadEncryptCommand(CommandResponse) {
+		t.Fatal("packet carrying the ephemeral key encrypted")
+	}
+}
+
+func TestPayloadEphemeralRotation(t *testing.T) {
+	testInitPeer(t)
+	peer, remote := testAddPeer(t)
+	payload := []byte("payload")
+
+	local, _ := ExportEphemeralKey()
+	encrypted, err := sealPayload(remote, local.PubKey(), CommandGet, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := decryptPayload(peerPublicKey, peer.PublicKey, CommandGet, encrypted); err != nil {
+		t.Fatal(err)
+	}
+
+	// In-flight packets under the previous key are accepted during the grace period.
+	if err := ephemeralKeyRotate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decryptPayload(peerPublicKey, peer.PublicKey, CommandGet, encrypted); err != nil {
+		t.Fatalf("previous key refused during the grace period: %v", err)
+	}
+
+	ephemeralKeyDiscardPrevious()
+	if _, err := decryptPayload(peerPublicKey, peer.PublicKey, CommandGet, encrypted); err != ErrPayloadDecryption {
+		t.Fatalf("discarded key accepted: %v", err)
+	}
+
+	// Outgoing payloads use the current keys of both sides.
+	encrypted, err = encryptPayload(peer.PublicKey, CommandGet, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, _ = ExportEphemeralKey()
+	if decrypted, err := openPayload(remote, local.PubKey(), CommandGet, encrypted); err != nil || !bytes.Equal(decrypted, payload) {
+		t.Fatalf("payload to peer not decryptable: %v", err)
+	}
+
+	_, unknown, _ := Secp256k1NewPrivateKey()
+	if _, err := encryptPayload(unknown, CommandGet, payload); err != ErrNoEphemeralKey {
+		t.Fatalf("payload encrypted to unknown peer: %v", err)
+	}
+}
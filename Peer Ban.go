@@ -0,0 +1,44 @@
+/*
+File Name:  Peer Ban.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+List of banned peers. All packets from banned peers are dropped and they are never added to the peer list.
+The list is kept in memory only; the application is responsible for banning peers again after a restart.
+*/
+
+package core
+
+import (
+	"sync"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+var peersBanned = make(map[[btcec.PubKeyBytesLenCompressed]byte]struct{})
+var peersBannedMutex sync.RWMutex
+
+// PeerBan bans the peer. If the peer is in the peer list, it is removed without notification.
+func PeerBan(publicKey *btcec.PublicKey) {
+	peersBannedMutex.Lock()
+	peersBanned[publicKey2Compressed(publicKey)] = struct{}{}
+	peersBannedMutex.Unlock()
+
+	PeerlistRemoveByKey(publicKey)
+}
+
+// PeerUnban removes the ban of the peer
+func PeerUnban(publicKey *btcec.PublicKey) {
+	peersBannedMutex.Lock()
+	delete(peersBanned, publicKey2Compressed(publicKey))
+	peersBannedMutex.Unlock()
+}
+
+// IsPeerBanned checks if the peer is banned
+func IsPeerBanned(publicKey *btcec.PublicKey) bool {
+	peersBannedMutex.RLock()
+	defer peersBannedMutex.RUnlock()
+
+	_, banned := peersBanned[publicKey2Compressed(publicKey)]
+	return banned
+}
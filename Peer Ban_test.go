@@ -0,0 +1,61 @@
+/*
+File Name:  Peer Ban_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeerBanAnnouncement(t *testing.T) {
+	testConfig(t)
+	testInitPeer(t)
+	network := testNetworkLoopback(t)
+
+	banned := testRemoteNew(t, network)
+	PeerBan(banned.publicKey)
+	defer PeerUnban(banned.publicKey)
+
+	banned.send(t, banned.announcement(t, ProtocolVersion), banned.address())
+	if PeerlistLookup(banned.publicKey) != nil {
+		t.Fatal("banned peer added to the peer list")
+	}
+	if packet := banned.receive(t, 200*time.Millisecond); packet != nil {
+		t.Fatalf("banned peer received command %d", packet.Command)
+	}
+
+	// Other peers are answered.
+	other := testRemoteNew(t, network)
+	other.send(t, other.announcement(t, ProtocolVersion), other.address())
+	if packet := other.receive(t, time.Second); packet == nil {
+		t.Fatal("announcement of another peer not answered")
+	}
+}
+
+func TestPeerBanRemoves(t *testing.T) {
+	testConfig(t)
+	testInitPeer(t)
+
+	peer, _ := testPeerlistAdd(t, time.Now())
+	PeerBan(peer.PublicKey)
+	defer PeerUnban(peer.PublicKey)
+
+	if !IsPeerBanned(peer.PublicKey) {
+		t.Fatal("peer not banned")
+	}
+	if PeerlistLookup(peer.PublicKey) != nil {
+		t.Fatal("banned peer not removed from the peer list")
+	}
+	if _, added := PeerlistAdd(peer.PublicKey, testConnection(testNetwork, "192.0.2.1:112", time.Now())); added {
+		t.Fatal("banned peer added to the peer list")
+	}
+
+	PeerUnban(peer.PublicKey)
+	if IsPeerBanned(peer.PublicKey) {
+		t.Fatal("peer still banned")
+	}
+}
@@ -0,0 +1,61 @@
+/*
+File Name:  Peer Connect.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Manual contact of a peer that is known out-of-band by public key and address. The package-level Connect starts the automatic discovery, therefore this is ConnectPeer.
+*/
+
+package core
+
+import (
+	"errors"
+	"net"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// ErrNoNetwork is returned if no network is available to reach the address
+var ErrNoNetwork = errors.New("no network available for the address family")
+
+// connectRequestID is the request ID used to wait for the response to an announcement. The request is keyed by the peer and CommandResponse, so a single ID is enough.
+const connectRequestID = 0
+
+// ConnectPeer contacts the peer at the address by sending an announcement and waits for the response.
+// The peer is added to the peer list when the response arrives. If the peer is already in the peer list, it is contacted anyway.
+// Returns ErrRequestTimeout if no response is received within the handshake timeout.
+func ConnectPeer(publicKey *btcec.PublicKey, addr *net.UDPAddr) (peer *PeerInfo, err error) {
+	if publicKey == nil || addr == nil {
+		return nil, errors.New("invalid public key or address")
+	} else if publicKey.IsEqual(peerPublicKey) {
+		return nil, errors.New("cannot connect to self")
+	}
+
+	// IPv4 addresses are reached via NAT64 on IPv6-only networks.
+	addr = nat64Address(addr)
+
+	if findNetworkForRemote(addr.IP) == nil {
+		return nil, ErrNoNetwork
+	}
+
+	// The request is only resolved by a response signed by the expected public key.
+	expected := &PeerInfo{PublicKey: publicKey}
+	response := requestRegister(expected, CommandResponse, connectRequestID)
+
+	handshakeAdd(addr, publicKey)
+	if err = sendAllNetworks(publicKey, announcementPacket(), addr); err != nil {
+		requestRemove(expected, CommandResponse, connectRequestID)
+		return nil, err
+	}
+
+	if _, err = requestWait(expected, CommandResponse, connectRequestID, response, handshakeTimeout()); err != nil {
+		return nil, err
+	}
+
+	// cmdResponse added the peer. It is nil if refused by the peer admission function.
+	if peer = PeerlistLookup(publicKey); peer == nil {
+		return nil, errors.New("peer not admitted to the peer list")
+	}
+
+	return peer, nil
+}
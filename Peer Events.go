@@ -0,0 +1,90 @@
+/*
+File Name:  Peer Events.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Callbacks that allow applications to react on peers becoming reachable or being lost, instead of polling the peer list.
+A peer is connected when it is added to the peer list or regains an active connection. It is disconnected when it loses its last active connection or is removed from the peer list.
+The callbacks are invoked once per transition and without holding any lock, so they may call back into the API.
+*/
+
+package core
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// States of a peer as reported via the callbacks
+const (
+	peerEventDisconnected = iota // No active connection
+	peerEventConnected           // Reported as connected
+	peerEventRemoved             // Removed from the peer list. Final, no more callbacks are invoked.
+)
+
+var (
+	peerConnectedCallback    func(peer *PeerInfo) // Called when a peer is connected. May be nil.
+	peerDisconnectedCallback func(peer *PeerInfo) // Called when a peer is disconnected. May be nil.
+	peerCallbackMutex        sync.RWMutex         // Mutex for the callbacks
+)
+
+// SetPeerConnectedCallback sets a function that is called when a peer is added to the peer list or regains an active connection. Use nil to remove it.
+func SetPeerConnectedCallback(f func(peer *PeerInfo)) {
+	peerCallbackMutex.Lock()
+	peerConnectedCallback = f
+	peerCallbackMutex.Unlock()
+}
+
+// SetPeerDisconnectedCallback sets a function that is called when a peer loses its last active connection or is removed from the peer list. Use nil to remove it.
+func SetPeerDisconnectedCallback(f func(peer *PeerInfo)) {
+	peerCallbackMutex.Lock()
+	peerDisconnectedCallback = f
+	peerCallbackMutex.Unlock()
+}
+
+// eventConnected invokes the connected callback if the peer was disconnected. The caller must not hold any lock.
+func (peer *PeerInfo) eventConnected() {
+	if !atomic.CompareAndSwapUint32(&peer.eventState, peerEventDisconnected, peerEventConnected) {
+		return
+	}
+
+	peerCallbackMutex.RLock()
+	callback := peerConnectedCallback
+	peerCallbackMutex.RUnlock()
+
+	if callback != nil {
+		callback(peer)
+	}
+}
+
+// eventDisconnected invokes the disconnected callback if the peer was connected. If removed is true, no more callbacks are invoked for the peer. The caller must not hold any lock.
+func (peer *PeerInfo) eventDisconnected(removed bool) {
+	if removed {
+		if atomic.SwapUint32(&peer.eventState, peerEventRemoved) != peerEventConnected {
+			return
+		}
+	} else if !atomic.CompareAndSwapUint32(&peer.eventState, peerEventConnected, peerEventDisconnected) {
+		return
+	}
+
+	peerCallbackMutex.RLock()
+	callback := peerDisconnectedCallback
+	peerCallbackMutex.RUnlock()
+
+	if callback != nil {
+		callback(peer)
+	}
+}
+
+// eventUpdate invokes the callbacks according to whether the peer has any active connection. It must be called after changing the active connections. The caller must not hold any lock.
+func (peer *PeerInfo) eventUpdate() {
+	peer.RLock()
+	active := len(peer.connectionActive) > 0
+	peer.RUnlock()
+
+	if active {
+		peer.eventConnected()
+	} else {
+		peer.eventDisconnected(false)
+	}
+}
@@ -0,0 +1,168 @@
+/*
+File Name:  Peer Exchange.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Peer exchange (PEX): Peers share known peers with each other, which allows discovery beyond the local network.
+A peer request is sent to new peers while the peer list is small. The response lists peers with active connections; the receiver contacts the unknown ones via an announcement.
+
+Requests are answered at most once per interval per peer, and only responses to own recent requests are accepted. The response size is capped to limit amplification.
+Private IPs are only shared with peers that are connected via a private IP themselves. Link-local addresses are never shared.
+
+Payload of CommandPeerRequest: none.
+
+Payload of CommandPeerResponse:
+Offset  Size   Info
+0       1      Count of peers
+1       51*n   Peers: 33 bytes compressed public key, 18 bytes address (see encodeObservedAddress)
+*/
+
+package core
+
+import (
+	"net"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// pexPeersMax is the maximum count of peers in a response
+const pexPeersMax = 16
+
+// pexEntrySize is the size of a single peer in the response
+const pexEntrySize = btcec.PubKeyBytesLenCompressed + observedAddressSize
+
+// pexInterval is the minimum time between requests from or to a single peer
+const pexInterval = 5 * time.Minute
+
+// pexPeersTarget is the peer list size up to which new peers are asked for their peers
+const pexPeersTarget = 32
+
+// pexState contains the timing of peer exchange with a peer
+type pexState struct {
+	requestIn  time.Time // Last request received from the peer
+	requestOut time.Time // Last request sent to the peer
+	pending    bool      // If true, a response to the last request is expected
+}
+
+// pexRequest asks the peer for its peers, if the peer list is small and the peer was not asked recently
+func (peer *PeerInfo) pexRequest() {
+	if config.PassiveMode || PeerlistCount() >= pexPeersTarget {
+		return
+	}
+
+	peer.Lock()
+	if time.Since(peer.pex.requestOut) < pexInterval {
+		peer.Unlock()
+		return
+	}
+	peer.pex.requestOut = time.Now()
+	peer.pex.pending = true
+	peer.Unlock()
+
+	peer.send(&PacketRaw{Command: CommandPeerRequest})
+}
+
+// cmdPeerRequest handles a request for known peers
+func (peer *PeerInfo) cmdPeerRequest(msg *packet2) {
+	if peer == nil {
+		return
+	}
+
+	peer.Lock()
+	if time.Since(peer.pex.requestIn) < pexInterval {
+		peer.Unlock()
+		return
+	}
+	peer.pex.requestIn = time.Now()
+	peer.Unlock()
+
+	sharePrivate := isPrivateIP(msg.connection.Address.IP)
+
+	payload := []byte{0}
+	count := 0
+
+	for _, known := range PeerlistGet() {
+		if count >= pexPeersMax {
+			break
+		} else if known == peer || known.IsLinkLocalOnly() {
+			continue
+		}
+
+		address := known.pexAddress(sharePrivate)
+		if address == nil {
+			continue
+		}
+
+		payload = append(payload, known.PublicKey.SerializeCompressed()...)
+		payload = append(payload, encodeObservedAddress(address)...)
+		count++
+	}
+
+	payload[0] = byte(count)
+
+	peer.send(&PacketRaw{Command: CommandPeerResponse, Payload: payload})
+}
+
+// pexAddress returns the address of the latest active connection to share with other peers. Nil if none is suitable.
+func (peer *PeerInfo) pexAddress(sharePrivate bool) (address *net.UDPAddr) {
+	peer.RLock()
+	defer peer.RUnlock()
+
+	connections := peer.connectionActive
+	if peer.connectionLatest != nil {
+		connections = append([]*Connection{peer.connectionLatest}, connections...)
+	}
+
+	for _, connection := range connections {
+		if isRoutableIP(connection.Address.IP) && (sharePrivate || !isPrivateIP(connection.Address.IP)) {
+			return connection.Address
+		}
+	}
+
+	return nil
+}
+
+// cmdPeerResponse handles the response to a peer request. Unknown peers are contacted.
+func (peer *PeerInfo) cmdPeerResponse(msg *packet2) {
+	if peer == nil || len(msg.Payload) < 1 {
+		return
+	}
+
+	// Only accept a response to a recent request.
+	peer.Lock()
+	requested := peer.pex.pending && time.Since(peer.pex.requestOut) < handshakeTimeout()
+	peer.pex.pending = false
+	peer.Unlock()
+	if !requested {
+		return
+	}
+
+	count := int(msg.Payload[0])
+	if count > pexPeersMax || len(msg.Payload) < 1+count*pexEntrySize {
+		return
+	}
+
+	for n := 0; n < count; n++ {
+		entry := msg.Payload[1+n*pexEntrySize : 1+(n+1)*pexEntrySize]
+
+		publicKey, err := btcec.ParsePubKey(entry[:btcec.PubKeyBytesLenCompressed], btcec.S256())
+		if err != nil || publicKey.IsEqual(peerPublicKey) || IsPeerBanned(publicKey) || PeerlistLookup(publicKey) != nil {
+			continue
+		}
+
+		address := decodeObservedAddress(entry[btcec.PubKeyBytesLenCompressed:])
+		if address == nil || !isRoutableIP(address.IP) || IsAddressSelf(address) {
+			continue
+		}
+
+		// IPv4 addresses are reached via NAT64 on IPv6-only networks.
+		address = nat64Address(address)
+		if endpointInBackoff(address) {
+			continue
+		}
+
+		handshakeAdd(address, publicKey)
+		sendAllNetworks(publicKey, announcementPacket(), address)
+	}
+}
@@ -0,0 +1,87 @@
+/*
+File Name:  Peer Exchange_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package core
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// testPexAddress is the public address of the first node, which is shared via peer exchange
+var testPexAddress = &net.UDPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 112}
+
+// TestPeerExchangeShare: This node is the second one. It knows the first node and shares it with the third.
+func TestPeerExchangeShare(t *testing.T) {
+	testConfig(t)
+	testInitPeer(t)
+	network := testNetworkLoopback(t)
+
+	_, first, _ := Secp256k1NewPrivateKey()
+	PeerlistAdd(first, &Connection{Network: network, Address: testPexAddress, Status: ConnectionActive, LastPacketIn: time.Now()})
+
+	third := testRemoteNew(t, network)
+	third.peerlistAdd(t)
+
+	third.send(t, &PacketRaw{Command: CommandPeerRequest}, third.address())
+	response := third.receive(t, time.Second)
+	if response == nil || response.Command != CommandPeerResponse {
+		t.Fatal("no peer response")
+	}
+	if len(response.Payload) != 1+pexEntrySize || response.Payload[0] != 1 {
+		t.Fatalf("peer response with %d bytes", len(response.Payload))
+	}
+
+	publicKey, err := btcec.ParsePubKey(response.Payload[1:1+btcec.PubKeyBytesLenCompressed], btcec.S256())
+	if err != nil || !publicKey.IsEqual(first) {
+		t.Fatal("first node not shared")
+	}
+	if address := decodeObservedAddress(response.Payload[1+btcec.PubKeyBytesLenCompressed:]); address == nil || !address.IP.Equal(testPexAddress.IP) || address.Port != testPexAddress.Port {
+		t.Fatal("wrong address shared")
+	}
+
+	// Requests are rate limited per peer.
+	third.send(t, &PacketRaw{Command: CommandPeerRequest}, third.address())
+	if packet := third.receive(t, 200*time.Millisecond); packet != nil {
+		t.Fatalf("second request answered with command %d", packet.Command)
+	}
+}
+
+// TestPeerExchangeLearn: This node is the third one. It learns the first node via the second and contacts it.
+func TestPeerExchangeLearn(t *testing.T) {
+	testConfig(t)
+	testInitPeer(t)
+	network := testNetworkLoopback(t)
+
+	second := testRemoteNew(t, network)
+	secondPeer := second.peerlistAdd(t)
+
+	secondPeer.pexRequest()
+	if request := second.receive(t, time.Second); request == nil || request.Command != CommandPeerRequest {
+		t.Fatal("no peer request sent")
+	}
+
+	_, first, _ := Secp256k1NewPrivateKey()
+	payload := []byte{1}
+	payload = append(payload, first.SerializeCompressed()...)
+	payload = append(payload, encodeObservedAddress(testPexAddress)...)
+
+	second.send(t, &PacketRaw{Command: CommandPeerResponse, Payload: payload}, second.address())
+
+	pending := handshakeComplete(testPexAddress)
+	if pending == nil || !pending.publicKey.IsEqual(first) {
+		t.Fatal("first node not contacted")
+	}
+
+	// Unsolicited responses are ignored.
+	second.send(t, &PacketRaw{Command: CommandPeerResponse, Payload: payload}, second.address())
+	if handshakeComplete(testPexAddress) != nil {
+		t.Fatal("unsolicited peer response accepted")
+	}
+}
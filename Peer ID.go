@@ -8,44 +8,104 @@ package core
 
 import (
 	"encoding/hex"
-	"log"
-	"os"
+	"errors"
+	"math/rand"
+	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcutil/base58"
 )
 
 // peerID is the current peers ID. It is a ECDSA (secp256k1) 257-bit public key.
 var peerPrivateKey *btcec.PrivateKey
 var peerPublicKey *btcec.PublicKey
 
-func initPeerID() {
+// initPeerID loads or creates the private key of this peer. An error is returned if the configured key is invalid or a new one could not be created.
+func initPeerID() (err error) {
 	peerList = make(map[[btcec.PubKeyBytesLenCompressed]byte]*PeerInfo)
 
+	// A key derived from the mnemonic takes precedence over the key file and the key in the config.
+	if strings.TrimSpace(config.PrivateKeyMnemonic) != "" {
+		if peerPrivateKey, peerPublicKey, err = PrivateKeyFromMnemonic(config.PrivateKeyMnemonic); err != nil {
+			return errors.New("private key mnemonic in config is invalid: " + err.Error())
+		}
+		return nil
+	}
+
+	if config.PrivateKeyFile != "" {
+		return initPeerIDFile()
+	}
+
 	// load existing key from config, if available
 	if len(config.PrivateKey) > 0 {
 		configPK, err := hex.DecodeString(config.PrivateKey)
-		if err == nil {
-			peerPrivateKey, peerPublicKey = btcec.PrivKeyFromBytes(btcec.S256(), configPK)
-			return
+		if err != nil {
+			return errors.New("private key in config is corrupted: " + err.Error())
 		}
 
-		log.Printf("Private key in config is corrupted! Error: %s\n", err.Error())
-		os.Exit(1)
+		peerPrivateKey, peerPublicKey = btcec.PrivKeyFromBytes(btcec.S256(), configPK)
+		return nil
 	}
 
 	// if the peer ID is empty, create a new user public-private key pair
-	var err error
 	peerPrivateKey, peerPublicKey, err = Secp256k1NewPrivateKey()
 	if err != nil {
-		log.Printf("Error generating public-private key pairs: %s\n", err.Error())
-		os.Exit(1)
+		return errors.New("error generating public-private key pair: " + err.Error())
 	}
 
 	// save the newly generated private key into the config
-	config.PrivateKey = hex.EncodeToString(peerPublicKey.SerializeCompressed())
+	config.PrivateKey = hex.EncodeToString(peerPrivateKey.Serialize())
 
 	saveConfig()
+
+	return nil
+}
+
+var (
+	duplicateIdentityWarning  time.Time                 // Last time a warning about a duplicate identity was logged
+	duplicateIdentityCallback func(sender *net.UDPAddr) // Called when a duplicate identity is detected. May be nil.
+	duplicateIdentityMutex    sync.Mutex                // Mutex for all variables above
+)
+
+// announcementsSentLimit is the maximum count of remembered signatures of our own announcements
+const announcementsSentLimit = 4096
+
+// announcementsSent are the signatures of our own announcements. A LAN host could otherwise replay our own Broadcast or Multicast announcement to trigger the duplicate identity detection.
+var announcementsSent = newSignatureCache(announcementsSentLimit, announcementReplayWindow)
+
+// SetDuplicateIdentityCallback sets a function that is called when another node with the same private key is detected, for example to shut down. Use nil to remove it.
+// It is called at most once per minute.
+func SetDuplicateIdentityCallback(f func(sender *net.UDPAddr)) {
+	duplicateIdentityMutex.Lock()
+	duplicateIdentityCallback = f
+	duplicateIdentityMutex.Unlock()
+}
+
+// duplicateIdentityCheck is called when an announcement signed with our own private key is received.
+// If it was sent from an address that is not ours, is fresh and was not sent by us, another node uses the same private key, for example a cloned VM. The warning is logged at most once per minute.
+func duplicateIdentityCheck(sender *net.UDPAddr, raw []byte, payload []byte) {
+	if IsAddressSelf(sender) || announcementStale(payload) || announcementsSent.contains(raw[len(raw)-signatureSize:]) {
+		return
+	}
+
+	duplicateIdentityMutex.Lock()
+	if time.Since(duplicateIdentityWarning) < time.Minute {
+		duplicateIdentityMutex.Unlock()
+		return
+	}
+	duplicateIdentityWarning = time.Now()
+	callback := duplicateIdentityCallback
+	duplicateIdentityMutex.Unlock()
+
+	logger.Warnf("WARNING: Duplicate identity detected! Another node at '%s' uses the same private key. Each node must use its own private key.\n", sender.String())
+
+	if callback != nil {
+		callback(sender)
+	}
 }
 
 // Secp256k1NewPrivateKey creates a new public-private key pair
@@ -66,25 +126,107 @@ func ExportPrivateKey() (privateKey *btcec.PrivateKey, publicKey *btcec.PublicKe
 // PeerInfo stores information about a single remote peer
 type PeerInfo struct {
 	PublicKey          *btcec.PublicKey // Public key
+	EphemeralPublicKey *btcec.PublicKey // Ephemeral public key signed by the public key. Nil if unknown. Protected by the mutex, see GetEphemeralKey.
+	ephemeralExpires   time.Time        // Expiry of the certificate of the ephemeral key. Protected by the mutex.
+	ephemeralPrevious  *btcec.PublicKey // Previous ephemeral key, accepted during the grace period after a change. Protected by the mutex.
+	ephemeralChanged   time.Time        // Time the ephemeral key changed. Protected by the mutex.
+	rekeyReceived      time.Time        // Time the last valid rekey message was received. Protected by the mutex.
 	connectionActive   []*Connection    // List of active established connections to the peer.
 	connectionInactive []*Connection    // List of former connections that are no longer valid. They may be removed after a while.
 	connectionLatest   *Connection      // Latest valid connection.
+	LastSeen           time.Time        // Last time a packet was received from the peer via any connection. Protected by the mutex, see GetLastSeen.
 	sync.RWMutex                        // Mutex for access to list of connections.
 
 	// statistics
 	StatsPacketSent     uint64 // Count of packets sent
 	StatsPacketReceived uint64 // Count of packets received
+	StatsBytesSent      uint64 // Count of bytes sent
+	StatsBytesReceived  uint64 // Count of bytes received
+
+	StatsConnectionsInvalidated uint64 // Count of active connections that were invalidated
+	StatsConnectionsRemoved     uint64 // Count of connections that were removed
+
+	// Endpoints (IP:Port) advertised by the peer in its announcement, in preference order. They are tried if all connections are lost. Protected by the mutex.
+	Endpoints        []*net.UDPAddr
+	endpointsLastTry time.Time // Last time the endpoints were tried
+
+	Reachability         int // Reachability as reported by the peer, see the Reachability constants. Protected by the mutex, see GetReachability.
+	reachabilityFailures int // Count of consecutive failed attempts to reach the peer via its endpoints
+
+	ProtocolVersion uint16 // Protocol version as reported by the peer, 0 if unknown. Protected by the mutex, see GetProtocolVersion.
+	UserAgent       string // Name and version of the software of the peer, empty if unknown. Protected by the mutex.
+
+	rateLimit  peerRateLimit      // Limits for incoming packets
+	bandwidth  peerBandwidth      // Share of the global limit for outgoing packets
+	throughput *throughputSampler // Samples of the byte counters. Created on first use of ThroughputRecent.
+	pex        pexState           // Timing of peer exchange. Protected by the mutex.
+
+	sequenceOut uint32         // Sequence number of the last packet sent to the peer, atomic access. See Packet Sequence.go.
+	sequenceIn  sequenceWindow // Recently received sequence numbers
+
+	eventState uint32 // State as reported via the peer callbacks, atomic access. See Peer Events.go.
 }
 
 var peerList map[[btcec.PubKeyBytesLenCompressed]byte]*PeerInfo
 var peerlistMutex sync.RWMutex
 
-// PeerlistAdd adds a new peer to the peer list. It does not validate the peer info. If the peer is already added, it does nothing. Connections must be live.
+// peerAdmissionFunc decides whether a new peer may be added. Nil allows all peers.
+var peerAdmissionFunc func(publicKey *btcec.PublicKey, addr *net.UDPAddr) bool
+
+// SetPeerAdmissionFunc sets a function that is consulted before a new peer is added to the peer list. If it returns false, the peer is dropped without response.
+// Use nil to allow all peers (default). It must be set before calling Connect.
+func SetPeerAdmissionFunc(f func(publicKey *btcec.PublicKey, addr *net.UDPAddr) bool) {
+	peerAdmissionFunc = f
+}
+
+// peerlistVersion is incremented on every change to the peer list
+var peerlistVersion uint64
+
+// PeerlistAdd adds a new peer to the peer list. It does not validate the peer info. If the peer is already added, it does nothing.
+// Connections with the status ConnectionActive (confirmed live) are added as active ones, all others as inactive. Nil and duplicate connections are ignored.
 func PeerlistAdd(PublicKey *btcec.PublicKey, connections ...*Connection) (peer *PeerInfo, added bool) {
-	if len(connections) == 0 {
+	connectionsActive, connectionsInactive := classifyConnections(connections)
+	if len(connectionsActive) == 0 && len(connectionsInactive) == 0 {
+		return nil, false
+	}
+
+	if IsPeerBanned(PublicKey) {
+		return nil, false
+	}
+
+	if config.DisableLinkLocalPeers && connectionsLinkLocalOnly(connectionsActive) && connectionsLinkLocalOnly(connectionsInactive) {
 		return nil, false
 	}
 
+	// The admission function is only consulted for new peers and is called without holding any lock.
+	if peerAdmissionFunc != nil {
+		if peer = PeerlistLookup(PublicKey); peer != nil {
+			return peer, false
+		}
+
+		var address *net.UDPAddr
+		if len(connectionsActive) > 0 {
+			address = connectionsActive[0].Address
+		} else {
+			address = connectionsInactive[0].Address
+		}
+
+		if !peerAdmissionFunc(PublicKey, address) {
+			return nil, false
+		}
+	}
+
+	// The callbacks are invoked after the peer list is unlocked.
+	var evicted *PeerInfo
+	defer func() {
+		if evicted != nil {
+			evicted.eventDisconnected(true)
+		}
+		if added {
+			peer.eventConnected()
+		}
+	}()
+
 	peerlistMutex.Lock()
 	defer peerlistMutex.Unlock()
 
@@ -93,18 +235,122 @@ func PeerlistAdd(PublicKey *btcec.PublicKey, connections ...*Connection) (peer *
 		return peer, false
 	}
 
-	peer = &PeerInfo{PublicKey: PublicKey, connectionActive: connections, connectionLatest: connections[0]}
+	if config.PeerLimit > 0 && len(peerList) >= config.PeerLimit {
+		if evicted = peerlistEvictStale(); evicted == nil {
+			return nil, false
+		}
+	}
+
+	peer = &PeerInfo{PublicKey: PublicKey, connectionActive: connectionsActive, connectionInactive: connectionsInactive, sequenceOut: rand.Uint32()}
+	if len(connectionsActive) > 0 {
+		peer.connectionLatest = connectionsActive[0]
+	}
+	for _, connection := range append(connectionsActive, connectionsInactive...) {
+		if connection.LastPacketIn.After(peer.LastSeen) {
+			peer.LastSeen = connection.LastPacketIn
+		}
+	}
+	peer.initRateLimit()
 	peerList[publicKey2Compressed(peer.PublicKey)] = peer
+	atomic.AddUint64(&peerlistVersion, 1)
 
 	return peer, true
 }
 
-// PeerlistRemove removes a peer from the peer list.
-func PeerlistRemove(peer *PeerInfo) {
+// peerlistEvictStale removes the least recently seen peer to make room for a new one. The caller must hold the peer list mutex.
+// Only a peer that was not seen for the connection invalidation time is evicted, so that a flood of announcements cannot displace live peers.
+// The connections of the evicted peer are removed, the same as via PeerlistRemoveByKey. Returns the evicted peer, or nil if none.
+func peerlistEvictStale() (evicted *PeerInfo) {
+	var oldest *PeerInfo
+	var oldestSeen time.Time
+
+	for _, peer := range peerList {
+		if lastSeen := peer.GetLastSeen(); oldest == nil || lastSeen.Before(oldestSeen) {
+			oldest, oldestSeen = peer, lastSeen
+		}
+	}
+
+	if oldest == nil || time.Since(oldestSeen) < connectionInvalidate() {
+		return nil
+	}
+
+	oldest.removeAllConnections()
+	delete(peerList, publicKey2Compressed(oldest.PublicKey))
+	atomic.AddUint64(&peerlistVersion, 1)
+
+	return oldest
+}
+
+// classifyConnections removes nil and duplicate connections and splits them into active and inactive ones.
+// Connections that are not active are changed to inactive and start expiring.
+func classifyConnections(connections []*Connection) (active, inactive []*Connection) {
+	var unique []*Connection
+
+loopConnections:
+	for _, connection := range connections {
+		if connection == nil || connection.Network == nil || connection.Address == nil {
+			continue
+		}
+		for _, existing := range unique {
+			if existing.Equal(connection) {
+				continue loopConnections
+			}
+		}
+		unique = append(unique, connection)
+
+		if connection.Status == ConnectionActive {
+			active = append(active, connection)
+		} else {
+			connection.setStatus(ConnectionInactive, "inactive: not confirmed at peer creation")
+			connection.Expires = time.Now().Add(connectionRemove())
+			inactive = append(inactive, connection)
+		}
+	}
+
+	return active, inactive
+}
+
+// PeerlistRemoveByKey removes the peer with the public key from the peer list. Its connections are removed first. The lookup and removal are atomic.
+// Returns the removed peer, or nil if the peer was not in the list. The peer is not notified, see DisconnectPeer.
+func PeerlistRemoveByKey(publicKey *btcec.PublicKey) (peer *PeerInfo) {
+	// The callback is invoked after the peer list is unlocked.
+	defer func() {
+		if peer != nil {
+			peer.eventDisconnected(true)
+		}
+	}()
+
 	peerlistMutex.Lock()
 	defer peerlistMutex.Unlock()
 
-	delete(peerList, publicKey2Compressed(peer.PublicKey))
+	key := publicKey2Compressed(publicKey)
+	peer, ok := peerList[key]
+	if !ok {
+		return nil
+	}
+
+	peer.removeAllConnections()
+	delete(peerList, key)
+	atomic.AddUint64(&peerlistVersion, 1)
+
+	return peer
+}
+
+// PeerlistRemove removes a peer from the peer list. The peer is not notified, see DisconnectPeer.
+func PeerlistRemove(peer *PeerInfo) {
+	peerlistMutex.Lock()
+
+	key := publicKey2Compressed(peer.PublicKey)
+	if _, ok := peerList[key]; !ok {
+		peerlistMutex.Unlock()
+		return
+	}
+
+	delete(peerList, key)
+	atomic.AddUint64(&peerlistVersion, 1)
+	peerlistMutex.Unlock()
+
+	peer.eventDisconnected(true)
 }
 
 // PeerlistGet returns the full peer list
@@ -119,6 +365,31 @@ func PeerlistGet() (peers []*PeerInfo) {
 	return peers
 }
 
+// PeerlistGetActive returns all peers that have at least one active connection
+func PeerlistGetActive() (peers []*PeerInfo) {
+	PeerlistForEach(func(peer *PeerInfo) bool {
+		if peer.IsActive() {
+			peers = append(peers, peer)
+		}
+		return true
+	})
+
+	return peers
+}
+
+// PeerlistForEach calls the function for each peer in the peer list until it returns false. The order is random.
+// It iterates under the read lock of the peer list without copying it. The function must not call other peer list functions such as PeerlistAdd, PeerlistRemove or PeerlistLookup, which may deadlock; use PeerlistGet instead.
+func PeerlistForEach(f func(peer *PeerInfo) bool) {
+	peerlistMutex.RLock()
+	defer peerlistMutex.RUnlock()
+
+	for _, peer := range peerList {
+		if !f(peer) {
+			return
+		}
+	}
+}
+
 // PeerlistLookup returns the peer from the list with the public key
 func PeerlistLookup(publicKey *btcec.PublicKey) (peer *PeerInfo) {
 	peerlistMutex.RLock()
@@ -128,6 +399,58 @@ func PeerlistLookup(publicKey *btcec.PublicKey) (peer *PeerInfo) {
 	return peer
 }
 
+// PeerlistVersion returns the version of the peer list. It changes on every add and remove, allowing to check cheaply whether the peer list changed.
+func PeerlistVersion() uint64 {
+	return atomic.LoadUint64(&peerlistVersion)
+}
+
+// PeerlistCountLinkLocalOnly returns the count of peers in the peer list that are only reachable via link-local addresses
+func PeerlistCountLinkLocalOnly() (count int) {
+	PeerlistForEach(func(peer *PeerInfo) bool {
+		if peer.IsLinkLocalOnly() {
+			count++
+		}
+		return true
+	})
+
+	return count
+}
+
+// IsLinkLocalOnly checks if the peer is only reachable via link-local addresses. Such addresses are not routable and must not be advertised to other peers.
+func (peer *PeerInfo) IsLinkLocalOnly() bool {
+	peer.RLock()
+	defer peer.RUnlock()
+
+	return connectionsLinkLocalOnly(peer.connectionActive) && connectionsLinkLocalOnly(peer.connectionInactive) && len(peer.connectionActive)+len(peer.connectionInactive) > 0
+}
+
+// connectionsLinkLocalOnly checks if all connections use link-local remote addresses
+func connectionsLinkLocalOnly(connections []*Connection) bool {
+	for _, connection := range connections {
+		if !connection.Address.IP.IsLinkLocalUnicast() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// GetLastSeen returns the last time a packet was received from the peer. It is zero if none was received yet.
+func (peer *PeerInfo) GetLastSeen() time.Time {
+	peer.RLock()
+	defer peer.RUnlock()
+
+	return peer.LastSeen
+}
+
+// IsActive checks if the peer has at least one active connection
+func (peer *PeerInfo) IsActive() bool {
+	peer.RLock()
+	defer peer.RUnlock()
+
+	return len(peer.connectionActive) > 0
+}
+
 // PeerlistCount returns the current count of peers in the peer list
 func PeerlistCount() (count int) {
 	peerlistMutex.RLock()
@@ -141,3 +464,29 @@ func publicKey2Compressed(publicKey *btcec.PublicKey) [btcec.PubKeyBytesLenCompr
 	copy(key[:], publicKey.SerializeCompressed())
 	return key
 }
+
+// PeerIDString returns the peer ID as base58 encoded compressed public key, for display to the user
+func PeerIDString(publicKey *btcec.PublicKey) string {
+	return base58.Encode(publicKey.SerializeCompressed())
+}
+
+// ParsePeerID parses a peer ID encoded via PeerIDString
+func ParsePeerID(s string) (publicKey *btcec.PublicKey, err error) {
+	// base58.Decode returns an empty slice on invalid characters.
+	data := base58.Decode(s)
+	if len(data) != btcec.PubKeyBytesLenCompressed {
+		return nil, errors.New("invalid peer ID")
+	}
+
+	// Only the compressed form is accepted, so each public key has exactly one string representation.
+	if data[0] != 0x02 && data[0] != 0x03 {
+		return nil, errors.New("invalid peer ID")
+	}
+
+	return btcec.ParsePubKey(data, btcec.S256())
+}
+
+// NodeID returns the peer ID as base58 string, see PeerIDString
+func (peer *PeerInfo) NodeID() string {
+	return PeerIDString(peer.PublicKey)
+}
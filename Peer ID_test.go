@@ -0,0 +1,158 @@
+/*
+File Name:  Peer ID_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package core
+
+import (
+	"encoding/hex"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+func TestPrivateKeyConfigRoundTrip(t *testing.T) {
+	testConfig(t)
+	previousFile := configFile
+	defer func() { configFile = previousFile }()
+
+	filename := filepath.Join(t.TempDir(), "Config.yaml")
+	if _, err := LoadConfig(filename); err != nil {
+		t.Fatal(err)
+	}
+	config.PrivateKey = ""
+
+	// A new key is generated and saved to the config file.
+	if err := initPeerID(); err != nil {
+		t.Fatal(err)
+	}
+	generated := peerPublicKey
+
+	privateKey, err := hex.DecodeString(config.PrivateKey)
+	if err != nil || len(privateKey) != btcec.PrivKeyBytesLen {
+		t.Fatalf("invalid private key in config: %q", config.PrivateKey)
+	}
+
+	config = Config{}
+	peerPrivateKey, peerPublicKey = nil, nil
+	if _, err := LoadConfig(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := initPeerID(); err != nil {
+		t.Fatal(err)
+	}
+	if !peerPublicKey.IsEqual(generated) {
+		t.Fatal("reloaded private key results in a different peer ID")
+	}
+}
+
+// testNetwork is a network used for connections in tests. Nothing is sent or received via it.
+var testNetwork = &Network{address: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 112}}
+
+// testPeerlistAdd adds a new peer with an active connection that received the last packet at the given time
+func testPeerlistAdd(t *testing.T, lastPacketIn time.Time) (peer *PeerInfo, added bool) {
+	_, publicKey, err := Secp256k1NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return PeerlistAdd(publicKey, testConnection(testNetwork, "192.0.2.1:112", lastPacketIn))
+}
+
+func TestPeerLimitEviction(t *testing.T) {
+	testConfig(t)
+	testInitPeer(t)
+	config.PeerLimit = 3
+
+	// All peers are stale. The one with the oldest LastSeen is evicted first.
+	var peers []*PeerInfo
+	for _, age := range []time.Duration{time.Hour, 3 * time.Hour, 2 * time.Hour} {
+		peer, added := testPeerlistAdd(t, time.Now().Add(-age))
+		if !added {
+			t.Fatal("peer below the limit not added")
+		}
+		peers = append(peers, peer)
+	}
+
+	if _, added := PeerlistAdd(peers[0].PublicKey, testConnection(testNetwork, "192.0.2.2:112", time.Now())); added {
+		t.Fatal("known peer added again")
+	}
+
+	newPeer, added := testPeerlistAdd(t, time.Now())
+	if !added {
+		t.Fatal("peer above the limit not added despite stale peers")
+	}
+	if PeerlistCount() != config.PeerLimit {
+		t.Fatalf("peer list contains %d peers, limit %d", PeerlistCount(), config.PeerLimit)
+	}
+	if PeerlistLookup(peers[1].PublicKey) != nil {
+		t.Fatal("oldest peer not evicted")
+	}
+	if len(peers[1].GetConnections(true)) != 0 {
+		t.Fatal("connections of the evicted peer not removed")
+	}
+	for _, peer := range []*PeerInfo{peers[0], peers[2], newPeer} {
+		if PeerlistLookup(peer.PublicKey) == nil {
+			t.Fatal("wrong peer evicted")
+		}
+	}
+}
+
+func TestPeerLimitRejectsLive(t *testing.T) {
+	testConfig(t)
+	testInitPeer(t)
+	config.PeerLimit = 2
+
+	for n := 0; n < config.PeerLimit; n++ {
+		if _, added := testPeerlistAdd(t, time.Now()); !added {
+			t.Fatal("peer below the limit not added")
+		}
+	}
+
+	if peer, added := testPeerlistAdd(t, time.Now()); added || peer != nil {
+		t.Fatal("live peer evicted for a new one")
+	}
+	if PeerlistCount() != config.PeerLimit {
+		t.Fatalf("peer list contains %d peers, limit %d", PeerlistCount(), config.PeerLimit)
+	}
+}
+
+func TestPeerlistRemoveByKey(t *testing.T) {
+	testConfig(t)
+	testInitPeer(t)
+
+	peer, _ := testPeerlistAdd(t, time.Now())
+	for _, address := range []string{"192.0.2.2:112", "192.0.2.3:112"} {
+		peer.registerConnection(testConnection(testNetwork, address, time.Now()))
+	}
+
+	connections := peer.GetConnections(true)
+	if len(connections) != 3 {
+		t.Fatalf("peer has %d active connections instead of 3", len(connections))
+	}
+
+	if removed := PeerlistRemoveByKey(peer.PublicKey); removed != peer {
+		t.Fatal("peer not returned on removal")
+	}
+	if PeerlistLookup(peer.PublicKey) != nil {
+		t.Fatal("peer still in the peer list")
+	}
+	for _, connection := range connections {
+		if connection.Status != ConnectionRemoved {
+			t.Fatalf("connection %s has status %s", connection.Address.String(), connection.Status.String())
+		}
+	}
+	if len(peer.GetConnections(true)) != 0 || len(peer.GetConnections(false)) != 0 {
+		t.Fatal("connections not removed from the peer")
+	}
+
+	if PeerlistRemoveByKey(peer.PublicKey) != nil {
+		t.Fatal("peer removed twice")
+	}
+}
@@ -0,0 +1,101 @@
+/*
+File Name:  Peer Throughput.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Recent throughput to a peer, calculated from samples of the byte counters.
+The sampler is only created on first query, so peers that are never queried do not pay for it. Samples are taken once per second by autoPingAll.
+*/
+
+package core
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// throughputWindow is the count of samples (one per second) used to calculate the recent throughput
+const throughputWindow = 10
+
+// throughputSample is a single sample of the byte counters
+type throughputSample struct {
+	time     time.Time
+	sent     uint64
+	received uint64
+}
+
+// throughputSampler keeps the latest samples in a ring buffer
+type throughputSampler struct {
+	samples [throughputWindow]throughputSample
+	count   int // Count of valid samples
+	next    int // Index of the next sample to write
+	sync.Mutex
+}
+
+// add adds a sample, overwriting the oldest one if full
+func (sampler *throughputSampler) add(sample throughputSample) {
+	sampler.Lock()
+	defer sampler.Unlock()
+
+	sampler.samples[sampler.next] = sample
+	sampler.next = (sampler.next + 1) % throughputWindow
+	if sampler.count < throughputWindow {
+		sampler.count++
+	}
+}
+
+// oldest returns the oldest sample
+func (sampler *throughputSampler) oldest() (sample throughputSample, ok bool) {
+	sampler.Lock()
+	defer sampler.Unlock()
+
+	if sampler.count == 0 {
+		return sample, false
+	}
+
+	return sampler.samples[(sampler.next-sampler.count+throughputWindow)%throughputWindow], true
+}
+
+// throughputSampleCurrent returns a sample of the peer's current byte counters
+func (peer *PeerInfo) throughputSampleCurrent() throughputSample {
+	return throughputSample{time: time.Now(), sent: atomic.LoadUint64(&peer.StatsBytesSent), received: atomic.LoadUint64(&peer.StatsBytesReceived)}
+}
+
+// throughputSample takes a sample of the byte counters, if the sampler was created
+func (peer *PeerInfo) throughputSample() {
+	peer.RLock()
+	sampler := peer.throughput
+	peer.RUnlock()
+
+	if sampler != nil {
+		sampler.add(peer.throughputSampleCurrent())
+	}
+}
+
+// ThroughputRecent returns the send and receive throughput to the peer in bytes per second over the last 10 seconds.
+// The first call starts sampling for the peer and returns 0. Subsequent calls return the throughput since the first call, up to the last 10 seconds.
+func (peer *PeerInfo) ThroughputRecent() (sendBps, recvBps float64) {
+	peer.Lock()
+	if peer.throughput == nil {
+		peer.throughput = &throughputSampler{}
+		peer.throughput.add(peer.throughputSampleCurrent())
+		peer.Unlock()
+		return 0, 0
+	}
+	sampler := peer.throughput
+	peer.Unlock()
+
+	oldest, ok := sampler.oldest()
+	if !ok {
+		return 0, 0
+	}
+
+	current := peer.throughputSampleCurrent()
+	elapsed := current.time.Sub(oldest.time).Seconds()
+	if elapsed <= 0 {
+		return 0, 0
+	}
+
+	return float64(current.sent-oldest.sent) / elapsed, float64(current.received-oldest.received) / elapsed
+}
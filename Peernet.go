@@ -6,19 +6,141 @@ Author:     Peter Kleissner
 
 package core
 
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
 // Init initializes the client. The config must be loaded first!
+// If the private key cannot be loaded or created, the error is logged and the process exits. Use Start to get the error instead.
 func Init() {
-	initPeerID()
+	if err := initClient(); err != nil {
+		logger.Errorf("Init error: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// initClient initializes the client. An error is only returned if the private key cannot be loaded or created, in which case nothing else is initialized.
+func initClient() (err error) {
+	if err = initPeerID(); err != nil {
+		return err
+	}
+
+	lifecycleContext, lifecycleCancel = context.WithCancel(context.Background())
+
+	initEphemeralKey()
 	initMulticastIPv6()
 	initBroadcastIPv4()
 	initNetwork()
+	initNAT64()
 	initSeedList()
+
+	return nil
 }
 
 // Connect starts bootstrapping and local peer discovery.
+// In passive mode no announcements are sent proactively; the node only responds to incoming announcements and pings.
 func Connect() {
-	go bootstrap()
-	go autoMulticastBroadcast()
-	go autoPingAll()
-	go networkChangeMonitor()
+	if !config.PassiveMode {
+		goBackground(bootstrap)
+		goBackground(autoMulticastBroadcast)
+	}
+	goBackground(autoPingAll)
+	goBackground(autoEphemeralKeyRotate)
+	goBackground(networkChangeMonitor)
+}
+
+// Shutdown terminates all networks and waits until their listen routines and the packet workers exited.
+// Other background routines are not stopped. Use Stop to stop the client entirely.
+func Shutdown() {
+	networkShutdown()
+}
+
+// lifecycleContext is canceled by Stop to end the background routines started by Connect
+var lifecycleContext context.Context
+var lifecycleCancel context.CancelFunc
+
+// backgroundWorkers are the background routines started by Connect
+var backgroundWorkers sync.WaitGroup
+
+var lifecycleMutex sync.Mutex
+var lifecycleStarted bool
+
+// ErrAlreadyStarted is returned by Start if the client is already running
+var ErrAlreadyStarted = errors.New("already started")
+
+// goBackground starts a background routine that Stop waits for. The routine must return when the context is canceled.
+func goBackground(worker func(ctx context.Context)) {
+	backgroundWorkers.Add(1)
+	go func(ctx context.Context) {
+		defer backgroundWorkers.Done()
+		worker(ctx)
+	}(lifecycleContext)
+}
+
+// sleepContext waits for the duration. Returns false if the context was canceled in the meantime, in which case the caller must exit.
+func sleepContext(ctx context.Context, duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Start initializes the client with the given config and connects to the network. It replaces Init and Connect.
+// Unlike Init it never exits the process; an invalid or inaccessible private key is returned as error.
+// The client can be stopped via Stop and started again afterwards.
+func Start(newConfig Config) (err error) {
+	lifecycleMutex.Lock()
+	defer lifecycleMutex.Unlock()
+
+	if lifecycleStarted {
+		return ErrAlreadyStarted
+	}
+
+	config = newConfig
+
+	if err = initClient(); err != nil {
+		return err
+	}
+	Connect()
+
+	lifecycleStarted = true
+
+	return nil
+}
+
+// Stop notifies all peers about the shutdown, terminates all networks and background routines and clears the peer list.
+// It blocks until all routines exited.
+func Stop() {
+	lifecycleMutex.Lock()
+	defer lifecycleMutex.Unlock()
+
+	if !lifecycleStarted {
+		return
+	}
+
+	for _, peer := range PeerlistGet() {
+		DisconnectPeer(peer, DisconnectReasonShutdown)
+	}
+
+	networkShutdown()
+
+	lifecycleCancel()
+	backgroundWorkers.Wait()
+
+	peerlistMutex.Lock()
+	peerList = make(map[[btcec.PubKeyBytesLenCompressed]byte]*PeerInfo)
+	peerlistMutex.Unlock()
+
+	lifecycleStarted = false
 }
@@ -0,0 +1,81 @@
+/*
+File Name:  Peernet_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package core
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoopsCancel(t *testing.T) {
+	testConfig(t)
+	testInitPeer(t)
+
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The wait group is only used to synchronize with the loops before the config is restored.
+	var loops sync.WaitGroup
+	loops.Add(2)
+
+	packets := make(chan networkWire)
+	packetWorkers.Add(2)
+	go packetWorker(ctx, packets)
+	go packetWorker(ctx, packets)
+	go func() {
+		defer loops.Done()
+		networkChangeMonitor(ctx)
+	}()
+	go func() {
+		defer loops.Done()
+		autoPingAll(ctx)
+	}()
+
+	if started := runtime.NumGoroutine() - before; started < 4 {
+		t.Fatalf("only %d goroutines started", started)
+	}
+
+	cancel()
+
+	// The netlink listener checks for cancellation once per second.
+	timeout := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(timeout) {
+			t.Fatalf("%d goroutines still running after cancel", runtime.NumGoroutine()-before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	packetWorkers.Wait()
+	loops.Wait()
+}
+
+func TestStartInvalidPrivateKey(t *testing.T) {
+	testConfig(t)
+	testInitPeer(t)
+
+	// A directory cannot be read as key file, the hex encoded key in the config is corrupted, and the mnemonic has an invalid checksum.
+	for _, newConfig := range []Config{{PrivateKeyFile: t.TempDir()}, {PrivateKey: "invalid"}, {PrivateKeyMnemonic: strings.Repeat("abandon ", 12)}} {
+		if err := Start(newConfig); err == nil {
+			Stop()
+			t.Fatalf("started with invalid private key in config %+v", newConfig)
+		}
+
+		lifecycleMutex.Lock()
+		started := lifecycleStarted
+		lifecycleMutex.Unlock()
+		if started {
+			t.Fatal("client marked as started after an error")
+		}
+	}
+}
@@ -0,0 +1,118 @@
+/*
+File Name:  Ping Payload.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Ping and pong messages may carry an optional payload to piggyback small control data on the regular keep-alive messages.
+An empty payload is valid. Unknown fields are ignored, which keeps it backward compatible.
+
+The payload is a list of fields:
+Offset  Size   Info
+0       1      Field type
+1       1      Size of data
+2       ?      Data
+*/
+
+package core
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Field types in ping and pong payloads
+const (
+	pingFieldObservedAddress = 1 // Pong only: Address of the receiver as observed by the sender. See encodeObservedAddress. Ignored on receipt, see Observed Address.go.
+	pingFieldTimestamp       = 2 // Ping only: 8 bytes timestamp of the sender. The receiver echoes it in the pong.
+	pingFieldTimestampEcho   = 3 // Pong only: The timestamp of the ping, used by the sender of the ping to measure the round-trip time.
+)
+
+// pingEpoch is the reference for ping timestamps. Timestamps are only compared locally; using the monotonic clock makes them immune to changes of the wall clock.
+var pingEpoch = time.Now()
+
+// rttMax is the maximum accepted round-trip time. Older echoes are ignored.
+const rttMax = time.Minute
+
+// pingField is a single field in a ping or pong payload
+type pingField struct {
+	Type uint8  // Field type
+	Data []byte // Data, maximum 255 bytes
+}
+
+// encodePingFields encodes the fields into a ping or pong payload
+func encodePingFields(fields ...pingField) (payload []byte) {
+	for _, field := range fields {
+		if len(field.Data) > 255 {
+			continue
+		}
+
+		payload = append(payload, field.Type, byte(len(field.Data)))
+		payload = append(payload, field.Data...)
+	}
+
+	return payload
+}
+
+// decodePingFields decodes the fields from a ping or pong payload. Decoding stops at the first invalid field.
+func decodePingFields(payload []byte) (fields []pingField) {
+	for len(payload) >= 2 {
+		size := int(payload[1])
+		if len(payload) < 2+size {
+			break
+		}
+
+		fields = append(fields, pingField{Type: payload[0], Data: payload[2 : 2+size]})
+		payload = payload[2+size:]
+	}
+
+	return fields
+}
+
+// handlePingFields handles the fields of an incoming ping or pong. It returns the fields to echo in the pong.
+func (peer *PeerInfo) handlePingFields(msg *packet2) (echo []pingField) {
+	for _, field := range decodePingFields(msg.Payload) {
+		switch field.Type {
+		case pingFieldTimestamp:
+			if msg.Command == CommandPing {
+				echo = append(echo, pingField{Type: pingFieldTimestampEcho, Data: field.Data})
+			}
+
+		case pingFieldTimestampEcho:
+			if msg.Command == CommandPong && len(field.Data) == 8 {
+				rtt := time.Since(pingEpoch) - time.Duration(binary.LittleEndian.Uint64(field.Data))
+				if rtt >= 0 && rtt < rttMax {
+					peer.updateRTT(msg.connection, rtt)
+				}
+			}
+		}
+	}
+
+	return echo
+}
+
+// pingTimestamp returns the timestamp field for an outgoing ping
+func pingTimestamp() pingField {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, uint64(time.Since(pingEpoch)))
+	return pingField{Type: pingFieldTimestamp, Data: data}
+}
+
+// updateRTT updates the round-trip time of the connection as exponential moving average, with a weight of 1/8 for the new sample.
+func (peer *PeerInfo) updateRTT(connection *Connection, rtt time.Duration) {
+	peer.Lock()
+	defer peer.Unlock()
+
+	if connection.RTT == 0 {
+		connection.RTT = rtt
+	} else {
+		connection.RTT += (rtt - connection.RTT) / 8
+	}
+}
+
+// GetRTT returns the round-trip time of the connection. It is 0 if not measured yet.
+func (peer *PeerInfo) GetRTT(connection *Connection) time.Duration {
+	peer.RLock()
+	defer peer.RUnlock()
+
+	return connection.RTT
+}
@@ -0,0 +1,130 @@
+/*
+File Name:  Private Key File.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+The private key can be stored in a separate file instead of the config (see config.PrivateKeyFile), which allows operators to manage keys as files.
+The file contains either the hex encoded private key, or a PEM block "EC PRIVATE KEY" with the key in the SEC1 format as created by "openssl ecparam -name secp256k1 -genkey".
+*/
+
+package core
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// privateKeySize is the size of a secp256k1 private key
+const privateKeySize = 32
+
+// pemTypePrivateKey is the PEM block type of a SEC1 private key
+const pemTypePrivateKey = "EC PRIVATE KEY"
+
+// oidSecp256k1 is the ASN.1 object identifier of the secp256k1 curve
+var oidSecp256k1 = asn1.ObjectIdentifier{1, 3, 132, 0, 10}
+
+// ecPrivateKeySEC1 is the ASN.1 structure of a private key in the SEC1 format (RFC 5915)
+type ecPrivateKeySEC1 struct {
+	Version       int
+	PrivateKey    []byte
+	NamedCurveOID asn1.ObjectIdentifier `asn1:"optional,explicit,tag:0"`
+	PublicKey     asn1.BitString        `asn1:"optional,explicit,tag:1"`
+}
+
+// ErrPrivateKeyInvalid is returned if a private key file cannot be decoded
+var ErrPrivateKeyInvalid = errors.New("invalid private key")
+
+// LoadPrivateKeyFile loads a private key from the file. It may be hex encoded or a PEM block in the SEC1 format.
+func LoadPrivateKeyFile(path string) (privateKey *btcec.PrivateKey, publicKey *btcec.PublicKey, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var key []byte
+
+	if block := pemFindBlock(data, pemTypePrivateKey); block != nil {
+		var sec1 ecPrivateKeySEC1
+		if _, err := asn1.Unmarshal(block.Bytes, &sec1); err != nil || sec1.Version != 1 {
+			return nil, nil, ErrPrivateKeyInvalid
+		}
+		if len(sec1.NamedCurveOID) > 0 && !sec1.NamedCurveOID.Equal(oidSecp256k1) {
+			return nil, nil, ErrPrivateKeyInvalid
+		}
+
+		key = sec1.PrivateKey
+	} else if bytes.Contains(data, []byte("-----BEGIN")) {
+		return nil, nil, ErrPrivateKeyInvalid
+	} else if key, err = hex.DecodeString(strings.TrimSpace(string(data))); err != nil {
+		return nil, nil, ErrPrivateKeyInvalid
+	}
+
+	if len(key) != privateKeySize || bytes.Equal(key, make([]byte, privateKeySize)) {
+		return nil, nil, ErrPrivateKeyInvalid
+	}
+
+	privateKey, publicKey = btcec.PrivKeyFromBytes(btcec.S256(), key)
+	return privateKey, publicKey, nil
+}
+
+// pemFindBlock returns the first PEM block of the type. Other blocks such as "EC PARAMETERS" are skipped. Returns nil if not found.
+func pemFindBlock(data []byte, blockType string) (block *pem.Block) {
+	for {
+		if block, data = pem.Decode(data); block == nil || block.Type == blockType {
+			return block
+		}
+	}
+}
+
+// SavePrivateKeyFile saves the current private key to the file. If the file extension is ".pem", it is stored as PEM block in the SEC1 format, otherwise hex encoded.
+// The file is only readable by the current user.
+func SavePrivateKeyFile(path string) (err error) {
+	if peerPrivateKey == nil {
+		return ErrPrivateKeyInvalid
+	}
+
+	var data []byte
+
+	if strings.EqualFold(filepath.Ext(path), ".pem") {
+		sec1, err := asn1.Marshal(ecPrivateKeySEC1{Version: 1, PrivateKey: peerPrivateKey.Serialize(), NamedCurveOID: oidSecp256k1})
+		if err != nil {
+			return err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: pemTypePrivateKey, Bytes: sec1})
+	} else {
+		data = []byte(hex.EncodeToString(peerPrivateKey.Serialize()) + "\n")
+	}
+
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// initPeerIDFile loads the private key from config.PrivateKeyFile. If the file does not exist, a new key is created and saved to it.
+func initPeerIDFile() (err error) {
+	peerPrivateKey, peerPublicKey, err = LoadPrivateKeyFile(config.PrivateKeyFile)
+	if err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return errors.New("private key file '" + config.PrivateKeyFile + "' could not be loaded: " + err.Error())
+	}
+
+	if peerPrivateKey, peerPublicKey, err = Secp256k1NewPrivateKey(); err != nil {
+		return errors.New("error generating public-private key pair: " + err.Error())
+	}
+
+	if err = SavePrivateKeyFile(config.PrivateKeyFile); err != nil {
+		return errors.New("error saving private key file '" + config.PrivateKeyFile + "': " + err.Error())
+	}
+
+	logger.Infof("Created new private key file '%s'\n", config.PrivateKeyFile)
+
+	return nil
+}
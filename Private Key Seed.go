@@ -0,0 +1,134 @@
+/*
+File Name:  Private Key Seed.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+The private key can be derived deterministically from a seed, which allows reproducible test networks and recovering the peer ID from a backup of the seed.
+The same seed always results in the same private key and therefore the same peer ID on any machine.
+
+Derivation of the seed from a mnemonic (BIP39):
+    seed = PBKDF2-HMAC-SHA512(password = mnemonic, salt = "mnemonic", iterations = 2048, length = 64 bytes)
+The words of the mnemonic are separated by single spaces. The mnemonic must be valid according to BIP39: 12, 15, 18, 21 or 24 words of the English word list (Mnemonic English.txt), with a matching checksum.
+BIP39 requires the mnemonic to be normalized via NFKD. All words of the English word list are lowercase ASCII, for which NFKD is the identity, so a valid mnemonic is always normalized.
+Any other text (for example uppercase or accented letters) is not a word of the list and is refused.
+
+Derivation of the private key from the seed:
+    key = first 32 bytes of HMAC-SHA512(key = "Peernet seed", data = seed)
+If the key is zero or not lower than the order of secp256k1 (which is practically impossible), the HMAC is repeated with the previous output as data.
+The HMAC key differs from BIP32 ("Bitcoin seed"), so that a mnemonic used for a wallet does not reveal the wallet's master key.
+*/
+
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	_ "embed" // Required for embedding the BIP39 word list
+	"errors"
+	"math/big"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// seedHMACKey is the HMAC key to derive the private key from the seed
+const seedHMACKey = "Peernet seed"
+
+// PrivateKeyFromSeed derives the private key deterministically from the seed. The seed should contain at least 16 bytes of entropy.
+func PrivateKeyFromSeed(seed []byte) (privateKey *btcec.PrivateKey, publicKey *btcec.PublicKey) {
+	data := seed
+
+	for {
+		mac := hmac.New(sha512.New, []byte(seedHMACKey))
+		mac.Write(data)
+		data = mac.Sum(nil)
+
+		key := new(big.Int).SetBytes(data[:btcec.PrivKeyBytesLen])
+		if key.Sign() > 0 && key.Cmp(btcec.S256().N) < 0 {
+			return btcec.PrivKeyFromBytes(btcec.S256(), data[:btcec.PrivKeyBytesLen])
+		}
+	}
+}
+
+// mnemonicWordList is the BIP39 English word list, one word per line
+//
+//go:embed "Mnemonic English.txt"
+var mnemonicWordList string
+
+// mnemonicWords maps each word of the word list to its index
+var mnemonicWords = mnemonicWordsIndex(mnemonicWordList)
+
+func mnemonicWordsIndex(list string) (words map[string]int) {
+	words = make(map[string]int)
+	for n, word := range strings.Fields(list) {
+		words[word] = n
+	}
+	return words
+}
+
+// ErrMnemonicLength is returned if the mnemonic does not have 12, 15, 18, 21 or 24 words
+var ErrMnemonicLength = errors.New("mnemonic must have 12, 15, 18, 21 or 24 words")
+
+// ErrMnemonicWord is returned if a word of the mnemonic is not in the BIP39 English word list
+var ErrMnemonicWord = errors.New("mnemonic contains a word that is not in the BIP39 English word list")
+
+// ErrMnemonicChecksum is returned if the checksum of the mnemonic does not match
+var ErrMnemonicChecksum = errors.New("mnemonic checksum mismatch")
+
+// mnemonicValidate checks the words and the checksum of the mnemonic. Each word encodes 11 bits; the entropy is followed by the first (entropy bits / 32) bits of its SHA-256 hash.
+func mnemonicValidate(words []string) (err error) {
+	if len(words) < 12 || len(words) > 24 || len(words)%3 != 0 {
+		return ErrMnemonicLength
+	}
+
+	bits := make([]byte, 0, len(words)*11)
+	for _, word := range words {
+		index, ok := mnemonicWords[word]
+		if !ok {
+			return ErrMnemonicWord
+		}
+		for n := 10; n >= 0; n-- {
+			bits = append(bits, byte(index>>n)&1)
+		}
+	}
+
+	checksumBits := len(bits) / 33
+	entropy := make([]byte, (len(bits)-checksumBits)/8)
+	for n := range entropy {
+		for _, bit := range bits[n*8 : n*8+8] {
+			entropy[n] = entropy[n]<<1 | bit
+		}
+	}
+
+	hash := sha256.Sum256(entropy)
+	for n, bit := range bits[len(entropy)*8:] {
+		if hash[n/8]>>(7-n%8)&1 != bit {
+			return ErrMnemonicChecksum
+		}
+	}
+
+	return nil
+}
+
+// SeedFromMnemonic returns the seed of the mnemonic as defined by BIP39 without passphrase. An error is returned if the mnemonic is invalid.
+func SeedFromMnemonic(mnemonic string) (seed []byte, err error) {
+	words := strings.Fields(mnemonic)
+	if err = mnemonicValidate(words); err != nil {
+		return nil, err
+	}
+
+	return pbkdf2.Key([]byte(strings.Join(words, " ")), []byte("mnemonic"), 2048, 64, sha512.New), nil
+}
+
+// PrivateKeyFromMnemonic derives the private key deterministically from the mnemonic. An error is returned if the mnemonic is invalid.
+func PrivateKeyFromMnemonic(mnemonic string) (privateKey *btcec.PrivateKey, publicKey *btcec.PublicKey, err error) {
+	seed, err := SeedFromMnemonic(mnemonic)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	privateKey, publicKey = PrivateKeyFromSeed(seed)
+	return privateKey, publicKey, nil
+}
@@ -0,0 +1,81 @@
+/*
+File Name:  Private Key Seed_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package core
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// testMnemonic is the first test vector of BIP39 (entropy 0x00 * 16)
+var testMnemonic = strings.Repeat("abandon ", 11) + "about"
+
+func TestSeedFromMnemonic(t *testing.T) {
+	if len(mnemonicWords) != 2048 {
+		t.Fatalf("word list has %d words", len(mnemonicWords))
+	}
+
+	// Seed of the BIP39 test vector with empty passphrase. Extra whitespace is ignored.
+	seed, err := SeedFromMnemonic("  " + strings.Replace(testMnemonic, " ", "\t ", 3) + "\n")
+	if err != nil {
+		t.Fatalf("SeedFromMnemonic: %v", err)
+	} else if hex.EncodeToString(seed) != "5eb00bbddcf069084889a8ab9155568165f5c453ccb85e70811aaed6f6da5fc19a5ac40b389cd370d086206dec8aa6c43daea6690f20ad3d8d48b2d2ce9e38e4" {
+		t.Fatalf("unexpected seed %x", seed)
+	}
+
+	// Other BIP39 test vectors with 12 and 24 words
+	for _, mnemonic := range []string{
+		"legal winner thank year wave sausage worth useful legal winner thank yellow",
+		"letter advice cage absurd amount doctor acoustic avoid letter advice cage above",
+		"zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo wrong",
+		strings.Repeat("abandon ", 23) + "art",
+		"void come effort suffer camp survey warrior heavy shoot primary clutch crush open amazing screen patrol group space point ten exist slush involve unfold",
+	} {
+		if _, err := SeedFromMnemonic(mnemonic); err != nil {
+			t.Fatalf("valid mnemonic '%s' refused: %v", mnemonic, err)
+		}
+	}
+}
+
+func TestSeedFromMnemonicInvalid(t *testing.T) {
+	for _, test := range []struct {
+		mnemonic string
+		err      error
+	}{
+		{"", ErrMnemonicLength},
+		{strings.Repeat("abandon ", 11), ErrMnemonicLength},
+		{strings.Repeat("abandon ", 13), ErrMnemonicLength},
+		{strings.Repeat("abandon ", 12), ErrMnemonicChecksum},
+		{strings.Repeat("zoo ", 12), ErrMnemonicChecksum},
+		{strings.Repeat("abandon ", 11) + "About", ErrMnemonicWord},
+		{strings.Repeat("abandon ", 11) + "abóut", ErrMnemonicWord},
+		{"correct horse battery staple is not a mnemonic of the word list", ErrMnemonicWord},
+	} {
+		if _, err := SeedFromMnemonic(test.mnemonic); err != test.err {
+			t.Fatalf("mnemonic '%s': error %v, expected %v", test.mnemonic, err, test.err)
+		}
+	}
+}
+
+func TestPrivateKeyFromMnemonic(t *testing.T) {
+	// The derivation must never change, otherwise peer IDs restored from a mnemonic change.
+	privateKey, publicKey, err := PrivateKeyFromMnemonic(testMnemonic)
+	if err != nil {
+		t.Fatalf("PrivateKeyFromMnemonic: %v", err)
+	}
+	if hex.EncodeToString(privateKey.Serialize()) != "0865a51eb27ce12557075ca59c3e96907b07dd5575a40de708c8d8414971616c" {
+		t.Fatalf("unexpected private key %x", privateKey.Serialize())
+	}
+	if peerID := hex.EncodeToString(publicKey.SerializeCompressed()); peerID != "026af2ba82d11bc55cdb1c9977541e5d67948f145035bc199dbee1252ceac7a6ba" {
+		t.Fatalf("unexpected peer ID %s", peerID)
+	}
+
+	if _, _, err := PrivateKeyFromMnemonic(strings.Repeat("abandon ", 12)); err != ErrMnemonicChecksum {
+		t.Fatalf("invalid mnemonic: error %v", err)
+	}
+}
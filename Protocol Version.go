@@ -0,0 +1,167 @@
+/*
+File Name:  Protocol Version.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Peers exchange their protocol version and user agent (name and version of the software) in the announcement and the response, which helps debugging mixed networks.
+The block follows the certificate of the ephemeral key and is only sent if the certificate is present. Older peers send none and ignore it.
+
+Peers with a higher major protocol version use a wire format unknown to this node. Their announcements and responses are refused, so that they are never added to the peer list. A known peer that reports such a version was upgraded and is removed.
+Minor versions are backward compatible.
+
+Legacy peers are peers that do not send a protocol version (older nodes without the certificate of the ephemeral key) or an older major version. They are accepted, with these restrictions:
+* They do not know the challenge, see Address Validation.go. Their address is validated by sending them an announcement without payload and waiting for their response instead.
+* No ephemeral key of the current format is known, so payloads to them are never encrypted and they are not sent rekey messages.
+
+Version history:
+1.0    Initial version
+1.1    Announcements contain the time they were created, see Announcement Replay.go
+2.0    The certificate of the ephemeral key contains its expiry, see Ephemeral Key.go. Peers with version 1.x are legacy peers.
+
+Offset  Size   Info
+0       2      Protocol version, see ProtocolVersion
+2       1      Length of the user agent
+3       ?      User agent, UTF-8
+*/
+
+package core
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ProtocolVersion is the protocol version of this implementation. The major version is in the high byte, the minor version in the low byte.
+const ProtocolVersion = 0x0200
+
+// protocolVersionMajor returns the major version of the protocol version
+func protocolVersionMajor(protocolVersion uint16) uint8 {
+	return uint8(protocolVersion >> 8)
+}
+
+// protocolVersionString returns the protocol version in the format "major.minor"
+func protocolVersionString(protocolVersion uint16) string {
+	return strconv.Itoa(int(protocolVersion>>8)) + "." + strconv.Itoa(int(protocolVersion&0xff))
+}
+
+// protocolVersionSizeMin is the size of the protocol version block without the user agent
+const protocolVersionSizeMin = 3
+
+// userAgentLengthMax is the maximum length of the user agent in bytes
+const userAgentLengthMax = 255
+
+// userAgentLocal returns the user agent of this node. If not set in the config, it identifies the core library.
+func userAgentLocal() (userAgent string) {
+	userAgent = config.UserAgent
+	if userAgent == "" {
+		userAgent = "Peernet Core/" + Version
+	}
+	if len(userAgent) > userAgentLengthMax {
+		userAgent = userAgent[:userAgentLengthMax]
+	}
+	return userAgent
+}
+
+// encodeProtocolVersion returns the protocol version block
+func encodeProtocolVersion() (data []byte) {
+	userAgent := userAgentLocal()
+
+	data = make([]byte, protocolVersionSizeMin+len(userAgent))
+	binary.LittleEndian.PutUint16(data[0:2], ProtocolVersion)
+	data[2] = byte(len(userAgent))
+	copy(data[protocolVersionSizeMin:], userAgent)
+
+	return data
+}
+
+// decodeProtocolVersion decodes the protocol version block. Returns false if it is missing or invalid.
+// Non-printable characters are removed from the user agent, since it is logged and shown to the user.
+func decodeProtocolVersion(data []byte) (protocolVersion uint16, userAgent string, valid bool) {
+	if len(data) < protocolVersionSizeMin || len(data) < protocolVersionSizeMin+int(data[2]) {
+		return 0, "", false
+	}
+
+	protocolVersion = binary.LittleEndian.Uint16(data[0:2])
+	userAgent = strings.Map(func(r rune) rune {
+		if !unicode.IsPrint(r) {
+			return -1
+		}
+		return r
+	}, string(data[protocolVersionSizeMin:protocolVersionSizeMin+int(data[2])]))
+
+	return protocolVersion, userAgent, true
+}
+
+// decodeProtocolVersionAfterCertificate decodes the protocol version block following the certificate of the ephemeral key. Returns false if it is missing or invalid.
+func decodeProtocolVersionAfterCertificate(certificate []byte) (protocolVersion uint16, userAgent string, valid bool) {
+	if len(certificate) < ephemeralCertificateSize {
+		return 0, "", false
+	}
+
+	return decodeProtocolVersion(certificate[ephemeralCertificateSize:])
+}
+
+// decodeProtocolVersionAnyCertificate is like decodeProtocolVersionAfterCertificate, but also decodes the block of peers with version 1.x.
+func decodeProtocolVersionAnyCertificate(certificate []byte) (protocolVersion uint16, userAgent string, valid bool) {
+	protocolVersion, userAgent, valid = decodeProtocolVersionAfterCertificate(certificate)
+	if valid && protocolVersionMajor(protocolVersion) == protocolVersionMajor(ProtocolVersion) {
+		return protocolVersion, userAgent, true
+	}
+
+	// Peers before protocol version 2.0 use a smaller certificate, so the block is at a different offset.
+	if len(certificate) >= ephemeralCertificateSizeV1 {
+		if protocolVersionV1, userAgentV1, validV1 := decodeProtocolVersion(certificate[ephemeralCertificateSizeV1:]); validV1 && protocolVersionMajor(protocolVersionV1) == 1 {
+			return protocolVersionV1, userAgentV1, true
+		}
+	}
+
+	return protocolVersion, userAgent, valid
+}
+
+// protocolCompatible checks if the protocol version in the data following the certificate of the ephemeral key is compatible with this node. Incompatible versions are logged.
+// Legacy peers with an older or missing protocol version are accepted.
+func protocolCompatible(certificate []byte, sender *net.UDPAddr) bool {
+	protocolVersion, userAgent, valid := decodeProtocolVersionAnyCertificate(certificate)
+	if !valid || protocolVersionMajor(protocolVersion) <= protocolVersionMajor(ProtocolVersion) {
+		return true
+	}
+
+	logger.Infof("Refusing peer %s with incompatible protocol version %s (%s), local version %s\n", sender.String(), protocolVersionString(protocolVersion), userAgent, protocolVersionString(ProtocolVersion))
+	return false
+}
+
+// announcementLegacy checks if the announcement was sent by a legacy peer, which does not include the certificate of the ephemeral key and the protocol version of the current major version
+func announcementLegacy(payload []byte) bool {
+	protocolVersion, _, valid := decodeProtocolVersionAfterCertificate(payload[announcementEndpointsSize(payload):])
+	return !valid || protocolVersionMajor(protocolVersion) < protocolVersionMajor(ProtocolVersion)
+}
+
+// isLegacy checks if the peer is a legacy peer with an older or missing protocol version
+func (peer *PeerInfo) isLegacy() bool {
+	protocolVersion, _ := peer.GetProtocolVersion()
+	return protocolVersionMajor(protocolVersion) < protocolVersionMajor(ProtocolVersion)
+}
+
+// setProtocolVersion stores the protocol version and user agent of the peer from the data following the certificate of the ephemeral key. A missing block is ignored.
+func (peer *PeerInfo) setProtocolVersion(certificate []byte) {
+	protocolVersion, userAgent, valid := decodeProtocolVersionAnyCertificate(certificate)
+	if !valid {
+		return
+	}
+
+	peer.Lock()
+	peer.ProtocolVersion = protocolVersion
+	peer.UserAgent = userAgent
+	peer.Unlock()
+}
+
+// GetProtocolVersion returns the protocol version and user agent of the peer. The protocol version is 0 and the user agent empty if the peer did not send them.
+func (peer *PeerInfo) GetProtocolVersion() (protocolVersion uint16, userAgent string) {
+	peer.RLock()
+	defer peer.RUnlock()
+
+	return peer.ProtocolVersion, peer.UserAgent
+}
@@ -0,0 +1,136 @@
+/*
+File Name:  Protocol Version_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProtocolVersionHigherMajor(t *testing.T) {
+	testConfig(t)
+	testInitPeer(t)
+	network := testNetworkLoopback(t)
+
+	remote := testRemoteNew(t, network)
+	remote.send(t, remote.announcement(t, ProtocolVersion+0x0100), remote.address())
+
+	if packet := remote.receive(t, 200*time.Millisecond); packet != nil {
+		t.Fatalf("incompatible peer received command %d", packet.Command)
+	}
+	if PeerlistLookup(remote.publicKey) != nil {
+		t.Fatal("incompatible peer added to the peer list")
+	}
+
+	// A known peer that announces an incompatible version was upgraded and is removed.
+	remote.peerlistAdd(t)
+	remote.send(t, remote.announcement(t, ProtocolVersion+0x0100), remote.address())
+	if PeerlistLookup(remote.publicKey) != nil {
+		t.Fatal("known peer with incompatible version not removed")
+	}
+}
+
+func TestProtocolVersionEqual(t *testing.T) {
+	testConfig(t)
+	testInitPeer(t)
+	network := testNetworkLoopback(t)
+
+	// A different minor version is compatible.
+	for _, version := range []uint16{ProtocolVersion, ProtocolVersion + 1} {
+		remote := testRemoteNew(t, network)
+		remote.send(t, remote.announcement(t, version), remote.address())
+
+		challenge := remote.receive(t, time.Second)
+		if challenge == nil || challenge.Command != CommandChallenge {
+			t.Fatalf("version %s: announcement not answered with a challenge", protocolVersionString(version))
+		}
+
+		echo := append(append([]byte{}, challenge.Payload...), remote.announcement(t, version).Payload...)
+		remote.send(t, &PacketRaw{Command: CommandChallengeEcho, Payload: echo}, remote.address())
+
+		peer := PeerlistLookup(remote.publicKey)
+		if peer == nil {
+			t.Fatalf("version %s: peer not added", protocolVersionString(version))
+		}
+		if protocolVersion, _ := peer.GetProtocolVersion(); protocolVersion != version {
+			t.Fatalf("version %s: peer has version %s", protocolVersionString(version), protocolVersionString(protocolVersion))
+		}
+	}
+}
+
+func TestProtocolVersionLegacy(t *testing.T) {
+	testConfig(t)
+	testInitPeer(t)
+	network := testNetworkLoopback(t)
+	config.PayloadEncryption = true
+
+	// A legacy peer sends an announcement without certificate and protocol version, and does not know the challenge.
+	remote := testRemoteNew(t, network)
+	remote.send(t, &PacketRaw{Command: CommandAnnouncement}, remote.address())
+
+	announcement := remote.receive(t, time.Second)
+	if announcement == nil || announcement.Command != CommandAnnouncement {
+		t.Fatal("legacy announcement not answered with an announcement")
+	} else if len(announcement.Payload) != 0 {
+		t.Fatalf("legacy announcement answered with %d bytes payload", len(announcement.Payload))
+	}
+	if PeerlistLookup(remote.publicKey) != nil {
+		t.Fatal("legacy peer added before the address was validated")
+	}
+
+	// The response of the legacy peer validates the address.
+	remote.send(t, &PacketRaw{Command: CommandResponse}, remote.address())
+	peer := PeerlistLookup(remote.publicKey)
+	if peer == nil {
+		t.Fatal("legacy peer not added after its response")
+	} else if !peer.isLegacy() {
+		t.Fatal("peer without protocol version not considered legacy")
+	}
+
+	// The peer is asked for other peers after it was added.
+	if packet := remote.receive(t, time.Second); packet == nil || packet.Command != CommandPeerRequest {
+		t.Fatal("no peer request sent")
+	}
+
+	// Payloads to legacy peers are not encrypted, and they are not sent rekey messages.
+	peer.send(&PacketRaw{Command: CommandChat, Payload: []byte("hello")})
+	if packet := remote.receive(t, time.Second); packet == nil || packet.Encrypted || string(packet.Payload) != "hello" {
+		t.Fatal("payload to legacy peer not sent unencrypted")
+	}
+
+	rekeySendUnconfirmed()
+	if packet := remote.receive(t, 200*time.Millisecond); packet != nil {
+		t.Fatalf("legacy peer sent command %d", packet.Command)
+	}
+}
+
+func TestProtocolVersionResponse(t *testing.T) {
+	testConfig(t)
+	testInitPeer(t)
+	network := testNetworkLoopback(t)
+	remote := testRemoteNew(t, network)
+	peer := remote.peerlistAdd(t)
+	defer PeerlistRemove(peer)
+
+	// response returns a response of the remote node with the protocol version, which follows the observed address like in responsePacket
+	response := func(version uint16) *PacketRaw {
+		payload := append(encodeObservedAddress(remote.address()), remote.announcement(t, version).Payload[2:]...)
+		return &PacketRaw{Command: CommandResponse, Payload: payload}
+	}
+
+	// The response of a known peer updates its protocol version.
+	remote.send(t, response(ProtocolVersion+1), remote.address())
+	if protocolVersion, _ := peer.GetProtocolVersion(); protocolVersion != ProtocolVersion+1 {
+		t.Fatalf("protocol version %s not updated by response", protocolVersionString(protocolVersion))
+	}
+
+	// A known peer that responds with an incompatible version is removed.
+	remote.send(t, response(ProtocolVersion+0x0100), remote.address())
+	if PeerlistLookup(remote.publicKey) != nil {
+		t.Fatal("known peer with incompatible version in response not removed")
+	}
+}
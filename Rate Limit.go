@@ -0,0 +1,194 @@
+/*
+File Name:  Rate Limit.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Token bucket rate limiting. Tokens are refilled continuously at the given rate up to the burst size.
+*/
+
+package core
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenBucket is a single token bucket rate limiter
+type tokenBucket struct {
+	rate       float64   // Tokens added per second
+	burst      float64   // Maximum tokens
+	tokens     float64   // Currently available tokens
+	lastRefill time.Time // Last time tokens were refilled
+	sync.Mutex
+}
+
+// newTokenBucket creates a new token bucket that is initially full
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, lastRefill: time.Now()}
+}
+
+// refill adds the tokens accumulated since the last refill. The caller must hold the mutex.
+func (bucket *tokenBucket) refill() {
+	now := time.Now()
+	bucket.tokens += now.Sub(bucket.lastRefill).Seconds() * bucket.rate
+	if bucket.tokens > bucket.burst {
+		bucket.tokens = bucket.burst
+	}
+	bucket.lastRefill = now
+}
+
+// allow takes n tokens if available
+func (bucket *tokenBucket) allow(n float64) bool {
+	bucket.Lock()
+	defer bucket.Unlock()
+
+	bucket.refill()
+	if bucket.tokens < n {
+		return false
+	}
+
+	bucket.tokens -= n
+	return true
+}
+
+// canTake checks if n tokens are available. Requests larger than the burst size are possible once the bucket is full.
+func (bucket *tokenBucket) canTake(n float64) bool {
+	bucket.Lock()
+	defer bucket.Unlock()
+
+	bucket.refill()
+	if n > bucket.burst {
+		n = bucket.burst
+	}
+	return bucket.tokens >= n
+}
+
+// consume takes n tokens unconditionally. The tokens may become negative, which delays subsequent requests until the debt is refilled.
+func (bucket *tokenBucket) consume(n float64) {
+	bucket.Lock()
+	defer bucket.Unlock()
+
+	bucket.refill()
+	bucket.tokens -= n
+}
+
+// setRate changes the rate and burst size
+func (bucket *tokenBucket) setRate(rate, burst float64) {
+	bucket.Lock()
+	defer bucket.Unlock()
+
+	bucket.refill()
+	bucket.rate = rate
+	bucket.burst = burst
+	if bucket.tokens > burst {
+		bucket.tokens = burst
+	}
+}
+
+// available returns the currently available tokens
+func (bucket *tokenBucket) available() float64 {
+	bucket.Lock()
+	defer bucket.Unlock()
+
+	bucket.refill()
+	return bucket.tokens
+}
+
+// ipRateLimitEntriesMax is the maximum count of IPs tracked by an ipRateLimiter
+const ipRateLimitEntriesMax = 4096
+
+// ipRateLimiter limits events per source IP, each IP with its own token bucket
+type ipRateLimiter struct {
+	rate    float64                 // Tokens added per second
+	burst   float64                 // Maximum tokens
+	buckets map[string]*tokenBucket // Bucket per IP
+	sync.Mutex
+}
+
+// newIPRateLimiter creates a new rate limiter per IP
+func newIPRateLimiter(rate, burst float64) *ipRateLimiter {
+	return &ipRateLimiter{rate: rate, burst: burst, buckets: make(map[string]*tokenBucket)}
+}
+
+// allow takes a token from the IP's bucket if available.
+// If the count of tracked IPs reaches the maximum, IPs with a full bucket are forgotten first, as they behave like new ones. On a flood all are forgotten rather than growing unbounded.
+func (limiter *ipRateLimiter) allow(ip net.IP) bool {
+	key := string(ip.To16())
+
+	limiter.Lock()
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		if len(limiter.buckets) >= ipRateLimitEntriesMax {
+			for keyR, bucketR := range limiter.buckets {
+				if bucketR.available() >= bucketR.burst {
+					delete(limiter.buckets, keyR)
+				}
+			}
+
+			if len(limiter.buckets) >= ipRateLimitEntriesMax {
+				limiter.buckets = make(map[string]*tokenBucket)
+			}
+		}
+
+		bucket = newTokenBucket(limiter.rate, limiter.burst)
+		limiter.buckets[key] = bucket
+	}
+	limiter.Unlock()
+
+	return bucket.allow(1)
+}
+
+// peerRateLimit limits the incoming packets from a single peer. The limiters are nil if not enabled.
+type peerRateLimit struct {
+	packets *tokenBucket // Packets per second
+	bytes   *tokenBucket // Bytes per second
+	dropped uint64       // Count of packets dropped due to the limit
+}
+
+// initRateLimit creates the rate limiters for the peer based on the config. Burst size is 1 second.
+func (peer *PeerInfo) initRateLimit() {
+	if config.PeerLimitPackets > 0 {
+		peer.rateLimit.packets = newTokenBucket(float64(config.PeerLimitPackets), float64(config.PeerLimitPackets))
+	}
+	if config.PeerLimitBytes > 0 {
+		peer.rateLimit.bytes = newTokenBucket(float64(config.PeerLimitBytes), float64(config.PeerLimitBytes))
+	}
+}
+
+// rateLimitAllow checks if an incoming packet of the given size is within the peer's limits
+func (peer *PeerInfo) rateLimitAllow(size int) bool {
+	if peer.rateLimit.packets != nil && !peer.rateLimit.packets.allow(1) {
+		atomic.AddUint64(&peer.rateLimit.dropped, 1)
+		return false
+	}
+	if peer.rateLimit.bytes != nil && !peer.rateLimit.bytes.allow(float64(size)) {
+		atomic.AddUint64(&peer.rateLimit.dropped, 1)
+		return false
+	}
+
+	return true
+}
+
+// RateLimitState is the state of the rate limiter of a peer. Available tokens are -1 if the limit is not enabled.
+type RateLimitState struct {
+	PacketsAvailable float64 // Packets that may be received immediately
+	BytesAvailable   float64 // Bytes that may be received immediately
+	Dropped          uint64  // Count of packets dropped due to the limit
+}
+
+// RateLimitState returns the current state of the peer's rate limiter
+func (peer *PeerInfo) RateLimitState() (state RateLimitState) {
+	state.PacketsAvailable, state.BytesAvailable = -1, -1
+
+	if peer.rateLimit.packets != nil {
+		state.PacketsAvailable = peer.rateLimit.packets.available()
+	}
+	if peer.rateLimit.bytes != nil {
+		state.BytesAvailable = peer.rateLimit.bytes.available()
+	}
+	state.Dropped = atomic.LoadUint64(&peer.rateLimit.dropped)
+
+	return state
+}
@@ -0,0 +1,127 @@
+/*
+File Name:  Reachability.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Peers report in the announcement whether they believe they are publicly reachable or behind NAT. Public peers are preferred as relay and bootstrap candidates.
+The claim is not trusted blindly: If reaching a peer that claims to be public via its endpoints fails repeatedly, it is downgraded to unknown.
+*/
+
+package core
+
+import (
+	"net"
+	"sort"
+)
+
+// Reachability of a peer
+const (
+	ReachabilityUnknown = 0 // Unknown
+	ReachabilityPublic  = 1 // Reachable from the internet, either via a public IP or a forwarded port
+	ReachabilityNAT     = 2 // Behind NAT, not reachable from the internet without the peer contacting first
+)
+
+// reachabilityFailuresMax is the count of failed attempts to reach a peer via its endpoints, after which a claimed public peer is downgraded to unknown
+const reachabilityFailuresMax = 3
+
+// isPrivateIP checks if the IP is in a private range (RFC 1918 for IPv4, RFC 4193 unique local addresses for IPv6). Such IPs are not reachable from the internet.
+func isPrivateIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4[0] == 10 || ip4[0] == 172 && ip4[1]&0xf0 == 16 || ip4[0] == 192 && ip4[1] == 168 || ip4[0] == 100 && ip4[1]&0xc0 == 64 // including 100.64.0.0/10 carrier-grade NAT
+	}
+	return len(ip) == net.IPv6len && ip[0]&0xfe == 0xfc
+}
+
+// localReachability returns the reachability of this node. It is public if listening on a public IP, and NAT if only an external address different from the listening addresses is known.
+func localReachability() uint8 {
+	ipsListenMutex.RLock()
+	for listenA := range ipsListen {
+		host, _, err := net.SplitHostPort(listenA)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil && isRoutableIP(ip) && !isPrivateIP(ip) {
+			ipsListenMutex.RUnlock()
+			return ReachabilityPublic
+		}
+	}
+	ipsListenMutex.RUnlock()
+
+	// A port mapped via UPnP is a forwarded port, unless the gateway itself is behind NAT.
+	for _, network := range networksSnapshot() {
+		if external := network.UPnPAddress(); external != nil && external.IP != nil && isRoutableIP(external.IP) && !isPrivateIP(external.IP) {
+			return ReachabilityPublic
+		}
+	}
+
+	for _, network := range networksSnapshot() {
+		if _, external := network.ObservedAddresses(); external != nil && !IsAddressSelf(external) {
+			return ReachabilityNAT
+		}
+	}
+
+	return ReachabilityUnknown
+}
+
+// setReachability sets the reachability as reported by the peer in its announcement. A claim to be public is ignored if the peer was downgraded before.
+func (peer *PeerInfo) setReachability(payload []byte) {
+	if len(payload) < 1 {
+		return
+	}
+
+	reachability := int(payload[0])
+	if reachability != ReachabilityPublic && reachability != ReachabilityNAT {
+		reachability = ReachabilityUnknown
+	}
+
+	peer.Lock()
+	if reachability == ReachabilityPublic && peer.reachabilityFailures >= reachabilityFailuresMax {
+		reachability = ReachabilityUnknown
+	}
+	peer.Reachability = reachability
+	peer.Unlock()
+}
+
+// reachabilityAttempt is called for each attempt to reach the peer via its endpoints after all connections were lost, and with success = true once connections are active again.
+// A peer claiming to be public is downgraded to unknown after repeated failed attempts.
+func (peer *PeerInfo) reachabilityAttempt(success bool) {
+	peer.Lock()
+	defer peer.Unlock()
+
+	if success {
+		peer.reachabilityFailures = 0
+		return
+	}
+
+	peer.reachabilityFailures++
+	if peer.reachabilityFailures >= reachabilityFailuresMax && peer.Reachability == ReachabilityPublic {
+		peer.Reachability = ReachabilityUnknown
+	}
+}
+
+// GetReachability returns the reachability of the peer. See the Reachability constants.
+func (peer *PeerInfo) GetReachability() int {
+	peer.RLock()
+	defer peer.RUnlock()
+
+	return peer.Reachability
+}
+
+// RelayCandidates returns up to count peers suitable as relay or bootstrap candidates. Public peers are preferred, followed by peers with unknown reachability. Peers behind NAT are excluded.
+func RelayCandidates(count int) (candidates []*PeerInfo) {
+	for _, peer := range PeerlistGet() {
+		if peer.GetReachability() != ReachabilityNAT && len(peer.GetConnections(true)) > 0 {
+			candidates = append(candidates, peer)
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].GetReachability() == ReachabilityPublic && candidates[j].GetReachability() != ReachabilityPublic
+	})
+
+	if len(candidates) > count {
+		candidates = candidates[:count]
+	}
+
+	return candidates
+}
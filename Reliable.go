@@ -0,0 +1,189 @@
+/*
+File Name:  Reliable.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Reliable delivery for packets that must not be lost, such as block transfers. The packet is wrapped in CommandReliable with a sequence number.
+The receiver acknowledges it with CommandAck and dispatches the original packet. The sender retransmits with exponential backoff until the acknowledgement arrives.
+Retransmissions of already received packets are acknowledged again but not dispatched twice.
+Only peers in the peer list may send reliable packets, and only commands listed in reliableCommandAllowed may be wrapped. Handshake and transport commands are excluded, as wrapping them would bypass their own checks.
+
+Payload of CommandReliable:
+Offset  Size   Info
+0       4      Sequence number, unique per sender
+4       1      Command of the original packet
+5       ?      Payload of the original packet
+
+Payload of CommandAck:
+Offset  Size   Info
+0       4      Sequence number
+*/
+
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// reliableTimeoutInitial is the time to wait for the acknowledgement before the first retransmission. It is doubled on each retransmission.
+const reliableTimeoutInitial = 500 * time.Millisecond
+
+// reliableRetriesMax is the count of retransmissions before giving up
+const reliableRetriesMax = 5
+
+// reliableSeenTime is how long received sequence numbers are kept to detect retransmissions. It exceeds the total retransmission time.
+const reliableSeenTime = 60 * time.Second
+
+// reliableSeenMax is the maximum count of remembered received sequence numbers. If reached, expired ones are removed first and then the oldest one.
+const reliableSeenMax = 1024
+
+// ErrAckTimeout is returned if no acknowledgement was received after all retransmissions
+var ErrAckTimeout = errors.New("no acknowledgement received")
+
+type reliableKey struct {
+	peer     [btcec.PubKeyBytesLenCompressed]byte
+	sequence uint32
+}
+
+var (
+	reliablePending  = make(map[reliableKey]chan struct{}) // Sent packets waiting for the acknowledgement
+	reliableSeen     = make(map[reliableKey]time.Time)     // Received sequence numbers
+	reliableMutex    sync.Mutex
+	reliableSequence uint32 // Last used sequence number, atomic access
+)
+
+// initReliable starts the sequence numbers at a random value, like PeerlistAdd does for the packet sequence.
+// A restarted node would otherwise reuse sequence numbers that the receiver still remembers as seen, and its packets would be acknowledged but dropped.
+func initReliable() {
+	atomic.StoreUint32(&reliableSequence, rand.Uint32())
+}
+
+// sendReliable sends the packet and waits until the peer acknowledged it. If connection is nil, the peer's active connections are used.
+// The packet is retransmitted with exponential backoff. Returns ErrAckTimeout if all retransmissions failed.
+func (peer *PeerInfo) sendReliable(packet *PacketRaw, connection *Connection) (err error) {
+	sequence := atomic.AddUint32(&reliableSequence, 1)
+	key := reliableKey{peer: publicKey2Compressed(peer.PublicKey), sequence: sequence}
+
+	payload := make([]byte, 5+len(packet.Payload))
+	binary.LittleEndian.PutUint32(payload[0:4], sequence)
+	payload[4] = packet.Command
+	copy(payload[5:], packet.Payload)
+	wrapped := &PacketRaw{Command: CommandReliable, Payload: payload}
+
+	ack := make(chan struct{}, 1)
+	reliableMutex.Lock()
+	reliablePending[key] = ack
+	reliableMutex.Unlock()
+
+	defer func() {
+		reliableMutex.Lock()
+		delete(reliablePending, key)
+		reliableMutex.Unlock()
+	}()
+
+	timeout := reliableTimeoutInitial
+
+	for retry := 0; retry <= reliableRetriesMax; retry++ {
+		if connection != nil {
+			err = peer.sendConnection(wrapped, connection)
+		} else {
+			err = peer.send(wrapped)
+		}
+		if err != nil && err != ErrBandwidthLimit {
+			return err
+		}
+
+		select {
+		case <-ack:
+			return nil
+		case <-time.After(timeout):
+		}
+
+		timeout *= 2
+	}
+
+	return ErrAckTimeout
+}
+
+// reliableCommandAllowed checks if the command may be wrapped in CommandReliable
+func reliableCommandAllowed(command uint8) bool {
+	switch command {
+	case CommandGet, CommandGetResponse, CommandPeerRequest, CommandPeerResponse, CommandDisconnect, CommandChat, CommandChatReliable, CommandChatAck:
+		return true
+	}
+
+	return command >= CommandUserMin
+}
+
+// cmdReliable handles an incoming reliable packet. It is acknowledged and the original packet is dispatched, unless it was received before.
+func (peer *PeerInfo) cmdReliable(msg *packet2) {
+	// Unknown senders are not acknowledged, as the source address could be spoofed.
+	if peer == nil || len(msg.Payload) < 5 || !reliableCommandAllowed(msg.Payload[4]) {
+		return
+	}
+
+	sequence := binary.LittleEndian.Uint32(msg.Payload[0:4])
+	ackPayload := make([]byte, 4)
+	binary.LittleEndian.PutUint32(ackPayload, sequence)
+	peer.sendConnection(&PacketRaw{Command: CommandAck, Payload: ackPayload}, msg.connection)
+
+	key := reliableKey{peer: publicKey2Compressed(msg.SenderPublicKey), sequence: sequence}
+
+	reliableMutex.Lock()
+	if _, ok := reliableSeen[key]; ok {
+		reliableMutex.Unlock()
+		return
+	}
+	if len(reliableSeen) >= reliableSeenMax {
+		reliableSeenExpire()
+	}
+	reliableSeen[key] = time.Now()
+	reliableMutex.Unlock()
+
+	packetDispatch(peer, &packet2{SenderPublicKey: msg.SenderPublicKey, PacketRaw: PacketRaw{Protocol: msg.Protocol, Command: msg.Payload[4], Payload: msg.Payload[5:]}, connection: msg.connection})
+}
+
+// reliableSeenExpire removes expired received sequence numbers. If none expired, the oldest one is removed. The caller must hold reliableMutex.
+func reliableSeenExpire() {
+	var oldestKey reliableKey
+	var oldest time.Time
+
+	for key, received := range reliableSeen {
+		if time.Since(received) > reliableSeenTime {
+			delete(reliableSeen, key)
+		} else if oldest.IsZero() || received.Before(oldest) {
+			oldestKey, oldest = key, received
+		}
+	}
+
+	if len(reliableSeen) >= reliableSeenMax {
+		delete(reliableSeen, oldestKey)
+	}
+}
+
+// cmdAck handles the acknowledgement of a reliable packet
+func (peer *PeerInfo) cmdAck(msg *packet2) {
+	if len(msg.Payload) < 4 {
+		return
+	}
+
+	key := reliableKey{peer: publicKey2Compressed(msg.SenderPublicKey), sequence: binary.LittleEndian.Uint32(msg.Payload[0:4])}
+
+	reliableMutex.Lock()
+	ack, ok := reliablePending[key]
+	reliableMutex.Unlock()
+
+	if ok {
+		select {
+		case ack <- struct{}{}:
+		default:
+		}
+	}
+}
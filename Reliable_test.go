@@ -0,0 +1,114 @@
+/*
+File Name:  Reliable_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package core
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testReliableAck returns the acknowledgement of the sequence number
+func testReliableAck(sequence uint32) *PacketRaw {
+	payload := make([]byte, 4)
+	binary.LittleEndian.PutUint32(payload, sequence)
+	return &PacketRaw{Command: CommandAck, Payload: payload}
+}
+
+func TestReliableRetransmit(t *testing.T) {
+	testConfig(t)
+	testInitPeer(t)
+	network := testNetworkLoopback(t)
+	testNetworksRegister(t, network)
+	remote := testRemoteNew(t, network)
+	peer := remote.peerlistAdd(t)
+	defer PeerlistRemove(peer)
+
+	result := make(chan error, 1)
+	go func() { result <- peer.sendReliable(&PacketRaw{Command: CommandUserMin, Payload: []byte("data")}, nil) }()
+
+	first := remote.receive(t, time.Second)
+	if first == nil || first.Command != CommandReliable || len(first.Payload) != 5+4 || first.Payload[4] != CommandUserMin {
+		t.Fatalf("reliable packet not received: %v", first)
+	}
+	sequence := binary.LittleEndian.Uint32(first.Payload[0:4])
+
+	// Without acknowledgement the packet is sent again with the same sequence number.
+	second := remote.receive(t, 2*reliableTimeoutInitial)
+	if second == nil || second.Command != CommandReliable || binary.LittleEndian.Uint32(second.Payload[0:4]) != sequence {
+		t.Fatalf("reliable packet not retransmitted: %v", second)
+	}
+
+	// An acknowledgement of another sequence number is ignored.
+	remote.send(t, testReliableAck(sequence+1), remote.address())
+	select {
+	case err := <-result:
+		t.Fatalf("resolved by the acknowledgement of another sequence number: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	remote.send(t, testReliableAck(sequence), remote.address())
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("sendReliable: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("acknowledgement not processed")
+	}
+}
+
+func TestReliableDuplicate(t *testing.T) {
+	testConfig(t)
+	testInitPeer(t)
+	network := testNetworkLoopback(t)
+	testNetworksRegister(t, network)
+	remote := testRemoteNew(t, network)
+	peer := remote.peerlistAdd(t)
+	defer PeerlistRemove(peer)
+	count := testCommandHandler(t, CommandUserMin)
+
+	payload := make([]byte, 5, 9)
+	binary.LittleEndian.PutUint32(payload[0:4], 4711)
+	payload[4] = CommandUserMin
+	payload = append(payload, "data"...)
+
+	// Retransmissions are acknowledged each time, but dispatched only once.
+	for n := 0; n < 2; n++ {
+		remote.send(t, &PacketRaw{Command: CommandReliable, Payload: payload}, remote.address())
+
+		ack := remote.receive(t, time.Second)
+		if ack == nil || ack.Command != CommandAck || binary.LittleEndian.Uint32(ack.Payload) != 4711 {
+			t.Fatalf("reliable packet %d not acknowledged: %v", n, ack)
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if received := atomic.LoadUint64(count); received != 1 {
+		t.Fatalf("reliable packet dispatched %d times, expected once", received)
+	}
+
+	// Commands that may not be wrapped are neither acknowledged nor dispatched.
+	payload[4] = CommandAnnouncement
+	remote.send(t, &PacketRaw{Command: CommandReliable, Payload: payload}, remote.address())
+	if reply := remote.receive(t, 200*time.Millisecond); reply != nil {
+		t.Fatalf("wrapped announcement answered with command %d", reply.Command)
+	}
+}
+
+func TestReliableSequenceRandom(t *testing.T) {
+	sequences := make(map[uint32]bool)
+	for n := 0; n < 3; n++ {
+		initReliable()
+		sequences[atomic.LoadUint32(&reliableSequence)] = true
+	}
+
+	if len(sequences) == 1 {
+		t.Fatal("reliable sequence numbers do not start at a random value")
+	}
+}
@@ -0,0 +1,75 @@
+/*
+File Name:  Requests.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Correlation of requests and responses. A request is registered with a peer, the command of the expected response and an ID before it is sent out; the handler of the response resolves it.
+Each response command has its own ID space, so IDs of different request types (for example random IDs of get requests and the fixed connectRequestID) never collide.
+*/
+
+package core
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// ErrRequestTimeout is returned if no response was received in time
+var ErrRequestTimeout = errors.New("timeout waiting for response")
+
+type requestKey struct {
+	peer    [btcec.PubKeyBytesLenCompressed]byte // Peer who is expected to respond
+	command uint8                                // Command of the expected response
+	id      uint32                               // Request ID
+}
+
+var requestsPending = make(map[requestKey]chan *packet2)
+var requestsMutex sync.Mutex
+
+// requestRegister registers a request before sending it. The returned channel receives the response.
+func requestRegister(peer *PeerInfo, command uint8, id uint32) (response chan *packet2) {
+	response = make(chan *packet2, 1)
+
+	requestsMutex.Lock()
+	requestsPending[requestKey{peer: publicKey2Compressed(peer.PublicKey), command: command, id: id}] = response
+	requestsMutex.Unlock()
+
+	return response
+}
+
+// requestRemove removes a pending request
+func requestRemove(peer *PeerInfo, command uint8, id uint32) {
+	requestsMutex.Lock()
+	delete(requestsPending, requestKey{peer: publicKey2Compressed(peer.PublicKey), command: command, id: id})
+	requestsMutex.Unlock()
+}
+
+// requestResolve passes the response to the waiting request for the command of the response. Returns false if no request is pending.
+func requestResolve(peer *PeerInfo, id uint32, msg *packet2) bool {
+	key := requestKey{peer: publicKey2Compressed(peer.PublicKey), command: msg.Command, id: id}
+
+	requestsMutex.Lock()
+	response, ok := requestsPending[key]
+	delete(requestsPending, key)
+	requestsMutex.Unlock()
+
+	if ok {
+		response <- msg
+	}
+
+	return ok
+}
+
+// requestWait waits for the response of a registered request. The request is removed in any case.
+func requestWait(peer *PeerInfo, command uint8, id uint32, response chan *packet2, timeout time.Duration) (msg *packet2, err error) {
+	select {
+	case msg = <-response:
+		return msg, nil
+	case <-time.After(timeout):
+		requestRemove(peer, command, id)
+		return nil, ErrRequestTimeout
+	}
+}
@@ -0,0 +1,234 @@
+/*
+File Name:  STUN.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Detection of the external address (IP:Port) via STUN (RFC 5389). The binding request is sent from the listening socket of the network, so that the returned mapping is the one used for peer traffic.
+Responses are received by the regular listener and identified by the transaction ID; any other packet is processed normally.
+
+The result is cached per network. It is refreshed for all networks when an IP is added, using the last STUN server.
+*/
+
+package core
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	stunHeaderSize        = 20
+	stunMagicCookie       = 0x2112A442
+	stunBindingRequest    = 0x0001
+	stunBindingSuccess    = 0x0101
+	stunAttrMappedAddr    = 0x0001
+	stunAttrXorMappedAddr = 0x0020
+)
+
+// stunRetries are the timeouts of the transmissions of a binding request
+var stunRetries = []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second}
+
+// networkSTUN is the cached result of the STUN detection of a network
+type networkSTUN struct {
+	address *net.UDPAddr // External address. Nil if not detected.
+	time    time.Time    // When it was detected
+	sync.Mutex
+}
+
+var (
+	stunPending      = make(map[[12]byte]chan *net.UDPAddr) // pending transactions
+	stunPendingMutex sync.Mutex
+	stunServerLast   string // last STUN server used, for refresh on network changes
+	stunServerMutex  sync.Mutex
+)
+
+// DiscoverExternalAddress detects the external address via the STUN server ("host:port"). The request is sent from a network that can reach the server.
+// The result is cached for the network, see STUNAddress.
+func DiscoverExternalAddress(stunServer string) (external *net.UDPAddr, err error) {
+	server, err := net.ResolveUDPAddr("udp", stunServer)
+	if err != nil {
+		return nil, err
+	}
+
+	network := findNetworkForRemote(server.IP)
+	if network == nil {
+		return nil, ErrNoNetwork
+	}
+
+	stunServerMutex.Lock()
+	stunServerLast = stunServer
+	stunServerMutex.Unlock()
+
+	return network.DiscoverExternalAddress(server)
+}
+
+// DiscoverExternalAddress detects the external address of the network via the STUN server and caches it
+func (network *Network) DiscoverExternalAddress(server *net.UDPAddr) (external *net.UDPAddr, err error) {
+	var transaction [12]byte
+	if _, err = rand.Read(transaction[:]); err != nil {
+		return nil, err
+	}
+
+	request := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(request[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint32(request[4:8], stunMagicCookie)
+	copy(request[8:20], transaction[:])
+
+	response := make(chan *net.UDPAddr, 1)
+	stunPendingMutex.Lock()
+	stunPending[transaction] = response
+	stunPendingMutex.Unlock()
+
+	defer func() {
+		stunPendingMutex.Lock()
+		delete(stunPending, transaction)
+		stunPendingMutex.Unlock()
+	}()
+
+	for _, timeout := range stunRetries {
+		if err = network.send(server.IP, server.Port, request); err != nil {
+			return nil, err
+		}
+
+		select {
+		case external = <-response:
+			network.stun.Lock()
+			network.stun.address = external
+			network.stun.time = time.Now()
+			network.stun.Unlock()
+
+			return external, nil
+		case <-time.After(timeout):
+		}
+	}
+
+	return nil, errors.New("no response from STUN server")
+}
+
+// STUNAddress returns the external address of the network as detected via STUN. Nil if not detected.
+func (network *Network) STUNAddress() (external *net.UDPAddr, detected time.Time) {
+	network.stun.Lock()
+	defer network.stun.Unlock()
+
+	return network.stun.address, network.stun.time
+}
+
+// stunResponse checks if the incoming packet is a response to a pending STUN request and passes the address to it.
+// Returns false if the packet is not a STUN response that is expected.
+func stunResponse(raw []byte) bool {
+	if len(raw) < stunHeaderSize || binary.BigEndian.Uint16(raw[0:2]) != stunBindingSuccess || binary.BigEndian.Uint32(raw[4:8]) != stunMagicCookie || int(binary.BigEndian.Uint16(raw[2:4]))+stunHeaderSize != len(raw) {
+		return false
+	}
+
+	var transaction [12]byte
+	copy(transaction[:], raw[8:20])
+
+	stunPendingMutex.Lock()
+	response, ok := stunPending[transaction]
+	delete(stunPending, transaction)
+	stunPendingMutex.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	// The channel is buffered and only used once, it never blocks.
+	if external := stunDecodeAddress(raw); external != nil {
+		response <- external
+	}
+
+	return true
+}
+
+// stunDecodeAddress returns the address from the attributes of a binding response. XOR-MAPPED-ADDRESS is preferred over MAPPED-ADDRESS.
+func stunDecodeAddress(raw []byte) (external *net.UDPAddr) {
+	attributes := raw[stunHeaderSize:]
+
+	for len(attributes) >= 4 {
+		attrType := binary.BigEndian.Uint16(attributes[0:2])
+		attrLength := int(binary.BigEndian.Uint16(attributes[2:4]))
+		if 4+attrLength > len(attributes) {
+			break
+		}
+		value := attributes[4 : 4+attrLength]
+
+		switch attrType {
+		case stunAttrXorMappedAddr:
+			if address := stunDecodeAttrAddress(value, raw[4:20]); address != nil {
+				return address
+			}
+		case stunAttrMappedAddr:
+			if address := stunDecodeAttrAddress(value, nil); address != nil {
+				external = address
+			}
+		}
+
+		// attributes are padded to 4 bytes
+		attrLength = (attrLength + 3) &^ 3
+		if 4+attrLength > len(attributes) {
+			break
+		}
+		attributes = attributes[4+attrLength:]
+	}
+
+	return external
+}
+
+// stunDecodeAttrAddress decodes an address attribute. If xor is not nil (magic cookie and transaction ID), the address is XOR'ed.
+func stunDecodeAttrAddress(value []byte, xor []byte) (address *net.UDPAddr) {
+	if len(value) < 4 {
+		return nil
+	}
+
+	var ipLength int
+	switch value[1] {
+	case 0x01:
+		ipLength = net.IPv4len
+	case 0x02:
+		ipLength = net.IPv6len
+	default:
+		return nil
+	}
+	if len(value) < 4+ipLength {
+		return nil
+	}
+
+	port := binary.BigEndian.Uint16(value[2:4])
+	ip := make(net.IP, ipLength)
+	copy(ip, value[4:4+ipLength])
+
+	if xor != nil {
+		port ^= uint16(stunMagicCookie >> 16)
+		for n := range ip {
+			ip[n] ^= xor[n]
+		}
+	}
+
+	return &net.UDPAddr{IP: ip, Port: int(port)}
+}
+
+// stunRefresh detects the external address again for all networks of the same IP family as the last used STUN server.
+func stunRefresh() {
+	stunServerMutex.Lock()
+	stunServer := stunServerLast
+	stunServerMutex.Unlock()
+
+	if stunServer == "" {
+		return
+	}
+
+	server, err := net.ResolveUDPAddr("udp", stunServer)
+	if err != nil {
+		return
+	}
+
+	for _, network := range networksSnapshot() {
+		if IsIPv4(network.address.IP) == IsIPv4(server.IP) && !network.IsTerminated() {
+			network.DiscoverExternalAddress(server)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+/*
+File Name:  Transfers.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Limit of simultaneous inbound and outbound transfers (file and block requests). Excess requests wait in a bounded queue; if the queue is full the request is rejected as busy and the remote peer shall retry later.
+*/
+
+package core
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrTransfersBusy is returned if the maximum count of simultaneous transfers is reached and the queue is full
+var ErrTransfersBusy = errors.New("too many simultaneous transfers, retry later")
+
+// transferLimiter limits the count of simultaneous transfers in one direction
+type transferLimiter struct {
+	slots    chan struct{} // Semaphore. Nil if unlimited.
+	active   int32         // Count of active transfers
+	queued   int32         // Count of transfers waiting for a slot
+	queueMax int32         // Maximum count of waiting transfers
+}
+
+var transfersInbound, transfersOutbound *transferLimiter
+
+// newTransferLimiter creates a new limiter. 0 = unlimited. The queue holds as many transfers as may be active.
+func newTransferLimiter(max int) (limiter *transferLimiter) {
+	limiter = &transferLimiter{queueMax: int32(max)}
+	if max > 0 {
+		limiter.slots = make(chan struct{}, max)
+	}
+	return limiter
+}
+
+// initTransferLimits creates the limiters based on the config. Transfers that are active keep their slot in the previous limiter.
+func initTransferLimits() {
+	transfersInbound = newTransferLimiter(config.MaxConcurrentTransfers)
+	transfersOutbound = newTransferLimiter(config.MaxConcurrentTransfers)
+}
+
+// acquire waits up to the timeout for a free slot. The returned function must be called when the transfer is finished.
+func (limiter *transferLimiter) acquire(timeout time.Duration) (release func(), err error) {
+	if limiter.slots == nil {
+		atomic.AddInt32(&limiter.active, 1)
+		return limiter.releaseFunc(), nil
+	}
+
+	if atomic.AddInt32(&limiter.queued, 1) > limiter.queueMax {
+		atomic.AddInt32(&limiter.queued, -1)
+		return nil, ErrTransfersBusy
+	}
+	defer atomic.AddInt32(&limiter.queued, -1)
+
+	select {
+	case limiter.slots <- struct{}{}:
+		atomic.AddInt32(&limiter.active, 1)
+		return limiter.releaseFunc(), nil
+	case <-time.After(timeout):
+		return nil, ErrTransfersBusy
+	}
+}
+
+// releaseFunc returns the function to release a slot. Calling it multiple times has no effect.
+func (limiter *transferLimiter) releaseFunc() func() {
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			atomic.AddInt32(&limiter.active, -1)
+			if limiter.slots != nil {
+				<-limiter.slots
+			}
+		})
+	}
+}
+
+// TransfersActive returns the count of active inbound and outbound transfers
+func TransfersActive() (inbound, outbound int) {
+	return int(atomic.LoadInt32(&transfersInbound.active)), int(atomic.LoadInt32(&transfersOutbound.active))
+}
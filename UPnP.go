@@ -0,0 +1,285 @@
+/*
+File Name:  UPnP.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Port mapping via UPnP IGD (Internet Gateway Device) for IPv4 networks listening on a private IP, see config.EnableUPnP.
+The gateway is discovered via SSDP on the network's interface. The UDP port mapping uses the same external port as the local one and is refreshed before the lease expires.
+The mapping is removed when the network is terminated. If no gateway is found, the network keeps working without the mapping.
+*/
+
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upnpLeaseDuration is the lease duration in seconds requested for port mappings. They are refreshed at half of it.
+const upnpLeaseDuration = 3600
+
+// upnpRetry is the delay before retrying to discover a gateway or create the mapping after a failure
+const upnpRetry = 5 * time.Minute
+
+// upnpTimeout is the timeout for SSDP discovery and for each HTTP request to the gateway
+const upnpTimeout = 3 * time.Second
+
+// networkUPnP is the state of the port mapping of a network
+type networkUPnP struct {
+	external *net.UDPAddr // External address (IP of the gateway and mapped port). Nil if no mapping exists.
+	sync.Mutex
+}
+
+// upnpGateway is a discovered Internet Gateway Device
+type upnpGateway struct {
+	controlURL  string // URL for SOAP requests
+	serviceType string // WANIPConnection or WANPPPConnection
+}
+
+// upnpMapper creates the port mapping and refreshes it until the network is terminated. It is started as listen routine so that Terminate waits for the removal of the mapping.
+func (network *Network) upnpMapper() {
+	localIP := network.address.IP
+	port := network.address.Port
+
+	var gateway *upnpGateway
+	var err error
+
+	for {
+		delay := upnpRetry
+
+		if gateway == nil {
+			if gateway, err = upnpDiscover(localIP); err != nil {
+				logger.Infof("upnpMapper no UPnP gateway found for '%s': %s\n", localIP.String(), err.Error())
+			}
+		}
+
+		if gateway != nil {
+			if err = gateway.addPortMapping(localIP, port); err != nil {
+				logger.Errorf("upnpMapper error mapping UDP port %d for '%s': %s\n", port, localIP.String(), err.Error())
+				gateway = nil // discover again on retry
+			} else {
+				external := &net.UDPAddr{Port: port}
+				if externalIP, err := gateway.externalIP(); err == nil {
+					external.IP = externalIP
+				}
+
+				network.upnp.Lock()
+				network.upnp.external = external
+				network.upnp.Unlock()
+
+				delay = upnpLeaseDuration * time.Second / 2
+			}
+		}
+
+		select {
+		case <-network.terminateSignal:
+			if gateway != nil && network.UPnPAddress() != nil {
+				if err := gateway.deletePortMapping(port); err != nil {
+					logger.Errorf("upnpMapper error removing mapping of UDP port %d: %s\n", port, err.Error())
+				}
+			}
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// UPnPAddress returns the external address mapped via UPnP. Nil if there is no mapping. The IP is nil if the gateway did not report it.
+func (network *Network) UPnPAddress() (external *net.UDPAddr) {
+	network.upnp.Lock()
+	defer network.upnp.Unlock()
+
+	return network.upnp.external
+}
+
+// upnpDiscover discovers an Internet Gateway Device via SSDP from the local IP
+func upnpDiscover(localIP net.IP) (gateway *upnpGateway, err error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	request := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: 239.255.255.250:1900\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n"
+
+	if _, err = conn.WriteTo([]byte(request), &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}); err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(upnpTimeout))
+	buffer := make([]byte, 2048)
+	locations := make(map[string]struct{})
+
+	for {
+		length, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			break // timeout
+		}
+
+		response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buffer[:length])), nil)
+		if err != nil {
+			continue
+		}
+		location := response.Header.Get("Location")
+		if location == "" {
+			continue
+		} else if _, ok := locations[location]; ok {
+			continue
+		}
+		locations[location] = struct{}{}
+
+		if gateway, err = upnpGatewayFromDescription(location); err == nil {
+			return gateway, nil
+		}
+	}
+
+	return nil, errors.New("no gateway responded")
+}
+
+// upnpDevice is a device in the device description
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// upnpGatewayFromDescription reads the device description and returns the gateway if it provides a WAN connection service
+func upnpGatewayFromDescription(location string) (gateway *upnpGateway, err error) {
+	client := http.Client{Timeout: upnpTimeout}
+	response, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var description struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err = xml.NewDecoder(response.Body).Decode(&description); err != nil {
+		return nil, err
+	}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if description.URLBase != "" {
+		if urlBase, err := url.Parse(description.URLBase); err == nil {
+			base = urlBase
+		}
+	}
+
+	// search all devices recursively for the service
+	devices := []upnpDevice{description.Device}
+	for len(devices) > 0 {
+		device := devices[0]
+		devices = append(devices[1:], device.Devices...)
+
+		for _, service := range device.Services {
+			if strings.HasPrefix(service.ServiceType, "urn:schemas-upnp-org:service:WANIPConnection:") || strings.HasPrefix(service.ServiceType, "urn:schemas-upnp-org:service:WANPPPConnection:") {
+				control, err := base.Parse(service.ControlURL)
+				if err != nil {
+					continue
+				}
+				return &upnpGateway{controlURL: control.String(), serviceType: service.ServiceType}, nil
+			}
+		}
+	}
+
+	return nil, errors.New("no WAN connection service")
+}
+
+// soapRequest sends a SOAP request to the gateway and returns the response body
+func (gateway *upnpGateway) soapRequest(action, arguments string) (body []byte, err error) {
+	envelope := `<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>` +
+		`<u:` + action + ` xmlns:u="` + gateway.serviceType + `">` + arguments + `</u:` + action + `>` +
+		`</s:Body></s:Envelope>`
+
+	request, err := http.NewRequest(http.MethodPost, gateway.controlURL, strings.NewReader(envelope))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	request.Header.Set("SOAPAction", `"`+gateway.serviceType+`#`+action+`"`)
+
+	client := http.Client{Timeout: upnpTimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err = ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	} else if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("gateway returned status %d", response.StatusCode)
+	}
+
+	return body, nil
+}
+
+// addPortMapping maps the UDP port on the gateway to the same port of the local IP
+func (gateway *upnpGateway) addPortMapping(localIP net.IP, port int) (err error) {
+	portA := strconv.Itoa(port)
+
+	_, err = gateway.soapRequest("AddPortMapping", "<NewRemoteHost></NewRemoteHost>"+
+		"<NewExternalPort>"+portA+"</NewExternalPort>"+
+		"<NewProtocol>UDP</NewProtocol>"+
+		"<NewInternalPort>"+portA+"</NewInternalPort>"+
+		"<NewInternalClient>"+localIP.String()+"</NewInternalClient>"+
+		"<NewEnabled>1</NewEnabled>"+
+		"<NewPortMappingDescription>Peernet</NewPortMappingDescription>"+
+		"<NewLeaseDuration>"+strconv.Itoa(upnpLeaseDuration)+"</NewLeaseDuration>")
+
+	return err
+}
+
+// deletePortMapping removes the mapping of the UDP port
+func (gateway *upnpGateway) deletePortMapping(port int) (err error) {
+	_, err = gateway.soapRequest("DeletePortMapping", "<NewRemoteHost></NewRemoteHost>"+
+		"<NewExternalPort>"+strconv.Itoa(port)+"</NewExternalPort>"+
+		"<NewProtocol>UDP</NewProtocol>")
+
+	return err
+}
+
+// externalIP returns the external IP of the gateway
+func (gateway *upnpGateway) externalIP() (ip net.IP, err error) {
+	body, err := gateway.soapRequest("GetExternalIPAddress", "")
+	if err != nil {
+		return nil, err
+	}
+
+	var response struct {
+		IP string `xml:"Body>GetExternalIPAddressResponse>NewExternalIPAddress"`
+	}
+	if err = xml.Unmarshal(body, &response); err != nil {
+		return nil, err
+	}
+
+	if ip = net.ParseIP(strings.TrimSpace(response.IP)); ip == nil {
+		return nil, errors.New("invalid external IP")
+	}
+
+	return ip, nil
+}
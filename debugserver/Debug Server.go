@@ -0,0 +1,215 @@
+/*
+File Name:  Debug Server.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Minimal HTTP server for inspecting a running node. It is never started automatically; the application must explicitly call StartDebugServer.
+Do not expose it publicly: There is no authentication. It refuses to listen on other than loopback addresses unless explicitly allowed.
+
+The chat form contains a random token created when the server starts, which /chat requires. Other websites opened in the browser cannot read it and therefore cannot send messages via cross-site requests.
+
+Endpoints:
+/               Index page with links and a form to send a chat message
+/topology       Networks, peers and their connections (JSON)
+/stats          Network statistics (JSON)
+/config         Current config with the private key removed (YAML)
+/chat           POST: Send a chat message. Form fields "text", "peer" (optional) and "token".
+*/
+
+package debugserver
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/PeernetOfficial/core"
+)
+
+// ErrAddressNotLoopback is returned by StartDebugServer if the address is not a loopback address and remote access is not allowed
+var ErrAddressNotLoopback = errors.New("debug server address is not a loopback address")
+
+// debugServer contains the state of a single debug server
+type debugServer struct {
+	token string // Random token required by /chat
+}
+
+// StartDebugServer starts the debug HTTP server on the given address, for example "127.0.0.1:8080".
+// Unless allowRemote is true, only loopback addresses are allowed, since the server has no authentication.
+func StartDebugServer(addr string, allowRemote bool) (server *http.Server, err error) {
+	if !allowRemote && !isLoopbackAddress(addr) {
+		return nil, ErrAddressNotLoopback
+	}
+
+	token := make([]byte, 16)
+	if _, err = rand.Read(token); err != nil {
+		return nil, err
+	}
+	debug := &debugServer{token: hex.EncodeToString(token)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", debug.debugIndex)
+	mux.HandleFunc("/topology", debugTopology)
+	mux.HandleFunc("/stats", debugStats)
+	mux.HandleFunc("/config", debugConfig)
+	mux.HandleFunc("/chat", debug.debugChat)
+
+	// Listen first so that the caller receives any error immediately.
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	server = &http.Server{Handler: mux, ReadTimeout: 10 * time.Second, WriteTimeout: 10 * time.Second}
+
+	go server.Serve(listener)
+
+	return server, nil
+}
+
+// isLoopbackAddress checks if the host of the address is a loopback IP or "localhost"
+func isLoopbackAddress(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (debug *debugServer) debugIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	publicKey := ""
+	if _, key := core.ExportPrivateKey(); key != nil {
+		publicKey = fmt.Sprintf("%x", key.SerializeCompressed())
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, `<html><head><title>Peernet Debug</title></head><body>
+<h1>Peernet Core %s</h1>
+<p>Public Key: %s</p>
+<ul>
+<li><a href="/topology">Topology</a></li>
+<li><a href="/stats">Statistics</a></li>
+<li><a href="/config">Config</a></li>
+</ul>
+<form method="post" action="/chat">Chat message: <input type="text" name="text"> to peer ID (empty = all peers): <input type="text" name="peer"> <input type="hidden" name="token" value="%s"> <input type="submit" value="Send"></form>
+</body></html>`, html.EscapeString(core.Version), publicKey, debug.token)
+}
+
+func debugTopology(w http.ResponseWriter, r *http.Request) {
+	data, err := core.DiagnosticsJSON()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// debugStatistics contains aggregated statistics
+type debugStatistics struct {
+	Peers               int    `json:"peers"`               // Count of peers in the peer list
+	NetworksIPv4        int    `json:"networksipv4"`        // Count of IPv4 networks listening
+	NetworksIPv6        int    `json:"networksipv6"`        // Count of IPv6 networks listening
+	ConnectionsActive   int    `json:"connectionsactive"`   // Count of active connections across all peers
+	ConnectionsInactive int    `json:"connectionsinactive"` // Count of inactive connections across all peers
+	PacketsSent         uint64 `json:"packetssent"`         // Packets sent to all peers
+	PacketsReceived     uint64 `json:"packetsreceived"`     // Packets received from all peers
+	HandlerPanics       uint64 `json:"handlerpanics"`       // Count of panics in command handlers
+	ChecksumMismatch    uint64 `json:"checksummismatch"`    // Count of incoming packets with a checksum mismatch
+	SignatureInvalid    uint64 `json:"signatureinvalid"`    // Count of incoming packets with an invalid signature
+	PacketsDropped      uint64 `json:"packetsdropped"`      // Incoming packets dropped because the packet workers could not keep up
+	BytesIn             uint64 `json:"bytesin"`             // Bytes received on all networks
+	BytesOut            uint64 `json:"bytesout"`            // Bytes sent on all networks
+}
+
+func debugStats(w http.ResponseWriter, r *http.Request) {
+	var stats debugStatistics
+
+	stats.NetworksIPv4 = len(core.GetNetworks(4))
+	stats.NetworksIPv6 = len(core.GetNetworks(6))
+	stats.HandlerPanics = core.StatsHandlerPanics()
+	stats.ChecksumMismatch = core.StatsChecksumMismatch()
+	stats.SignatureInvalid = core.StatsSignatureInvalid()
+	stats.PacketsDropped = core.StatsPacketsDropped()
+
+	totals := core.NetworkStats()
+	stats.BytesIn = totals.BytesIn
+	stats.BytesOut = totals.BytesOut
+
+	for _, peer := range core.PeerlistGet() {
+		stats.Peers++
+		stats.ConnectionsActive += len(peer.GetConnections(true))
+		stats.ConnectionsInactive += len(peer.GetConnections(false))
+		stats.PacketsSent += atomic.LoadUint64(&peer.StatsPacketSent)
+		stats.PacketsReceived += atomic.LoadUint64(&peer.StatsPacketReceived)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+func debugConfig(w http.ResponseWriter, r *http.Request) {
+	data, err := core.GetConfigRedacted()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(data)
+}
+
+func (debug *debugServer) debugChat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(r.FormValue("token")), []byte(debug.token)) != 1 {
+		http.Error(w, "invalid token", http.StatusForbidden)
+		return
+	}
+
+	text := r.FormValue("text")
+	if text == "" {
+		http.Error(w, "empty message", http.StatusBadRequest)
+		return
+	}
+
+	// The optional peer ID limits the message to a single peer.
+	if peerID := r.FormValue("peer"); peerID != "" {
+		publicKey, err := core.ParsePeerID(peerID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := core.SendChatTo(publicKey, text); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	} else {
+		core.SendChatAll(text)
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
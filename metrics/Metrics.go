@@ -0,0 +1,82 @@
+/*
+File Name:  Metrics.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Prometheus collector for the statistics of a running node. It is a separate package, so the Prometheus dependency is only required if used.
+
+Usage:
+prometheus.MustRegister(metrics.NewCollector())
+*/
+
+package metrics
+
+import (
+	"github.com/PeernetOfficial/core"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector implements prometheus.Collector. The values are read from the core statistics on each scrape.
+type Collector struct {
+	peers               *prometheus.Desc
+	connectionsActive   *prometheus.Desc
+	connectionsInactive *prometheus.Desc
+	listeners           *prometheus.Desc
+	packetsIn           *prometheus.Desc
+	packetsOut          *prometheus.Desc
+	bytesIn             *prometheus.Desc
+	bytesOut            *prometheus.Desc
+	packetsDropped      *prometheus.Desc
+	connectionsInvalid  *prometheus.Desc
+	connectionsRemoved  *prometheus.Desc
+}
+
+// NewCollector creates a new collector
+func NewCollector() *Collector {
+	return &Collector{
+		peers:               prometheus.NewDesc("peernet_peers", "Count of peers in the peer list.", nil, nil),
+		connectionsActive:   prometheus.NewDesc("peernet_connections_active", "Count of active connections across all peers.", nil, nil),
+		connectionsInactive: prometheus.NewDesc("peernet_connections_inactive", "Count of inactive connections across all peers.", nil, nil),
+		listeners:           prometheus.NewDesc("peernet_listeners", "Count of listening networks.", []string{"family"}, nil),
+		packetsIn:           prometheus.NewDesc("peernet_packets_received_total", "Packets received on all networks.", nil, nil),
+		packetsOut:          prometheus.NewDesc("peernet_packets_sent_total", "Packets sent on all networks.", nil, nil),
+		bytesIn:             prometheus.NewDesc("peernet_bytes_received_total", "Bytes received on all networks.", nil, nil),
+		bytesOut:            prometheus.NewDesc("peernet_bytes_sent_total", "Bytes sent on all networks.", nil, nil),
+		packetsDropped:      prometheus.NewDesc("peernet_packets_dropped_total", "Received packets that were dropped.", nil, nil),
+		connectionsInvalid:  prometheus.NewDesc("peernet_connections_invalidated_total", "Active connections that were invalidated.", nil, nil),
+		connectionsRemoved:  prometheus.NewDesc("peernet_connections_removed_total", "Connections that were removed.", nil, nil),
+	}
+}
+
+// Describe sends the descriptors of all metrics
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.peers
+	ch <- c.connectionsActive
+	ch <- c.connectionsInactive
+	ch <- c.listeners
+	ch <- c.packetsIn
+	ch <- c.packetsOut
+	ch <- c.bytesIn
+	ch <- c.bytesOut
+	ch <- c.packetsDropped
+	ch <- c.connectionsInvalid
+	ch <- c.connectionsRemoved
+}
+
+// Collect sends the current values of all metrics. The traffic counters are cumulative since the start of the process, including closed networks.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	stats := core.NetworkStats()
+
+	ch <- prometheus.MustNewConstMetric(c.peers, prometheus.GaugeValue, float64(stats.Peers))
+	ch <- prometheus.MustNewConstMetric(c.connectionsActive, prometheus.GaugeValue, float64(stats.ConnectionsActive))
+	ch <- prometheus.MustNewConstMetric(c.connectionsInactive, prometheus.GaugeValue, float64(stats.ConnectionsInactive))
+	ch <- prometheus.MustNewConstMetric(c.listeners, prometheus.GaugeValue, float64(len(core.GetNetworks(4))), "ipv4")
+	ch <- prometheus.MustNewConstMetric(c.listeners, prometheus.GaugeValue, float64(len(core.GetNetworks(6))), "ipv6")
+	ch <- prometheus.MustNewConstMetric(c.packetsIn, prometheus.CounterValue, float64(stats.PacketsIn))
+	ch <- prometheus.MustNewConstMetric(c.packetsOut, prometheus.CounterValue, float64(stats.PacketsOut))
+	ch <- prometheus.MustNewConstMetric(c.bytesIn, prometheus.CounterValue, float64(stats.BytesIn))
+	ch <- prometheus.MustNewConstMetric(c.bytesOut, prometheus.CounterValue, float64(stats.BytesOut))
+	ch <- prometheus.MustNewConstMetric(c.packetsDropped, prometheus.CounterValue, float64(stats.PacketsDropped))
+	ch <- prometheus.MustNewConstMetric(c.connectionsInvalid, prometheus.CounterValue, float64(stats.ConnectionsInvalidated))
+	ch <- prometheus.MustNewConstMetric(c.connectionsRemoved, prometheus.CounterValue, float64(stats.ConnectionsRemoved))
+}
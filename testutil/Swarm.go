@@ -0,0 +1,428 @@
+/*
+File Name:  Swarm.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Swarm of interconnected nodes on the loopback address for integration tests of higher layers.
+
+The core package holds the state of a single node (identity, peer list, config and networks) in package-level variables. Each node of the swarm therefore runs in its own process:
+The test binary is started again as child process, which runs the node instead of the tests. The test binary must call RunNode at the beginning of TestMain:
+
+func TestMain(m *testing.M) {
+	testutil.RunNode()
+	os.Exit(m.Run())
+}
+
+The swarm is isolated: The nodes only listen on 127.0.0.1 in passive mode without seed list and IPv6, so they neither contact nor discover other nodes. Only the nodes of the swarm are admitted to their peer lists.
+All nodes are connected to each other via ConnectPeer before NewTestSwarm returns.
+
+The parent controls a node via JSON lines: Requests are written to stdin of the child, responses and incoming messages are read from its stdout. Log output of the child goes to stderr.
+*/
+
+package testutil
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PeernetOfficial/core"
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// envNodeKey is the environment variable with the private key of the node (hex encoded). If set, the process runs as node, see RunNode.
+const envNodeKey = "PEERNET_TESTUTIL_NODE"
+
+// envSwarmKeys is the environment variable with the public keys of all nodes of the swarm (hex encoded, comma separated)
+const envSwarmKeys = "PEERNET_TESTUTIL_SWARM"
+
+// requestTimeout is the maximum time a node may take to process a request
+const requestTimeout = 30 * time.Second
+
+// ErrTimeout is returned if no message or response arrives in time
+var ErrTimeout = errors.New("timeout")
+
+// ErrNodeExited is returned if the node process exited. This happens if the test binary does not call RunNode in TestMain.
+var ErrNodeExited = errors.New("node process exited, RunNode must be called in TestMain")
+
+// Swarm is a set of interconnected nodes
+type Swarm struct {
+	Nodes []*Node
+}
+
+// Node is a single node of the swarm running in a child process
+type Node struct {
+	PublicKey *btcec.PublicKey // Public key (peer ID) of the node
+	Address   *net.UDPAddr     // Address the node listens on
+
+	cmd        *exec.Cmd
+	stdin      io.WriteCloser
+	responses  chan *nodeResponse
+	messages   chan *Message
+	exited     chan struct{}
+	sync.Mutex // Serializes requests
+}
+
+// Message is a custom command received by a node
+type Message struct {
+	Sender  *btcec.PublicKey // Public key of the sending node
+	Command uint8            // Command, at least core.CommandUserMin
+	Payload []byte           // Payload
+}
+
+// nodeRequest is a request from the parent to the node
+type nodeRequest struct {
+	Op        string // "connect", "send" or "peers"
+	PublicKey string // Public key of the remote node, hex encoded
+	Address   string // Address of the remote node for "connect"
+	Command   uint8  // Command for "send"
+	Payload   []byte // Payload for "send"
+}
+
+// nodeResponse is a response or an incoming message from the node
+type nodeResponse struct {
+	Event     string   // "ready", "result" or "message"
+	Error     string   // Error of the request, empty on success
+	Address   string   // Listen address for "ready"
+	Peers     []string // Public keys of the peers for "peers", hex encoded
+	PublicKey string   // Sender for "message", hex encoded
+	Command   uint8    // Command for "message"
+	Payload   []byte   // Payload for "message"
+}
+
+// messageQueueSize is the count of incoming messages buffered per node
+const messageQueueSize = 1024
+
+// NewTestSwarm starts n nodes and connects each of them to all others. Use Close to stop them.
+func NewTestSwarm(n int) (swarm *Swarm, err error) {
+	if n < 1 {
+		return nil, errors.New("at least one node required")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	privateKeys := make([]*btcec.PrivateKey, n)
+	publicKeys := make([]string, n)
+	for i := range privateKeys {
+		if privateKeys[i], err = btcec.NewPrivateKey(btcec.S256()); err != nil {
+			return nil, err
+		}
+		publicKeys[i] = hex.EncodeToString(privateKeys[i].PubKey().SerializeCompressed())
+	}
+
+	swarm = &Swarm{}
+
+	for i := range privateKeys {
+		node, err := startNode(executable, privateKeys[i], publicKeys)
+		if err != nil {
+			swarm.Close()
+			return nil, err
+		}
+		swarm.Nodes = append(swarm.Nodes, node)
+	}
+
+	for i, node := range swarm.Nodes {
+		for _, remote := range swarm.Nodes[i+1:] {
+			if _, err = node.request(&nodeRequest{Op: "connect", PublicKey: publicKey2Hex(remote.PublicKey), Address: remote.Address.String()}); err != nil {
+				swarm.Close()
+				return nil, errors.New("connecting nodes: " + err.Error())
+			}
+		}
+	}
+
+	return swarm, nil
+}
+
+// startNode starts the test binary as node and waits until it listens
+func startNode(executable string, privateKey *btcec.PrivateKey, swarmKeys []string) (node *Node, err error) {
+	node = &Node{
+		PublicKey: privateKey.PubKey(),
+		responses: make(chan *nodeResponse),
+		messages:  make(chan *Message, messageQueueSize),
+		exited:    make(chan struct{}),
+	}
+
+	// No tests are run in the child, in case it does not call RunNode.
+	node.cmd = exec.Command(executable, "-test.run=^$")
+	node.cmd.Env = append(os.Environ(), envNodeKey+"="+hex.EncodeToString(privateKey.Serialize()), envSwarmKeys+"="+strings.Join(swarmKeys, ","))
+	node.cmd.Stderr = os.Stderr
+
+	if node.stdin, err = node.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	stdout, err := node.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = node.cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	go node.readResponses(stdout)
+
+	response, err := node.response()
+	if err == nil && response.Event != "ready" {
+		err = errors.New("unexpected event from node: " + response.Event)
+	}
+	if err == nil {
+		node.Address, err = net.ResolveUDPAddr("udp4", response.Address)
+	}
+	if err != nil {
+		node.Close()
+		return nil, err
+	}
+
+	return node, nil
+}
+
+// readResponses reads the output of the node until it exits. Incoming messages are queued, if the queue is full they are dropped.
+func (node *Node) readResponses(stdout io.Reader) {
+	defer close(node.exited)
+
+	decoder := json.NewDecoder(stdout)
+	for {
+		var response nodeResponse
+		if err := decoder.Decode(&response); err != nil {
+			return
+		}
+
+		if response.Event != "message" {
+			node.responses <- &response
+			continue
+		}
+
+		sender, err := publicKeyFromHex(response.PublicKey)
+		if err != nil {
+			continue
+		}
+
+		select {
+		case node.messages <- &Message{Sender: sender, Command: response.Command, Payload: response.Payload}:
+		default:
+		}
+	}
+}
+
+// response waits for the next response of the node
+func (node *Node) response() (response *nodeResponse, err error) {
+	select {
+	case response = <-node.responses:
+		return response, nil
+	case <-node.exited:
+		return nil, ErrNodeExited
+	case <-time.After(requestTimeout):
+		return nil, ErrTimeout
+	}
+}
+
+// request sends the request to the node and waits for the result
+func (node *Node) request(request *nodeRequest) (response *nodeResponse, err error) {
+	node.Lock()
+	defer node.Unlock()
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = node.stdin.Write(append(data, '\n')); err != nil {
+		return nil, ErrNodeExited
+	}
+
+	if response, err = node.response(); err != nil {
+		return nil, err
+	} else if response.Error != "" {
+		return nil, errors.New(response.Error)
+	}
+
+	return response, nil
+}
+
+// Send sends a custom command from this node to the receiver node. The command must be at least core.CommandUserMin.
+func (node *Node) Send(receiver *Node, command uint8, payload []byte) (err error) {
+	_, err = node.request(&nodeRequest{Op: "send", PublicKey: publicKey2Hex(receiver.PublicKey), Command: command, Payload: payload})
+	return err
+}
+
+// Receive returns the next custom command received by this node. Returns ErrTimeout if none arrives within the timeout.
+func (node *Node) Receive(timeout time.Duration) (message *Message, err error) {
+	select {
+	case message = <-node.messages:
+		return message, nil
+	case <-time.After(timeout):
+		return nil, ErrTimeout
+	}
+}
+
+// Peers returns the public keys of all peers in the peer list of the node
+func (node *Node) Peers() (peers []*btcec.PublicKey, err error) {
+	response, err := node.request(&nodeRequest{Op: "peers"})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, peer := range response.Peers {
+		publicKey, err := publicKeyFromHex(peer)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, publicKey)
+	}
+
+	return peers, nil
+}
+
+// Close stops the node and waits until its process exited
+func (node *Node) Close() {
+	node.stdin.Close()
+
+	select {
+	case <-node.exited:
+	case <-time.After(requestTimeout):
+		node.cmd.Process.Kill()
+	}
+
+	node.cmd.Wait()
+}
+
+// Close stops all nodes of the swarm
+func (swarm *Swarm) Close() {
+	var wg sync.WaitGroup
+	for _, node := range swarm.Nodes {
+		wg.Add(1)
+		go func(node *Node) {
+			defer wg.Done()
+			node.Close()
+		}(node)
+	}
+	wg.Wait()
+}
+
+func publicKey2Hex(publicKey *btcec.PublicKey) string {
+	return hex.EncodeToString(publicKey.SerializeCompressed())
+}
+
+func publicKeyFromHex(text string) (publicKey *btcec.PublicKey, err error) {
+	data, err := hex.DecodeString(text)
+	if err != nil {
+		return nil, err
+	}
+	return btcec.ParsePubKey(data, btcec.S256())
+}
+
+// RunNode runs the process as node of a swarm if it was started by NewTestSwarm, and exits when the parent closes the node. Otherwise it returns immediately.
+// It must be called at the beginning of TestMain of every test binary that uses NewTestSwarm.
+func RunNode() {
+	privateKey := os.Getenv(envNodeKey)
+	if privateKey == "" {
+		return
+	}
+
+	if err := runNode(privateKey, strings.Split(os.Getenv(envSwarmKeys), ",")); err != nil {
+		os.Stderr.WriteString("testutil node error: " + err.Error() + "\n")
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// runNode starts the node and processes requests from stdin until it is closed
+func runNode(privateKey string, swarmKeys []string) (err error) {
+	swarm := make(map[string]bool)
+	for _, key := range swarmKeys {
+		swarm[key] = true
+	}
+
+	var outputMutex sync.Mutex
+	encoder := json.NewEncoder(os.Stdout)
+	output := func(response *nodeResponse) {
+		outputMutex.Lock()
+		encoder.Encode(response)
+		outputMutex.Unlock()
+	}
+
+	// Only nodes of the swarm are admitted.
+	core.SetPeerAdmissionFunc(func(publicKey *btcec.PublicKey, addr *net.UDPAddr) bool {
+		return swarm[publicKey2Hex(publicKey)]
+	})
+
+	for command := core.CommandUserMin; command <= 255; command++ {
+		core.RegisterCommandHandler(uint8(command), func(peer *core.PeerInfo, msg *core.Message) {
+			output(&nodeResponse{Event: "message", PublicKey: publicKey2Hex(msg.SenderPublicKey), Command: msg.Command, Payload: msg.Payload})
+		})
+	}
+
+	if err = core.Start(core.Config{Listen: []string{"127.0.0.1:0"}, PassiveMode: true, DisableIPv6: true, PrivateKey: privateKey}); err != nil {
+		return err
+	}
+	defer core.Stop()
+
+	networks := core.GetNetworks(4)
+	if len(networks) == 0 {
+		return errors.New("no network listening on 127.0.0.1")
+	}
+	listen, _, _ := networks[0].GetListen()
+	output(&nodeResponse{Event: "ready", Address: listen.String()})
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		var request nodeRequest
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			return err
+		}
+
+		response := &nodeResponse{Event: "result"}
+		if err := nodeRequestExecute(&request, response); err != nil {
+			response.Error = err.Error()
+		}
+		output(response)
+	}
+
+	return scanner.Err()
+}
+
+// nodeRequestExecute executes a request in the node
+func nodeRequestExecute(request *nodeRequest, response *nodeResponse) (err error) {
+	switch request.Op {
+	case "peers":
+		for _, peer := range core.PeerlistGet() {
+			response.Peers = append(response.Peers, publicKey2Hex(peer.PublicKey))
+		}
+		return nil
+	}
+
+	publicKey, err := publicKeyFromHex(request.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	switch request.Op {
+	case "connect":
+		address, err := net.ResolveUDPAddr("udp4", request.Address)
+		if err != nil {
+			return err
+		}
+		_, err = core.ConnectPeer(publicKey, address)
+		return err
+
+	case "send":
+		peer := core.PeerlistLookup(publicKey)
+		if peer == nil {
+			return errors.New("node is not a peer")
+		}
+		return peer.SendCommand(request.Command, request.Payload)
+	}
+
+	return errors.New("unknown request " + request.Op)
+}
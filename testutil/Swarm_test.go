@@ -0,0 +1,55 @@
+/*
+File Name:  Swarm_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package testutil
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/PeernetOfficial/core"
+)
+
+func TestMain(m *testing.M) {
+	RunNode()
+	os.Exit(m.Run())
+}
+
+func TestSwarm(t *testing.T) {
+	swarm, err := NewTestSwarm(3)
+	if err != nil {
+		t.Fatalf("NewTestSwarm: %v", err)
+	}
+	defer swarm.Close()
+
+	for n, node := range swarm.Nodes {
+		peers, err := node.Peers()
+		if err != nil {
+			t.Fatalf("node %d peers: %v", n, err)
+		} else if len(peers) != len(swarm.Nodes)-1 {
+			t.Fatalf("node %d has %d peers, expected %d", n, len(peers), len(swarm.Nodes)-1)
+		}
+	}
+
+	sender, receiver := swarm.Nodes[0], swarm.Nodes[2]
+	payload := []byte("swarm test")
+	if err := sender.Send(receiver, core.CommandUserMin, payload); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	message, err := receiver.Receive(10 * time.Second)
+	if err != nil {
+		t.Fatalf("Receive: %v", err)
+	} else if !message.Sender.IsEqual(sender.PublicKey) || message.Command != core.CommandUserMin || !bytes.Equal(message.Payload, payload) {
+		t.Fatalf("unexpected message %+v", message)
+	}
+
+	if _, err := swarm.Nodes[1].Receive(500 * time.Millisecond); err != ErrTimeout {
+		t.Fatalf("node 1 received a message not sent to it: %v", err)
+	}
+}